@@ -47,7 +47,10 @@ func main() {
 	}
 	defer rdb.Close()
 
-	router := rest.NewRouter(conf, db, mc, rdb)
+	router, err := rest.NewRouter(ctx, conf, db, mc, rdb)
+	if err != nil {
+		logger.Fatal(err)
+	}
 	srv := server.New(conf, router)
 
 	if err := srv.Start(ctx); err != nil {
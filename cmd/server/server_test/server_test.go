@@ -19,7 +19,9 @@ func TestServer(t *testing.T) {
 			Port: "61111",
 		},
 	}
-	srv := server.New(c, rest.NewRouter(c, nil, nil, nil))
+	router, err := rest.NewRouter(context.Background(), c, nil, nil, nil)
+	assert.NoError(t, err)
+	srv := server.New(c, router)
 	ctx := context.Background()
 
 	go func() {
@@ -36,6 +38,6 @@ func TestServer(t *testing.T) {
 		assert.NoError(t, err)
 	}()
 
-	err := srv.Start(ctx)
+	err = srv.Start(ctx)
 	assert.Error(t, err) // http: Server closed
 }
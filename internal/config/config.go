@@ -18,15 +18,37 @@ type Config struct {
 	Admins      []string
 	Development bool
 
-	Email       Email
-	Memcached   Memcached
-	Postgres    Postgres
-	RateLimiter RateLimiter
-	Redis       Redis
-	Server      Server
-	Session     Session
-	Static      Static
-	Stripe      Stripe
+	Cookie        Cookie
+	Email         Email
+	EmailChange   EmailChange
+	Geocoding     Geocoding
+	Keyring       Keyring
+	Memcached     Memcached
+	Moderation    Moderation
+	OIDC          OIDC
+	Password      Password
+	PasswordReset PasswordReset
+	Postgres      Postgres
+	RateLimiter   RateLimiter
+	Redis         Redis
+	Reviews       Reviews
+	Server        Server
+	Session       Session
+	Static        Static
+	Stripe        Stripe
+	Verification  Verification
+}
+
+// Cookie contains the attributes of the cookies set by the server.
+type Cookie struct {
+	// Empty restricts the cookies to the host that set them
+	Domain string
+	// Send the cookies only over HTTPS
+	Secure bool
+	// Strict, lax or none (requires secure)
+	SameSite string
+	// Prefix the names with "__Host-", requires secure and no domain
+	HostPrefix bool
 }
 
 // Email holds email attributes.
@@ -37,11 +59,84 @@ type Email struct {
 	Password string
 }
 
+// EmailChange contains the email change flow configuration.
+type EmailChange struct {
+	// Time the confirmation sent to the new address is valid for
+	Expiration time.Duration
+	// Time the link sent to the old address can revert the change for
+	RevertExpiration time.Duration
+}
+
+// Geocoding contains the offline geocoder configuration.
+type Geocoding struct {
+	// Path to a CSV file with the fields country, zip code, city, latitude and longitude
+	Dataset string
+}
+
+// Keyring contains the keys used to encrypt cookies and secrets, if none is set the token
+// secret key is used.
+type Keyring struct {
+	// Newest first, the first key encrypts and all of them decrypt
+	Keys []string
+	// Path to a file with the keys, one per line and newest first. It takes precedence over Keys
+	File string
+}
+
 // Memcached is the LRU-cache configuration.
 type Memcached struct {
 	Servers []string
 }
 
+// Moderation contains the reviews moderation configuration.
+type Moderation struct {
+	// Reviews containing any of these words are held for moderation
+	Words []string
+	// Number of reports that send an approved review back to the moderation queue
+	ReportThreshold int
+}
+
+// OIDC contains the OpenID Connect providers users can log in with.
+type OIDC struct {
+	// URL the server is reachable at, used to build the providers' redirect URLs
+	BaseURL   string
+	Providers []OIDCProvider
+}
+
+// OIDCProvider is an OpenID Connect identity provider.
+type OIDCProvider struct {
+	// Name used in the login URLs: /login/{name}
+	Name string
+	// Issuer URL, the rest of the provider configuration is discovered from it
+	Issuer   string
+	ClientID string
+	// If empty, it's read from the OIDC_{NAME}_CLIENT_SECRET environment variable
+	ClientSecret string
+	// Scopes requested besides "openid", "email" and "profile" by default
+	Scopes []string
+}
+
+// Password contains the passwords hashing parameters and policy.
+type Password struct {
+	// Argon2id memory in KiB, changing the parameters rehashes the passwords as users log in
+	Memory uint32
+	// Argon2id passes over the memory
+	Iterations uint32
+	// Argon2id threads
+	Parallelism uint8
+	// Minimum number of characters
+	MinLength int
+	// Path to a file with the passwords users can't choose, one per line
+	Blocklist string
+}
+
+// PasswordReset contains the "forgot password" flow configuration.
+type PasswordReset struct {
+	// Time the reset tokens are valid for
+	Expiration time.Duration
+	// Reset requests allowed per hour for each email and IP address
+	Limit int
+}
+
 // Postgres hols the database attributes.
 type Postgres struct {
 	Username string
@@ -64,6 +159,12 @@ type Redis struct {
 	Password string
 }
 
+// Reviews configuration.
+type Reviews struct {
+	// Time after creation during which authors can edit their reviews
+	EditWindow time.Duration
+}
+
 // Server holds the server attributes.
 type Server struct {
 	Host string
@@ -81,9 +182,33 @@ type Server struct {
 
 // Session contains the session configuration.
 type Session struct {
+	Throttle Throttle
+	// Maximum lifetime of the sessions, even if they are in use (0 means no limit)
+	Absolute time.Duration
+	// Time without activity after which sessions expire, each request extends it (0 means no limit)
+	Idle time.Duration
+	// Time after logging in during which sensitive actions are allowed (0 disables the check)
+	Fresh time.Duration
+}
+
+// Throttle contains the limits applied to failed login attempts, they are counted per IP address
+// and per account.
+type Throttle struct {
+	// Failed attempts allowed before delaying the following ones
 	Attempts int64
-	Delay    int64
-	Length   int
+	// Delay after exceeding the attempts, it doubles with every failure (0 disables the delays)
+	Delay time.Duration
+	// Maximum delay between attempts
+	MaxDelay time.Duration
+	// Time after which failed attempts are forgotten
+	Window time.Duration
+	// Failed attempts after which the account is locked and its owner notified (0 disables lockouts)
+	Lockout int64
+	// Time the account remains locked unless its owner unlocks it
+	LockoutDuration time.Duration
+	// Failed logins per minute across all accounts considered credential stuffing, every
+	// failure is delayed while it lasts (0 disables the detection)
+	Stuffing int64
 }
 
 // Static contains the static file system.
@@ -99,6 +224,16 @@ type Stripe struct {
 	}
 }
 
+// Verification contains the email verification flow configuration.
+type Verification struct {
+	// Time the verification tokens are valid for
+	Expiration time.Duration
+	// Verification emails that can be requested per hour for each email and IP address
+	Limit int
+	// Age after which accounts that didn't verify their email are deleted (0 keeps them)
+	Cleanup time.Duration
+}
+
 // New sets up the configuration with the values the user gave.
 // Defaults and env variables are placed at the end to make the config easier to read.
 func New() (Config, error) {
@@ -172,17 +307,42 @@ var (
 		"admins": []string{},
 		// Development
 		"development": true,
+		// Cookie
+		"cookie.domain":     "",
+		"cookie.secure":     true,
+		"cookie.samesite":   "strict",
+		"cookie.hostprefix": false,
 		// Email
 		"email.host":     "smtp.default.com",
 		"email.port":     "587",
 		"email.sender":   "default@adak.com",
 		"email.password": "default",
 		"email.admins":   "../pkg/auth/",
-		// Google
-		"google.client.id":     "id",
-		"google.client.secret": "secret",
+		// Email change
+		"emailchange.expiration":       "24h",
+		"emailchange.revertexpiration": "168h",
+		// Geocoding
+		"geocoding.dataset": "",
+		// Keyring
+		"keyring.keys": []string{},
+		"keyring.file": "",
 		// Memcached
 		"memcached.servers": []string{"memcached:11211"},
+		// Moderation
+		"moderation.words":           []string{},
+		"moderation.reportthreshold": 3,
+		// OpenID Connect
+		"oidc.baseurl":   "http://localhost:4000",
+		"oidc.providers": []interface{}{},
+		// Password
+		"password.memory":      19 * 1024,
+		"password.iterations":  2,
+		"password.parallelism": 1,
+		"password.minlength":   8,
+		"password.blocklist":   "",
+		// Password reset
+		"passwordreset.expiration": "1h",
+		"passwordreset.limit":      3, // Per hour
 		// Postgres
 		"postgres.username": "adak",
 		"postgres.password": "adak",
@@ -196,6 +356,8 @@ var (
 		"redis.host":     "redis",
 		"redis.port":     "6379",
 		"redis.password": "",
+		// Reviews
+		"reviews.editwindow": "48h",
 		// Server
 		"server.host":             "0.0.0.0",
 		"server.port":             "4000",
@@ -205,14 +367,25 @@ var (
 		"server.timeout.write":    5,
 		"server.timeout.shutdown": 5,
 		// Session
-		"session.attempts": 5,
-		"session.delay":    0,
-		"session.length":   0,
+		"session.absolute":                 "720h",
+		"session.idle":                     "24h",
+		"session.fresh":                    "15m",
+		"session.throttle.attempts":        5,
+		"session.throttle.delay":           "1s",
+		"session.throttle.maxdelay":        "15m",
+		"session.throttle.window":          "1h",
+		"session.throttle.lockout":         20,
+		"session.throttle.lockoutduration": "1h",
+		"session.throttle.stuffing":        100,
 		// Stripe
 		"stripe.secretkey":    "sk_test_default",
 		"stripe.logger.level": "4",
 		// Token
 		"token.secretkey": "secretkey",
+		// Verification
+		"verification.expiration": "24h",
+		"verification.limit":      3, // Per hour
+		"verification.cleanup":    "168h",
 	}
 
 	envVars = map[string]string{
@@ -220,16 +393,40 @@ var (
 		"admins": "ADAK_ADMINS",
 		// Development
 		"development": "DEVELOPMENT",
+		// Cookie
+		"cookie.domain":     "COOKIE_DOMAIN",
+		"cookie.secure":     "COOKIE_SECURE",
+		"cookie.samesite":   "COOKIE_SAMESITE",
+		"cookie.hostprefix": "COOKIE_HOST_PREFIX",
 		// Email
 		"email.host":     "EMAIL_HOST",
 		"email.port":     "EMAIL_PORT",
 		"email.sender":   "EMAIL_SENDER",
 		"email.password": "EMAIL_PASSWORD",
-		// Google
-		"google.client.id":     "GOOGLE_CLIENT_ID",
-		"google.client.secret": "GOOGLE_CLIENT_SECRET",
+		// Email change
+		"emailchange.expiration":       "EMAIL_CHANGE_EXPIRATION",
+		"emailchange.revertexpiration": "EMAIL_CHANGE_REVERT_EXPIRATION",
+		// Geocoding
+		"geocoding.dataset": "GEOCODING_DATASET",
+		// Keyring
+		"keyring.keys": "KEYRING_KEYS",
+		"keyring.file": "KEYRING_FILE",
 		// Memcached
 		"memcached.servers": "MEMCACHED_SERVERS",
+		// Moderation
+		"moderation.words":           "MODERATION_WORDS",
+		"moderation.reportthreshold": "MODERATION_REPORT_THRESHOLD",
+		// OpenID Connect
+		"oidc.baseurl": "OIDC_BASE_URL",
+		// Password
+		"password.memory":      "PASSWORD_MEMORY",
+		"password.iterations":  "PASSWORD_ITERATIONS",
+		"password.parallelism": "PASSWORD_PARALLELISM",
+		"password.minlength":   "PASSWORD_MIN_LENGTH",
+		"password.blocklist":   "PASSWORD_BLOCKLIST",
+		// Password reset
+		"passwordreset.expiration": "PASSWORD_RESET_EXPIRATION",
+		"passwordreset.limit":      "PASSWORD_RESET_LIMIT",
 		// Postgres
 		"postgres.username": "POSTGRES_USERNAME",
 		"postgres.password": "POSTGRES_PASSWORD",
@@ -243,6 +440,8 @@ var (
 		"redis.host":     "REDIS_HOST",
 		"redis.port":     "REDIS_PORT",
 		"redis.password": "REDIS_PASSWORD",
+		// Reviews
+		"reviews.editwindow": "REVIEWS_EDIT_WINDOW",
 		// Server
 		"server.host":             "SV_HOST",
 		"server.port":             "SV_PORT",
@@ -252,13 +451,24 @@ var (
 		"server.timeout.write":    "SV_TIMEOUT_WRITE",
 		"server.timeout.shutdown": "SV_TIMEOUT_SHUTDOWN",
 		// Session
-		"session.attempts": "SESSION_ATTEMPTS",
-		"session.delay":    "SESSION_DELAY",
-		"session.length":   "SESSION_LENGTH",
+		"session.absolute":                 "SESSION_ABSOLUTE_TIMEOUT",
+		"session.idle":                     "SESSION_IDLE_TIMEOUT",
+		"session.fresh":                    "SESSION_FRESH_LOGIN",
+		"session.throttle.attempts":        "SESSION_THROTTLE_ATTEMPTS",
+		"session.throttle.delay":           "SESSION_THROTTLE_DELAY",
+		"session.throttle.maxdelay":        "SESSION_THROTTLE_MAX_DELAY",
+		"session.throttle.window":          "SESSION_THROTTLE_WINDOW",
+		"session.throttle.lockout":         "SESSION_THROTTLE_LOCKOUT",
+		"session.throttle.lockoutduration": "SESSION_THROTTLE_LOCKOUT_DURATION",
+		"session.throttle.stuffing":        "SESSION_THROTTLE_STUFFING",
 		// Stripe
 		"stripe.secretkey":    "STRIPE_SECRET_KEY",
 		"stripe.logger.level": "STRIPE_LOGGER_LEVEL",
 		// Token
 		"token.secretkey": "TOKEN_SECRET_KEY",
+		// Verification
+		"verification.expiration": "VERIFICATION_EXPIRATION",
+		"verification.limit":      "VERIFICATION_LIMIT",
+		"verification.cleanup":    "VERIFICATION_CLEANUP",
 	}
 )
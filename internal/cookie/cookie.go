@@ -1,27 +1,76 @@
+// Package cookie sets and reads the encrypted cookies following the policy configured.
 package cookie
 
 import (
 	"encoding/hex"
 	"net/http"
+	"strings"
+	"sync"
 
+	"github.com/GGP1/adak/internal/config"
 	"github.com/GGP1/adak/internal/crypt"
 
 	"github.com/pkg/errors"
 )
 
-// Delete a cookie.
-func Delete(w http.ResponseWriter, name string) {
-	http.SetCookie(w, &http.Cookie{
-		Name:     name,
-		Value:    "",
-		HttpOnly: true,
-		MaxAge:   -1,
-	})
+// hostPrefix makes browsers reject the cookie unless it's secure, has no domain and its path is "/",
+// so it can't be set nor overwritten by other subdomains.
+const hostPrefix = "__Host-"
+
+// policy contains the attributes of the cookies.
+type policy struct {
+	domain     string
+	secure     bool
+	sameSite   http.SameSite
+	hostPrefix bool
+}
+
+var (
+	mu      sync.RWMutex
+	current = policy{secure: true, sameSite: http.SameSiteStrictMode}
+)
+
+// Configure sets the cookies attributes, it must be called before serving requests.
+func Configure(conf config.Cookie) error {
+	p := policy{
+		domain:     conf.Domain,
+		secure:     conf.Secure,
+		hostPrefix: conf.HostPrefix,
+	}
+
+	switch strings.ToLower(conf.SameSite) {
+	case "", "strict":
+		p.sameSite = http.SameSiteStrictMode
+	case "lax":
+		p.sameSite = http.SameSiteLaxMode
+	case "none":
+		if !p.secure {
+			return errors.New("cookies with SameSite none must be secure")
+		}
+		p.sameSite = http.SameSiteNoneMode
+	default:
+		return errors.Errorf("invalid SameSite mode %q", conf.SameSite)
+	}
+
+	if p.hostPrefix && (!p.secure || p.domain != "") {
+		return errors.New("cookies with the __Host- prefix must be secure and have no domain")
+	}
+
+	mu.Lock()
+	current = p
+	mu.Unlock()
+	return nil
+}
+
+// Delete a cookie, the path must be the one used to set it.
+func Delete(w http.ResponseWriter, name, path string) {
+	p := getPolicy()
+	http.SetCookie(w, p.cookie(name, "", path, -1))
 }
 
 // Get deciphers and returns the cookie.
 func Get(r *http.Request, name string) (*http.Cookie, error) {
-	cookie, err := r.Cookie(name)
+	cookie, err := r.Cookie(getPolicy().name(name))
 	if err != nil {
 		return nil, err
 	}
@@ -53,28 +102,65 @@ func GetValue(r *http.Request, name string) (string, error) {
 
 // IsSet returns whether the cookie is set or not.
 func IsSet(r *http.Request, name string) bool {
-	c, _ := r.Cookie(name)
+	c, _ := r.Cookie(getPolicy().name(name))
 
 	return c != nil
 }
 
 // Set a cookie.
 func Set(w http.ResponseWriter, name, value, path string, age int) error {
-	ciphertext, err := crypt.Encrypt([]byte(value))
-	if err != nil {
-		return err
+	return getPolicy().set(w, name, value, path, age)
+}
+
+// SetLax is like Set but the cookie is also sent when the user navigates from another site,
+// as when a login provider redirects them back, unless the policy is already less strict.
+func SetLax(w http.ResponseWriter, name, value, path string, age int) error {
+	p := getPolicy()
+	if p.sameSite == http.SameSiteStrictMode {
+		p.sameSite = http.SameSiteLaxMode
 	}
+	return p.set(w, name, value, path, age)
+}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     name,
-		Value:    hex.EncodeToString(ciphertext),
+// cookie returns a cookie with the policy attributes.
+func (p policy) cookie(name, value, path string, age int) *http.Cookie {
+	c := &http.Cookie{
+		Name:     p.name(name),
+		Value:    value,
 		Path:     path,
-		Domain:   "localhost",
-		Secure:   false,
+		Domain:   p.domain,
+		Secure:   p.secure,
 		HttpOnly: true, // True means no scripts, http requests only. It does not refer to http(s)
-		SameSite: http.SameSiteStrictMode,
+		SameSite: p.sameSite,
 		MaxAge:   age,
-	})
+	}
+	if p.hostPrefix {
+		c.Path = "/"
+	}
+	return c
+}
+
+// set encrypts the value and sets the cookie.
+func (p policy) set(w http.ResponseWriter, name, value, path string, age int) error {
+	ciphertext, err := crypt.Encrypt([]byte(value))
+	if err != nil {
+		return err
+	}
 
+	http.SetCookie(w, p.cookie(name, hex.EncodeToString(ciphertext), path, age))
 	return nil
 }
+
+// name returns the name of the cookie with the prefix, if any.
+func (p policy) name(name string) string {
+	if p.hostPrefix {
+		return hostPrefix + name
+	}
+	return name
+}
+
+func getPolicy() policy {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current
+}
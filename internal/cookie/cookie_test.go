@@ -6,6 +6,7 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"github.com/GGP1/adak/internal/config"
 	"github.com/GGP1/adak/internal/crypt"
 
 	"github.com/stretchr/testify/assert"
@@ -22,9 +23,12 @@ func TestDelete(t *testing.T) {
 		Path:  "/",
 	})
 
-	Delete(w, name)
+	Delete(w, name, "/")
 
-	assert.NotEqual(t, 0, len(w.Result().Cookies()))
+	cookies := w.Result().Cookies()
+	assert.Equal(t, 2, len(cookies))
+	assert.Equal(t, "/", cookies[1].Path)
+	assert.Equal(t, -1, cookies[1].MaxAge)
 }
 
 func TestGet(t *testing.T) {
@@ -67,6 +71,34 @@ func TestGetValue(t *testing.T) {
 	assert.Equal(t, expected, got)
 }
 
+func TestGetPreviousKey(t *testing.T) {
+	assert.NoError(t, crypt.Configure(config.Keyring{Keys: []string{"old"}}))
+	ciphertext, err := crypt.Encrypt([]byte("adak"))
+	assert.NoError(t, err)
+
+	// Rotate the key, cookies set before must still be valid
+	assert.NoError(t, crypt.Configure(config.Keyring{Keys: []string{"new", "old"}}))
+	defer crypt.Configure(config.Keyring{Keys: []string{"new"}})
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{
+		Name:  "test-rotation",
+		Value: hex.EncodeToString(ciphertext),
+		Path:  "/",
+	})
+
+	got, err := GetValue(r, "test-rotation")
+	assert.NoError(t, err)
+	assert.Equal(t, "adak", got)
+
+	t.Run("Removed key", func(t *testing.T) {
+		assert.NoError(t, crypt.Configure(config.Keyring{Keys: []string{"new"}}))
+
+		_, err := GetValue(r, "test-rotation")
+		assert.Error(t, err)
+	})
+}
+
 func TestGetErrors(t *testing.T) {
 	t.Run("Cookie isn't set", func(t *testing.T) {
 		r := httptest.NewRequest("GET", "/", nil)
@@ -121,3 +153,76 @@ func TestSet(t *testing.T) {
 
 	assert.Equal(t, 1, len(w.Result().Cookies()))
 }
+
+func TestSetLax(t *testing.T) {
+	defer Configure(config.Cookie{Secure: true})
+
+	w := httptest.NewRecorder()
+	assert.NoError(t, SetLax(w, "test-set-lax", "adak", "/", 0))
+	assert.Equal(t, http.SameSiteLaxMode, w.Result().Cookies()[0].SameSite)
+
+	err := Configure(config.Cookie{Secure: true, SameSite: "none"})
+	assert.NoError(t, err)
+
+	w = httptest.NewRecorder()
+	assert.NoError(t, SetLax(w, "test-set-lax", "adak", "/", 0))
+	assert.Equal(t, http.SameSiteNoneMode, w.Result().Cookies()[0].SameSite, "Less strict policies must be kept")
+}
+
+func TestConfigure(t *testing.T) {
+	defer Configure(config.Cookie{Secure: true})
+
+	t.Run("Policy", func(t *testing.T) {
+		err := Configure(config.Cookie{Domain: "adak.example.com", Secure: true, SameSite: "lax"})
+		assert.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		assert.NoError(t, Set(w, "SID", "adak", "/", 60))
+
+		c := w.Result().Cookies()[0]
+		assert.Equal(t, "SID", c.Name)
+		assert.Equal(t, "adak.example.com", c.Domain)
+		assert.True(t, c.Secure)
+		assert.True(t, c.HttpOnly)
+		assert.Equal(t, http.SameSiteLaxMode, c.SameSite)
+	})
+
+	t.Run("Host prefix", func(t *testing.T) {
+		err := Configure(config.Cookie{Secure: true, SameSite: "strict", HostPrefix: true})
+		assert.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		assert.NoError(t, Set(w, "SID", "adak", "/", 60))
+		Delete(w, "SID", "/")
+
+		cookies := w.Result().Cookies()
+		assert.Equal(t, 2, len(cookies))
+		for _, c := range cookies {
+			assert.Equal(t, "__Host-SID", c.Name)
+			assert.Equal(t, "/", c.Path)
+			assert.Empty(t, c.Domain)
+		}
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(cookies[0])
+		assert.True(t, IsSet(r, "SID"))
+		got, err := GetValue(r, "SID")
+		assert.NoError(t, err)
+		assert.Equal(t, "adak", got)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		cases := map[string]config.Cookie{
+			"SameSite":               {Secure: true, SameSite: "invalid"},
+			"SameSite none insecure": {SameSite: "none"},
+			"Host prefix insecure":   {HostPrefix: true},
+			"Host prefix domain":     {Secure: true, Domain: "adak.example.com", HostPrefix: true},
+		}
+
+		for desc, conf := range cases {
+			t.Run(desc, func(t *testing.T) {
+				assert.Error(t, Configure(conf))
+			})
+		}
+	})
+}
@@ -1,76 +1,245 @@
+// Package crypt encrypts the cookies and the secrets stored, like the two-factor authentication ones.
+//
+// The keys are kept in a keyring, the first one encrypts and all of them decrypt, so they can
+// be rotated adding a new key at the beginning and removing the old ones once the data they
+// encrypted expired. Ciphertexts are prefixed with a version byte and the ID of the key used.
 package crypt
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"io"
+	"os"
+	"strings"
 	"sync"
 
+	"github.com/GGP1/adak/internal/config"
+
 	"github.com/pkg/errors"
 	"github.com/spf13/viper"
 	"golang.org/x/crypto/chacha20poly1305"
 )
 
+const (
+	// version identifies the ciphertexts with a key ID, data encrypted before had only the nonce.
+	version = 1
+	// idSize is the length of the keys IDs.
+	idSize = 4
+	// headerSize is the length of the version and the key ID.
+	headerSize = 1 + idSize
+)
+
 var (
 	// Do not provide additional information about the failure to potential attackers
 	errEncrypt = errors.New("encrypt error")
 	errDecrypt = errors.New("decrypt error")
 
-	once sync.Once
-	sum  []byte
+	mu      sync.RWMutex
+	keyring *Keyring
 )
 
-// Encrypt ciphers data with the given key.
-func Encrypt(data []byte) ([]byte, error) {
-	hash := createHMAC()
+// Keyring contains the keys used to encrypt and decrypt data.
+type Keyring struct {
+	keys []key
+}
+
+type key struct {
+	id   [idSize]byte
+	aead cipher.AEAD
+}
+
+// NewKeyring returns a keyring with the secrets provided, the first one is the current.
+func NewKeyring(secrets ...string) (*Keyring, error) {
+	if len(secrets) == 0 {
+		return nil, errors.New("the keyring requires at least one key")
+	}
+
+	k := &Keyring{keys: make([]key, 0, len(secrets))}
+	for _, secret := range secrets {
+		derived := deriveKey(secret)
+		aead, err := chacha20poly1305.New(derived)
+		if err != nil {
+			return nil, errors.Wrap(err, "creating cipher")
+		}
+
+		// Only a fingerprint of the derived key is exposed
+		fingerprint := sha256.Sum256(derived)
+		var id [idSize]byte
+		copy(id[:], fingerprint[:idSize])
+		for _, other := range k.keys {
+			if other.id == id {
+				return nil, errors.New("the keyring contains duplicated keys")
+			}
+		}
+
+		k.keys = append(k.keys, key{id: id, aead: aead})
+	}
+
+	return k, nil
+}
 
-	AEAD, err := chacha20poly1305.New(hash)
+// LoadKeyring returns a keyring with the keys from the configuration file or, if it's not set,
+// with the ones listed. The token secret key is used if there are none.
+func LoadKeyring(conf config.Keyring) (*Keyring, error) {
+	secrets := conf.Keys
+	if conf.File != "" {
+		var err error
+		secrets, err = readKeys(conf.File)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(secrets) == 0 {
+		return NewKeyring(viper.GetString("token.secretkey"))
+	}
+
+	for _, secret := range secrets {
+		if secret == "" {
+			return nil, errors.New("keys can't be empty")
+		}
+	}
+	return NewKeyring(secrets...)
+}
+
+// Configure replaces the keyring used by Encrypt and Decrypt, it must be called before
+// serving requests.
+func Configure(conf config.Keyring) error {
+	k, err := LoadKeyring(conf)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	keyring = k
+	mu.Unlock()
+	return nil
+}
+
+// Encrypt ciphers data with the current key.
+func Encrypt(data []byte) ([]byte, error) {
+	k, err := defaultKeyring()
 	if err != nil {
 		return nil, errEncrypt
 	}
+	return k.Encrypt(data)
+}
+
+// Decrypt deciphers data with the key it was encrypted with.
+func Decrypt(data []byte) ([]byte, error) {
+	k, err := defaultKeyring()
+	if err != nil {
+		return nil, errDecrypt
+	}
+	return k.Decrypt(data)
+}
 
-	nonce := make([]byte, AEAD.NonceSize())
+// Encrypt ciphers data with the current key.
+func (k *Keyring) Encrypt(data []byte) ([]byte, error) {
+	current := k.keys[0]
+	nonceSize := current.aead.NonceSize()
 
+	dst := make([]byte, headerSize+nonceSize, headerSize+nonceSize+len(data)+current.aead.Overhead())
+	dst[0] = version
+	copy(dst[1:headerSize], current.id[:])
+
+	nonce := dst[headerSize:]
 	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return nil, errEncrypt
 	}
 
-	dst := make([]byte, AEAD.NonceSize())
-	copy(dst, nonce)
+	// The header is authenticated so the key ID can't be tampered with
+	return current.aead.Seal(dst, nonce, data, dst[:headerSize]), nil
+}
 
-	ciphertext := AEAD.Seal(dst, nonce, data, nil)
+// Decrypt deciphers data with the key it was encrypted with, it must be in the keyring.
+func (k *Keyring) Decrypt(data []byte) ([]byte, error) {
+	if len(data) > headerSize && data[0] == version {
+		for _, key := range k.keys {
+			if !bytes.Equal(data[1:headerSize], key.id[:]) {
+				continue
+			}
+			if plaintext, err := open(key.aead, data[headerSize:], data[:headerSize]); err == nil {
+				return plaintext, nil
+			}
+			break
+		}
+	}
 
-	return ciphertext, nil
-}
+	// Data encrypted before the keyring has no header and may have been encrypted with any key.
+	// It could also start with the version byte by chance
+	for _, key := range k.keys {
+		if plaintext, err := open(key.aead, data, nil); err == nil {
+			return plaintext, nil
+		}
+	}
 
-// Decrypt deciphers data with the given key.
-func Decrypt(data []byte) ([]byte, error) {
-	hash := createHMAC()
+	return nil, errDecrypt
+}
 
-	AEAD, err := chacha20poly1305.New(hash)
-	if err != nil {
+func open(aead cipher.AEAD, data, additionalData []byte) ([]byte, error) {
+	nonceSize := aead.NonceSize()
+	if len(data) < nonceSize+aead.Overhead() {
 		return nil, errDecrypt
 	}
 
-	nonceSize := AEAD.NonceSize()
 	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
 
-	plaintext, err := AEAD.Open(nil, nonce, ciphertext, nil)
-	if err != nil {
-		return nil, errDecrypt
+// defaultKeyring returns the configured keyring, or one with the token secret key if
+// Configure wasn't called.
+func defaultKeyring() (*Keyring, error) {
+	mu.RLock()
+	k := keyring
+	mu.RUnlock()
+	if k != nil {
+		return k, nil
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if keyring == nil {
+		var err error
+		keyring, err = NewKeyring(viper.GetString("token.secretkey"))
+		if err != nil {
+			return nil, err
+		}
 	}
+	return keyring, nil
+}
 
-	return plaintext, nil
+// deriveKey creates an HMAC SHA256 hash (32 bytes) with the secret provided.
+func deriveKey(secret string) []byte {
+	hash := hmac.New(sha256.New, []byte(secret))
+	return hash.Sum(nil)
 }
 
-// Create an HMAC SHA256 hash (32 bytes) with the key provided.
-func createHMAC() []byte {
-	once.Do(func() {
-		key := []byte(viper.GetString("token.secretkey"))
-		hash := hmac.New(sha256.New, key)
-		sum = hash.Sum(nil)
-	})
+// readKeys returns the keys in the file, one per line. Empty lines and the ones starting
+// with "#" are ignored.
+func readKeys(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening the keys file")
+	}
+	defer f.Close()
+
+	var keys []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading the keys file")
+	}
 
-	return sum
+	return keys, nil
 }
@@ -2,9 +2,15 @@ package crypt
 
 import (
 	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/GGP1/adak/internal/config"
+
 	"github.com/spf13/viper"
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 func TestCrypt(t *testing.T) {
@@ -25,3 +31,163 @@ func TestCrypt(t *testing.T) {
 		t.Errorf("Expected %q, got %q", data, plaintext)
 	}
 }
+
+func TestKeyring(t *testing.T) {
+	data := []byte("testing keyring")
+
+	old, err := NewKeyring("old")
+	if err != nil {
+		t.Fatalf("Failed creating keyring: %v", err)
+	}
+	oldCiphertext, err := old.Encrypt(data)
+	if err != nil {
+		t.Fatalf("Failed encrypting data: %v", err)
+	}
+
+	rotated, err := NewKeyring("new", "old")
+	if err != nil {
+		t.Fatalf("Failed creating keyring: %v", err)
+	}
+
+	t.Run("Previous key", func(t *testing.T) {
+		plaintext, err := rotated.Decrypt(oldCiphertext)
+		if err != nil {
+			t.Fatalf("Failed decrypting data: %v", err)
+		}
+		if !bytes.Equal(plaintext, data) {
+			t.Errorf("Expected %q, got %q", data, plaintext)
+		}
+	})
+
+	t.Run("Newest key encrypts", func(t *testing.T) {
+		ciphertext, err := rotated.Encrypt(data)
+		if err != nil {
+			t.Fatalf("Failed encrypting data: %v", err)
+		}
+		if _, err := old.Decrypt(ciphertext); err == nil {
+			t.Error("Expected the old keyring to fail decrypting data encrypted with the new key")
+		}
+
+		current, err := NewKeyring("new")
+		if err != nil {
+			t.Fatalf("Failed creating keyring: %v", err)
+		}
+		if _, err := current.Decrypt(ciphertext); err != nil {
+			t.Errorf("Failed decrypting data: %v", err)
+		}
+	})
+
+	t.Run("Removed key", func(t *testing.T) {
+		current, err := NewKeyring("new")
+		if err != nil {
+			t.Fatalf("Failed creating keyring: %v", err)
+		}
+		if _, err := current.Decrypt(oldCiphertext); err == nil {
+			t.Error("Expected an error decrypting data encrypted with a removed key")
+		}
+	})
+
+	t.Run("Legacy format", func(t *testing.T) {
+		// Data encrypted before the keyring had only the nonce and the ciphertext
+		aead, err := chacha20poly1305.New(deriveKey("old"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			t.Fatal(err)
+		}
+		legacy := aead.Seal(nonce, nonce, data, nil)
+
+		plaintext, err := rotated.Decrypt(legacy)
+		if err != nil {
+			t.Fatalf("Failed decrypting data: %v", err)
+		}
+		if !bytes.Equal(plaintext, data) {
+			t.Errorf("Expected %q, got %q", data, plaintext)
+		}
+	})
+
+	t.Run("Tampered key ID", func(t *testing.T) {
+		ciphertext, err := rotated.Encrypt(data)
+		if err != nil {
+			t.Fatalf("Failed encrypting data: %v", err)
+		}
+		copy(ciphertext[1:headerSize], oldCiphertext[1:headerSize])
+		if _, err := rotated.Decrypt(ciphertext); err == nil {
+			t.Error("Expected an error decrypting data with a tampered key ID")
+		}
+	})
+
+	t.Run("Short data", func(t *testing.T) {
+		for _, data := range [][]byte{nil, {version}, oldCiphertext[:headerSize+3]} {
+			if _, err := rotated.Decrypt(data); err == nil {
+				t.Errorf("Expected an error decrypting %x", data)
+			}
+		}
+	})
+}
+
+func TestNewKeyringErrors(t *testing.T) {
+	cases := map[string][]string{
+		"No keys":    nil,
+		"Duplicated": {"new", "old", "new"},
+	}
+
+	for desc, secrets := range cases {
+		t.Run(desc, func(t *testing.T) {
+			if _, err := NewKeyring(secrets...); err == nil {
+				t.Error("Expected an error and got nil")
+			}
+		})
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+	data := []byte("testing load keyring")
+	old, err := NewKeyring("old")
+	if err != nil {
+		t.Fatalf("Failed creating keyring: %v", err)
+	}
+	ciphertext, err := old.Encrypt(data)
+	if err != nil {
+		t.Fatalf("Failed encrypting data: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte("# Newest first\nnew\n\nold\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]config.Keyring{
+		"File": {File: path, Keys: []string{"ignored"}},
+		"Keys": {Keys: []string{"new", "old"}},
+	}
+
+	for desc, conf := range cases {
+		t.Run(desc, func(t *testing.T) {
+			k, err := LoadKeyring(conf)
+			if err != nil {
+				t.Fatalf("Failed loading keyring: %v", err)
+			}
+			if len(k.keys) != 2 {
+				t.Fatalf("Expected 2 keys, got %d", len(k.keys))
+			}
+			if _, err := k.Decrypt(ciphertext); err != nil {
+				t.Errorf("Failed decrypting data: %v", err)
+			}
+		})
+	}
+
+	t.Run("Empty key", func(t *testing.T) {
+		if _, err := LoadKeyring(config.Keyring{Keys: []string{"new", ""}}); err == nil {
+			t.Error("Expected an error and got nil")
+		}
+	})
+
+	t.Run("Missing file", func(t *testing.T) {
+		if _, err := LoadKeyring(config.Keyring{File: filepath.Join(t.TempDir(), "missing")}); err == nil {
+			t.Error("Expected an error and got nil")
+		}
+	})
+}
@@ -27,17 +27,21 @@ type Emailer struct {
 	senderAddr string
 	senderPwd  string
 
-	validation  *template.Template
-	changeEmail *template.Template
+	validation    *template.Template
+	changeEmail   *template.Template
+	emailChanged  *template.Template
+	invitation    *template.Template
+	passwordReset *template.Template
+	accountLocked *template.Template
 }
 
 // Items is a struct that keeps the values passed to the templates.
 type Items struct {
-	ID       string
 	Name     string
 	Email    string
 	Token    string
 	NewEmail string
+	Shop     string
 }
 
 // New returns a new emailer.
@@ -63,6 +67,22 @@ func New() Emailer {
 		if err != nil {
 			logger.Fatalf("Failed parsing change email template")
 		}
+		emailer.emailChanged, err = template.ParseFS(fs, "static/templates/emailChanged.html")
+		if err != nil {
+			logger.Fatalf("Failed parsing email changed template")
+		}
+		emailer.invitation, err = template.ParseFS(fs, "static/templates/invitation.html")
+		if err != nil {
+			logger.Fatalf("Failed parsing invitation template")
+		}
+		emailer.passwordReset, err = template.ParseFS(fs, "static/templates/passwordReset.html")
+		if err != nil {
+			logger.Fatalf("Failed parsing password reset template")
+		}
+		emailer.accountLocked, err = template.ParseFS(fs, "static/templates/accountLocked.html")
+		if err != nil {
+			logger.Fatalf("Failed parsing account locked template")
+		}
 	}
 
 	return emailer
@@ -70,8 +90,6 @@ func New() Emailer {
 
 // SendValidation sends a validation email to the user.
 func (e *Emailer) SendValidation(ctx context.Context, username, email, token string) error {
-	// Email content
-	from := mail.Address{Name: e.name, Address: e.senderAddr}
 	to := mail.Address{Name: username, Address: email}
 	items := Items{
 		Name:  username,
@@ -79,54 +97,78 @@ func (e *Emailer) SendValidation(ctx context.Context, username, email, token str
 		Token: token,
 	}
 
-	headers := make(map[string]string, 4)
-	headers["From"] = from.String()
-	headers["To"] = to.String()
-	headers["Subject"] = "Validation email"
-	headers["Content-Type"] = `text/html; charset="UTF-8"`
+	return e.send(to, "Validation email", e.validation, items)
+}
 
-	message := bufferpool.Get()
-	defer bufferpool.Put(message)
+// SendChangeConfirmation sends the link to confirm the email change to the new address.
+func (e *Emailer) SendChangeConfirmation(username, newEmail, token string) error {
+	to := mail.Address{Name: username, Address: newEmail}
+	items := Items{
+		Name:     username,
+		Token:    token,
+		NewEmail: newEmail,
+	}
 
-	for k, v := range headers {
-		fmtHeaders(message, k, v)
+	return e.send(to, "Email change confirmation", e.changeEmail, items)
+}
+
+// SendEmailChanged notifies the old address that the email was changed and sends the link to revert it.
+func (e *Emailer) SendEmailChanged(username, email, newEmail, token string) error {
+	to := mail.Address{Name: username, Address: email}
+	items := Items{
+		Name:     username,
+		Email:    email,
+		Token:    token,
+		NewEmail: newEmail,
 	}
 
-	buf := bufferpool.Get()
-	if err := e.validation.Execute(buf, items); err != nil {
-		return err
+	return e.send(to, "Your email was changed", e.emailChanged, items)
+}
+
+// SendInvitation sends an invitation to join a shop's staff.
+func (e *Emailer) SendInvitation(email, shopName, token string) error {
+	to := mail.Address{Address: email}
+	items := Items{
+		Email: email,
+		Token: token,
+		Shop:  shopName,
 	}
-	message.Write(buf.Bytes())
-	bufferpool.Put(buf)
 
-	// Connect to smtp
-	auth := smtp.PlainAuth("", e.senderAddr, e.senderPwd, e.host)
+	return e.send(to, "Invitation to join "+shopName, e.invitation, items)
+}
 
-	if err := smtp.SendMail(e.addr, auth, from.Address, []string{to.Address}, message.Bytes()); err != nil {
-		logger.Debugf("Couldn't send the validation email: %v.\nAddr: %s\nEmail: %s", err, e.addr, to.Address)
-		return errors.Wrap(err, "couldn't send the email")
+// SendPasswordReset sends the link to reset the account password.
+func (e *Emailer) SendPasswordReset(username, email, token string) error {
+	to := mail.Address{Name: username, Address: email}
+	items := Items{
+		Name:  username,
+		Email: email,
+		Token: token,
 	}
 
-	logger.Infof("Successfully sent email to: %s", to.Address)
-	return nil
+	return e.send(to, "Password reset", e.passwordReset, items)
 }
 
-// SendChangeConfirmation sends a confirmation email to the user.
-func (e *Emailer) SendChangeConfirmation(id, username, email, newEmail, token string) error {
-	// Email content
-	from := mail.Address{Name: e.name, Address: e.senderAddr}
+// SendAccountLocked notifies the user that their account was locked and sends the link to unlock it.
+func (e *Emailer) SendAccountLocked(username, email, token string) error {
 	to := mail.Address{Name: username, Address: email}
 	items := Items{
-		ID:       id,
-		Name:     username,
-		Token:    token,
-		NewEmail: newEmail,
+		Name:  username,
+		Email: email,
+		Token: token,
 	}
 
+	return e.send(to, "Account locked", e.accountLocked, items)
+}
+
+// send executes the template with the items provided and sends the result to the address.
+func (e *Emailer) send(to mail.Address, subject string, tmpl *template.Template, items Items) error {
+	from := mail.Address{Name: e.name, Address: e.senderAddr}
+
 	headers := make(map[string]string, 4)
 	headers["From"] = from.String()
 	headers["To"] = to.String()
-	headers["Subject"] = "Email change confirmation"
+	headers["Subject"] = subject
 	headers["Content-Type"] = `text/html; charset="UTF-8"`
 
 	message := bufferpool.Get()
@@ -137,7 +179,7 @@ func (e *Emailer) SendChangeConfirmation(id, username, email, newEmail, token st
 	}
 
 	buf := bufferpool.Get()
-	if err := e.changeEmail.Execute(buf, items); err != nil {
+	if err := tmpl.Execute(buf, items); err != nil {
 		return err
 	}
 	message.Write(buf.Bytes())
@@ -147,7 +189,7 @@ func (e *Emailer) SendChangeConfirmation(id, username, email, newEmail, token st
 	auth := smtp.PlainAuth("", e.senderAddr, e.senderPwd, e.host)
 
 	if err := smtp.SendMail(e.addr, auth, from.Address, []string{to.Address}, message.Bytes()); err != nil {
-		logger.Debugf("Couldn't send the change confirmation email: %v.\nAddr: %s\nEmail: %s", err, e.addr, to.Address)
+		logger.Debugf("Couldn't send the %q email: %v.\nAddr: %s\nEmail: %s", subject, err, e.addr, to.Address)
 		return errors.Wrap(err, "couldn't send the email")
 	}
 
@@ -0,0 +1,62 @@
+// Package filter detects forbidden words in texts written by users.
+package filter
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/GGP1/adak/internal/sanitize"
+)
+
+// Filter contains a set of forbidden words.
+type Filter struct {
+	words map[string]struct{}
+}
+
+// New returns a filter that matches the words provided. Accents and
+// letter case are ignored.
+func New(words []string) Filter {
+	set := make(map[string]struct{}, len(words))
+	for _, w := range words {
+		w = normalize(w)
+		if w == "" {
+			continue
+		}
+		set[w] = struct{}{}
+	}
+
+	return Filter{words: set}
+}
+
+// Match returns the forbidden words found in the text, each of them only once
+// and in order of appearance.
+func (f Filter) Match(text string) []string {
+	if len(f.words) == 0 {
+		return nil
+	}
+
+	var (
+		matches []string
+		seen    = make(map[string]struct{})
+	)
+	for _, word := range strings.FieldsFunc(normalize(text), isSeparator) {
+		if _, ok := f.words[word]; !ok {
+			continue
+		}
+		if _, ok := seen[word]; ok {
+			continue
+		}
+		seen[word] = struct{}{}
+		matches = append(matches, word)
+	}
+
+	return matches
+}
+
+func normalize(s string) string {
+	return strings.ToLower(strings.TrimSpace(sanitize.Normalize(s)))
+}
+
+func isSeparator(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+}
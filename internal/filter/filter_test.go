@@ -0,0 +1,55 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatch(t *testing.T) {
+	f := New([]string{"scam", "Fraude", " "})
+
+	cases := []struct {
+		desc     string
+		text     string
+		expected []string
+	}{
+		{
+			desc:     "Clean",
+			text:     "Great product, fast delivery",
+			expected: nil,
+		},
+		{
+			desc:     "Case",
+			text:     "This shop is a SCAM!",
+			expected: []string{"scam"},
+		},
+		{
+			desc:     "Accents",
+			text:     "Es un fraudé",
+			expected: []string{"fraude"},
+		},
+		{
+			desc:     "Repeated",
+			text:     "scam, fraude and scam again",
+			expected: []string{"scam", "fraude"},
+		},
+		{
+			desc:     "Substring",
+			text:     "scampi was delicious",
+			expected: nil,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			got := f.Match(tc.text)
+			assert.Equal(t, tc.expected, got)
+		})
+	}
+}
+
+func TestMatchEmpty(t *testing.T) {
+	f := New(nil)
+	assert.Nil(t, f.Match("anything"))
+}
@@ -0,0 +1,128 @@
+// Package geo provides an offline geocoder and geographic helpers.
+package geo
+
+import (
+	"encoding/csv"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/GGP1/adak/internal/sanitize"
+
+	"github.com/pkg/errors"
+)
+
+// Point is a geographic location.
+type Point struct {
+	Latitude  float64
+	Longitude float64
+}
+
+// Geocoder translates addresses into coordinates using a local dataset.
+type Geocoder struct {
+	// Keys are formatted as "country|zip_code" and "country||city"
+	places map[string]Point
+}
+
+// Load returns a geocoder with the places in the CSV file located at path. Each record
+// must contain the fields country, zip code, city, latitude and longitude, in that order,
+// and the first line is considered a header.
+//
+// If the path is empty the geocoder won't find any place.
+func Load(path string) (*Geocoder, error) {
+	if path == "" {
+		return &Geocoder{places: map[string]Point{}}, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening geocoding dataset")
+	}
+	defer f.Close()
+
+	return parse(f)
+}
+
+// Lookup returns the coordinates of the place with the zip code provided or, if
+// there is none, the ones of the city.
+func (g *Geocoder) Lookup(country, zipCode, city string) (Point, bool) {
+	country = normalize(country)
+	if zipCode != "" {
+		if p, ok := g.places[country+"|"+normalize(zipCode)]; ok {
+			return p, true
+		}
+	}
+
+	p, ok := g.places[country+"||"+normalize(city)]
+	return p, ok
+}
+
+// earthRadius is the mean radius of the earth in meters.
+const earthRadius = 6371008.8
+
+// Distance returns the great-circle distance in meters between two points.
+func Distance(a, b Point) float64 {
+	lat1, lat2 := a.Latitude*math.Pi/180, b.Latitude*math.Pi/180
+	dLat := lat2 - lat1
+	dLng := (b.Longitude - a.Longitude) * math.Pi / 180
+
+	h := math.Pow(math.Sin(dLat/2), 2) + math.Cos(lat1)*math.Cos(lat2)*math.Pow(math.Sin(dLng/2), 2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
+}
+
+// ValidCoordinates returns whether the latitude and longitude are within their ranges.
+func ValidCoordinates(lat, lng float64) bool {
+	return lat >= -90 && lat <= 90 && lng >= -180 && lng <= 180
+}
+
+func parse(r io.Reader) (*Geocoder, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 5
+	reader.ReuseRecord = true
+
+	// Skip header
+	if _, err := reader.Read(); err != nil {
+		return nil, errors.Wrap(err, "reading header")
+	}
+
+	g := &Geocoder{places: make(map[string]Point)}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "reading record")
+		}
+
+		lat, err := strconv.ParseFloat(record[3], 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing latitude")
+		}
+		lng, err := strconv.ParseFloat(record[4], 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing longitude")
+		}
+		if !ValidCoordinates(lat, lng) {
+			return nil, errors.Errorf("invalid coordinates (%f, %f)", lat, lng)
+		}
+
+		country, zipCode, city := normalize(record[0]), normalize(record[1]), normalize(record[2])
+		p := Point{Latitude: lat, Longitude: lng}
+		if zipCode != "" {
+			g.places[country+"|"+zipCode] = p
+		}
+		// Keep the first entry of each city, usually its center
+		if _, ok := g.places[country+"||"+city]; !ok && city != "" {
+			g.places[country+"||"+city] = p
+		}
+	}
+
+	return g, nil
+}
+
+func normalize(s string) string {
+	return sanitize.Normalize(strings.ToLower(strings.TrimSpace(s)))
+}
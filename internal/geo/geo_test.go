@@ -0,0 +1,69 @@
+package geo
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLookup(t *testing.T) {
+	g, err := Load("testdata/places.csv")
+	assert.NoError(t, err)
+
+	cases := []struct {
+		desc     string
+		country  string
+		zipCode  string
+		city     string
+		expected Point
+		found    bool
+	}{
+		{desc: "Zip code", country: "New Zealand", zipCode: "1023", city: "Auckland", expected: Point{-36.8688, 174.7770}, found: true},
+		{desc: "City fallback", country: "new zealand", zipCode: "9999", city: "AUCKLAND", expected: Point{-36.8485, 174.7633}, found: true},
+		{desc: "Accents", country: "Espana", city: "Madrid", expected: Point{40.4168, -3.7038}, found: true},
+		{desc: "Not found", country: "Argentina", zipCode: "1900", city: "La Plata", found: false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			p, ok := g.Lookup(tc.country, tc.zipCode, tc.city)
+			assert.Equal(t, tc.found, ok)
+			assert.Equal(t, tc.expected, p)
+		})
+	}
+}
+
+func TestDistance(t *testing.T) {
+	auckland := Point{-36.8485, 174.7633}
+	wellington := Point{-41.2865, 174.7762}
+
+	assert.Equal(t, 0.0, Distance(auckland, auckland))
+	assert.InDelta(t, 493_400, Distance(auckland, wellington), 1000)
+	assert.Equal(t, Distance(auckland, wellington), Distance(wellington, auckland))
+}
+
+func TestLoadEmpty(t *testing.T) {
+	g, err := Load("")
+	assert.NoError(t, err)
+
+	_, ok := g.Lookup("New Zealand", "1010", "Auckland")
+	assert.False(t, ok)
+}
+
+func TestParseInvalid(t *testing.T) {
+	header := "country,zip_code,city,latitude,longitude\n"
+	cases := map[string]string{
+		"Latitude":    header + "NZ,1010,Auckland,north,174.7",
+		"Range":       header + "NZ,1010,Auckland,-136.8,174.7",
+		"Fields":      header + "NZ,1010,-36.8,174.7",
+		"Empty input": "",
+	}
+
+	for desc, input := range cases {
+		t.Run(desc, func(t *testing.T) {
+			_, err := parse(strings.NewReader(input))
+			assert.Error(t, err)
+		})
+	}
+}
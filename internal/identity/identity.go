@@ -0,0 +1,74 @@
+// Package identity keeps track of the user making a request, whether they authenticated
+// with the session cookie or an API key.
+package identity
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNotAuthenticated is returned when the request doesn't contain the identity, the
+// authentication middleware stores it.
+var ErrNotAuthenticated = errors.New("please log in to access")
+
+type identityKey struct{}
+
+// Identity is the user authenticated in a request.
+type Identity struct {
+	UserID string
+	CartID string
+	// Scopes contains the permissions of the API key used, it's nil for sessions
+	Scopes []string
+	APIKey bool
+}
+
+// HasScopes returns whether the request was authenticated with the session cookie or with
+// an API key that has all the scopes provided.
+func (i Identity) HasScopes(scopes ...string) bool {
+	if !i.APIKey {
+		return true
+	}
+
+	for _, scope := range scopes {
+		found := false
+		for _, s := range i.Scopes {
+			if s == scope {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// NewContext returns a copy of the context containing the identity.
+func NewContext(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// FromContext returns the identity stored in the context, if any.
+func FromContext(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(Identity)
+	return identity, ok
+}
+
+// UserID returns the id of the user making the request.
+func UserID(r *http.Request) (string, error) {
+	if id, ok := FromContext(r.Context()); ok {
+		return id.UserID, nil
+	}
+	return "", ErrNotAuthenticated
+}
+
+// CartID returns the id of the cart of the user making the request.
+func CartID(r *http.Request) (string, error) {
+	if id, ok := FromContext(r.Context()); ok {
+		return id.CartID, nil
+	}
+	return "", ErrNotAuthenticated
+}
@@ -3,11 +3,14 @@ package params
 import (
 	"context"
 	"encoding/base64"
+	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/GGP1/adak/internal/sanitize"
 	"github.com/GGP1/adak/internal/validate"
 	"github.com/go-chi/chi/v5"
 	"github.com/pkg/errors"
@@ -26,6 +29,40 @@ const (
 
 type obj uint8
 
+// DefaultLanguage is the language used when the client didn't specify a supported one.
+const DefaultLanguage = "en"
+
+// languages contains the ISO 639-1 codes of the languages supported by the full-text search,
+// each of them has a text search configuration in postgres.
+var languages = map[string]struct{}{
+	"de": {},
+	"en": {},
+	"es": {},
+	"fr": {},
+	"hi": {},
+	"it": {},
+	"ja": {},
+	"pt": {},
+	"ru": {},
+	"zh": {},
+}
+
+// Search results sorting options.
+const (
+	// SortRelevance sorts by how well the documents match the query, it's the default
+	SortRelevance = "relevance"
+	// SortRating sorts by the average rating, then by the number of reviews
+	SortRating = "rating"
+)
+
+// Reviews sorting options.
+const (
+	// SortRecent sorts by creation date, it's the default
+	SortRecent = "recent"
+	// SortHelpful sorts by the difference between helpful and unhelpful votes
+	SortHelpful = "helpful"
+)
+
 // Cursor contains the values used for pagination.
 type Cursor struct {
 	// Used defines if the client used a cursor or not
@@ -40,6 +77,17 @@ type Cursor struct {
 type Query struct {
 	Cursor Cursor
 	Limit  string
+	// Verified filters reviews by verified purchases, only used with reviews
+	Verified bool
+	// Sort defines the reviews order, only used with reviews
+	Sort string
+}
+
+// Search contains the full-text search parameters provided by the client.
+type Search struct {
+	Query    string
+	Language string
+	Sort     string
 }
 
 // DecodeCursor decodes de cursor and returns both it and time
@@ -100,9 +148,97 @@ func ParseQuery(rawQuery string, obj obj) (Query, error) {
 		Cursor: cursor,
 		Limit:  limit,
 	}
+
+	if obj == Review {
+		if v := values.Get("verified"); v != "" {
+			params.Verified, err = strconv.ParseBool(v)
+			if err != nil {
+				return Query{}, errors.Wrap(err, "verified")
+			}
+		}
+
+		switch sort := values.Get("sort"); sort {
+		case "", SortRecent:
+		case SortHelpful:
+			params.Sort = sort
+		default:
+			return Query{}, errors.Errorf("invalid sort option %q", sort)
+		}
+	}
+
 	return params, nil
 }
 
+// ParseSearch returns the search parameters after normalizing and validating them.
+//
+// The language is taken from the Accept-Language header and the sorting from the "sort" url parameter.
+func ParseSearch(r *http.Request) (Search, error) {
+	query := sanitize.Normalize(chi.URLParam(r, "query"))
+	if err := validate.SearchQuery(query); err != nil {
+		return Search{}, err
+	}
+
+	sortBy := r.URL.Query().Get("sort")
+	switch sortBy {
+	case "":
+		sortBy = SortRelevance
+	case SortRelevance, SortRating:
+	default:
+		return Search{}, errors.Errorf("invalid sort option %q", sortBy)
+	}
+
+	search := Search{
+		Query:    query,
+		Language: Language(r.Header.Get("Accept-Language")),
+		Sort:     sortBy,
+	}
+	return search, nil
+}
+
+// Language returns the supported language with the highest quality value
+// from an Accept-Language header, DefaultLanguage is returned if there is none.
+func Language(acceptLanguage string) string {
+	type tag struct {
+		lang    string
+		quality float64
+	}
+
+	var tags []tag
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		lang, q, _ := strings.Cut(strings.TrimSpace(part), ";")
+		// Keep only the primary subtag, "es-AR" becomes "es"
+		lang, _, _ = strings.Cut(strings.ToLower(lang), "-")
+		if _, ok := languages[lang]; !ok {
+			continue
+		}
+
+		quality := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(q), "q="); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil || f <= 0 {
+				continue
+			}
+			quality = f
+		}
+		tags = append(tags, tag{lang: lang, quality: quality})
+	}
+
+	if len(tags) == 0 {
+		return DefaultLanguage
+	}
+
+	sort.SliceStable(tags, func(i, j int) bool {
+		return tags[i].quality > tags[j].quality
+	})
+	return tags[0].lang
+}
+
+// SupportedLanguage returns whether the full-text search supports the language provided.
+func SupportedLanguage(lang string) bool {
+	_, ok := languages[lang]
+	return ok
+}
+
 // URLID returns the id parsed from the url.
 func URLID(ctx context.Context) (string, error) {
 	id := chi.URLParamFromCtx(ctx, "id")
@@ -56,6 +56,24 @@ func TestParseQuery(t *testing.T) {
 				Limit: "20",
 			},
 		},
+		{
+			desc:     "Verified reviews",
+			obj:      Review,
+			rawQuery: "verified=true",
+			expected: Query{
+				Limit:    "20",
+				Verified: true,
+			},
+		},
+		{
+			desc:     "Helpful reviews",
+			obj:      Review,
+			rawQuery: "sort=helpful",
+			expected: Query{
+				Limit: "20",
+				Sort:  SortHelpful,
+			},
+		},
 	}
 
 	for _, tc := range cases {
@@ -115,3 +133,44 @@ func TestSplit(t *testing.T) {
 		})
 	}
 }
+
+func TestLanguage(t *testing.T) {
+	cases := []struct {
+		desc           string
+		acceptLanguage string
+		expected       string
+	}{
+		{
+			desc:           "Empty",
+			acceptLanguage: "",
+			expected:       DefaultLanguage,
+		},
+		{
+			desc:           "Region",
+			acceptLanguage: "es-AR",
+			expected:       "es",
+		},
+		{
+			desc:           "Quality",
+			acceptLanguage: "fr;q=0.7, de;q=0.9, en;q=0.8",
+			expected:       "de",
+		},
+		{
+			desc:           "Unsupported",
+			acceptLanguage: "xx-YY, pt-BR;q=0.5",
+			expected:       "pt",
+		},
+		{
+			desc:           "Wildcard",
+			acceptLanguage: "*",
+			expected:       DefaultLanguage,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			got := Language(tc.acceptLanguage)
+			assert.Equal(t, tc.expected, got)
+		})
+	}
+}
@@ -0,0 +1,168 @@
+// Package password hashes and verifies the users' passwords and enforces the password policy.
+//
+// New passwords are hashed with argon2id and encoded in the PHC string format,
+// "$argon2id$v=19$m=<memory>,t=<iterations>,p=<parallelism>$<salt>$<key>". Hashes created
+// with bcrypt or with different parameters are still verified and reported as outdated so
+// they are replaced when the user logs in.
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/GGP1/adak/internal/config"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	saltLength = 16
+	keyLength  = 32
+)
+
+// ErrMismatch is returned when the password doesn't match the hash.
+var ErrMismatch = errors.New("invalid password")
+
+// params are the argon2id parameters.
+type params struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+}
+
+// defaultParams follow the OWASP recommendation for argon2id.
+var defaultParams = params{memory: 19 * 1024, iterations: 2, parallelism: 1}
+
+var (
+	mu      sync.RWMutex
+	current = defaultParams
+	policy  = Policy{MinLength: 8}
+)
+
+// Configure sets the hashing parameters and the policy, it must be called before serving
+// requests. The default parameters are used for the values not set.
+func Configure(conf config.Password) error {
+	p := defaultParams
+	if conf.Memory > 0 {
+		p.memory = conf.Memory
+	}
+	if conf.Iterations > 0 {
+		p.iterations = conf.Iterations
+	}
+	if conf.Parallelism > 0 {
+		p.parallelism = conf.Parallelism
+	}
+
+	pol, err := NewPolicy(conf.MinLength, conf.Blocklist)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	current = p
+	policy = pol
+	mu.Unlock()
+	return nil
+}
+
+// Hash returns the argon2id hash of the password.
+func Hash(password string) (string, error) {
+	mu.RLock()
+	p := current
+	mu.RUnlock()
+
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", errors.Wrap(err, "generating salt")
+	}
+
+	key := argon2.IDKey([]byte(password), salt, p.iterations, p.memory, p.parallelism, keyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.memory, p.iterations,
+		p.parallelism, base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Verify compares the password with the hash, it returns ErrMismatch if they don't match
+// and whether the hash is outdated and should be replaced by a new one.
+//
+// Empty hashes never match, users without a password can't log in with one.
+func Verify(hash, password string) (bool, error) {
+	if strings.HasPrefix(hash, "$2") {
+		if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+			return false, ErrMismatch
+		}
+		return true, nil
+	}
+
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		return false, ErrMismatch
+	}
+
+	p, salt, key, err := decode(hash)
+	if err != nil {
+		return false, err
+	}
+
+	other := argon2.IDKey([]byte(password), salt, p.iterations, p.memory, p.parallelism, uint32(len(key)))
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return false, ErrMismatch
+	}
+
+	mu.RLock()
+	outdated := p != current || len(salt) != saltLength || len(key) != keyLength
+	mu.RUnlock()
+	return outdated, nil
+}
+
+// Validate checks that the password complies with the policy.
+func Validate(password, email, username string) error {
+	mu.RLock()
+	p := policy
+	mu.RUnlock()
+	return p.Validate(password, email, username)
+}
+
+// decode parses an argon2id hash in the PHC string format.
+func decode(hash string) (params, []byte, []byte, error) {
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return params{}, nil, nil, errors.New("invalid argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return params{}, nil, nil, errors.Wrap(err, "invalid argon2id version")
+	}
+	if version != argon2.Version {
+		return params{}, nil, nil, errors.Errorf("unsupported argon2id version %d", version)
+	}
+
+	var p params
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.iterations, &p.parallelism); err != nil {
+		return params{}, nil, nil, errors.Wrap(err, "invalid argon2id parameters")
+	}
+	if p.memory == 0 || p.iterations == 0 || p.parallelism == 0 {
+		return params{}, nil, nil, errors.New("invalid argon2id parameters")
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params{}, nil, nil, errors.Wrap(err, "invalid argon2id salt")
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params{}, nil, nil, errors.Wrap(err, "invalid argon2id key")
+	}
+	// An empty key would match any password
+	if len(key) == 0 {
+		return params{}, nil, nil, errors.New("invalid argon2id key")
+	}
+
+	return p, salt, key, nil
+}
@@ -0,0 +1,104 @@
+package password
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/GGP1/adak/internal/config"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHashAndVerify(t *testing.T) {
+	hash, err := Hash("correct horse")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=19456,t=2,p=1$"))
+
+	other, err := Hash("correct horse")
+	assert.NoError(t, err)
+	assert.NotEqual(t, hash, other, "Salts must be random")
+
+	outdated, err := Verify(hash, "correct horse")
+	assert.NoError(t, err)
+	assert.False(t, outdated)
+
+	_, err = Verify(hash, "battery staple")
+	assert.ErrorIs(t, err, ErrMismatch)
+
+	t.Run("Bcrypt", func(t *testing.T) {
+		hash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+		assert.NoError(t, err)
+
+		outdated, err := Verify(string(hash), "correct horse")
+		assert.NoError(t, err)
+		assert.True(t, outdated)
+
+		_, err = Verify(string(hash), "battery staple")
+		assert.ErrorIs(t, err, ErrMismatch)
+	})
+
+	t.Run("Parameters changed", func(t *testing.T) {
+		assert.NoError(t, Configure(config.Password{Memory: 8 * 1024, Iterations: 1, Parallelism: 1, MinLength: 8}))
+		defer Configure(config.Password{MinLength: 8})
+
+		outdated, err := Verify(hash, "correct horse")
+		assert.NoError(t, err)
+		assert.True(t, outdated)
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		_, err := Verify("", "")
+		assert.ErrorIs(t, err, ErrMismatch)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := Verify("$argon2id$v=19$m=19456,t=2$salt$key", "correct horse")
+		assert.Error(t, err)
+
+		_, err = Verify("$argon2id$v=19$m=19456,t=2,p=1$c2FsdHNhbHRzYWx0c2FsdA$", "correct horse")
+		assert.Error(t, err)
+	})
+}
+
+func TestPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	assert.NoError(t, os.WriteFile(path, []byte("# Common passwords\npassword123\n\nQwertyuiop\n"), 0o600))
+
+	policy, err := NewPolicy(8, path)
+	assert.NoError(t, err)
+
+	cases := []struct {
+		desc     string
+		password string
+		err      error
+	}{
+		{desc: "Valid", password: "correct horse"},
+		{desc: "Too short", password: "short", err: errors.New("the password must have at least 8 characters")},
+		{desc: "Blocklisted", password: "Password123", err: ErrBlocklisted},
+		{desc: "Blocklisted case-insensitive", password: "qwertyuiop", err: ErrBlocklisted},
+		{desc: "Email", password: "Gopher@Test.com", err: ErrPersonalInfo},
+		{desc: "Username", password: "the_gopher", err: ErrPersonalInfo},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			err := policy.Validate(tc.password, "gopher@test.com", "The_Gopher")
+			if tc.err == nil {
+				assert.NoError(t, err)
+				return
+			}
+			var policyErr *PolicyError
+			assert.ErrorAs(t, err, &policyErr)
+			assert.EqualError(t, err, tc.err.Error())
+		})
+	}
+
+	t.Run("Missing blocklist", func(t *testing.T) {
+		_, err := NewPolicy(8, filepath.Join(t.TempDir(), "missing.txt"))
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,81 @@
+package password
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrBlocklisted is returned when the password is in the blocklist.
+	ErrBlocklisted error = &PolicyError{"this password is too common, please choose another one"}
+	// ErrPersonalInfo is returned when the password is the user's email or username.
+	ErrPersonalInfo error = &PolicyError{"the password can't be your email or username"}
+)
+
+// PolicyError is returned when a password doesn't meet the policy requirements.
+type PolicyError struct {
+	reason string
+}
+
+func (e *PolicyError) Error() string {
+	return e.reason
+}
+
+// Policy contains the requirements passwords must meet.
+type Policy struct {
+	MinLength int
+	blocklist map[string]struct{}
+}
+
+// NewPolicy returns a policy loading the blocklist from the file in path, if any.
+func NewPolicy(minLength int, path string) (Policy, error) {
+	p := Policy{MinLength: minLength}
+	if path == "" {
+		return p, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return Policy{}, errors.Wrap(err, "opening the passwords blocklist")
+	}
+	defer f.Close()
+
+	p.blocklist = make(map[string]struct{})
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p.blocklist[strings.ToLower(line)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return Policy{}, errors.Wrap(err, "reading the passwords blocklist")
+	}
+
+	return p, nil
+}
+
+// Validate checks that the password meets the policy requirements. The comparisons with
+// the blocklist, email and username are case-insensitive.
+func (p Policy) Validate(password, email, username string) error {
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return &PolicyError{fmt.Sprintf("the password must have at least %d characters", p.MinLength)}
+	}
+
+	lower := strings.ToLower(password)
+	if _, ok := p.blocklist[lower]; ok {
+		return ErrBlocklisted
+	}
+
+	if (email != "" && lower == strings.ToLower(email)) || (username != "" && lower == strings.ToLower(username)) {
+		return ErrPersonalInfo
+	}
+
+	return nil
+}
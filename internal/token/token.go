@@ -2,10 +2,12 @@ package token
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"math/big"
 	"net/http"
 
-	"github.com/GGP1/adak/internal/cookie"
+	"github.com/GGP1/adak/internal/identity"
 
 	"github.com/pkg/errors"
 )
@@ -27,14 +29,19 @@ func RandString(length int) string {
 	return string(b)
 }
 
+// Hash returns the hex encoded SHA-256 digest of the token, used to store tokens
+// in the database without being able to recover them.
+//
+// Tokens are long random strings, a fast hash is enough.
+func Hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 // CheckPermits cheks if the user is trying to perform and action on his own
 // account (return nil) or not (return error).
 func CheckPermits(r *http.Request, paramID string) error {
-	if len(paramID) > 32 {
-		return errors.New("invalid id")
-	}
-
-	userID, err := cookie.GetValue(r, "UID")
+	userID, err := identity.UserID(r)
 	if err != nil {
 		return err
 	}
@@ -1,11 +1,10 @@
 package token_test
 
 import (
-	"encoding/hex"
 	"net/http"
 	"testing"
 
-	"github.com/GGP1/adak/internal/crypt"
+	"github.com/GGP1/adak/internal/identity"
 	"github.com/GGP1/adak/internal/token"
 
 	"github.com/stretchr/testify/assert"
@@ -20,19 +19,20 @@ func TestGenerateString(t *testing.T) {
 	}
 }
 
+func TestHash(t *testing.T) {
+	tok := token.RandString(40)
+
+	assert.Equal(t, token.Hash(tok), token.Hash(tok))
+	assert.NotEqual(t, tok, token.Hash(tok))
+	assert.NotEqual(t, token.Hash(tok), token.Hash(tok+"a"))
+	assert.Len(t, token.Hash(tok), 64)
+}
+
 func TestCheckPermits(t *testing.T) {
 	id := "checkPermitsTest"
 	r, err := http.NewRequest("GET", "/", nil)
 	assert.NoError(t, err)
-
-	ciphertext, err := crypt.Encrypt([]byte(id))
-	assert.NoError(t, err)
-
-	r.AddCookie(&http.Cookie{
-		Name:  "UID",
-		Value: hex.EncodeToString(ciphertext),
-		Path:  "/",
-	})
+	r = r.WithContext(identity.NewContext(r.Context(), identity.Identity{UserID: id}))
 
 	t.Run("Success", func(t *testing.T) {
 		err = token.CheckPermits(r, id)
@@ -44,8 +44,15 @@ func TestCheckPermits(t *testing.T) {
 		assert.Error(t, err)
 	})
 
-	t.Run("ID too long", func(t *testing.T) {
-		err := token.CheckPermits(r, "9 }NkbKPLja;As[0<|d4nMG!5l3>x$+Qp")
-		assert.Error(t, err)
+	t.Run("Not authenticated", func(t *testing.T) {
+		r, err := http.NewRequest("GET", "/", nil)
+		assert.NoError(t, err)
+		assert.ErrorIs(t, token.CheckPermits(r, id), identity.ErrNotAuthenticated)
+	})
+
+	t.Run("UUID", func(t *testing.T) {
+		id := "c3a8f3f5-7c3e-4a5e-9b0c-6c1f3e0b2d4a"
+		r := r.WithContext(identity.NewContext(r.Context(), identity.Identity{UserID: id}))
+		assert.NoError(t, token.CheckPermits(r, id))
 	})
 }
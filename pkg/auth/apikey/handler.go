@@ -0,0 +1,111 @@
+package apikey
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/GGP1/adak/internal/identity"
+	"github.com/GGP1/adak/internal/response"
+	"github.com/GGP1/adak/internal/validate"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+)
+
+// Handler handles API keys endpoints.
+type Handler struct {
+	service Service
+}
+
+// CreatedKey is the response to creating a key, the only time the key is shown.
+type CreatedKey struct {
+	Key
+	Token string `json:"token"`
+}
+
+// NewHandler returns a new API keys handler.
+func NewHandler(service Service) Handler {
+	return Handler{service: service}
+}
+
+// Create generates a new key for the logged in user.
+func (h *Handler) Create() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		userID, err := identity.UserID(r)
+		if err != nil {
+			response.Error(w, http.StatusForbidden, err)
+			return
+		}
+
+		var add AddKey
+		if err := json.NewDecoder(r.Body).Decode(&add); err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+		defer r.Body.Close()
+
+		if err := validate.Struct(ctx, add); err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		key, token, err := h.service.Create(ctx, userID, add)
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrScopeNotGranted):
+				response.Error(w, http.StatusForbidden, err)
+			case errors.Is(err, ErrInvalidScope), errors.Is(err, ErrNoScopes), errors.Is(err, ErrInvalidExpiration):
+				response.Error(w, http.StatusBadRequest, err)
+			default:
+				response.Error(w, http.StatusInternalServerError, err)
+			}
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		response.JSON(w, http.StatusCreated, CreatedKey{Key: key, Token: token})
+	}
+}
+
+// Delete revokes one of the logged in user's keys.
+func (h *Handler) Delete() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := identity.UserID(r)
+		if err != nil {
+			response.Error(w, http.StatusForbidden, err)
+			return
+		}
+
+		if err := h.service.Delete(r.Context(), userID, chi.URLParam(r, "id")); err != nil {
+			if errors.Is(err, ErrKeyNotFound) {
+				response.Error(w, http.StatusNotFound, err)
+				return
+			}
+			response.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		response.JSONText(w, http.StatusOK, "api key deleted")
+	}
+}
+
+// List lists the logged in user's keys.
+func (h *Handler) List() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := identity.UserID(r)
+		if err != nil {
+			response.Error(w, http.StatusForbidden, err)
+			return
+		}
+
+		keys, err := h.service.List(r.Context(), userID)
+		if err != nil {
+			response.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		response.JSON(w, http.StatusOK, keys)
+	}
+}
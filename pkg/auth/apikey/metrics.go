@@ -0,0 +1,40 @@
+package apikey
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+type metrics struct {
+	authentications *prometheus.CounterVec
+	changes         *prometheus.CounterVec
+	methodCalls     *prometheus.CounterVec
+}
+
+func initMetrics() metrics {
+	const ns, sub = "adak", "api_keys"
+	return metrics{
+		authentications: promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "authentications_total",
+			Help:      "Total number of requests authenticated with api keys per result",
+		}, []string{"result"}),
+		changes: promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "changes_total",
+			Help:      "Total number of api keys created and deleted",
+		}, []string{"action"}),
+		methodCalls: promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "method_calls_total",
+			Help:      "Total number of calls per method",
+		}, []string{"method"}),
+	}
+}
+
+func (m metrics) incMethodCalls(method string) {
+	m.methodCalls.With(prometheus.Labels{"method": method}).Inc()
+}
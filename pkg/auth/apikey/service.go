@@ -0,0 +1,216 @@
+// Package apikey implements personal access tokens used by machine clients to
+// authenticate without a session.
+package apikey
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/GGP1/adak/internal/token"
+	"github.com/GGP1/adak/pkg/role"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"gopkg.in/guregu/null.v4/zero"
+)
+
+const (
+	// Prefix is prepended to the keys to make them easy to identify, e.g. by secret scanners.
+	Prefix = "adak_"
+	// ScopeAccount allows the key to access the endpoints that only require being logged in, every
+	// user can use it.
+	ScopeAccount = "account"
+	// ScopeAdmin allows the key to access the administrators' endpoints, only administrators can use it.
+	ScopeAdmin = "admin"
+	// keyLength is the number of random characters of a key.
+	keyLength = 40
+)
+
+var (
+	// ErrInvalidExpiration is returned when the expiration isn't in the future.
+	ErrInvalidExpiration = errors.New("the expiration must be in the future")
+	// ErrInvalidKey is returned when the key doesn't exist or expired.
+	ErrInvalidKey = errors.New("invalid api key")
+	// ErrInvalidScope is returned when a scope isn't a permission nor the account or admin scope.
+	ErrInvalidScope = errors.New("invalid scope")
+	// ErrKeyNotFound is returned when the key doesn't exist or belongs to another user.
+	ErrKeyNotFound = errors.New("api key not found")
+	// ErrNoScopes is returned when a key is created without scopes.
+	ErrNoScopes = errors.New("the key must have at least one scope")
+	// ErrScopeNotGranted is returned when the user's roles don't grant the scope.
+	ErrScopeNotGranted = errors.New("your roles don't grant the scope")
+)
+
+// Service provides API keys operations.
+type Service interface {
+	Authenticate(ctx context.Context, key string) (Key, error)
+	Create(ctx context.Context, userID string, add AddKey) (Key, string, error)
+	Delete(ctx context.Context, userID, id string) error
+	List(ctx context.Context, userID string) ([]Key, error)
+}
+
+// Key is a personal access token, the key itself is only shown when it's created.
+type Key struct {
+	ID         string         `json:"id" db:"id"`
+	UserID     string         `json:"-" db:"user_id"`
+	CartID     string         `json:"-" db:"cart_id"`
+	Name       string         `json:"name" db:"name"`
+	Scopes     pq.StringArray `json:"scopes" db:"scopes"`
+	ExpiresAt  zero.Time      `json:"expires_at,omitempty" db:"expires_at"`
+	LastUsedAt zero.Time      `json:"last_used_at,omitempty" db:"last_used_at"`
+	CreatedAt  time.Time      `json:"created_at" db:"created_at"`
+}
+
+// AddKey is used to create API keys.
+type AddKey struct {
+	Name      string    `json:"name" validate:"required,max=64"`
+	Scopes    []string  `json:"scopes"`
+	ExpiresAt zero.Time `json:"expires_at"`
+}
+
+type service struct {
+	db      *sqlx.DB
+	metrics metrics
+}
+
+// NewService returns a new API keys service.
+func NewService(db *sqlx.DB) Service {
+	return &service{db, initMetrics()}
+}
+
+// Authenticate returns the key information and records its use.
+func (s *service) Authenticate(ctx context.Context, key string) (Key, error) {
+	s.metrics.incMethodCalls("Authenticate")
+
+	if !strings.HasPrefix(key, Prefix) {
+		s.metrics.authentications.WithLabelValues("invalid").Inc()
+		return Key{}, ErrInvalidKey
+	}
+
+	q := `UPDATE api_keys k SET last_used_at=NOW() FROM users u
+	WHERE k.key_hash=$1 AND u.id=k.user_id AND (k.expires_at IS NULL OR k.expires_at > NOW())
+	RETURNING k.id, k.user_id, u.cart_id, k.name, k.scopes, k.expires_at, k.last_used_at, k.created_at`
+	var k Key
+	if err := s.db.GetContext(ctx, &k, q, token.Hash(key)); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			s.metrics.authentications.WithLabelValues("invalid").Inc()
+			return Key{}, ErrInvalidKey
+		}
+		return Key{}, errors.Wrap(err, "authenticating api key")
+	}
+
+	s.metrics.authentications.WithLabelValues("valid").Inc()
+	return k, nil
+}
+
+// Create generates a new key for the user, it must have at least one scope and they must be
+// granted by the user's roles. It returns the key information and the key itself, which isn't stored.
+func (s *service) Create(ctx context.Context, userID string, add AddKey) (Key, string, error) {
+	s.metrics.incMethodCalls("Create")
+
+	if len(add.Scopes) == 0 {
+		return Key{}, "", ErrNoScopes
+	}
+	if add.ExpiresAt.Valid && !add.ExpiresAt.Time.After(time.Now()) {
+		return Key{}, "", ErrInvalidExpiration
+	}
+
+	var roles []string
+	if err := s.db.SelectContext(ctx, &roles, "SELECT role FROM user_roles WHERE user_id=$1", userID); err != nil {
+		return Key{}, "", errors.Wrap(err, "fetching roles")
+	}
+
+	scopes := make([]string, 0, len(add.Scopes))
+	for _, scope := range add.Scopes {
+		if !validScope(scope) {
+			return Key{}, "", errors.Wrap(ErrInvalidScope, scope)
+		}
+		if !grants(roles, scope) {
+			return Key{}, "", errors.Wrap(ErrScopeNotGranted, scope)
+		}
+		if !contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	key := Prefix + token.RandString(keyLength)
+	k := Key{
+		ID:        uuid.NewString(),
+		UserID:    userID,
+		Name:      add.Name,
+		Scopes:    scopes,
+		ExpiresAt: add.ExpiresAt,
+		CreatedAt: time.Now(),
+	}
+
+	q := `INSERT INTO api_keys (id, user_id, name, key_hash, scopes, expires_at, created_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	_, err := s.db.ExecContext(ctx, q, k.ID, k.UserID, k.Name, token.Hash(key), k.Scopes, k.ExpiresAt, k.CreatedAt)
+	if err != nil {
+		return Key{}, "", errors.Wrap(err, "couldn't create the api key")
+	}
+
+	s.metrics.changes.WithLabelValues("create").Inc()
+	return k, key, nil
+}
+
+// Delete revokes one of the user's keys.
+func (s *service) Delete(ctx context.Context, userID, id string) error {
+	s.metrics.incMethodCalls("Delete")
+
+	res, err := s.db.ExecContext(ctx, "DELETE FROM api_keys WHERE id=$1 AND user_id=$2", id, userID)
+	if err != nil {
+		return errors.Wrap(err, "couldn't delete the api key")
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrKeyNotFound
+	}
+
+	s.metrics.changes.WithLabelValues("delete").Inc()
+	return nil
+}
+
+// List returns the user's keys, the most recent first.
+func (s *service) List(ctx context.Context, userID string) ([]Key, error) {
+	s.metrics.incMethodCalls("List")
+
+	q := `SELECT id, user_id, name, scopes, expires_at, last_used_at, created_at
+	FROM api_keys WHERE user_id=$1 ORDER BY created_at DESC`
+	keys := []Key{}
+	if err := s.db.SelectContext(ctx, &keys, q, userID); err != nil {
+		return nil, errors.Wrap(err, "fetching api keys")
+	}
+
+	return keys, nil
+}
+
+// grants returns whether the roles allow using the scope.
+func grants(roles []string, scope string) bool {
+	if scope == ScopeAccount {
+		return true
+	}
+	if scope == ScopeAdmin {
+		return contains(roles, role.Admin)
+	}
+	return role.Grants(roles, role.Permission(scope))
+}
+
+// validScope returns whether the scope is a permission or the account or admin scope,
+// the admin role is granted every permission.
+func validScope(scope string) bool {
+	return scope == ScopeAccount || scope == ScopeAdmin || role.Grants([]string{role.Admin}, role.Permission(scope))
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package apikey_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/GGP1/adak/internal/logger"
+	"github.com/GGP1/adak/internal/test"
+	"github.com/GGP1/adak/pkg/auth/apikey"
+	"github.com/GGP1/adak/pkg/role"
+	"github.com/GGP1/adak/pkg/user"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/guregu/null.v4/zero"
+)
+
+var usr = user.AddUser{ID: "1", CartID: "1", Username: "test", Email: "apikey@test.com", Password: "testing123"}
+
+// TestMain failed when creating the api keys service.
+func NewAPIKeyService(t *testing.T) (context.Context, apikey.Service, role.Service) {
+	t.Helper()
+	logger.Disable()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	db := test.StartPostgres(t)
+	mc := test.StartMemcached(t)
+	service := apikey.NewService(db)
+
+	assert.NoError(t, user.NewService(db, mc).Create(ctx, usr))
+
+	t.Cleanup(func() {
+		cancel()
+	})
+
+	return ctx, service, role.NewService(db)
+}
+
+func TestAPIKeyService(t *testing.T) {
+	ctx, s, roles := NewAPIKeyService(t)
+
+	t.Run("Scopes", func(t *testing.T) {
+		_, _, err := s.Create(ctx, usr.ID, apikey.AddKey{Name: "test"})
+		assert.ErrorIs(t, err, apikey.ErrNoScopes)
+
+		_, _, err = s.Create(ctx, usr.ID, apikey.AddKey{Name: "test", Scopes: []string{"unknown"}})
+		assert.ErrorIs(t, err, apikey.ErrInvalidScope)
+
+		_, _, err = s.Create(ctx, usr.ID, apikey.AddKey{Name: "test", Scopes: []string{string(role.ProductsWrite)}})
+		assert.ErrorIs(t, err, apikey.ErrScopeNotGranted)
+
+		// Customers can use the account scope
+		k, _, err := s.Create(ctx, usr.ID, apikey.AddKey{Name: "test", Scopes: []string{apikey.ScopeAccount}})
+		assert.NoError(t, err)
+		assert.NoError(t, s.Delete(ctx, usr.ID, k.ID))
+
+		assert.NoError(t, roles.Grant(ctx, usr.ID, role.ShopOwner, ""))
+		_, _, err = s.Create(ctx, usr.ID, apikey.AddKey{Name: "test", Scopes: []string{apikey.ScopeAdmin}})
+		assert.ErrorIs(t, err, apikey.ErrScopeNotGranted)
+	})
+
+	var key apikey.Key
+	var token string
+	t.Run("Create", func(t *testing.T) {
+		var err error
+		scopes := []string{string(role.ProductsWrite), string(role.ProductsWrite)}
+		key, token, err = s.Create(ctx, usr.ID, apikey.AddKey{Name: "ci", Scopes: scopes})
+		assert.NoError(t, err)
+		assert.Contains(t, token, apikey.Prefix)
+		assert.Equal(t, []string{string(role.ProductsWrite)}, []string(key.Scopes))
+
+		keys, err := s.List(ctx, usr.ID)
+		assert.NoError(t, err)
+		assert.Len(t, keys, 1)
+		assert.False(t, keys[0].LastUsedAt.Valid)
+	})
+
+	t.Run("Authenticate", func(t *testing.T) {
+		k, err := s.Authenticate(ctx, token)
+		assert.NoError(t, err)
+		assert.Equal(t, usr.ID, k.UserID)
+		assert.Equal(t, usr.CartID, k.CartID)
+		assert.True(t, k.LastUsedAt.Valid)
+
+		_, err = s.Authenticate(ctx, token+"x")
+		assert.ErrorIs(t, err, apikey.ErrInvalidKey)
+	})
+
+	t.Run("Expiration", func(t *testing.T) {
+		past := apikey.AddKey{Name: "expired", Scopes: []string{apikey.ScopeAccount}, ExpiresAt: zero.TimeFrom(time.Now().Add(-time.Hour))}
+		_, _, err := s.Create(ctx, usr.ID, past)
+		assert.ErrorIs(t, err, apikey.ErrInvalidExpiration)
+
+		soon := apikey.AddKey{Name: "soon", Scopes: []string{apikey.ScopeAccount}, ExpiresAt: zero.TimeFrom(time.Now().Add(time.Second))}
+		_, token, err := s.Create(ctx, usr.ID, soon)
+		assert.NoError(t, err)
+
+		time.Sleep(1100 * time.Millisecond)
+		_, err = s.Authenticate(ctx, token)
+		assert.ErrorIs(t, err, apikey.ErrInvalidKey)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		assert.ErrorIs(t, s.Delete(ctx, "2", key.ID), apikey.ErrKeyNotFound)
+		assert.NoError(t, s.Delete(ctx, usr.ID, key.ID))
+
+		_, err := s.Authenticate(ctx, token)
+		assert.ErrorIs(t, err, apikey.ErrInvalidKey)
+	})
+}
@@ -3,75 +3,133 @@ package auth
 import (
 	"context"
 	"crypto/rand"
+	"encoding/hex"
 	"net/http"
 	"time"
 
 	"github.com/GGP1/adak/internal/config"
 	"github.com/GGP1/adak/internal/cookie"
+	"github.com/GGP1/adak/internal/identity"
 	"github.com/GGP1/adak/internal/logger"
+	"github.com/GGP1/adak/internal/password"
+	"github.com/GGP1/adak/internal/token"
+	"github.com/GGP1/adak/pkg/auth/twofactor"
 	"github.com/GGP1/adak/pkg/tracking"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
-	"golang.org/x/crypto/bcrypt"
 )
 
+// pendingExpiration is the time users have to complete the login with the second factor.
+const pendingExpiration = 5 * time.Minute
+
+// ErrInvalidPendingLogin is returned when the pending login doesn't exist or expired.
+var ErrInvalidPendingLogin = errors.New("invalid or expired login, please enter your credentials again")
+
 // Session provides auth operations.
 type Session interface {
 	AlreadyLoggedIn(ctx context.Context, r *http.Request) bool
-	Login(ctx context.Context, w http.ResponseWriter, r *http.Request, email, password string) error
-	LoginOAuth(ctx context.Context, w http.ResponseWriter, r *http.Request, email string) error
+	CSRFToken(ctx context.Context, r *http.Request) (string, error)
+	Fresh(ctx context.Context, r *http.Request) bool
+	Identity(ctx context.Context, r *http.Request) (identity.Identity, error)
+	Login(ctx context.Context, w http.ResponseWriter, r *http.Request, email, password string) (string, error)
+	LoginOAuth(ctx context.Context, w http.ResponseWriter, r *http.Request, userID string) (string, error)
+	LoginTwoFactor(ctx context.Context, w http.ResponseWriter, r *http.Request, pendingToken, code string) error
+	LimitTwoFactor(ctx context.Context, r *http.Request, userID string, verify func() error) error
+	List(ctx context.Context, r *http.Request) ([]Record, error)
 	Logout(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	LogoutAll(ctx context.Context, userID string) error
+	LogoutOthers(ctx context.Context, r *http.Request) error
+	Reauthenticate(ctx context.Context, r *http.Request, password, code string) error
+	Revoke(ctx context.Context, userID, sessionID string) error
+	Unlock(ctx context.Context, token string) error
 }
 
 type session struct {
-	conf    config.Session
-	db      *sqlx.DB
-	dev     bool
-	metrics metrics
-	rdb     *redis.Client
+	conf      config.Session
+	db        *sqlx.DB
+	dev       bool
+	emailer   Emailer
+	metrics   metrics
+	rdb       *redis.Client
+	twoFactor twofactor.Service
 }
 
 // NewSession creates a new session with the necessary dependencies.
-func NewSession(db *sqlx.DB, rdb *redis.Client, config config.Session, development bool) Session {
+func NewSession(db *sqlx.DB, rdb *redis.Client, twoFactor twofactor.Service, emailer Emailer, config config.Session, development bool) Session {
 	return &session{
-		conf:    config,
-		db:      db,
-		dev:     development,
-		metrics: initMetrics(),
-		rdb:     rdb,
+		conf:      config,
+		db:        db,
+		dev:       development,
+		emailer:   emailer,
+		metrics:   initMetrics(rdb),
+		rdb:       rdb,
+		twoFactor: twoFactor,
 	}
 }
 
-// AlreadyLoggedIn returns if the user is logged in or not.
+// AlreadyLoggedIn returns if the user is logged in or not. Sessions in use are renewed
+// until they reach their absolute timeout.
 func (s *session) AlreadyLoggedIn(ctx context.Context, r *http.Request) bool {
+	_, err := s.Identity(ctx, r)
+	return err == nil
+}
+
+// Identity returns the user and the cart of the session, the client only holds the session
+// cookie. Sessions in use are renewed until they reach their absolute timeout.
+func (s *session) Identity(ctx context.Context, r *http.Request) (identity.Identity, error) {
 	sID, err := cookie.GetValue(r, "SID")
 	if err != nil {
-		return false
+		return identity.Identity{}, ErrSessionNotFound
 	}
 
-	value, err := s.rdb.Get(ctx, sID).Result()
+	record, err := s.rdb.HGetAll(ctx, sID).Result()
 	if err != nil {
-		return false
+		return identity.Identity{}, errors.Wrap(err, "fetching session")
+	}
+	if len(record) == 0 {
+		return identity.Identity{}, ErrSessionNotFound
+	}
+
+	now := time.Now()
+	userID, id := splitSessionID(sID)
+	expiresAt := unixField(record["expires_at"])
+	if !expiresAt.IsZero() && !now.Before(expiresAt) {
+		// Redis removes it at the same time, this covers clock differences
+		s.deleteSessions(ctx, userID, id)
+		return identity.Identity{}, ErrSessionNotFound
+	}
+
+	if now.Sub(unixField(record["last_seen"])) > s.renewInterval() {
+		if err := s.renew(ctx, r, sID, expiresAt); err != nil {
+			logger.Debugf("couldn't renew session: %v", err)
+		}
+	}
+
+	cartID, ok := record[cartIDField]
+	if !ok {
+		// Sessions created before the cart was stored in them
+		cartID = s.storeCartID(ctx, sID, userID)
 	}
 
-	return value == sID[len(sID)-16:]
+	return identity.Identity{UserID: userID, CartID: cartID}, nil
 }
 
 // Login attempts to log a user in.
-func (s *session) Login(ctx context.Context, w http.ResponseWriter, r *http.Request, email, password string) error {
-	// There is no chance of collision with the rate limiter as it uses the prefix "rate:"
+//
+// Failed attempts delay the following ones from the same IP address or to the same account
+// and, after too many, the account is locked, see throttle.go.
+//
+// Users with two-factor authentication enabled aren't logged in until they send a valid
+// code to LoginTwoFactor along with the pending login token returned.
+func (s *session) Login(ctx context.Context, w http.ResponseWriter, r *http.Request, email, password string) (string, error) {
 	ip := tracking.GetUserIP(r)
-
-	if s.conf.Delay != 0 {
-		ttl := s.rdb.TTL(ctx, ip).Val()
-		if ttl > 0 {
-			return errors.Errorf("please wait %v before trying again", ttl)
-		}
+	if err := s.checkThrottle(ctx, ip, email); err != nil {
+		return "", err
 	}
 
-	query := "SELECT id, cart_id, username, email, password, verified_email FROM users WHERE email=$1"
+	query := "SELECT id, cart_id, username, email, password, verified_email FROM users WHERE lower(email)=lower($1)"
 	row := s.db.QueryRowContext(ctx, query, email)
 
 	var user User
@@ -79,102 +137,247 @@ func (s *session) Login(ctx context.Context, w http.ResponseWriter, r *http.Requ
 		&user.Email, &user.Password, &user.VerifiedEmail)
 	if err != nil {
 		logger.Debug(err)
-		if err := s.addDelay(ctx, ip); err != nil {
-			return errors.Wrap(err, "adding delay")
+		if err := s.loginFailed(ctx, ip, email, nil); err != nil {
+			return "", err
 		}
-		return errors.New("invalid email or password")
+		return "", errInvalidCredentials
 	}
 
 	if !user.VerifiedEmail && !s.dev {
-		return errors.New("please verify your email before logging in")
+		return "", errors.New("please verify your email before logging in")
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+	if err := s.verifyPassword(ctx, user, password); err != nil {
 		logger.Debug(err)
-		if err := s.addDelay(ctx, ip); err != nil {
-			return errors.Wrap(err, "adding delay")
+		if err := s.loginFailed(ctx, ip, email, &user); err != nil {
+			return "", err
 		}
-		return errors.New("invalid email or password")
+		return "", errInvalidCredentials
 	}
 
-	return s.storeSession(ctx, w, user.ID, user.CartID)
+	if err := s.loginSucceeded(ctx, email); err != nil {
+		return "", err
+	}
+
+	return s.login(ctx, w, r, user)
 }
 
-// LoginOAuth authenticates users using OAuth2.
-func (s *session) LoginOAuth(ctx context.Context, w http.ResponseWriter, r *http.Request, email string) error {
-	query := "SELECT id, cart_id, username, email, password, verified_email FROM users WHERE email=$1"
-	row := s.db.QueryRowContext(ctx, query, email)
+// LoginOAuth logs in the user an external identity belongs to, it must have been verified by the provider.
+func (s *session) LoginOAuth(ctx context.Context, w http.ResponseWriter, r *http.Request, userID string) (string, error) {
+	query := "SELECT id, cart_id, username, email, password, verified_email FROM users WHERE id=$1"
+	row := s.db.QueryRowContext(ctx, query, userID)
 
 	var user User
 	err := row.Scan(&user.ID, &user.CartID, &user.Username,
 		&user.Email, &user.Password, &user.VerifiedEmail)
 	if err != nil {
 		logger.Debug(err)
-		return errors.New("invalid email or password")
+		return "", errors.New("user not found")
 	}
 
 	if !user.VerifiedEmail && !s.dev {
-		return errors.New("please verify your email before logging in")
+		return "", errors.New("please verify your email before logging in")
 	}
 
-	return s.storeSession(ctx, w, user.ID, user.CartID)
+	return s.login(ctx, w, r, user)
+}
+
+// LimitTwoFactor runs verify, which checks a second factor code of the user, with the same
+// limits as LoginTwoFactor. The errors caused by the limits match twofactor.ErrTooManyAttempts.
+func (s *session) LimitTwoFactor(ctx context.Context, r *http.Request, userID string, verify func() error) error {
+	var user User
+	if err := s.db.GetContext(ctx, &user, "SELECT id, username, email FROM users WHERE id=$1", userID); err != nil {
+		return errors.Wrap(err, "fetching user")
+	}
+
+	err := s.verifyTwoFactor(ctx, tracking.GetUserIP(r), user, verify)
+	var throttled *ThrottledError
+	if errors.As(err, &throttled) || errors.Is(err, ErrAccountLocked) {
+		return errors.Wrap(twofactor.ErrTooManyAttempts, err.Error())
+	}
+	return err
+}
+
+// LoginTwoFactor completes the login of a user with two-factor authentication enabled.
+//
+// Invalid codes are limited per account and not per pending login, otherwise entering the
+// password again would give attackers new attempts, see throttle.go.
+func (s *session) LoginTwoFactor(ctx context.Context, w http.ResponseWriter, r *http.Request, pendingToken, code string) error {
+	key := "2fa:" + token.Hash(pendingToken)
+
+	userID, err := s.rdb.Get(ctx, key).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return ErrInvalidPendingLogin
+		}
+		return errors.Wrap(err, "fetching pending login")
+	}
+
+	var user User
+	q := "SELECT id, cart_id, username, email FROM users WHERE id=$1"
+	if err := s.db.GetContext(ctx, &user, q, userID); err != nil {
+		return errors.Wrap(err, "fetching user")
+	}
+
+	verify := func() error { return s.twoFactor.Verify(ctx, userID, code) }
+	if err := s.verifyTwoFactor(ctx, tracking.GetUserIP(r), user, verify); err != nil {
+		return err
+	}
+
+	// Only the first request deleting the key completes the login
+	n, err := s.rdb.Del(ctx, key).Result()
+	if err != nil {
+		return errors.Wrap(err, "deleting pending login")
+	}
+	if n == 0 {
+		return ErrInvalidPendingLogin
+	}
+
+	return s.storeSession(ctx, w, r, userID, user.CartID)
+}
+
+// Reauthenticate confirms the credentials of the logged in user, allowing them to perform
+// sensitive actions during the following minutes. Users with two-factor authentication
+// enabled must send a code as well.
+func (s *session) Reauthenticate(ctx context.Context, r *http.Request, password, code string) error {
+	sID, err := cookie.GetValue(r, "SID")
+	if err != nil {
+		return err
+	}
+	userID, _ := splitSessionID(sID)
+
+	var user User
+	q := "SELECT id, username, email, password FROM users WHERE id=$1"
+	if err := s.db.GetContext(ctx, &user, q, userID); err != nil {
+		return errors.Wrap(err, "fetching user")
+	}
+
+	// Stolen sessions must not be used to guess the password
+	ip := tracking.GetUserIP(r)
+	if err := s.checkThrottle(ctx, ip, user.Email); err != nil {
+		return err
+	}
+
+	if err := s.verifyPassword(ctx, user, password); err != nil {
+		logger.Debug(err)
+		if err := s.loginFailed(ctx, ip, user.Email, &user); err != nil {
+			return err
+		}
+		return errors.New("invalid password")
+	}
+
+	if err := s.loginSucceeded(ctx, user.Email); err != nil {
+		return err
+	}
+
+	enabled, err := s.twoFactor.Enabled(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if enabled {
+		verify := func() error { return s.twoFactor.Verify(ctx, userID, code) }
+		if err := s.verifyTwoFactor(ctx, ip, user, verify); err != nil {
+			return err
+		}
+	}
+
+	return s.updateRecord(ctx, sID, 0, "auth_at", time.Now().Unix())
+}
+
+// Fresh returns whether the user logged in or confirmed their credentials recently enough
+// to perform sensitive actions.
+func (s *session) Fresh(ctx context.Context, r *http.Request) bool {
+	if s.conf.Fresh == 0 {
+		return true
+	}
+
+	sID, err := cookie.GetValue(r, "SID")
+	if err != nil {
+		return false
+	}
+
+	authAt, err := s.rdb.HGet(ctx, sID, "auth_at").Int64()
+	if err != nil {
+		return false
+	}
+
+	return time.Since(time.Unix(authAt, 0)) <= s.conf.Fresh
 }
 
 // Logout removes the user session and its cookies.
 func (s *session) Logout(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	// The error is already checked by AlreadyLoggedIn
 	sID, _ := cookie.GetValue(r, "SID")
-	if err := s.rdb.Del(ctx, sID).Err(); err != nil {
-		return errors.Wrap(err, "deleting the session")
+	userID, id := splitSessionID(sID)
+	if err := s.deleteSessions(ctx, userID, id); err != nil {
+		return err
 	}
-	cookie.Delete(w, "SID")
-	cookie.Delete(w, "UID")
-	cookie.Delete(w, "CID")
-	s.metrics.activeSessions.Dec()
+	cookie.Delete(w, "SID", "/")
 	return nil
 }
 
-func (s *session) addDelay(ctx context.Context, key string) error {
-	if s.conf.Delay == 0 {
+// login stores the session of the user or, if they have two-factor authentication enabled,
+// a pending login and returns its token.
+func (s *session) login(ctx context.Context, w http.ResponseWriter, r *http.Request, user User) (string, error) {
+	enabled, err := s.twoFactor.Enabled(ctx, user.ID)
+	if err != nil {
+		return "", err
+	}
+
+	if !enabled {
+		return "", s.storeSession(ctx, w, r, user.ID, user.CartID)
+	}
+
+	pendingToken := token.RandString(32)
+	if err := s.rdb.Set(ctx, "2fa:"+token.Hash(pendingToken), user.ID, pendingExpiration).Err(); err != nil {
+		return "", errors.Wrap(err, "saving pending login")
+	}
+
+	return pendingToken, nil
+}
+
+// verifyPassword compares the password with the user's hash, outdated hashes are replaced
+// by one using the current algorithm and parameters.
+func (s *session) verifyPassword(ctx context.Context, user User, pass string) error {
+	outdated, err := password.Verify(user.Password, pass)
+	if err != nil || !outdated {
+		return err
+	}
+
+	hash, err := password.Hash(pass)
+	if err != nil {
+		logger.Errorf("couldn't rehash the password: %v", err)
 		return nil
 	}
-	// Cannot use pipeline as "v" is needed to set the ttl
-	// To make it incremental two values should be stored, attempts and timestamp
-	v := s.rdb.Incr(ctx, key).Val()
-	if v > s.conf.Attempts {
-		return s.rdb.Expire(ctx, key, time.Duration(s.conf.Delay)*time.Minute).Err()
+
+	// Matching the previous hash avoids overwriting a password changed meanwhile
+	q := "UPDATE users SET password=$3 WHERE id=$1 AND password=$2"
+	if _, err := s.db.ExecContext(ctx, q, user.ID, user.Password, hash); err != nil {
+		logger.Errorf("couldn't rehash the password: %v", err)
 	}
 	return nil
 }
 
-// storeSession saves the user key and sets the cookies used to authentication.
-func (s *session) storeSession(ctx context.Context, w http.ResponseWriter, userID, cartID string) error {
+// storeSession saves the session record and sets the cookie used to authenticate.
+func (s *session) storeSession(ctx context.Context, w http.ResponseWriter, r *http.Request, userID, cartID string) error {
 	// The salt that will be used to identify the user's session
 	salt := make([]byte, 16)
 	if _, err := rand.Read(salt); err != nil {
 		return errors.Wrap(err, "generating salt")
 	}
 
-	sID := userID + ":" + string(salt)
-
-	// Store the salt as the value
-	if err := s.rdb.Set(ctx, sID, salt, 0).Err(); err != nil {
-		return errors.Wrap(err, "saving session")
-	}
-	// -SID- session id
-	if err := cookie.Set(w, "SID", sID, "/", s.conf.Length); err != nil {
-		return err
-	}
-	// -UID- user id, used to deny users from making requests to other accounts
-	if err := cookie.Set(w, "UID", userID, "/", s.conf.Length); err != nil {
+	id := hex.EncodeToString(salt)
+	sID := userID + ":" + id
+	if err := s.saveRecord(ctx, r, userID, cartID, id); err != nil {
 		return err
 	}
-	// -CID- cart id, used to identify which cart belongs to each user
-	if err := cookie.Set(w, "CID", cartID, "/", s.conf.Length); err != nil {
+	// The cookie lives until the absolute timeout, the idle timeout is enforced by redis.
+	// The user and cart ids are kept in the session record
+	age := int(s.conf.Absolute / time.Second)
+	if err := cookie.Set(w, "SID", sID, "/", age); err != nil {
 		return err
 	}
 
-	s.metrics.activeSessions.Inc()
 	s.metrics.totalSessions.Inc()
 	return nil
 }
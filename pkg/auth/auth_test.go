@@ -2,15 +2,22 @@ package auth_test
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/GGP1/adak/internal/config"
+	"github.com/GGP1/adak/internal/cookie"
+	"github.com/GGP1/adak/internal/identity"
 	"github.com/GGP1/adak/internal/logger"
 	"github.com/GGP1/adak/internal/test"
+	"github.com/GGP1/adak/internal/totp"
 	"github.com/GGP1/adak/pkg/auth"
+	"github.com/GGP1/adak/pkg/auth/twofactor"
 	"github.com/go-redis/redis/v8"
 	"github.com/jmoiron/sqlx"
 	"golang.org/x/crypto/bcrypt"
@@ -19,16 +26,27 @@ import (
 )
 
 var (
-	session auth.Session
-	db      *sqlx.DB
-	rdb     *redis.Client
-	email   = "test_auth_session@test.com"
+	session   auth.Session
+	emailer   = &mockEmailer{tokens: make(chan string, 1)}
+	twoFactor twofactor.Service
+	db        *sqlx.DB
+	rdb       *redis.Client
+	email     = "test_auth_session@test.com"
 )
 
 func TestMain(m *testing.M) {
 	config := config.Session{
-		Attempts: 1,
-		Delay:    0,
+		Absolute: 24 * time.Hour,
+		Idle:     time.Hour,
+		Fresh:    time.Minute,
+		Throttle: config.Throttle{
+			Attempts:        2,
+			Delay:           time.Minute,
+			MaxDelay:        time.Hour,
+			Window:          time.Hour,
+			Lockout:         5,
+			LockoutDuration: time.Hour,
+		},
 	}
 	pgPool, pgResource, sqlxDB, err := test.RunPostgres()
 	if err != nil {
@@ -42,8 +60,9 @@ func TestMain(m *testing.M) {
 	db = sqlxDB
 	rdb = redisDB
 
-	session = auth.NewSession(db, rdb, config, true)
-	if err := createUser(context.Background()); err != nil {
+	twoFactor = twofactor.NewService(db)
+	session = auth.NewSession(db, rdb, twoFactor, emailer, config, true)
+	if err := createUser(context.Background(), "1", email); err != nil {
 		logger.Fatal(err)
 	}
 
@@ -62,9 +81,8 @@ func TestMain(m *testing.M) {
 func TestAlreadyLoggedIn(t *testing.T) {
 	t.Run("True", func(t *testing.T) {
 		ctx := context.Background()
-		salt := "0123456789111213"
-		sID := "1:" + salt
-		err := rdb.Set(ctx, sID, salt, 0).Err()
+		sID := "1:0123456789111213"
+		err := rdb.HSet(ctx, sID, "last_seen", time.Now().Unix()).Err()
 		assert.NoError(t, err)
 
 		r := httptest.NewRequest(http.MethodGet, "/", nil)
@@ -80,36 +98,149 @@ func TestAlreadyLoggedIn(t *testing.T) {
 	})
 }
 
+func TestIdentity(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Session without cart", func(t *testing.T) {
+		// Sessions created before the cart id was stored in them
+		sID := "1:legacy"
+		assert.NoError(t, rdb.HSet(ctx, sID, "last_seen", time.Now().Unix()).Err())
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		test.AddCookie(t, r, "SID", sID)
+		id, err := session.Identity(ctx, r)
+		assert.NoError(t, err)
+		assert.Equal(t, identity.Identity{UserID: "1", CartID: "cart1"}, id)
+
+		cartID, err := rdb.HGet(ctx, sID, "cart_id").Result()
+		assert.NoError(t, err)
+		assert.Equal(t, "cart1", cartID)
+	})
+
+	t.Run("Not found", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		test.AddCookie(t, r, "SID", "1:missing")
+		_, err := session.Identity(ctx, r)
+		assert.ErrorIs(t, err, auth.ErrSessionNotFound)
+	})
+}
+
 func TestLogin(t *testing.T) {
 	t.Run("Standard", func(t *testing.T) {
 		rec := httptest.NewRecorder()
 		req := httptest.NewRequest(http.MethodGet, "/", nil)
 
-		err := session.Login(context.Background(), rec, req, email, "password")
+		pendingToken, err := session.Login(context.Background(), rec, req, email, "password")
 		assert.NoError(t, err)
+		assert.Empty(t, pendingToken)
 
-		cookies := rec.Result().Cookies()
-		assert.Equal(t, 3, len(cookies))
-		assert.Equal(t, "SID", cookies[0].Name)
-		assert.Equal(t, "UID", cookies[1].Name)
-		assert.Equal(t, "CID", cookies[2].Name)
+		assertSessionCookie(t, rec)
 	})
 
 	t.Run("OAuth", func(t *testing.T) {
 		rec := httptest.NewRecorder()
 		req := httptest.NewRequest(http.MethodGet, "/", nil)
 
-		err := session.LoginOAuth(context.Background(), rec, req, email)
+		pendingToken, err := session.LoginOAuth(context.Background(), rec, req, "1")
 		assert.NoError(t, err)
+		assert.Empty(t, pendingToken)
 
-		cookies := rec.Result().Cookies()
-		assert.Equal(t, 3, len(cookies))
-		assert.Equal(t, "SID", cookies[0].Name)
-		assert.Equal(t, "UID", cookies[1].Name)
-		assert.Equal(t, "CID", cookies[2].Name)
+		assertSessionCookie(t, rec)
 	})
 }
 
+func TestRehash(t *testing.T) {
+	ctx := context.Background()
+	userID, userEmail := "rehash", "test_auth_rehash@test.com"
+	// Users created before argon2id have bcrypt hashes
+	assert.NoError(t, createUser(ctx, userID, userEmail))
+
+	login(t, userEmail)
+
+	var hash string
+	assert.NoError(t, db.GetContext(ctx, &hash, "SELECT password FROM users WHERE id=$1", userID))
+	assert.True(t, strings.HasPrefix(hash, "$argon2id$"), "The bcrypt hash wasn't replaced")
+
+	login(t, userEmail)
+	var again string
+	assert.NoError(t, db.GetContext(ctx, &again, "SELECT password FROM users WHERE id=$1", userID))
+	assert.Equal(t, hash, again, "Current hashes must not be replaced")
+}
+
+func TestLoginTwoFactor(t *testing.T) {
+	ctx := context.Background()
+	userID, userEmail := "2fa", "test_auth_2fa@test.com"
+	assert.NoError(t, createUser(ctx, userID, userEmail))
+
+	enrollment, err := twoFactor.Enroll(ctx, userID)
+	assert.NoError(t, err)
+	code, err := totp.Code(enrollment.Secret, totp.Counter(time.Now()))
+	assert.NoError(t, err)
+	recoveryCodes, err := twoFactor.Enable(ctx, userID, code)
+	assert.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	pendingToken, err := session.Login(ctx, rec, req, userEmail, "password")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, pendingToken)
+	// The session isn't created until the second factor is verified
+	assert.Empty(t, rec.Result().Cookies())
+
+	// Codes can't be reused
+	err = session.LoginTwoFactor(ctx, rec, req, pendingToken, code)
+	assert.ErrorIs(t, err, twofactor.ErrInvalidCode)
+
+	err = session.LoginTwoFactor(ctx, rec, req, pendingToken, recoveryCodes[0])
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(rec.Result().Cookies()))
+
+	// Pending logins are single-use
+	err = session.LoginTwoFactor(ctx, httptest.NewRecorder(), req, pendingToken, recoveryCodes[1])
+	assert.ErrorIs(t, err, auth.ErrInvalidPendingLogin)
+}
+
+func TestLoginTwoFactorLimits(t *testing.T) {
+	ctx := context.Background()
+	userID, userEmail := "2fa_limits", "test_auth_2fa_limits@test.com"
+	assert.NoError(t, createUser(ctx, userID, userEmail))
+
+	enrollment, err := twoFactor.Enroll(ctx, userID)
+	assert.NoError(t, err)
+	code, err := totp.Code(enrollment.Secret, totp.Counter(time.Now()))
+	assert.NoError(t, err)
+	_, err = twoFactor.Enable(ctx, userID, code)
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/login", nil)
+	// Every guess uses a new pending login, entering the password doesn't reset the invalid codes
+	for i := 0; i < 5; i++ {
+		keys, err := rdb.Keys(ctx, "login:*:wait").Result()
+		assert.NoError(t, err)
+		if len(keys) > 0 {
+			assert.NoError(t, rdb.Del(ctx, keys...).Err())
+		}
+
+		pendingToken, err := session.Login(ctx, httptest.NewRecorder(), req, userEmail, "password")
+		assert.NoError(t, err)
+		assert.NotEmpty(t, pendingToken)
+
+		err = session.LoginTwoFactor(ctx, httptest.NewRecorder(), req, pendingToken, "000000")
+		assert.ErrorIs(t, err, twofactor.ErrInvalidCode)
+	}
+
+	var unlockToken string
+	select {
+	case unlockToken = <-emailer.tokens:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The account wasn't locked")
+	}
+
+	_, err = session.Login(ctx, httptest.NewRecorder(), req, userEmail, "password")
+	assert.ErrorIs(t, err, auth.ErrAccountLocked)
+	assert.NoError(t, session.Unlock(ctx, unlockToken))
+}
+
 func TestLogout(t *testing.T) {
 	ctx := context.Background()
 
@@ -126,7 +257,297 @@ func TestLogout(t *testing.T) {
 	assert.Equal(t, "", cookies[2].Value)
 }
 
-func createUser(ctx context.Context) error {
+func TestSessions(t *testing.T) {
+	ctx := context.Background()
+	userID, userEmail := "sessions", "test_auth_sessions@test.com"
+	assert.NoError(t, createUser(ctx, userID, userEmail))
+
+	first := login(t, userEmail)
+	second := login(t, userEmail)
+	third := login(t, userEmail)
+
+	records, err := session.List(ctx, first)
+	assert.NoError(t, err)
+	assert.Len(t, records, 3)
+	current := 0
+	for _, r := range records {
+		assert.Equal(t, "test-agent", r.UserAgent)
+		assert.False(t, r.CreatedAt.IsZero())
+		if r.Current {
+			current++
+		}
+	}
+	assert.Equal(t, 1, current)
+
+	t.Run("Revoke", func(t *testing.T) {
+		secondID := currentSessionID(t, second)
+		// Sessions can only be revoked by their owner
+		assert.ErrorIs(t, session.Revoke(ctx, "1", secondID), auth.ErrSessionNotFound)
+
+		assert.NoError(t, session.Revoke(ctx, userID, secondID))
+		assert.False(t, session.AlreadyLoggedIn(ctx, second))
+	})
+
+	t.Run("Logout others", func(t *testing.T) {
+		assert.NoError(t, session.LogoutOthers(ctx, first))
+		assert.True(t, session.AlreadyLoggedIn(ctx, first))
+		assert.False(t, session.AlreadyLoggedIn(ctx, third))
+	})
+
+	t.Run("Logout all", func(t *testing.T) {
+		assert.NoError(t, session.LogoutAll(ctx, userID))
+		assert.False(t, session.AlreadyLoggedIn(ctx, first))
+
+		records, err := session.List(ctx, first)
+		assert.NoError(t, err)
+		assert.Len(t, records, 0)
+	})
+}
+
+func TestTimeouts(t *testing.T) {
+	ctx := context.Background()
+	userID, userEmail := "timeouts", "test_auth_timeouts@test.com"
+	assert.NoError(t, createUser(ctx, userID, userEmail))
+
+	r := login(t, userEmail)
+	sID, err := cookie.GetValue(r, "SID")
+	assert.NoError(t, err)
+
+	t.Run("Idle", func(t *testing.T) {
+		ttl, err := rdb.TTL(ctx, sID).Result()
+		assert.NoError(t, err)
+		assert.InDelta(t, time.Hour, ttl, float64(time.Minute))
+
+		// Simulate an hour of inactivity minus a minute, using the session renews it
+		assert.NoError(t, rdb.HSet(ctx, sID, "last_seen", time.Now().Add(-59*time.Minute).Unix()).Err())
+		assert.NoError(t, rdb.Expire(ctx, sID, time.Minute).Err())
+		assert.True(t, session.AlreadyLoggedIn(ctx, r))
+
+		ttl, err = rdb.TTL(ctx, sID).Result()
+		assert.NoError(t, err)
+		assert.InDelta(t, time.Hour, ttl, float64(time.Minute))
+	})
+
+	t.Run("Fresh", func(t *testing.T) {
+		assert.True(t, session.Fresh(ctx, r))
+
+		assert.NoError(t, rdb.HSet(ctx, sID, "auth_at", time.Now().Add(-time.Hour).Unix()).Err())
+		assert.False(t, session.Fresh(ctx, r))
+
+		assert.Error(t, session.Reauthenticate(ctx, r, "invalid", ""))
+		assert.False(t, session.Fresh(ctx, r))
+
+		assert.NoError(t, session.Reauthenticate(ctx, r, "password", ""))
+		assert.True(t, session.Fresh(ctx, r))
+	})
+
+	t.Run("Absolute", func(t *testing.T) {
+		assert.NoError(t, rdb.HSet(ctx, sID, "expires_at", time.Now().Add(-time.Second).Unix()).Err())
+		assert.False(t, session.AlreadyLoggedIn(ctx, r))
+
+		n, err := rdb.Exists(ctx, sID).Result()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), n)
+	})
+}
+
+func TestCSRFToken(t *testing.T) {
+	ctx := context.Background()
+	userID, userEmail := "csrf", "test_auth_csrf@test.com"
+	assert.NoError(t, createUser(ctx, userID, userEmail))
+
+	r := login(t, userEmail)
+	csrfToken, err := session.CSRFToken(ctx, r)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, csrfToken)
+
+	// The token is tied to the session
+	again, err := session.CSRFToken(ctx, r)
+	assert.NoError(t, err)
+	assert.Equal(t, csrfToken, again)
+
+	other, err := session.CSRFToken(ctx, login(t, userEmail))
+	assert.NoError(t, err)
+	assert.NotEqual(t, csrfToken, other)
+
+	t.Run("Missing", func(t *testing.T) {
+		// Sessions created before the tokens were introduced get one
+		sID, err := cookie.GetValue(r, "SID")
+		assert.NoError(t, err)
+		assert.NoError(t, rdb.HDel(ctx, sID, "csrf_token").Err())
+
+		csrfToken, err := session.CSRFToken(ctx, r)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, csrfToken)
+	})
+
+	t.Run("Logged out", func(t *testing.T) {
+		assert.NoError(t, session.LogoutAll(ctx, userID))
+		_, err := session.CSRFToken(ctx, r)
+		assert.ErrorIs(t, err, auth.ErrSessionNotFound)
+
+		sID, err := cookie.GetValue(r, "SID")
+		assert.NoError(t, err)
+		n, err := rdb.Exists(ctx, sID).Result()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), n)
+	})
+}
+
+func TestThrottle(t *testing.T) {
+	ctx := context.Background()
+	userID, userEmail := "throttle", "test_auth_throttle@test.com"
+	assert.NoError(t, createUser(ctx, userID, userEmail))
+
+	loginFrom := func(ip, email, password string) error {
+		req := httptest.NewRequest(http.MethodPost, "/login", nil)
+		req.RemoteAddr = ip + ":1234"
+		_, err := session.Login(ctx, httptest.NewRecorder(), req, email, password)
+		return err
+	}
+	// waitOver simulates the delay passing
+	waitOver := func() {
+		keys, err := rdb.Keys(ctx, "login:*:wait").Result()
+		assert.NoError(t, err)
+		if len(keys) > 0 {
+			assert.NoError(t, rdb.Del(ctx, keys...).Err())
+		}
+	}
+
+	t.Run("Backoff", func(t *testing.T) {
+		ip := "10.0.0.1"
+		assert.Error(t, loginFrom(ip, "unknown_throttle@test.com", "invalid"))
+		assert.Error(t, loginFrom(ip, "unknown_throttle@test.com", "invalid"))
+
+		// The third failure exceeds the attempts allowed
+		assert.Error(t, loginFrom(ip, "unknown_throttle@test.com", "invalid"))
+		var throttled *auth.ThrottledError
+		err := loginFrom(ip, "unknown_throttle@test.com", "invalid")
+		assert.ErrorAs(t, err, &throttled)
+		assert.InDelta(t, time.Minute, throttled.Wait, float64(time.Second))
+
+		// The delay doubles with every failure
+		waitOver()
+		assert.Error(t, loginFrom(ip, "unknown_throttle@test.com", "invalid"))
+		err = loginFrom(ip, "unknown_throttle@test.com", "invalid")
+		assert.ErrorAs(t, err, &throttled)
+		assert.InDelta(t, 2*time.Minute, throttled.Wait, float64(time.Second))
+
+		// Other addresses trying the same account are throttled as well
+		assert.ErrorAs(t, loginFrom("10.0.0.2", "unknown_throttle@test.com", "invalid"), &throttled)
+		waitOver()
+	})
+
+	t.Run("Success resets the account", func(t *testing.T) {
+		assert.Error(t, loginFrom("10.0.1.1", userEmail, "invalid"))
+		assert.Error(t, loginFrom("10.0.1.2", userEmail, "invalid"))
+		assert.NoError(t, loginFrom("10.0.1.3", userEmail, "password"))
+
+		assert.Error(t, loginFrom("10.0.1.4", userEmail, "invalid"))
+		assert.Error(t, loginFrom("10.0.1.5", userEmail, "invalid"))
+		// Not throttled, the failures before the login were forgotten
+		assert.NoError(t, loginFrom("10.0.1.6", userEmail, "password"))
+	})
+
+	t.Run("Lockout", func(t *testing.T) {
+		for i := 0; i < 5; i++ {
+			waitOver()
+			err := loginFrom(fmt.Sprintf("10.0.2.%d", i), userEmail, "invalid")
+			assert.EqualError(t, err, "invalid email or password")
+		}
+
+		var unlockToken string
+		select {
+		case unlockToken = <-emailer.tokens:
+		case <-time.After(5 * time.Second):
+			t.Fatal("The account locked email wasn't sent")
+		}
+
+		// Even the right password is rejected
+		waitOver()
+		assert.ErrorIs(t, loginFrom("10.0.2.10", userEmail, "password"), auth.ErrAccountLocked)
+
+		assert.ErrorIs(t, session.Unlock(ctx, "invalid"), auth.ErrInvalidUnlockToken)
+		assert.NoError(t, session.Unlock(ctx, unlockToken))
+		assert.NoError(t, loginFrom("10.0.2.11", userEmail, "password"))
+
+		// Tokens are single-use
+		assert.ErrorIs(t, session.Unlock(ctx, unlockToken), auth.ErrInvalidUnlockToken)
+	})
+
+	t.Run("Case-insensitive lockout", func(t *testing.T) {
+		spellings := []string{
+			"TEST_auth_throttle@test.com",
+			"Test_Auth_Throttle@test.com",
+			"test_auth_throttle@TEST.COM",
+			" test_auth_THROTTLE@test.com",
+			"TEST_AUTH_THROTTLE@TEST.COM",
+		}
+		for i, spelling := range spellings {
+			waitOver()
+			err := loginFrom(fmt.Sprintf("10.0.3.%d", i), spelling, "invalid")
+			assert.EqualError(t, err, "invalid email or password")
+		}
+
+		var unlockToken string
+		select {
+		case unlockToken = <-emailer.tokens:
+		case <-time.After(5 * time.Second):
+			t.Fatal("The account wasn't locked")
+		}
+
+		waitOver()
+		assert.ErrorIs(t, loginFrom("10.0.3.10", userEmail, "password"), auth.ErrAccountLocked)
+		assert.NoError(t, session.Unlock(ctx, unlockToken))
+	})
+}
+
+// assertSessionCookie checks that the session cookie is the only one set and that the
+// session contains the user and cart ids.
+func assertSessionCookie(t *testing.T, rec *httptest.ResponseRecorder) {
+	t.Helper()
+	cookies := rec.Result().Cookies()
+	assert.Equal(t, 1, len(cookies))
+	assert.Equal(t, "SID", cookies[0].Name)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(cookies[0])
+	id, err := session.Identity(context.Background(), r)
+	assert.NoError(t, err)
+	assert.Equal(t, "1", id.UserID)
+	assert.Equal(t, "cart1", id.CartID)
+}
+
+// login logs the user in and returns a request with the session cookies.
+func login(t *testing.T, email string) *http.Request {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("User-Agent", "test-agent")
+
+	_, err := session.Login(context.Background(), rec, req, email, "password")
+	assert.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, c := range rec.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+func currentSessionID(t *testing.T, r *http.Request) string {
+	t.Helper()
+	records, err := session.List(context.Background(), r)
+	assert.NoError(t, err)
+	for _, record := range records {
+		if record.Current {
+			return record.ID
+		}
+	}
+	return ""
+}
+
+func createUser(ctx context.Context, id, email string) error {
 	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.DefaultCost)
 	if err != nil {
 		return err
@@ -135,10 +556,19 @@ func createUser(ctx context.Context) error {
 	q := `INSERT INTO users
 	(id, cart_id, username, email, password, verified_email)
 	VALUES ($1, $2, $3, $4, $5, $6)`
-	_, err = db.ExecContext(ctx, q, "1", "2", "username", email, hash, true)
+	_, err = db.ExecContext(ctx, q, id, "cart"+id, "username", email, hash, true)
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
+
+type mockEmailer struct {
+	tokens chan string
+}
+
+func (e *mockEmailer) SendAccountLocked(username, email, token string) error {
+	e.tokens <- token
+	return nil
+}
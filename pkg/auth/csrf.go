@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/GGP1/adak/internal/cookie"
+	"github.com/GGP1/adak/internal/token"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+// csrfField is the session field storing its CSRF token.
+const csrfField = "csrf_token"
+
+// csrfScript returns the CSRF token of a session, generating it if the session was created
+// before they were introduced. It returns nil if the session doesn't exist so an expired
+// one isn't recreated.
+var csrfScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return false
+end
+redis.call("HSETNX", KEYS[1], ARGV[1], ARGV[2])
+return redis.call("HGET", KEYS[1], ARGV[1])
+`)
+
+// CSRFToken returns the synchronizer token of the user's session, it must be sent in
+// the X-CSRF-Token header of the requests that modify state.
+//
+// The token lives as long as the session, logging in again issues a new one.
+func (s *session) CSRFToken(ctx context.Context, r *http.Request) (string, error) {
+	sID, err := cookie.GetValue(r, "SID")
+	if err != nil {
+		return "", ErrSessionNotFound
+	}
+
+	csrfToken, err := csrfScript.Run(ctx, s.rdb, []string{sID}, csrfField, token.RandString(32)).Text()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return "", ErrSessionNotFound
+		}
+		return "", errors.Wrap(err, "fetching CSRF token")
+	}
+
+	return csrfToken, nil
+}
@@ -2,36 +2,20 @@ package auth
 
 import (
 	"encoding/json"
+	"math"
 	"net/http"
-	"os"
+	"strconv"
 
+	"github.com/GGP1/adak/internal/identity"
 	"github.com/GGP1/adak/internal/response"
 	"github.com/GGP1/adak/internal/sanitize"
-	"github.com/GGP1/adak/internal/token"
 	"github.com/GGP1/adak/internal/validate"
+	"github.com/GGP1/adak/pkg/auth/oidc"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/pkg/errors"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
 )
 
-var (
-	googleState  = token.RandString(20)
-	googleConfig = &oauth2.Config{
-		RedirectURL: "http://localhost:4000/login/oauth2/google",
-		Scopes:      []string{"https://www.googleapis.com/auth/userinfo.email"},
-		Endpoint:    google.Endpoint,
-	}
-)
-
-// There is no need to validate this data as it comes directly from Google.
-type oauthRes struct {
-	ID            string `json:"id"`
-	Email         string `json:"email"`
-	VerifiedEmail bool   `json:"verified_email"`
-	Picture       string `json:"picture"`
-}
-
 // BasicAuth provides basic authentication.
 func BasicAuth(s Session) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -48,12 +32,13 @@ func BasicAuth(s Session) http.HandlerFunc {
 			return
 		}
 
-		if err := s.Login(ctx, w, r, username, password); err != nil {
-			response.Error(w, http.StatusForbidden, err)
+		pendingToken, err := s.Login(ctx, w, r, username, password)
+		if err != nil {
+			loginError(w, err)
 			return
 		}
 
-		response.JSONText(w, http.StatusOK, "logged in")
+		loggedIn(w, pendingToken)
 	}
 }
 
@@ -82,8 +67,36 @@ func Login(s Session) http.HandlerFunc {
 		auth.Email = sanitize.Normalize(auth.Email)
 		auth.Password = sanitize.Normalize(auth.Password)
 
-		if err := s.Login(ctx, w, r, auth.Email, auth.Password); err != nil {
-			response.Error(w, http.StatusForbidden, err)
+		pendingToken, err := s.Login(ctx, w, r, auth.Email, auth.Password)
+		if err != nil {
+			loginError(w, err)
+			return
+		}
+
+		loggedIn(w, pendingToken)
+	}
+}
+
+// LoginTwoFactor completes the login of users with two-factor authentication enabled, taking
+// the pending login token and a code from the authenticator application or a recovery code.
+func LoginTwoFactor(s Session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		var login TwoFactorLogin
+		if err := json.NewDecoder(r.Body).Decode(&login); err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+		defer r.Body.Close()
+
+		if err := validate.Struct(ctx, login); err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if err := s.LoginTwoFactor(ctx, w, r, login.Token, login.Code); err != nil {
+			loginError(w, err)
 			return
 		}
 
@@ -104,63 +117,265 @@ func Logout(s Session) http.HandlerFunc {
 	}
 }
 
-// LoginGoogle redirects the user to the google oauth2.
-func LoginGoogle(s Session) http.HandlerFunc {
+// CSRFToken returns the token that must be sent in the X-CSRF-Token header of the
+// requests that modify state, it's only required when using the session cookies.
+func CSRFToken(s Session) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if s.AlreadyLoggedIn(r.Context(), r) {
-			http.Redirect(w, r, "/", http.StatusSeeOther)
+		csrfToken, err := s.CSRFToken(r.Context(), r)
+		if err != nil {
+			if errors.Is(err, ErrSessionNotFound) {
+				response.Error(w, http.StatusUnauthorized, errors.New("please log in to access"))
+				return
+			}
+			response.Error(w, http.StatusInternalServerError, err)
 			return
 		}
 
-		googleConfig.ClientID = os.Getenv("GOOGLE_CLIENT_ID")
-		googleConfig.ClientSecret = os.Getenv("GOOGLE_CLIENT_SECRET")
-		url := googleConfig.AuthCodeURL(googleState)
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("X-CSRF-Token", csrfToken)
+		response.JSON(w, http.StatusOK, map[string]string{"token": csrfToken})
+	}
+}
+
+// ForceLogout removes all the sessions of a user, used by administrators.
+func ForceLogout(s Session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := chi.URLParam(r, "id")
+
+		if err := s.LogoutAll(r.Context(), userID); err != nil {
+			response.Error(w, http.StatusInternalServerError, err)
+			return
+		}
 
-		http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+		response.JSONText(w, http.StatusOK, "user logged out from all sessions")
 	}
 }
 
-// OAuth2Google executes the oauth2 login with Google.
-func OAuth2Google(s Session) http.HandlerFunc {
+// Reauthenticate confirms the credentials of the logged in user so they can perform sensitive actions.
+func Reauthenticate(s Session) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var oauth oauthRes
 		ctx := r.Context()
 
-		res, err := userInfoGoogle(r.FormValue("state"), r.FormValue("code"))
-		if err != nil {
+		var reauth Reauthentication
+		if err := json.NewDecoder(r.Body).Decode(&reauth); err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+		defer r.Body.Close()
+
+		if err := validate.Struct(ctx, reauth); err != nil {
 			response.Error(w, http.StatusBadRequest, err)
 			return
 		}
 
-		if err := json.NewDecoder(res.Body).Decode(&oauth); err != nil {
+		if err := s.Reauthenticate(ctx, r, reauth.Password, reauth.Code); err != nil {
+			loginError(w, err)
+			return
+		}
+
+		response.JSONText(w, http.StatusOK, "credentials confirmed")
+	}
+}
+
+// RevokeOtherSessions logs the user out from all their sessions but the current one.
+func RevokeOtherSessions(s Session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := s.LogoutOthers(r.Context(), r); err != nil {
 			response.Error(w, http.StatusInternalServerError, err)
 			return
 		}
-		defer res.Body.Close()
 
-		if err := s.LoginOAuth(ctx, w, r, oauth.Email); err != nil {
+		response.JSONText(w, http.StatusOK, "other sessions revoked")
+	}
+}
+
+// RevokeSession logs the user out from one of their sessions.
+func RevokeSession(s Session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := identity.UserID(r)
+		if err != nil {
 			response.Error(w, http.StatusForbidden, err)
 			return
 		}
 
-		response.JSONText(w, http.StatusOK, "logged in")
+		if err := s.Revoke(r.Context(), userID, chi.URLParam(r, "id")); err != nil {
+			if errors.Is(err, ErrSessionNotFound) {
+				response.Error(w, http.StatusNotFound, err)
+				return
+			}
+			response.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		response.JSONText(w, http.StatusOK, "session revoked")
 	}
 }
 
-func userInfoGoogle(state, code string) (*http.Response, error) {
-	if state != googleState {
-		return nil, errors.New("invalid OAuth state")
+// Sessions lists the sessions of the logged in user.
+func Sessions(s Session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		records, err := s.List(r.Context(), r)
+		if err != nil {
+			response.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		response.JSON(w, http.StatusOK, records)
 	}
+}
 
-	token, err := googleConfig.Exchange(oauth2.NoContext, code)
-	if err != nil {
-		return nil, errors.Wrap(err, "code exchange failed")
+// Unlock unlocks the account with the token sent to its owner when it was locked.
+func Unlock(s Session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := s.Unlock(r.Context(), chi.URLParam(r, "token")); err != nil {
+			if errors.Is(err, ErrInvalidUnlockToken) {
+				response.Error(w, http.StatusBadRequest, err)
+				return
+			}
+			response.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		response.JSONText(w, http.StatusOK, "account unlocked")
 	}
+}
+
+// LoginProvider redirects the user to the OpenID Connect provider login.
+func LoginProvider(s Session, providers oidc.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		if s.AlreadyLoggedIn(ctx, r) {
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		url, state, err := providers.AuthCodeURL(ctx, chi.URLParam(r, "provider"), "")
+		if err != nil {
+			if errors.Is(err, oidc.ErrUnknownProvider) {
+				response.Error(w, http.StatusNotFound, err)
+				return
+			}
+			response.Error(w, http.StatusBadGateway, err)
+			return
+		}
+
+		if err := oidc.SetState(w, state); err != nil {
+			response.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		http.Redirect(w, r, url, http.StatusFound)
+	}
+}
+
+// ProviderCallback completes the login with the OpenID Connect provider. The first login
+// signs the user up, or links the identity to the account with the same verified email.
+func ProviderCallback(s Session, providers oidc.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		if errCode := r.FormValue("error"); errCode != "" {
+			response.Error(w, http.StatusBadRequest, errors.Errorf("login failed: %s %s", errCode, r.FormValue("error_description")))
+			return
+		}
+
+		state := r.FormValue("state")
+		if err := oidc.CheckState(w, r, state); err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
 
-	res, err := http.Get("https://www.googleapis.com/oauth2/v2/userinfo?access_token=" + token.AccessToken)
+		claims, err := providers.Exchange(ctx, chi.URLParam(r, "provider"), state, r.FormValue("code"))
+		if err != nil {
+			switch {
+			case errors.Is(err, oidc.ErrUnknownProvider):
+				response.Error(w, http.StatusNotFound, err)
+			case errors.Is(err, oidc.ErrInvalidState), errors.Is(err, oidc.ErrInvalidIDToken):
+				response.Error(w, http.StatusBadRequest, err)
+			default:
+				response.Error(w, http.StatusBadGateway, err)
+			}
+			return
+		}
+
+		if claims.LinkUserID != "" {
+			linkIdentity(w, r, s, providers, claims)
+			return
+		}
+
+		userID, err := providers.SignIn(ctx, claims)
+		if err != nil {
+			switch {
+			case errors.Is(err, oidc.ErrEmailNotVerified):
+				response.Error(w, http.StatusForbidden, err)
+			case errors.Is(err, oidc.ErrAccountExists):
+				response.Error(w, http.StatusConflict, err)
+			default:
+				response.Error(w, http.StatusInternalServerError, err)
+			}
+			return
+		}
+
+		pendingToken, err := s.LoginOAuth(ctx, w, r, userID)
+		if err != nil {
+			response.Error(w, http.StatusForbidden, err)
+			return
+		}
+
+		loggedIn(w, pendingToken)
+	}
+}
+
+// linkIdentity links the identity to the user that started the login, who must still be
+// logged in, so nobody can link their identity to someone else's account by sending them
+// the callback URL.
+func linkIdentity(w http.ResponseWriter, r *http.Request, s Session, providers oidc.Service, claims oidc.Claims) {
+	ctx := r.Context()
+
+	id, err := s.Identity(ctx, r)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed getting user info")
+		response.Error(w, http.StatusForbidden, errors.New("please log in to link the identity"))
+		return
+	}
+
+	if id.UserID != claims.LinkUserID {
+		response.Error(w, http.StatusForbidden, errors.New("the identity must be linked from the account that requested it"))
+		return
+	}
+
+	if err := providers.Link(ctx, id.UserID, claims); err != nil {
+		switch {
+		case errors.Is(err, oidc.ErrIdentityLinked), errors.Is(err, oidc.ErrProviderLinked):
+			response.Error(w, http.StatusConflict, err)
+		default:
+			response.Error(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	response.JSONText(w, http.StatusOK, claims.Provider+" account linked")
+}
+
+// loggedIn responds with the pending login token if the user must still send the second
+// factor, or confirms the login otherwise.
+func loggedIn(w http.ResponseWriter, pendingToken string) {
+	if pendingToken != "" {
+		response.JSON(w, http.StatusOK, PendingLogin{TwoFactorRequired: true, Token: pendingToken})
+		return
+	}
+
+	response.JSONText(w, http.StatusOK, "logged in")
+}
+
+// loginError responds with the login error, throttled requests are told when to retry.
+func loginError(w http.ResponseWriter, err error) {
+	var throttled *ThrottledError
+	if errors.As(err, &throttled) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(throttled.Wait.Seconds()))))
+		response.Error(w, http.StatusTooManyRequests, err)
+		return
 	}
 
-	return res, nil
+	response.Error(w, http.StatusForbidden, err)
 }
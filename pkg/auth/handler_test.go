@@ -6,6 +6,11 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+
+	"github.com/GGP1/adak/internal/identity"
+	"github.com/GGP1/adak/pkg/auth/oidc"
+
+	"github.com/go-chi/chi/v5"
 )
 
 type mockSession struct{}
@@ -13,15 +18,51 @@ type mockSession struct{}
 func (s *mockSession) AlreadyLoggedIn(ctx context.Context, r *http.Request) bool {
 	return false
 }
-func (s *mockSession) Login(ctx context.Context, w http.ResponseWriter, r *http.Request, email, password string) error {
-	return nil
+func (s *mockSession) CSRFToken(ctx context.Context, r *http.Request) (string, error) {
+	if _, err := r.Cookie("SID"); err != nil {
+		return "", ErrSessionNotFound
+	}
+	return "csrf-token", nil
+}
+func (s *mockSession) Identity(ctx context.Context, r *http.Request) (identity.Identity, error) {
+	return identity.Identity{}, ErrSessionNotFound
+}
+func (s *mockSession) Login(ctx context.Context, w http.ResponseWriter, r *http.Request, email, password string) (string, error) {
+	return "", nil
 }
-func (s *mockSession) LoginOAuth(ctx context.Context, w http.ResponseWriter, r *http.Request, email string) error {
+func (s *mockSession) LoginOAuth(ctx context.Context, w http.ResponseWriter, r *http.Request, email string) (string, error) {
+	return "", nil
+}
+func (s *mockSession) LoginTwoFactor(ctx context.Context, w http.ResponseWriter, r *http.Request, pendingToken, code string) error {
 	return nil
 }
+func (s *mockSession) LimitTwoFactor(ctx context.Context, r *http.Request, userID string, verify func() error) error {
+	return verify()
+}
 func (s *mockSession) Logout(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
+func (s *mockSession) LogoutAll(ctx context.Context, userID string) error {
+	return nil
+}
+func (s *mockSession) LogoutOthers(ctx context.Context, r *http.Request) error {
+	return nil
+}
+func (s *mockSession) List(ctx context.Context, r *http.Request) ([]Record, error) {
+	return nil, nil
+}
+func (s *mockSession) Revoke(ctx context.Context, userID, sessionID string) error {
+	return nil
+}
+func (s *mockSession) Fresh(ctx context.Context, r *http.Request) bool {
+	return true
+}
+func (s *mockSession) Unlock(ctx context.Context, token string) error {
+	return nil
+}
+func (s *mockSession) Reauthenticate(ctx context.Context, r *http.Request, password, code string) error {
+	return nil
+}
 
 func TestLoginHandler(t *testing.T) {
 	// Actually I should use the real session instead
@@ -72,20 +113,83 @@ func TestLogoutHandler(t *testing.T) {
 	}
 }
 
-func TestLoginGoogleHandler(t *testing.T) {
+type mockProviders struct{}
+
+func (p *mockProviders) AuthCodeURL(ctx context.Context, provider, linkUserID string) (string, string, error) {
+	if provider != "google" {
+		return "", "", oidc.ErrUnknownProvider
+	}
+	return "https://accounts.google.com/o/oauth2/v2/auth?state=state", "state", nil
+}
+func (p *mockProviders) Exchange(ctx context.Context, provider, state, code string) (oidc.Claims, error) {
+	return oidc.Claims{}, nil
+}
+func (p *mockProviders) Identities(ctx context.Context, userID string) ([]oidc.Identity, error) {
+	return nil, nil
+}
+func (p *mockProviders) Link(ctx context.Context, userID string, claims oidc.Claims) error {
+	return nil
+}
+func (p *mockProviders) Providers() []string {
+	return []string{"google"}
+}
+func (p *mockProviders) SignIn(ctx context.Context, claims oidc.Claims) (string, error) {
+	return "", nil
+}
+func (p *mockProviders) Unlink(ctx context.Context, userID, provider string) error {
+	return nil
+}
+
+func TestLoginProviderHandler(t *testing.T) {
 	var session *mockSession
-	rec := httptest.NewRecorder()
+	router := chi.NewRouter()
+	router.Get("/login/{provider}", LoginProvider(session, &mockProviders{}))
+
+	cases := []struct {
+		provider string
+		expected int
+	}{
+		{provider: "google", expected: http.StatusFound},
+		{provider: "unknown", expected: http.StatusNotFound},
+	}
 
-	req, err := http.NewRequest("GET", "https://localhost:4000/login/google", nil)
-	if err != nil {
-		t.Fatalf("Failed sending logout request: %v", err)
+	for _, tc := range cases {
+		rec := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "https://localhost:4000/login/"+tc.provider, nil)
+		if err != nil {
+			t.Fatalf("Failed sending login request: %v", err)
+		}
+
+		router.ServeHTTP(rec, req)
+
+		res := rec.Result()
+		if res.StatusCode != tc.expected {
+			t.Errorf("%s: expected %d, got %s", tc.provider, tc.expected, res.Status)
+		}
 	}
+}
 
-	hFunc := LoginGoogle(session)
-	hFunc.ServeHTTP(rec, req)
+func TestCSRFTokenHandler(t *testing.T) {
+	var session *mockSession
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "https://localhost:4000/csrf", nil)
+	req.AddCookie(&http.Cookie{Name: "SID", Value: "1:session"})
+	CSRFToken(session).ServeHTTP(rec, req)
 
 	res := rec.Result()
-	if res.StatusCode != http.StatusTemporaryRedirect {
+	if res.StatusCode != http.StatusOK {
 		t.Errorf("Expected OK, got %s", res.Status)
 	}
+	if got := res.Header.Get("X-CSRF-Token"); got != "csrf-token" {
+		t.Errorf("Expected the session token, got %q", got)
+	}
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "https://localhost:4000/csrf", nil)
+	CSRFToken(session).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected unauthorized without a session, got %d", rec.Code)
+	}
 }
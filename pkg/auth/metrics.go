@@ -1,24 +1,69 @@
 package auth
 
 import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 type metrics struct {
-	activeSessions prometheus.Gauge
-	totalSessions  prometheus.Counter
+	activeSessions     prometheus.GaugeFunc
+	credentialStuffing prometheus.Gauge
+	failedLogins       *prometheus.CounterVec
+	lockouts           prometheus.Counter
+	throttledLogins    *prometheus.CounterVec
+	totalSessions      prometheus.Counter
 }
 
-func initMetrics() metrics {
+func initMetrics(rdb *redis.Client) metrics {
 	const ns, sub = "adak", "auth"
 	return metrics{
-		activeSessions: promauto.NewGauge(prometheus.GaugeOpts{
+		// Sessions are counted in redis so every instance reports the same value
+		activeSessions: promauto.NewGaugeFunc(prometheus.GaugeOpts{
 			Namespace: ns,
 			Subsystem: sub,
 			Name:      "active_sessions_total",
 			Help:      "Total number of active sessions",
+		}, func() float64 {
+			if rdb == nil {
+				return 0
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			n, err := countSessions(ctx, rdb)
+			if err != nil {
+				return 0
+			}
+			return float64(n)
+		}),
+		credentialStuffing: promauto.NewGauge(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "credential_stuffing",
+			Help:      "Whether the failed logins per minute exceed the credential stuffing threshold (1) or not (0)",
+		}),
+		failedLogins: promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "failed_logins_total",
+			Help:      "Total number of failed logins per reason",
+		}, []string{"reason"}),
+		lockouts: promauto.NewCounter(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "lockouts_total",
+			Help:      "Total number of accounts locked after too many failed logins",
 		}),
+		throttledLogins: promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "throttled_logins_total",
+			Help:      "Total number of logins rejected for exceeding the failed attempts of an IP address or account",
+		}, []string{"scope"}),
 		totalSessions: promauto.NewCounter(prometheus.CounterOpts{
 			Namespace: ns,
 			Subsystem: sub,
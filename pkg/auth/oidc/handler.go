@@ -0,0 +1,121 @@
+package oidc
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"time"
+
+	"github.com/GGP1/adak/internal/cookie"
+	"github.com/GGP1/adak/internal/identity"
+	"github.com/GGP1/adak/internal/response"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+)
+
+// stateCookie binds the logins to the browser that started them, so users can't be tricked
+// into completing a login started by someone else and end up in their account.
+const stateCookie = "OIDC_STATE"
+
+// Handler handles the identities endpoints.
+type Handler struct {
+	service Service
+}
+
+// NewHandler returns a new identities handler.
+func NewHandler(service Service) Handler {
+	return Handler{service: service}
+}
+
+// Identities lists the identities linked to the logged in user.
+func (h *Handler) Identities() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := identity.UserID(r)
+		if err != nil {
+			response.Error(w, http.StatusForbidden, err)
+			return
+		}
+
+		identities, err := h.service.Identities(r.Context(), userID)
+		if err != nil {
+			response.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		response.JSON(w, http.StatusOK, identities)
+	}
+}
+
+// Link redirects the logged in user to the provider to link their account.
+func (h *Handler) Link() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := identity.UserID(r)
+		if err != nil {
+			response.Error(w, http.StatusForbidden, err)
+			return
+		}
+
+		url, state, err := h.service.AuthCodeURL(r.Context(), chi.URLParam(r, "provider"), userID)
+		if err != nil {
+			if errors.Is(err, ErrUnknownProvider) {
+				response.Error(w, http.StatusNotFound, err)
+				return
+			}
+			response.Error(w, http.StatusBadGateway, err)
+			return
+		}
+
+		if err := SetState(w, state); err != nil {
+			response.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		http.Redirect(w, r, url, http.StatusFound)
+	}
+}
+
+// Unlink removes the logged in user's identity from the provider.
+func (h *Handler) Unlink() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := identity.UserID(r)
+		if err != nil {
+			response.Error(w, http.StatusForbidden, err)
+			return
+		}
+
+		if err := h.service.Unlink(r.Context(), userID, chi.URLParam(r, "provider")); err != nil {
+			switch {
+			case errors.Is(err, ErrIdentityNotFound):
+				response.Error(w, http.StatusNotFound, err)
+			case errors.Is(err, ErrLastLoginMethod):
+				response.Error(w, http.StatusBadRequest, err)
+			default:
+				response.Error(w, http.StatusInternalServerError, err)
+			}
+			return
+		}
+
+		response.JSONText(w, http.StatusOK, "identity unlinked")
+	}
+}
+
+// CheckState returns ErrInvalidState if the state received in the callback isn't the one
+// stored in the user's browser when the login started, the cookie is removed either way.
+func CheckState(w http.ResponseWriter, r *http.Request, state string) error {
+	stored, err := cookie.GetValue(r, stateCookie)
+	if err != nil {
+		return ErrInvalidState
+	}
+	cookie.Delete(w, stateCookie, "/")
+
+	if state == "" || subtle.ConstantTimeCompare([]byte(stored), []byte(state)) != 1 {
+		return ErrInvalidState
+	}
+	return nil
+}
+
+// SetState stores the login state in the user's browser, the cookie is sent back when the
+// provider redirects them to the callback.
+func SetState(w http.ResponseWriter, state string) error {
+	return cookie.SetLax(w, stateCookie, state, "/", int(stateExpiration/time.Second))
+}
@@ -0,0 +1,284 @@
+package oidc
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/GGP1/adak/internal/sanitize"
+	"github.com/GGP1/adak/internal/token"
+	"github.com/GGP1/adak/pkg/role"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// maxUsernameLength must match the user's username validation.
+const maxUsernameLength = 25
+
+var (
+	// ErrAccountExists is returned when signing up with an email that belongs to an account
+	// whose ownership wasn't verified, its owner must log in and link the provider instead.
+	ErrAccountExists = errors.New("an account with this email already exists, log in and link the provider from your settings")
+	// ErrEmailNotVerified is returned when the provider didn't verify the user's email.
+	ErrEmailNotVerified = errors.New("the provider didn't send a verified email")
+	// ErrIdentityLinked is returned when the identity is already linked to another account.
+	ErrIdentityLinked = errors.New("this identity is already linked to another account")
+	// ErrIdentityNotFound is returned when the user hasn't linked the provider.
+	ErrIdentityNotFound = errors.New("identity not found")
+	// ErrLastLoginMethod is returned when unlinking the only way the user has to log in.
+	ErrLastLoginMethod = errors.New("this is your only login method, set a password before unlinking it")
+	// ErrProviderLinked is returned when the user already linked an identity from the provider.
+	ErrProviderLinked = errors.New("you already linked an account from this provider")
+)
+
+var invalidUsernameChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// Identity is an account in an external provider linked to a user.
+type Identity struct {
+	Provider  string    `json:"provider" db:"provider"`
+	Subject   string    `json:"-" db:"subject"`
+	Email     string    `json:"email,omitempty" db:"email"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// Identities returns the identities linked to the user.
+func (s *service) Identities(ctx context.Context, userID string) ([]Identity, error) {
+	s.metrics.incMethodCalls("Identities")
+
+	q := "SELECT provider, subject, email, created_at FROM identities WHERE user_id=$1 ORDER BY provider"
+	identities := []Identity{}
+	if err := s.db.SelectContext(ctx, &identities, q, userID); err != nil {
+		return nil, errors.Wrap(err, "fetching identities")
+	}
+
+	return identities, nil
+}
+
+// Link adds the identity to the user's login methods.
+func (s *service) Link(ctx context.Context, userID string, claims Claims) error {
+	s.metrics.incMethodCalls("Link")
+
+	var owner string
+	q := "SELECT user_id FROM identities WHERE provider=$1 AND subject=$2"
+	err := s.db.GetContext(ctx, &owner, q, claims.Provider, claims.Subject)
+	switch {
+	case err == nil && owner == userID:
+		return nil
+	case err == nil:
+		return ErrIdentityLinked
+	case !errors.Is(err, sql.ErrNoRows):
+		return errors.Wrap(err, "fetching identity")
+	}
+
+	if err := insertIdentity(ctx, s.db, userID, claims); err != nil {
+		return err
+	}
+
+	s.metrics.changes.WithLabelValues(claims.Provider, "link").Inc()
+	return nil
+}
+
+// SignIn returns the user the identity belongs to. The first time it's used, the identity
+// is linked to the account with the same email, only if both the provider and the account
+// verified it, or a new verified account is created.
+func (s *service) SignIn(ctx context.Context, claims Claims) (string, error) {
+	s.metrics.incMethodCalls("SignIn")
+
+	var userID string
+	q := "SELECT user_id FROM identities WHERE provider=$1 AND subject=$2"
+	err := s.db.GetContext(ctx, &userID, q, claims.Provider, claims.Subject)
+	if err == nil {
+		return userID, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return "", errors.Wrap(err, "fetching identity")
+	}
+
+	if claims.Email == "" || !claims.EmailVerified {
+		return "", ErrEmailNotVerified
+	}
+	email := sanitize.Normalize(claims.Email)
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "starting transaction")
+	}
+	defer tx.Rollback()
+
+	var user struct {
+		ID            string `db:"id"`
+		VerifiedEmail bool   `db:"verified_email"`
+	}
+	err = tx.GetContext(ctx, &user, "SELECT id, verified_email FROM users WHERE lower(email)=lower($1) FOR UPDATE", email)
+	switch {
+	case err == nil:
+		// Linking an account whose email wasn't verified would let anyone that registered
+		// it with someone else's email take over the account once its owner logs in
+		if !user.VerifiedEmail {
+			return "", ErrAccountExists
+		}
+		userID = user.ID
+
+	case errors.Is(err, sql.ErrNoRows):
+		userID, err = s.createUser(ctx, tx, email, claims)
+		if err != nil {
+			return "", err
+		}
+		s.metrics.changes.WithLabelValues(claims.Provider, "sign_up").Inc()
+
+	default:
+		return "", errors.Wrap(err, "fetching user")
+	}
+
+	if err := insertIdentity(ctx, tx, userID, claims); err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", errors.Wrap(err, "committing transaction")
+	}
+
+	s.metrics.changes.WithLabelValues(claims.Provider, "link").Inc()
+	return userID, nil
+}
+
+// Unlink removes the identity from the provider, users must keep at least one way to log in.
+func (s *service) Unlink(ctx context.Context, userID, provider string) error {
+	s.metrics.incMethodCalls("Unlink")
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "starting transaction")
+	}
+	defer tx.Rollback()
+
+	var password string
+	if err := tx.GetContext(ctx, &password, "SELECT password FROM users WHERE id=$1 FOR UPDATE", userID); err != nil {
+		return errors.Wrap(err, "fetching user")
+	}
+
+	var identities []string
+	if err := tx.SelectContext(ctx, &identities, "SELECT provider FROM identities WHERE user_id=$1", userID); err != nil {
+		return errors.Wrap(err, "fetching identities")
+	}
+
+	linked := false
+	for _, p := range identities {
+		if p == provider {
+			linked = true
+			break
+		}
+	}
+	if !linked {
+		return ErrIdentityNotFound
+	}
+	// Users that signed up with a provider have no password until they reset it
+	if password == "" && len(identities) == 1 {
+		return ErrLastLoginMethod
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM identities WHERE user_id=$1 AND provider=$2", userID, provider); err != nil {
+		return errors.Wrap(err, "couldn't unlink the identity")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "committing transaction")
+	}
+
+	s.metrics.changes.WithLabelValues(provider, "unlink").Inc()
+	return nil
+}
+
+// createUser creates a verified user and its cart. It doesn't have a password, the
+// bcrypt comparison always fails so it can only log in with the provider.
+func (s *service) createUser(ctx context.Context, tx *sqlx.Tx, email string, claims Claims) (string, error) {
+	userID := uuid.NewString()
+	cartID := uuid.NewString()
+
+	username, err := availableUsername(ctx, tx, email, claims.Name)
+	if err != nil {
+		return "", err
+	}
+
+	userQuery := `INSERT INTO users
+	(id, cart_id, username, email, password, verified_email, created_at)
+	VALUES ($1, $2, $3, $4, '', true, $5)`
+	if _, err := tx.ExecContext(ctx, userQuery, userID, cartID, username, email, time.Now()); err != nil {
+		return "", errors.Wrap(err, "couldn't create the user")
+	}
+
+	roles := role.Initial(email, s.admins)
+	rolesQuery := "INSERT INTO user_roles (user_id, role) SELECT $1, unnest($2::text[])"
+	if _, err := tx.ExecContext(ctx, rolesQuery, userID, pq.StringArray(roles)); err != nil {
+		return "", errors.Wrap(err, "couldn't assign the user roles")
+	}
+
+	cartQuery := `INSERT INTO carts
+	(id, counter, weight, discount, taxes, subtotal, total)
+	VALUES ($1, 0, 0, 0, 0, 0, 0)`
+	if _, err := tx.ExecContext(ctx, cartQuery, cartID); err != nil {
+		return "", errors.Wrap(err, "couldn't create the cart")
+	}
+
+	return userID, nil
+}
+
+// availableUsername derives a username from the user's name or email, a random
+// suffix is added if it's taken.
+func availableUsername(ctx context.Context, tx *sqlx.Tx, email, name string) (string, error) {
+	base := name
+	if base == "" {
+		base = strings.SplitN(email, "@", 2)[0]
+	}
+	base = strings.Trim(invalidUsernameChars.ReplaceAllString(sanitize.Normalize(base), "_"), "_")
+	if base == "" {
+		base = "user"
+	}
+
+	username := truncate(base, maxUsernameLength)
+	for i := 0; i < 5; i++ {
+		var exists bool
+		if err := tx.GetContext(ctx, &exists, "SELECT EXISTS(SELECT 1 FROM users WHERE username=$1)", username); err != nil {
+			return "", errors.Wrap(err, "checking username")
+		}
+		if !exists {
+			return username, nil
+		}
+
+		suffix := "_" + token.RandString(5)
+		username = truncate(base, maxUsernameLength-len(suffix)) + suffix
+	}
+
+	return "", errors.New("couldn't find an available username")
+}
+
+// insertIdentity links the identity to the user.
+func insertIdentity(ctx context.Context, db sqlx.ExecerContext, userID string, claims Claims) error {
+	q := `INSERT INTO identities (provider, subject, user_id, email, created_at)
+	VALUES ($1, $2, $3, $4, $5)`
+	_, err := db.ExecContext(ctx, q, claims.Provider, claims.Subject, userID, claims.Email, time.Now())
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			if pqErr.Constraint == "identities_user_id_provider_key" {
+				return ErrProviderLinked
+			}
+			return ErrIdentityLinked
+		}
+		return errors.Wrap(err, "couldn't link the identity")
+	}
+
+	return nil
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
@@ -0,0 +1,527 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GGP1/adak/internal/config"
+	"github.com/GGP1/adak/internal/logger"
+	"github.com/GGP1/adak/internal/test"
+	"github.com/GGP1/adak/pkg/role"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const clientID, clientSecret = "client", "secret"
+
+// mockProvider is an in-process OpenID Connect provider.
+type mockProvider struct {
+	*httptest.Server
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+
+	mu sync.Mutex
+	// codes maps the authorization codes issued to the request parameters
+	codes map[string]url.Values
+	// claims modifies the ID tokens issued
+	claims func(claims map[string]interface{})
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	m := &mockProvider{rsaKey: rsaKey, ecKey: ecKey, codes: make(map[string]url.Values)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", m.discovery)
+	mux.HandleFunc("/authorize", m.authorize)
+	mux.HandleFunc("/token", m.token)
+	mux.HandleFunc("/keys", m.keys)
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+
+	return m
+}
+
+func (m *mockProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(metadata{
+		Issuer:                m.URL,
+		AuthorizationEndpoint: m.URL + "/authorize",
+		TokenEndpoint:         m.URL + "/token",
+		JWKSURI:               m.URL + "/keys",
+	})
+}
+
+func (m *mockProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client_id") != clientID || query.Get("code_challenge_method") != "S256" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	code := base64.RawURLEncoding.EncodeToString(randBytes(16))
+	m.mu.Lock()
+	m.codes[code] = query
+	m.mu.Unlock()
+
+	redirect, _ := url.Parse(query.Get("redirect_uri"))
+	redirect.RawQuery = url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (m *mockProvider) token(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.FormValue("client_id"), r.FormValue("client_secret")
+	}
+	if id != clientID || secret != clientSecret {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+
+	m.mu.Lock()
+	params, ok := m.codes[r.FormValue("code")]
+	delete(m.codes, r.FormValue("code"))
+	m.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+	if !ok || challenge != params.Get("code_challenge") || r.FormValue("redirect_uri") != params.Get("redirect_uri") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+
+	claims := m.defaultClaims(params.Get("nonce"))
+	m.mu.Lock()
+	if m.claims != nil {
+		m.claims(claims)
+	}
+	m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     m.sign("RS256", "rsa", claims),
+	})
+}
+
+func (m *mockProvider) keys(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []jwk{
+			{
+				Kty: "RSA", Kid: "rsa", Use: "sig",
+				N: b64(m.rsaKey.N.Bytes()),
+				E: b64(big.NewInt(int64(m.rsaKey.E)).Bytes()),
+			},
+			{
+				Kty: "EC", Kid: "ec", Use: "sig", Crv: "P-256",
+				X: b64(m.ecKey.X.FillBytes(make([]byte, 32))),
+				Y: b64(m.ecKey.Y.FillBytes(make([]byte, 32))),
+			},
+		},
+	})
+}
+
+func (m *mockProvider) defaultClaims(nonce string) map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":            m.URL,
+		"sub":            "248289761001",
+		"aud":            clientID,
+		"exp":            now.Add(time.Hour).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          nonce,
+		"email":          "oidc@test.com",
+		"email_verified": true,
+		"name":           "Test",
+	}
+}
+
+// sign returns a token with the claims signed with the algorithm and key id provided.
+func (m *mockProvider) sign(alg, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signingInput := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	var signature []byte
+	switch alg {
+	case "RS256":
+		signature, _ = rsa.SignPKCS1v15(rand.Reader, m.rsaKey, crypto.SHA256, digest[:])
+	case "ES256":
+		r, s, _ := ecdsa.Sign(rand.Reader, m.ecKey, digest[:])
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+
+	return signingInput + "." + b64(signature)
+}
+
+func (m *mockProvider) config(name string) config.OIDCProvider {
+	return config.OIDCProvider{Name: name, Issuer: m.URL, ClientID: clientID, ClientSecret: clientSecret}
+}
+
+func TestVerify(t *testing.T) {
+	m := newMockProvider(t)
+	ctx := context.Background()
+	p := &provider{client: m.Client(), conf: m.config("mock")}
+
+	_, issuer, err := p.oauth2Config(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, m.URL, issuer)
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	cases := []struct {
+		desc   string
+		token  func() string
+		nonce  string
+		failed bool
+	}{
+		{
+			desc:  "RS256",
+			token: func() string { return m.sign("RS256", "rsa", m.defaultClaims("nonce")) },
+			nonce: "nonce",
+		},
+		{
+			desc:  "ES256",
+			token: func() string { return m.sign("ES256", "ec", m.defaultClaims("nonce")) },
+			nonce: "nonce",
+		},
+		{
+			desc:   "Invalid nonce",
+			token:  func() string { return m.sign("RS256", "rsa", m.defaultClaims("nonce")) },
+			nonce:  "other",
+			failed: true,
+		},
+		{
+			desc: "Invalid audience",
+			token: func() string {
+				claims := m.defaultClaims("nonce")
+				claims["aud"] = []string{"other"}
+				return m.sign("RS256", "rsa", claims)
+			},
+			nonce:  "nonce",
+			failed: true,
+		},
+		{
+			desc: "Invalid authorized party",
+			token: func() string {
+				claims := m.defaultClaims("nonce")
+				claims["aud"] = []string{clientID, "other"}
+				claims["azp"] = "other"
+				return m.sign("RS256", "rsa", claims)
+			},
+			nonce:  "nonce",
+			failed: true,
+		},
+		{
+			desc: "Invalid issuer",
+			token: func() string {
+				claims := m.defaultClaims("nonce")
+				claims["iss"] = "https://attacker.com"
+				return m.sign("RS256", "rsa", claims)
+			},
+			nonce:  "nonce",
+			failed: true,
+		},
+		{
+			desc: "Expired",
+			token: func() string {
+				claims := m.defaultClaims("nonce")
+				claims["exp"] = time.Now().Add(-time.Hour).Unix()
+				return m.sign("RS256", "rsa", claims)
+			},
+			nonce:  "nonce",
+			failed: true,
+		},
+		{
+			desc: "Invalid signature",
+			token: func() string {
+				original := m.rsaKey
+				m.rsaKey = other
+				defer func() { m.rsaKey = original }()
+				return m.sign("RS256", "rsa", m.defaultClaims("nonce"))
+			},
+			nonce:  "nonce",
+			failed: true,
+		},
+		{
+			desc:   "Algorithm mismatch",
+			token:  func() string { return m.sign("ES256", "rsa", m.defaultClaims("nonce")) },
+			nonce:  "nonce",
+			failed: true,
+		},
+		{
+			desc: "Unsigned",
+			token: func() string {
+				token := m.sign("RS256", "rsa", m.defaultClaims("nonce"))
+				return token[:strings.LastIndexByte(token, '.')+1]
+			},
+			nonce:  "nonce",
+			failed: true,
+		},
+		{
+			desc:   "Unknown key",
+			token:  func() string { return m.sign("RS256", "unknown", m.defaultClaims("nonce")) },
+			nonce:  "nonce",
+			failed: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			claims, err := p.verify(ctx, tc.token(), issuer, tc.nonce)
+			if tc.failed {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, "oidc@test.com", claims.Email)
+			assert.True(t, bool(claims.EmailVerified))
+		})
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	m := newMockProvider(t)
+	conf := m.config("mock")
+	conf.Issuer = m.URL + "/"
+	p := &provider{client: m.Client(), conf: conf}
+
+	_, _, err := p.oauth2Config(context.Background())
+	assert.Error(t, err)
+}
+
+func TestState(t *testing.T) {
+	login := httptest.NewRecorder()
+	require.NoError(t, SetState(login, "state"))
+	stored := login.Result().Cookies()[0]
+	assert.Equal(t, http.SameSiteLaxMode, stored.SameSite, "The cookie must be sent on the provider redirection")
+
+	cases := map[string]struct {
+		state  string
+		cookie *http.Cookie
+		err    error
+	}{
+		"Valid":     {state: "state", cookie: stored},
+		"Forged":    {state: "forged", cookie: stored, err: ErrInvalidState},
+		"No cookie": {state: "state", err: ErrInvalidState},
+		"Empty":     {cookie: stored, err: ErrInvalidState},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/login/mock/callback?state="+tc.state, nil)
+			if tc.cookie != nil {
+				r.AddCookie(tc.cookie)
+			}
+			assert.ErrorIs(t, CheckState(httptest.NewRecorder(), r, tc.state), tc.err)
+		})
+	}
+}
+
+func TestService(t *testing.T) {
+	logger.Disable()
+	ctx := context.Background()
+	m := newMockProvider(t)
+	db := test.StartPostgres(t)
+	rdb := test.StartRedis(t)
+
+	conf := config.OIDC{
+		BaseURL:   "http://localhost:4000",
+		Providers: []config.OIDCProvider{m.config("mock"), m.config("other")},
+	}
+	s := newService(db, rdb, conf, []string{"signup@test.com"}, m.Client())
+	assert.Equal(t, []string{"mock", "other"}, s.Providers())
+
+	client := m.Client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	// login follows the provider authorization and returns the callback parameters
+	login := func(t *testing.T, provider string) url.Values {
+		authURL, _, err := s.AuthCodeURL(ctx, provider, "")
+		require.NoError(t, err)
+
+		res, err := client.Get(authURL)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		require.Equal(t, http.StatusFound, res.StatusCode)
+
+		location, err := url.Parse(res.Header.Get("Location"))
+		require.NoError(t, err)
+		assert.Equal(t, "/login/"+provider+"/callback", location.Path)
+		return location.Query()
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		params := login(t, "mock")
+		claims, err := s.Exchange(ctx, "mock", params.Get("state"), params.Get("code"))
+		assert.NoError(t, err)
+		assert.Equal(t, Claims{
+			Provider:      "mock",
+			Subject:       "248289761001",
+			Email:         "oidc@test.com",
+			EmailVerified: true,
+			Name:          "Test",
+		}, claims)
+
+		// The state can't be reused
+		_, err = s.Exchange(ctx, "mock", params.Get("state"), params.Get("code"))
+		assert.ErrorIs(t, err, ErrInvalidState)
+	})
+
+	t.Run("Invalid state", func(t *testing.T) {
+		params := login(t, "mock")
+		_, err := s.Exchange(ctx, "mock", "forged", params.Get("code"))
+		assert.ErrorIs(t, err, ErrInvalidState)
+	})
+
+	t.Run("Provider mismatch", func(t *testing.T) {
+		params := login(t, "mock")
+		_, err := s.Exchange(ctx, "other", params.Get("state"), params.Get("code"))
+		assert.ErrorIs(t, err, ErrInvalidState)
+	})
+
+	t.Run("Unknown provider", func(t *testing.T) {
+		_, _, err := s.AuthCodeURL(ctx, "unknown", "")
+		assert.ErrorIs(t, err, ErrUnknownProvider)
+	})
+
+	t.Run("Invalid ID token", func(t *testing.T) {
+		m.mu.Lock()
+		m.claims = func(claims map[string]interface{}) { claims["nonce"] = "replayed" }
+		m.mu.Unlock()
+		defer func() {
+			m.mu.Lock()
+			m.claims = nil
+			m.mu.Unlock()
+		}()
+
+		params := login(t, "mock")
+		_, err := s.Exchange(ctx, "mock", params.Get("state"), params.Get("code"))
+		assert.ErrorIs(t, err, ErrInvalidIDToken)
+	})
+
+	t.Run("Link intent", func(t *testing.T) {
+		authURL, _, err := s.AuthCodeURL(ctx, "mock", "user-id")
+		require.NoError(t, err)
+		res, err := client.Get(authURL)
+		require.NoError(t, err)
+		res.Body.Close()
+		location, err := url.Parse(res.Header.Get("Location"))
+		require.NoError(t, err)
+
+		claims, err := s.Exchange(ctx, "mock", location.Query().Get("state"), location.Query().Get("code"))
+		assert.NoError(t, err)
+		assert.Equal(t, "user-id", claims.LinkUserID)
+	})
+
+	claims := Claims{Provider: "mock", Subject: "1", Email: "signup@test.com", EmailVerified: true, Name: "Sign up"}
+	var userID string
+	t.Run("Sign up", func(t *testing.T) {
+		var err error
+		userID, err = s.SignIn(ctx, claims)
+		assert.NoError(t, err)
+
+		var user struct {
+			Username      string `db:"username"`
+			VerifiedEmail bool   `db:"verified_email"`
+			CartID        string `db:"cart_id"`
+		}
+		q := "SELECT username, verified_email, cart_id FROM users WHERE id=$1"
+		assert.NoError(t, db.GetContext(ctx, &user, q, userID))
+		assert.Equal(t, "Sign_up", user.Username)
+		assert.True(t, user.VerifiedEmail)
+
+		var cartExists bool
+		assert.NoError(t, db.GetContext(ctx, &cartExists, "SELECT EXISTS(SELECT 1 FROM carts WHERE id=$1)", user.CartID))
+		assert.True(t, cartExists)
+
+		var roles []string
+		assert.NoError(t, db.SelectContext(ctx, &roles, "SELECT role FROM user_roles WHERE user_id=$1 ORDER BY role", userID))
+		assert.Equal(t, []string{role.Admin, role.Customer}, roles)
+
+		// The next logins return the same user
+		id, err := s.SignIn(ctx, claims)
+		assert.NoError(t, err)
+		assert.Equal(t, userID, id)
+
+		unverified := claims
+		unverified.Subject = "2"
+		unverified.EmailVerified = false
+		_, err = s.SignIn(ctx, unverified)
+		assert.ErrorIs(t, err, ErrEmailNotVerified)
+	})
+
+	t.Run("Merge", func(t *testing.T) {
+		q := `INSERT INTO users (id, cart_id, username, email, password, verified_email)
+		VALUES ($1, $1, $1, $2, 'hash', $3)`
+		_, err := db.ExecContext(ctx, q, "verified", "verified@test.com", true)
+		assert.NoError(t, err)
+		_, err = db.ExecContext(ctx, q, "unverified", "unverified@test.com", false)
+		assert.NoError(t, err)
+
+		id, err := s.SignIn(ctx, Claims{Provider: "other", Subject: "3", Email: "verified@test.com", EmailVerified: true})
+		assert.NoError(t, err)
+		assert.Equal(t, "verified", id)
+
+		// Accounts whose email wasn't verified could have been registered by someone else
+		_, err = s.SignIn(ctx, Claims{Provider: "other", Subject: "4", Email: "unverified@test.com", EmailVerified: true})
+		assert.ErrorIs(t, err, ErrAccountExists)
+	})
+
+	t.Run("Link", func(t *testing.T) {
+		other := Claims{Provider: "other", Subject: "5"}
+		assert.NoError(t, s.Link(ctx, userID, other))
+		assert.NoError(t, s.Link(ctx, userID, other))
+		assert.ErrorIs(t, s.Link(ctx, "verified", other), ErrIdentityLinked)
+		assert.ErrorIs(t, s.Link(ctx, userID, Claims{Provider: "other", Subject: "6"}), ErrProviderLinked)
+
+		identities, err := s.Identities(ctx, userID)
+		assert.NoError(t, err)
+		assert.Len(t, identities, 2)
+	})
+
+	t.Run("Unlink", func(t *testing.T) {
+		assert.NoError(t, s.Unlink(ctx, userID, "other"))
+		assert.ErrorIs(t, s.Unlink(ctx, userID, "other"), ErrIdentityNotFound)
+		// The user signed up with the provider and has no password
+		assert.ErrorIs(t, s.Unlink(ctx, userID, "mock"), ErrLastLoginMethod)
+		// Users with a password can unlink all their identities
+		assert.NoError(t, s.Unlink(ctx, "verified", "other"))
+	})
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func randBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
@@ -0,0 +1,364 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GGP1/adak/internal/config"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// leeway is the clock skew tolerated when validating the tokens' times.
+	leeway = time.Minute
+	// keysRefreshInterval is the minimum time between key set fetches when a token is
+	// signed with an unknown key, to not let invalid tokens hammer the provider.
+	keysRefreshInterval = time.Minute
+)
+
+// metadata is the provider configuration published at /.well-known/openid-configuration.
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type idTokenHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type idTokenClaims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	AuthorizedBy  string   `json:"azp"`
+	Expiry        int64    `json:"exp"`
+	IssuedAt      int64    `json:"iat"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified boolean  `json:"email_verified"`
+	Name          string   `json:"name"`
+}
+
+// audience may be a single string or an array of them.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	var ss []string
+	if err := json.Unmarshal(b, &ss); err != nil {
+		return err
+	}
+	*a = ss
+	return nil
+}
+
+// boolean accepts booleans encoded as strings, some providers do it.
+type boolean bool
+
+func (b *boolean) UnmarshalJSON(data []byte) error {
+	switch strings.Trim(string(data), `"`) {
+	case "true":
+		*b = true
+	case "false", "null":
+		*b = false
+	default:
+		return errors.Errorf("invalid boolean %s", data)
+	}
+	return nil
+}
+
+// provider is an OpenID Connect provider, its configuration is discovered on the first use.
+type provider struct {
+	client      *http.Client
+	conf        config.OIDCProvider
+	redirectURL string
+
+	mu          sync.Mutex
+	meta        *metadata
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+}
+
+// oauth2Config returns the provider OAuth2 configuration, discovering it if necessary.
+func (p *provider) oauth2Config(ctx context.Context) (*oauth2.Config, string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.meta == nil {
+		meta, err := p.discover(ctx)
+		if err != nil {
+			return nil, "", err
+		}
+		p.meta = meta
+	}
+
+	scopes := append([]string{"openid"}, p.conf.Scopes...)
+	if len(p.conf.Scopes) == 0 {
+		scopes = append(scopes, "email", "profile")
+	}
+
+	conf := &oauth2.Config{
+		ClientID:     p.conf.ClientID,
+		ClientSecret: p.conf.ClientSecret,
+		RedirectURL:  p.redirectURL,
+		Scopes:       scopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  p.meta.AuthorizationEndpoint,
+			TokenURL: p.meta.TokenEndpoint,
+		},
+	}
+	return conf, p.meta.Issuer, nil
+}
+
+// discover fetches the provider configuration.
+func (p *provider) discover(ctx context.Context) (*metadata, error) {
+	url := strings.TrimSuffix(p.conf.Issuer, "/") + "/.well-known/openid-configuration"
+	var meta metadata
+	if err := p.getJSON(ctx, url, &meta); err != nil {
+		return nil, errors.Wrap(err, "discovering provider configuration")
+	}
+
+	// The issuer must be exactly the one configured, otherwise a compromised document
+	// could make us accept tokens from another issuer
+	if meta.Issuer != p.conf.Issuer {
+		return nil, errors.Errorf("issuer mismatch: expected %q, got %q", p.conf.Issuer, meta.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, errors.New("incomplete provider configuration")
+	}
+
+	return &meta, nil
+}
+
+// verify validates the ID token signature and claims and returns its claims.
+func (p *provider) verify(ctx context.Context, rawIDToken, issuer, nonce string) (idTokenClaims, error) {
+	parts := strings.Split(rawIDToken, ".")
+	if len(parts) != 3 {
+		return idTokenClaims{}, errors.New("malformed token")
+	}
+
+	var header idTokenHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return idTokenClaims{}, errors.Wrap(err, "decoding header")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return idTokenClaims{}, errors.Wrap(err, "decoding signature")
+	}
+
+	key, err := p.publicKey(ctx, header.Kid)
+	if err != nil {
+		return idTokenClaims{}, err
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := verifySignature(header.Alg, key, digest[:], signature); err != nil {
+		return idTokenClaims{}, err
+	}
+
+	var claims idTokenClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return idTokenClaims{}, errors.Wrap(err, "decoding claims")
+	}
+
+	now := time.Now()
+	switch {
+	case claims.Issuer != issuer:
+		return idTokenClaims{}, errors.New("invalid issuer")
+	case !contains(claims.Audience, p.conf.ClientID):
+		return idTokenClaims{}, errors.New("invalid audience")
+	case len(claims.Audience) > 1 && claims.AuthorizedBy != p.conf.ClientID:
+		return idTokenClaims{}, errors.New("invalid authorized party")
+	case claims.Expiry == 0 || now.After(time.Unix(claims.Expiry, 0).Add(leeway)):
+		return idTokenClaims{}, errors.New("token expired")
+	case time.Unix(claims.IssuedAt, 0).After(now.Add(leeway)):
+		return idTokenClaims{}, errors.New("token issued in the future")
+	case subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return idTokenClaims{}, errors.New("invalid nonce")
+	case claims.Subject == "":
+		return idTokenClaims{}, errors.New("missing subject")
+	}
+
+	return claims, nil
+}
+
+// publicKey returns the provider key with the id passed, the key set is fetched again
+// if it's unknown as providers rotate their keys.
+func (p *provider) publicKey(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	if time.Since(p.keysFetched) < keysRefreshInterval {
+		return nil, errors.Errorf("unknown key %q", kid)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := p.getJSON(ctx, p.meta.JWKSURI, &set); err != nil {
+		return nil, errors.Wrap(err, "fetching key set")
+	}
+	p.keysFetched = time.Now()
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := parseKey(k)
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	p.keys = keys
+
+	key, ok := p.keys[kid]
+	if !ok {
+		return nil, errors.Errorf("unknown key %q", kid)
+	}
+	return key, nil
+}
+
+func (p *provider) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return errors.Errorf("unexpected status: %s", res.Status)
+	}
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func parseKey(k jwk) (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, errors.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("invalid point")
+		}
+		return key, nil
+
+	default:
+		return nil, errors.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// verifySignature checks the signature of the token digest, the algorithm must match the key
+// type so an attacker can't choose a weaker one.
+func verifySignature(alg string, key crypto.PublicKey, digest, signature []byte) error {
+	switch alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("key type doesn't match the algorithm")
+		}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, signature); err != nil {
+			return errors.New("invalid signature")
+		}
+		return nil
+
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("key type doesn't match the algorithm")
+		}
+		if len(signature) != 64 {
+			return errors.New("invalid signature")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+
+	default:
+		return errors.Errorf("unsupported algorithm %q", alg)
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,217 @@
+// Package oidc implements the login with OpenID Connect providers using the authorization
+// code flow with PKCE, and the identities linking users to their providers' accounts.
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/GGP1/adak/internal/config"
+	"github.com/GGP1/adak/internal/token"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// stateExpiration is the time users have to complete the login on the provider.
+	stateExpiration = 10 * time.Minute
+	// statePrefix is the prefix of the redis keys storing the login attempts.
+	statePrefix = "oidc:"
+)
+
+var (
+	// ErrInvalidIDToken is returned when the ID token is missing or fails the verification.
+	ErrInvalidIDToken = errors.New("invalid ID token")
+	// ErrInvalidState is returned when the state is unknown, expired or was already used.
+	ErrInvalidState = errors.New("invalid or expired OAuth state")
+	// ErrUnknownProvider is returned when the provider isn't configured.
+	ErrUnknownProvider = errors.New("unknown provider")
+)
+
+// Service provides OpenID Connect operations.
+type Service interface {
+	AuthCodeURL(ctx context.Context, provider, linkUserID string) (string, string, error)
+	Exchange(ctx context.Context, provider, state, code string) (Claims, error)
+	Identities(ctx context.Context, userID string) ([]Identity, error)
+	Link(ctx context.Context, userID string, claims Claims) error
+	Providers() []string
+	SignIn(ctx context.Context, claims Claims) (string, error)
+	Unlink(ctx context.Context, userID, provider string) error
+}
+
+// Claims contains the information about the user sent by the provider.
+type Claims struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	// LinkUserID is the user that started the login to link the identity to their account
+	LinkUserID string
+}
+
+// attempt is a login in progress.
+type attempt struct {
+	Provider string `json:"provider"`
+	Verifier string `json:"verifier"`
+	Nonce    string `json:"nonce"`
+	UserID   string `json:"user_id,omitempty"`
+}
+
+type service struct {
+	// admins are the emails of the users that sign up as administrators
+	admins    []string
+	db        *sqlx.DB
+	metrics   metrics
+	providers map[string]*provider
+	rdb       *redis.Client
+}
+
+// NewService returns a new OpenID Connect service, the users signing up with an email
+// in the admins list are granted the admin role.
+func NewService(db *sqlx.DB, rdb *redis.Client, config config.OIDC, admins []string) Service {
+	return newService(db, rdb, config, admins, &http.Client{Timeout: 10 * time.Second})
+}
+
+func newService(db *sqlx.DB, rdb *redis.Client, config config.OIDC, admins []string, client *http.Client) *service {
+	baseURL := strings.TrimSuffix(config.BaseURL, "/")
+	providers := make(map[string]*provider, len(config.Providers))
+	for _, p := range config.Providers {
+		if p.ClientSecret == "" {
+			p.ClientSecret = os.Getenv("OIDC_" + strings.ToUpper(p.Name) + "_CLIENT_SECRET")
+		}
+		providers[p.Name] = &provider{
+			client:      client,
+			conf:        p,
+			redirectURL: baseURL + "/login/" + p.Name + "/callback",
+		}
+	}
+
+	return &service{
+		admins:    admins,
+		db:        db,
+		metrics:   initMetrics(),
+		providers: providers,
+		rdb:       rdb,
+	}
+}
+
+// AuthCodeURL starts a login and returns the provider URL the user must be redirected to
+// and the state, which must be bound to the user's browser with SetState.
+// If linkUserID isn't empty, the identity will be linked to that user instead.
+func (s *service) AuthCodeURL(ctx context.Context, name, linkUserID string) (string, string, error) {
+	s.metrics.incMethodCalls("AuthCodeURL")
+
+	p, ok := s.providers[name]
+	if !ok {
+		return "", "", ErrUnknownProvider
+	}
+
+	conf, _, err := p.oauth2Config(ctx)
+	if err != nil {
+		return "", "", err
+	}
+
+	state := token.RandString(32)
+	a := attempt{
+		Provider: name,
+		Verifier: oauth2.GenerateVerifier(),
+		Nonce:    token.RandString(32),
+		UserID:   linkUserID,
+	}
+	value, err := json.Marshal(a)
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := s.rdb.Set(ctx, statePrefix+token.Hash(state), value, stateExpiration).Err(); err != nil {
+		return "", "", errors.Wrap(err, "storing state")
+	}
+
+	url := conf.AuthCodeURL(state,
+		oauth2.S256ChallengeOption(a.Verifier),
+		oauth2.SetAuthURLParam("nonce", a.Nonce),
+	)
+	return url, state, nil
+}
+
+// Exchange completes the login, it trades the code for the tokens and returns the
+// claims of the verified ID token.
+func (s *service) Exchange(ctx context.Context, name, state, code string) (Claims, error) {
+	s.metrics.incMethodCalls("Exchange")
+
+	p, ok := s.providers[name]
+	if !ok {
+		return Claims{}, ErrUnknownProvider
+	}
+
+	// States are single-use
+	value, err := s.rdb.GetDel(ctx, statePrefix+token.Hash(state)).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			s.metrics.logins.WithLabelValues(name, "invalid_state").Inc()
+			return Claims{}, ErrInvalidState
+		}
+		return Claims{}, errors.Wrap(err, "fetching state")
+	}
+
+	var a attempt
+	if err := json.Unmarshal(value, &a); err != nil {
+		return Claims{}, errors.Wrap(err, "decoding state")
+	}
+	if a.Provider != name {
+		s.metrics.logins.WithLabelValues(name, "invalid_state").Inc()
+		return Claims{}, ErrInvalidState
+	}
+
+	conf, issuer, err := p.oauth2Config(ctx)
+	if err != nil {
+		return Claims{}, err
+	}
+
+	tok, err := conf.Exchange(context.WithValue(ctx, oauth2.HTTPClient, p.client), code, oauth2.VerifierOption(a.Verifier))
+	if err != nil {
+		s.metrics.logins.WithLabelValues(name, "exchange_failed").Inc()
+		return Claims{}, errors.Wrap(err, "code exchange failed")
+	}
+
+	rawIDToken, _ := tok.Extra("id_token").(string)
+	if rawIDToken == "" {
+		s.metrics.logins.WithLabelValues(name, "invalid_id_token").Inc()
+		return Claims{}, errors.Wrap(ErrInvalidIDToken, "missing from the token response")
+	}
+
+	claims, err := p.verify(ctx, rawIDToken, issuer, a.Nonce)
+	if err != nil {
+		s.metrics.logins.WithLabelValues(name, "invalid_id_token").Inc()
+		return Claims{}, errors.Wrap(ErrInvalidIDToken, err.Error())
+	}
+
+	s.metrics.logins.WithLabelValues(name, "success").Inc()
+	return Claims{
+		Provider:      name,
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: bool(claims.EmailVerified),
+		Name:          claims.Name,
+		LinkUserID:    a.UserID,
+	}, nil
+}
+
+// Providers returns the names of the providers configured.
+func (s *service) Providers() []string {
+	names := make([]string, 0, len(s.providers))
+	for name := range s.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
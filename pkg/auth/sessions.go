@@ -0,0 +1,357 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GGP1/adak/internal/cookie"
+	"github.com/GGP1/adak/internal/logger"
+	"github.com/GGP1/adak/internal/token"
+	"github.com/GGP1/adak/pkg/tracking"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+// Sessions are stored in redis as hashes under the key "userID:id" (the SID cookie value),
+// they are also indexed in sorted sets scored by their expiration (0 if they don't expire):
+// one per user, to list and revoke them, and a global one, to count them.
+//
+// The hashes expire after the idle timeout or at the absolute one, whatever comes first,
+// and their expiration is extended every time they are used.
+const (
+	// activeSessionsKey is the sorted set containing all the session keys.
+	activeSessionsKey = "sessions"
+	// userSessionsPrefix is the prefix of the sorted sets containing the ids of each user's sessions.
+	userSessionsPrefix = "user_sessions:"
+	// lastSeenInterval is the minimum time between updates of the sessions' last activity.
+	lastSeenInterval = time.Minute
+	// cartIDField is the session field containing the user's cart id.
+	cartIDField = "cart_id"
+)
+
+// ErrSessionNotFound is returned when the session doesn't exist or belongs to another user.
+var ErrSessionNotFound = errors.New("session not found")
+
+// updateScript sets the fields of a session only if it still exists, so a concurrent
+// logout isn't undone. ARGV[1] is the new expiration in milliseconds (0 keeps the current
+// one) followed by the field/value pairs.
+var updateScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+redis.call("HSET", KEYS[1], unpack(ARGV, 2))
+if tonumber(ARGV[1]) > 0 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return 1
+`)
+
+// Record contains the information about a user's session.
+type Record struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Current   bool      `json:"current"`
+}
+
+// List returns the sessions of the logged in user, the most recently used first.
+func (s *session) List(ctx context.Context, r *http.Request) ([]Record, error) {
+	sID, err := cookie.GetValue(r, "SID")
+	if err != nil {
+		return nil, err
+	}
+	userID, currentID := splitSessionID(sID)
+
+	ids, err := s.userSessions(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	cmds := make([]*redis.StringStringMapCmd, len(ids))
+	_, err = s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, id := range ids {
+			cmds[i] = pipe.HGetAll(ctx, userID+":"+id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching sessions")
+	}
+
+	records := make([]Record, 0, len(ids))
+	var stale []interface{}
+	for i, cmd := range cmds {
+		fields := cmd.Val()
+		// The session expired but the index wasn't cleaned up yet
+		if len(fields) == 0 {
+			stale = append(stale, ids[i])
+			continue
+		}
+
+		records = append(records, Record{
+			ID:        ids[i],
+			CreatedAt: unixField(fields["created_at"]),
+			LastSeen:  unixField(fields["last_seen"]),
+			IP:        fields["ip"],
+			UserAgent: fields["user_agent"],
+			Current:   ids[i] == currentID,
+		})
+	}
+
+	if len(stale) > 0 {
+		s.rdb.ZRem(ctx, userSessionsPrefix+userID, stale...)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].LastSeen.After(records[j].LastSeen)
+	})
+	return records, nil
+}
+
+// LogoutAll removes all the sessions of the user, they will have to log in again on every device.
+func (s *session) LogoutAll(ctx context.Context, userID string) error {
+	ids, err := s.userSessions(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	return s.deleteSessions(ctx, userID, ids...)
+}
+
+// LogoutOthers removes all the sessions of the logged in user except the current one.
+func (s *session) LogoutOthers(ctx context.Context, r *http.Request) error {
+	sID, err := cookie.GetValue(r, "SID")
+	if err != nil {
+		return err
+	}
+	userID, currentID := splitSessionID(sID)
+
+	ids, err := s.userSessions(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	others := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if id != currentID {
+			others = append(others, id)
+		}
+	}
+
+	return s.deleteSessions(ctx, userID, others...)
+}
+
+// Revoke removes one of the user's sessions.
+func (s *session) Revoke(ctx context.Context, userID, sessionID string) error {
+	if err := s.rdb.ZScore(ctx, userSessionsPrefix+userID, sessionID).Err(); err != nil {
+		if errors.Is(err, redis.Nil) {
+			return ErrSessionNotFound
+		}
+		return errors.Wrap(err, "fetching session")
+	}
+
+	return s.deleteSessions(ctx, userID, sessionID)
+}
+
+// saveRecord stores the session information and indexes it.
+func (s *session) saveRecord(ctx context.Context, r *http.Request, userID, cartID, id string) error {
+	now := time.Now()
+	sID := userID + ":" + id
+	var expiresAt time.Time
+	if s.conf.Absolute > 0 {
+		expiresAt = now.Add(s.conf.Absolute)
+	}
+	ttl := s.ttl(now, expiresAt)
+
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, sID,
+			"created_at", now.Unix(),
+			"last_seen", now.Unix(),
+			"auth_at", now.Unix(),
+			"expires_at", unix(expiresAt),
+			"ip", tracking.GetUserIP(r),
+			"user_agent", r.UserAgent(),
+			cartIDField, cartID,
+			csrfField, token.RandString(32),
+		)
+		if ttl > 0 {
+			pipe.Expire(ctx, sID, ttl)
+		}
+		pipe.ZAdd(ctx, userSessionsPrefix+userID, &redis.Z{Score: score(now, ttl), Member: id})
+		pipe.ZAdd(ctx, activeSessionsKey, &redis.Z{Score: score(now, ttl), Member: sID})
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "saving session")
+	}
+
+	return nil
+}
+
+// renew records the session activity and extends its expiration.
+func (s *session) renew(ctx context.Context, r *http.Request, sID string, expiresAt time.Time) error {
+	now := time.Now()
+	ttl := s.ttl(now, expiresAt)
+	err := s.updateRecord(ctx, sID, ttl,
+		"last_seen", now.Unix(),
+		"ip", tracking.GetUserIP(r),
+		"user_agent", r.UserAgent(),
+	)
+	if err != nil || ttl == 0 {
+		return err
+	}
+
+	userID, id := splitSessionID(sID)
+	_, err = s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAddXX(ctx, userSessionsPrefix+userID, &redis.Z{Score: score(now, ttl), Member: id})
+		pipe.ZAddXX(ctx, activeSessionsKey, &redis.Z{Score: score(now, ttl), Member: sID})
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "updating sessions expiration")
+	}
+
+	return nil
+}
+
+// storeCartID fetches the user's cart id and saves it in the session, it returns an empty
+// string if it fails.
+func (s *session) storeCartID(ctx context.Context, sID, userID string) string {
+	var cartID string
+	if err := s.db.GetContext(ctx, &cartID, "SELECT cart_id FROM users WHERE id=$1", userID); err != nil {
+		logger.Debugf("couldn't fetch the session cart: %v", err)
+		return ""
+	}
+
+	if err := s.updateRecord(ctx, sID, 0, cartIDField, cartID); err != nil {
+		logger.Debugf("couldn't save the session cart: %v", err)
+	}
+	return cartID
+}
+
+// renewInterval returns the minimum time between renewals of a session.
+func (s *session) renewInterval() time.Duration {
+	if s.conf.Idle > 0 && s.conf.Idle/2 < lastSeenInterval {
+		return s.conf.Idle / 2
+	}
+	return lastSeenInterval
+}
+
+// ttl returns the time left until the session expires from now, 0 if it doesn't.
+func (s *session) ttl(now, expiresAt time.Time) time.Duration {
+	var ttl time.Duration
+	if !expiresAt.IsZero() {
+		ttl = expiresAt.Sub(now)
+	}
+	if s.conf.Idle > 0 && (ttl == 0 || s.conf.Idle < ttl) {
+		ttl = s.conf.Idle
+	}
+	return ttl
+}
+
+// updateRecord sets the session fields if it exists, a ttl greater than 0 replaces its expiration.
+func (s *session) updateRecord(ctx context.Context, sID string, ttl time.Duration, fields ...interface{}) error {
+	args := append([]interface{}{ttl.Milliseconds()}, fields...)
+	updated, err := updateScript.Run(ctx, s.rdb, []string{sID}, args...).Int()
+	if err != nil {
+		return errors.Wrap(err, "updating session")
+	}
+	if updated == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// userSessions returns the ids of the user's sessions that haven't expired.
+func (s *session) userSessions(ctx context.Context, userID string) ([]string, error) {
+	key := userSessionsPrefix + userID
+	if err := s.rdb.ZRemRangeByScore(ctx, key, "(0", strconv.FormatInt(time.Now().Unix(), 10)).Err(); err != nil {
+		return nil, errors.Wrap(err, "removing expired sessions")
+	}
+
+	ids, err := s.rdb.ZRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching sessions")
+	}
+
+	return ids, nil
+}
+
+// deleteSessions removes the user's sessions and their indexes.
+func (s *session) deleteSessions(ctx context.Context, userID string, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	keys := make([]string, len(ids))
+	members := make([]interface{}, len(ids))
+	sIDs := make([]interface{}, len(ids))
+	for i, id := range ids {
+		keys[i] = userID + ":" + id
+		members[i] = id
+		sIDs[i] = keys[i]
+	}
+
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, keys...)
+		pipe.ZRem(ctx, userSessionsPrefix+userID, members...)
+		pipe.ZRem(ctx, activeSessionsKey, sIDs...)
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "deleting sessions")
+	}
+
+	return nil
+}
+
+// countSessions returns the number of active sessions across all the instances.
+func countSessions(ctx context.Context, rdb *redis.Client) (int64, error) {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	if err := rdb.ZRemRangeByScore(ctx, activeSessionsKey, "(0", now).Err(); err != nil {
+		return 0, err
+	}
+
+	return rdb.ZCard(ctx, activeSessionsKey).Result()
+}
+
+// splitSessionID returns the user id and the session id from the SID cookie value.
+func splitSessionID(sID string) (string, string) {
+	i := strings.LastIndexByte(sID, ':')
+	if i == -1 {
+		return sID, ""
+	}
+	return sID[:i], sID[i+1:]
+}
+
+// score returns the expiration of the session in the sorted sets, 0 if it doesn't expire.
+func score(now time.Time, ttl time.Duration) float64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return float64(now.Add(ttl).Unix())
+}
+
+// unix returns the unix time of t or 0 if it's zero.
+func unix(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// unixField parses a unix time stored in a session, 0 and invalid values result in the zero time.
+func unixField(value string) time.Time {
+	sec, _ := strconv.ParseInt(value, 10, 64)
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
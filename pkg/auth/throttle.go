@@ -0,0 +1,359 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GGP1/adak/internal/logger"
+	"github.com/GGP1/adak/internal/token"
+	"github.com/GGP1/adak/pkg/auth/twofactor"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+// Failed logins are counted in redis per IP address and per account (the hash of the email,
+// so it works for emails that aren't registered), the counters are forgotten after the
+// throttle window. Once a counter exceeds the attempts allowed, the next ones must wait a
+// delay that doubles with every failure, stored in the "<counter>:wait" keys.
+//
+// A global counter of failures per minute detects credential stuffing, attacks trying many
+// accounts from many addresses that stay below the limits of each counter.
+//
+// Second factor codes are counted per account in the "login:2fa:" keys before verifying
+// them, so concurrent guesses can't exceed the limits. Invalid codes delay the following
+// ones and lock the account like failed logins, but only a valid code resets them: whoever
+// is guessing already knows the password.
+const (
+	ipPrefix        = "login:ip:"
+	accountPrefix   = "login:account:"
+	failuresPrefix  = "login:failures:"
+	twoFactorPrefix = "login:2fa:"
+	unlockPrefix    = "login:unlock:"
+	// defaultMaxDelay is used when the maximum delay isn't configured.
+	defaultMaxDelay = 15 * time.Minute
+	// defaultWindow is used when the throttle window or the lockout duration aren't configured.
+	defaultWindow = time.Hour
+)
+
+var (
+	// ErrAccountLocked is returned when logging in to an account locked after too many failed attempts.
+	ErrAccountLocked = errors.New("the account is locked due to too many failed login attempts, use the link sent to your email or try again later")
+	// ErrInvalidUnlockToken is returned when the unlock token doesn't exist or expired.
+	ErrInvalidUnlockToken = errors.New("invalid or expired unlock token")
+
+	errInvalidCredentials = errors.New("invalid email or password")
+)
+
+// failScript increments the counters in KEYS, those created are set to expire after the
+// milliseconds in the ARGV element with the same index. It returns the counters values.
+var failScript = redis.NewScript(`
+local counts = {}
+for i, key in ipairs(KEYS) do
+	local n = redis.call("INCR", key)
+	if n == 1 then
+		redis.call("PEXPIRE", key, ARGV[i])
+	end
+	counts[i] = n
+end
+return counts
+`)
+
+// Emailer sends the notifications about the users' accounts.
+type Emailer interface {
+	SendAccountLocked(username, email, token string) error
+}
+
+// ThrottledError is returned when there were too many failed attempts recently.
+type ThrottledError struct {
+	Wait time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	wait := e.Wait.Round(time.Second)
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return fmt.Sprintf("too many failed attempts, please wait %v before trying again", wait)
+}
+
+// Unlock removes the lock and the failed attempts of the account the token was sent to.
+func (s *session) Unlock(ctx context.Context, unlockToken string) error {
+	account, err := s.rdb.GetDel(ctx, unlockPrefix+token.Hash(unlockToken)).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return ErrInvalidUnlockToken
+		}
+		return errors.Wrap(err, "fetching unlock token")
+	}
+
+	key, codesKey := accountPrefix+account, twoFactorPrefix+account
+	if err := s.rdb.Del(ctx, key, key+":wait", key+":locked", codesKey, codesKey+":wait").Err(); err != nil {
+		return errors.Wrap(err, "unlocking account")
+	}
+
+	return nil
+}
+
+// checkThrottle returns an error if the IP address or the account must wait before trying
+// again or if the account is locked.
+func (s *session) checkThrottle(ctx context.Context, ip, email string) error {
+	if !s.throttling() {
+		return nil
+	}
+
+	ipKey, accountKey := ipPrefix+ip, accountPrefix+accountID(email)
+	var locked *redis.IntCmd
+	waits := make([]*redis.DurationCmd, 2)
+	_, err := s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		locked = pipe.Exists(ctx, accountKey+":locked")
+		waits[0] = pipe.PTTL(ctx, ipKey+":wait")
+		waits[1] = pipe.PTTL(ctx, accountKey+":wait")
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "checking failed attempts")
+	}
+
+	if locked.Val() > 0 {
+		s.metrics.failedLogins.WithLabelValues("locked").Inc()
+		return ErrAccountLocked
+	}
+
+	var wait time.Duration
+	for i, scope := range []string{"ip", "account"} {
+		if d := waits[i].Val(); d > 0 {
+			s.metrics.throttledLogins.WithLabelValues(scope).Inc()
+			if d > wait {
+				wait = d
+			}
+		}
+	}
+	if wait > 0 {
+		s.metrics.failedLogins.WithLabelValues("throttled").Inc()
+		return &ThrottledError{Wait: wait}
+	}
+
+	return nil
+}
+
+// loginFailed records a failed attempt, delays the following ones if the limits were
+// exceeded and locks the account after too many. user is nil if the email isn't registered.
+func (s *session) loginFailed(ctx context.Context, ip, email string, user *User) error {
+	reason := "invalid_password"
+	if user == nil {
+		reason = "unknown_email"
+	}
+	s.metrics.failedLogins.WithLabelValues(reason).Inc()
+
+	if !s.throttling() {
+		return nil
+	}
+
+	window := s.window()
+	now := time.Now()
+	account := accountID(email)
+	ipKey, accountKey := ipPrefix+ip, accountPrefix+account
+	failuresKey := failuresPrefix + strconv.FormatInt(now.Unix()/60, 10)
+
+	keys := []string{ipKey, accountKey, failuresKey}
+	ttls := []interface{}{window.Milliseconds(), window.Milliseconds(), (2 * time.Minute).Milliseconds()}
+	counts, err := failScript.Run(ctx, s.rdb, keys, ttls...).Int64Slice()
+	if err != nil {
+		return errors.Wrap(err, "counting failed attempts")
+	}
+
+	// While under attack every failure is delayed
+	attempts := s.conf.Throttle.Attempts
+	stuffing := s.conf.Throttle.Stuffing > 0 && counts[2] >= s.conf.Throttle.Stuffing
+	if stuffing {
+		attempts = 0
+		s.metrics.credentialStuffing.Set(1)
+	} else {
+		s.metrics.credentialStuffing.Set(0)
+	}
+
+	_, err = s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		if d := s.backoff(counts[0] - attempts); d > 0 {
+			pipe.Set(ctx, ipKey+":wait", 1, d)
+		}
+		if d := s.backoff(counts[1] - attempts); d > 0 {
+			pipe.Set(ctx, accountKey+":wait", 1, d)
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "delaying attempts")
+	}
+
+	lockout := s.conf.Throttle.Lockout
+	if user == nil || lockout <= 0 || counts[1] < lockout {
+		return nil
+	}
+
+	return s.lock(ctx, account, user)
+}
+
+// loginSucceeded forgets the failed attempts on the account. The ones from the IP address
+// are kept, otherwise attackers could reset them logging in to their own accounts.
+func (s *session) loginSucceeded(ctx context.Context, email string) error {
+	if !s.throttling() {
+		return nil
+	}
+
+	key := accountPrefix + accountID(email)
+	if err := s.rdb.Del(ctx, key, key+":wait").Err(); err != nil {
+		return errors.Wrap(err, "resetting failed attempts")
+	}
+	return nil
+}
+
+// verifyTwoFactor runs verify, which checks a second factor code of the user, counting the
+// attempt beforehand. Invalid codes delay the following ones and lock the account.
+func (s *session) verifyTwoFactor(ctx context.Context, ip string, user User, verify func() error) error {
+	if !s.throttling() {
+		return verify()
+	}
+
+	if err := s.checkThrottle(ctx, ip, user.Email); err != nil {
+		return err
+	}
+
+	account := accountID(user.Email)
+	key := twoFactorPrefix + account
+	wait, err := s.rdb.PTTL(ctx, key+":wait").Result()
+	if err != nil {
+		return errors.Wrap(err, "checking invalid codes")
+	}
+	if wait > 0 {
+		s.metrics.throttledLogins.WithLabelValues("2fa").Inc()
+		s.metrics.failedLogins.WithLabelValues("throttled").Inc()
+		return &ThrottledError{Wait: wait}
+	}
+
+	counts, err := failScript.Run(ctx, s.rdb, []string{key}, s.window().Milliseconds()).Int64Slice()
+	if err != nil {
+		return errors.Wrap(err, "counting code attempts")
+	}
+	attempt, lockout := counts[0], s.conf.Throttle.Lockout
+	// Concurrent guesses beyond the limit aren't verified
+	if lockout > 0 && attempt > lockout {
+		if err := s.lock(ctx, account, &user); err != nil {
+			return err
+		}
+		return ErrAccountLocked
+	}
+
+	err = verify()
+	if err == nil {
+		if err := s.rdb.Del(ctx, key, key+":wait").Err(); err != nil {
+			return errors.Wrap(err, "resetting code attempts")
+		}
+		return nil
+	}
+	if !errors.Is(err, twofactor.ErrInvalidCode) {
+		// The code wasn't checked
+		if err := s.rdb.Decr(ctx, key).Err(); err != nil {
+			logger.Errorf("couldn't discount the code attempt: %v", err)
+		}
+		return err
+	}
+
+	s.metrics.failedLogins.WithLabelValues("invalid_code").Inc()
+	if d := s.backoff(attempt - s.conf.Throttle.Attempts); d > 0 {
+		if err := s.rdb.Set(ctx, key+":wait", 1, d).Err(); err != nil {
+			return errors.Wrap(err, "delaying attempts")
+		}
+	}
+	if lockout > 0 && attempt >= lockout {
+		if err := s.lock(ctx, account, &user); err != nil {
+			return err
+		}
+	}
+
+	return err
+}
+
+// lock locks the account and emails its owner the link to unlock it.
+func (s *session) lock(ctx context.Context, account string, user *User) error {
+	duration := s.conf.Throttle.LockoutDuration
+	if duration <= 0 {
+		duration = defaultWindow
+	}
+
+	key := accountPrefix + account
+	locked, err := s.rdb.SetNX(ctx, key+":locked", 1, duration).Result()
+	if err != nil {
+		return errors.Wrap(err, "locking account")
+	}
+	// Already locked by a concurrent attempt
+	if !locked {
+		return nil
+	}
+	s.metrics.lockouts.Inc()
+
+	unlockToken := token.RandString(32)
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, unlockPrefix+token.Hash(unlockToken), account, duration)
+		// The lock replaces the failed attempts
+		pipe.Del(ctx, key, twoFactorPrefix+account, twoFactorPrefix+account+":wait")
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "saving unlock token")
+	}
+
+	if s.emailer != nil {
+		username, email := user.Username, user.Email
+		go func() {
+			if err := s.emailer.SendAccountLocked(username, email, unlockToken); err != nil {
+				logger.Errorf("couldn't send the account locked email: %v", err)
+			}
+		}()
+	}
+	return nil
+}
+
+// accountID returns the identifier of the account in the counters keys. Accounts are looked up
+// by email case-insensitively, so the different spellings of an email must share the counters.
+func accountID(email string) string {
+	return token.Hash(strings.ToLower(strings.TrimSpace(email)))
+}
+
+// backoff returns the delay after exceeding the attempts allowed by the number provided.
+func (s *session) backoff(exceeded int64) time.Duration {
+	if exceeded <= 0 || s.conf.Throttle.Delay <= 0 {
+		return 0
+	}
+
+	maxDelay := s.conf.Throttle.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = defaultMaxDelay
+	}
+
+	d := s.conf.Throttle.Delay
+	for i := int64(1); i < exceeded && d < maxDelay; i++ {
+		d *= 2
+	}
+	if d > maxDelay {
+		d = maxDelay
+	}
+	return d
+}
+
+// window returns the time after which failed attempts are forgotten.
+func (s *session) window() time.Duration {
+	if s.conf.Throttle.Window <= 0 {
+		return defaultWindow
+	}
+	return s.conf.Throttle.Window
+}
+
+// throttling returns whether failed attempts must be counted.
+func (s *session) throttling() bool {
+	t := s.conf.Throttle
+	return t.Delay > 0 || t.Lockout > 0 || t.Stuffing > 0
+}
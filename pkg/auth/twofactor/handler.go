@@ -0,0 +1,228 @@
+package twofactor
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/GGP1/adak/internal/identity"
+	"github.com/GGP1/adak/internal/response"
+	"github.com/GGP1/adak/internal/validate"
+	"github.com/GGP1/adak/pkg/role"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+	"github.com/skip2/go-qrcode"
+)
+
+// Handler handles two-factor authentication endpoints.
+type Handler struct {
+	service Service
+}
+
+// Code is a code from the authenticator application, or a recovery code where accepted.
+type Code struct {
+	Code string `json:"code" validate:"required"`
+}
+
+// RecoveryCodes is the response to enabling two-factor authentication.
+type RecoveryCodes struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// Limiter limits the attempts to verify the codes of each user.
+type Limiter interface {
+	LimitTwoFactor(ctx context.Context, r *http.Request, userID string, verify func() error) error
+}
+
+// NewHandler returns a new two-factor authentication handler.
+func NewHandler(service Service) Handler {
+	return Handler{service: service}
+}
+
+// Disable turns off two-factor authentication for the logged in user, the codes sent count
+// towards the limits of the login ones.
+func (h *Handler) Disable(limiter Limiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		userID, err := identity.UserID(r)
+		if err != nil {
+			response.Error(w, http.StatusForbidden, err)
+			return
+		}
+
+		code, ok := decodeCode(w, r)
+		if !ok {
+			return
+		}
+
+		disable := func() error { return h.service.Disable(ctx, userID, code.Code) }
+		if err := limiter.LimitTwoFactor(ctx, r, userID, disable); err != nil {
+			switch {
+			case errors.Is(err, ErrTooManyAttempts):
+				response.Error(w, http.StatusTooManyRequests, err)
+			case errors.Is(err, ErrRequired), errors.Is(err, ErrInvalidCode):
+				response.Error(w, http.StatusForbidden, err)
+			case errors.Is(err, ErrNotEnabled):
+				response.Error(w, http.StatusBadRequest, err)
+			default:
+				response.Error(w, http.StatusInternalServerError, err)
+			}
+			return
+		}
+
+		response.JSONText(w, http.StatusOK, "two-factor authentication disabled")
+	}
+}
+
+// Enable confirms the enrollment with a code from the authenticator application and
+// returns the recovery codes.
+func (h *Handler) Enable() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		userID, err := identity.UserID(r)
+		if err != nil {
+			response.Error(w, http.StatusForbidden, err)
+			return
+		}
+
+		code, ok := decodeCode(w, r)
+		if !ok {
+			return
+		}
+
+		codes, err := h.service.Enable(ctx, userID, code.Code)
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrInvalidCode):
+				response.Error(w, http.StatusForbidden, err)
+			case errors.Is(err, ErrNotEnrolling), errors.Is(err, ErrAlreadyEnabled):
+				response.Error(w, http.StatusBadRequest, err)
+			default:
+				response.Error(w, http.StatusInternalServerError, err)
+			}
+			return
+		}
+
+		response.JSON(w, http.StatusOK, RecoveryCodes{RecoveryCodes: codes})
+	}
+}
+
+// Enroll generates the secret the logged in user must add to their authenticator application.
+func (h *Handler) Enroll() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		userID, err := identity.UserID(r)
+		if err != nil {
+			response.Error(w, http.StatusForbidden, err)
+			return
+		}
+
+		enrollment, err := h.service.Enroll(ctx, userID)
+		if err != nil {
+			if errors.Is(err, ErrAlreadyEnabled) {
+				response.Error(w, http.StatusBadRequest, err)
+				return
+			}
+			response.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		response.JSON(w, http.StatusCreated, enrollment)
+	}
+}
+
+// QRCode returns a PNG image with the provisioning URI of the enrollment in progress.
+func (h *Handler) QRCode() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		userID, err := identity.UserID(r)
+		if err != nil {
+			response.Error(w, http.StatusForbidden, err)
+			return
+		}
+
+		enrollment, err := h.service.Pending(ctx, userID)
+		if err != nil {
+			if errors.Is(err, ErrNotEnrolling) || errors.Is(err, ErrAlreadyEnabled) {
+				response.Error(w, http.StatusNotFound, err)
+				return
+			}
+			response.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		png, err := qrcode.Encode(enrollment.URI, qrcode.Medium, 256)
+		if err != nil {
+			response.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		w.Write(png)
+	}
+}
+
+// RequiredRoles lists the roles that require two-factor authentication.
+func (h *Handler) RequiredRoles() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		roles, err := h.service.RequiredRoles(r.Context())
+		if err != nil {
+			response.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		response.JSON(w, http.StatusOK, roles)
+	}
+}
+
+// SetRequired sets whether the role requires two-factor authentication.
+func (h *Handler) SetRequired(required bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		roleName := chi.URLParam(r, "role")
+
+		userID, err := identity.UserID(r)
+		if err != nil {
+			response.Error(w, http.StatusForbidden, err)
+			return
+		}
+
+		if err := h.service.SetRequired(ctx, roleName, required, userID); err != nil {
+			if errors.Is(err, role.ErrUnknownRole) {
+				response.Error(w, http.StatusNotFound, err)
+				return
+			}
+			response.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		if required {
+			response.JSONText(w, http.StatusOK, "two-factor authentication required for "+roleName)
+			return
+		}
+		response.JSONText(w, http.StatusOK, "two-factor authentication optional for "+roleName)
+	}
+}
+
+func decodeCode(w http.ResponseWriter, r *http.Request) (Code, bool) {
+	var code Code
+	if err := json.NewDecoder(r.Body).Decode(&code); err != nil {
+		response.Error(w, http.StatusBadRequest, err)
+		return Code{}, false
+	}
+	defer r.Body.Close()
+
+	if err := validate.Struct(r.Context(), code); err != nil {
+		response.Error(w, http.StatusBadRequest, err)
+		return Code{}, false
+	}
+
+	return code, true
+}
@@ -0,0 +1,40 @@
+package twofactor
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+type metrics struct {
+	changes       *prometheus.CounterVec
+	methodCalls   *prometheus.CounterVec
+	verifications *prometheus.CounterVec
+}
+
+func initMetrics() metrics {
+	const ns, sub = "adak", "two_factor"
+	return metrics{
+		changes: promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "changes_total",
+			Help:      "Total number of times two-factor authentication was enabled and disabled",
+		}, []string{"action"}),
+		methodCalls: promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "method_calls_total",
+			Help:      "Total number of calls per method",
+		}, []string{"method"}),
+		verifications: promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "verifications_total",
+			Help:      "Total number of codes verified per type and result",
+		}, []string{"type", "result"}),
+	}
+}
+
+func (m metrics) incMethodCalls(method string) {
+	m.methodCalls.With(prometheus.Labels{"method": method}).Inc()
+}
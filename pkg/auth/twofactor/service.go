@@ -0,0 +1,369 @@
+// Package twofactor implements two-factor authentication with time-based one-time
+// passwords and recovery codes.
+package twofactor
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/GGP1/adak/internal/crypt"
+	"github.com/GGP1/adak/internal/token"
+	"github.com/GGP1/adak/internal/totp"
+	"github.com/GGP1/adak/pkg/role"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+const (
+	// issuer is the name displayed by the authenticator applications.
+	issuer = "Adak"
+	// recoveryCodes is the number of recovery codes generated when enabling two-factor authentication.
+	recoveryCodes = 10
+)
+
+var (
+	// ErrAlreadyEnabled is returned when trying to enroll a user that already enabled two-factor authentication.
+	ErrAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	// ErrInvalidCode is returned when the code is not valid, expired or was already used.
+	ErrInvalidCode = errors.New("invalid code")
+	// ErrNotEnabled is returned when the user hasn't enabled two-factor authentication.
+	ErrNotEnabled = errors.New("two-factor authentication is not enabled")
+	// ErrNotEnrolling is returned when the user hasn't started the enrollment.
+	ErrNotEnrolling = errors.New("two-factor authentication enrollment not started")
+	// ErrTooManyAttempts is returned when the code can't be verified due to too many invalid ones.
+	ErrTooManyAttempts = errors.New("too many invalid codes")
+	// ErrRequired is returned when trying to disable two-factor authentication while one of the user's roles requires it.
+	ErrRequired = errors.New("two-factor authentication is required by one of your roles")
+)
+
+// Service provides two-factor authentication operations.
+type Service interface {
+	Disable(ctx context.Context, userID, code string) error
+	Enable(ctx context.Context, userID, code string) ([]string, error)
+	Enabled(ctx context.Context, userID string) (bool, error)
+	Enroll(ctx context.Context, userID string) (Enrollment, error)
+	Missing(ctx context.Context, userID string) (bool, error)
+	Pending(ctx context.Context, userID string) (Enrollment, error)
+	RequiredRoles(ctx context.Context) ([]string, error)
+	SetRequired(ctx context.Context, role string, required bool, setBy string) error
+	Verify(ctx context.Context, userID, code string) error
+}
+
+// Enrollment contains the information needed to add the account to an authenticator application.
+type Enrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type service struct {
+	db      *sqlx.DB
+	metrics metrics
+}
+
+// NewService returns a new two-factor authentication service.
+func NewService(db *sqlx.DB) Service {
+	return &service{db, initMetrics()}
+}
+
+// Disable turns off two-factor authentication and deletes the user's recovery codes,
+// a valid code is required.
+func (s *service) Disable(ctx context.Context, userID, code string) error {
+	s.metrics.incMethodCalls("Disable")
+
+	var required bool
+	if err := s.db.GetContext(ctx, &required, requiredQuery, userID); err != nil {
+		return errors.Wrap(err, "checking roles")
+	}
+	if required {
+		return ErrRequired
+	}
+
+	if err := s.Verify(ctx, userID, code); err != nil {
+		return err
+	}
+
+	// Recovery codes are deleted on cascade
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM two_factor WHERE user_id=$1", userID); err != nil {
+		return errors.Wrap(err, "couldn't disable two-factor authentication")
+	}
+
+	s.metrics.changes.WithLabelValues("disable").Inc()
+	return nil
+}
+
+// Enable finishes the enrollment once the user proves the authenticator application is
+// set up by sending a valid code. It returns the recovery codes, which are shown only once.
+func (s *service) Enable(ctx context.Context, userID, code string) ([]string, error) {
+	s.metrics.incMethodCalls("Enable")
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "starting transaction")
+	}
+	defer tx.Rollback()
+
+	var tf twoFactor
+	q := "SELECT secret, enabled, last_counter FROM two_factor WHERE user_id=$1 FOR UPDATE"
+	if err := tx.GetContext(ctx, &tf, q, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotEnrolling
+		}
+		return nil, errors.Wrap(err, "fetching enrollment")
+	}
+	if tf.Enabled {
+		return nil, ErrAlreadyEnabled
+	}
+
+	secret, err := decryptSecret(tf.Secret)
+	if err != nil {
+		return nil, err
+	}
+
+	counter, ok := totp.Validate(secret, code, time.Now())
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+
+	eq := "UPDATE two_factor SET enabled=true, last_counter=$2, enabled_at=NOW() WHERE user_id=$1"
+	if _, err := tx.ExecContext(ctx, eq, userID, counter); err != nil {
+		return nil, errors.Wrap(err, "couldn't enable two-factor authentication")
+	}
+
+	codes := make([]string, recoveryCodes)
+	hashes := make([]string, recoveryCodes)
+	for i := range codes {
+		c := token.RandString(10)
+		codes[i] = c[:5] + "-" + c[5:]
+		hashes[i] = token.Hash(c)
+	}
+
+	rq := "INSERT INTO recovery_codes (user_id, code_hash) SELECT $1, unnest($2::text[])"
+	if _, err := tx.ExecContext(ctx, rq, userID, pq.StringArray(hashes)); err != nil {
+		return nil, errors.Wrap(err, "couldn't save the recovery codes")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrap(err, "committing transaction")
+	}
+
+	s.metrics.changes.WithLabelValues("enable").Inc()
+	return codes, nil
+}
+
+// Enabled returns whether the user has two-factor authentication enabled.
+func (s *service) Enabled(ctx context.Context, userID string) (bool, error) {
+	s.metrics.incMethodCalls("Enabled")
+
+	var enabled bool
+	q := "SELECT EXISTS(SELECT 1 FROM two_factor WHERE user_id=$1 AND enabled)"
+	if err := s.db.GetContext(ctx, &enabled, q, userID); err != nil {
+		return false, errors.Wrap(err, "checking two-factor authentication")
+	}
+
+	return enabled, nil
+}
+
+// Enroll generates a new secret for the user, two-factor authentication isn't enabled
+// until a valid code is sent. Enrolling again replaces the previous secret.
+func (s *service) Enroll(ctx context.Context, userID string) (Enrollment, error) {
+	s.metrics.incMethodCalls("Enroll")
+
+	var email string
+	if err := s.db.GetContext(ctx, &email, "SELECT email FROM users WHERE id=$1", userID); err != nil {
+		return Enrollment{}, errors.Wrap(err, "fetching user")
+	}
+
+	secret, err := totp.NewSecret()
+	if err != nil {
+		return Enrollment{}, err
+	}
+
+	encrypted, err := crypt.Encrypt([]byte(secret))
+	if err != nil {
+		return Enrollment{}, err
+	}
+
+	q := `INSERT INTO two_factor (user_id, secret) VALUES ($1, $2)
+	ON CONFLICT (user_id) DO UPDATE SET secret=$2, last_counter=0 WHERE NOT two_factor.enabled`
+	res, err := s.db.ExecContext(ctx, q, userID, encrypted)
+	if err != nil {
+		return Enrollment{}, errors.Wrap(err, "couldn't save the secret")
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return Enrollment{}, ErrAlreadyEnabled
+	}
+
+	return Enrollment{Secret: secret, URI: totp.URI(issuer, email, secret)}, nil
+}
+
+// Missing returns whether any of the user's roles requires two-factor authentication
+// and they haven't enabled it.
+func (s *service) Missing(ctx context.Context, userID string) (bool, error) {
+	s.metrics.incMethodCalls("Missing")
+
+	var missing bool
+	q := "SELECT (" + requiredQuery + ") AND NOT EXISTS(SELECT 1 FROM two_factor WHERE user_id=$1 AND enabled)"
+	if err := s.db.GetContext(ctx, &missing, q, userID); err != nil {
+		return false, errors.Wrap(err, "checking two-factor authentication")
+	}
+
+	return missing, nil
+}
+
+// Pending returns the enrollment that is waiting to be confirmed.
+func (s *service) Pending(ctx context.Context, userID string) (Enrollment, error) {
+	s.metrics.incMethodCalls("Pending")
+
+	var email string
+	var tf twoFactor
+	q := `SELECT u.email, t.secret, t.enabled FROM two_factor t
+	JOIN users u ON u.id=t.user_id WHERE t.user_id=$1`
+	if err := s.db.QueryRowContext(ctx, q, userID).Scan(&email, &tf.Secret, &tf.Enabled); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Enrollment{}, ErrNotEnrolling
+		}
+		return Enrollment{}, errors.Wrap(err, "fetching enrollment")
+	}
+	// The secret can't be read anymore once it's enabled
+	if tf.Enabled {
+		return Enrollment{}, ErrAlreadyEnabled
+	}
+
+	secret, err := decryptSecret(tf.Secret)
+	if err != nil {
+		return Enrollment{}, err
+	}
+
+	return Enrollment{Secret: secret, URI: totp.URI(issuer, email, secret)}, nil
+}
+
+// RequiredRoles returns the roles whose users must enable two-factor authentication.
+func (s *service) RequiredRoles(ctx context.Context) ([]string, error) {
+	s.metrics.incMethodCalls("RequiredRoles")
+
+	var roles []string
+	if err := s.db.SelectContext(ctx, &roles, "SELECT role FROM two_factor_roles ORDER BY role"); err != nil {
+		return nil, errors.Wrap(err, "fetching roles")
+	}
+
+	return roles, nil
+}
+
+// SetRequired sets whether the users with the role must enable two-factor authentication
+// to use the permissions it grants.
+func (s *service) SetRequired(ctx context.Context, r string, required bool, setBy string) error {
+	s.metrics.incMethodCalls("SetRequired")
+
+	if !role.Exists(r) {
+		return role.ErrUnknownRole
+	}
+
+	q := "DELETE FROM two_factor_roles WHERE role=$1"
+	args := []interface{}{r}
+	if required {
+		q = `INSERT INTO two_factor_roles (role, set_by) VALUES ($1, NULLIF($2, ''))
+		ON CONFLICT (role) DO NOTHING`
+		args = append(args, setBy)
+	}
+
+	if _, err := s.db.ExecContext(ctx, q, args...); err != nil {
+		return errors.Wrap(err, "couldn't update the role")
+	}
+
+	return nil
+}
+
+// Verify checks the code generated by the authenticator application or a recovery code,
+// both of them can be used only once.
+func (s *service) Verify(ctx context.Context, userID, code string) error {
+	s.metrics.incMethodCalls("Verify")
+
+	code = strings.TrimSpace(code)
+	if len(code) == totp.Digits {
+		return s.verifyCode(ctx, userID, code)
+	}
+
+	return s.useRecoveryCode(ctx, userID, code)
+}
+
+func (s *service) verifyCode(ctx context.Context, userID, code string) error {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "starting transaction")
+	}
+	defer tx.Rollback()
+
+	var tf twoFactor
+	q := "SELECT secret, enabled, last_counter FROM two_factor WHERE user_id=$1 FOR UPDATE"
+	if err := tx.GetContext(ctx, &tf, q, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotEnabled
+		}
+		return errors.Wrap(err, "fetching secret")
+	}
+	if !tf.Enabled {
+		return ErrNotEnabled
+	}
+
+	secret, err := decryptSecret(tf.Secret)
+	if err != nil {
+		return err
+	}
+
+	// Codes from time steps previous to the last one used are rejected to prevent replays
+	counter, ok := totp.Validate(secret, code, time.Now())
+	if !ok || counter <= tf.LastCounter {
+		s.metrics.verifications.WithLabelValues("code", "failure").Inc()
+		return ErrInvalidCode
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE two_factor SET last_counter=$2 WHERE user_id=$1", userID, counter); err != nil {
+		return errors.Wrap(err, "updating last code used")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "committing transaction")
+	}
+
+	s.metrics.verifications.WithLabelValues("code", "success").Inc()
+	return nil
+}
+
+func (s *service) useRecoveryCode(ctx context.Context, userID, code string) error {
+	code = strings.ReplaceAll(code, "-", "")
+	q := "DELETE FROM recovery_codes WHERE user_id=$1 AND code_hash=$2"
+	res, err := s.db.ExecContext(ctx, q, userID, token.Hash(code))
+	if err != nil {
+		return errors.Wrap(err, "using recovery code")
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		s.metrics.verifications.WithLabelValues("recovery_code", "failure").Inc()
+		return ErrInvalidCode
+	}
+
+	s.metrics.verifications.WithLabelValues("recovery_code", "success").Inc()
+	return nil
+}
+
+// requiredQuery returns whether any of the user's roles requires two-factor authentication.
+const requiredQuery = `SELECT EXISTS(SELECT 1 FROM user_roles ur
+JOIN two_factor_roles tr ON tr.role=ur.role WHERE ur.user_id=$1)`
+
+type twoFactor struct {
+	Secret      []byte
+	Enabled     bool
+	LastCounter int64 `db:"last_counter"`
+}
+
+func decryptSecret(secret []byte) (string, error) {
+	plaintext, err := crypt.Decrypt(secret)
+	if err != nil {
+		return "", errors.Wrap(err, "decrypting secret")
+	}
+	return string(plaintext), nil
+}
@@ -0,0 +1,103 @@
+package twofactor_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/GGP1/adak/internal/logger"
+	"github.com/GGP1/adak/internal/test"
+	"github.com/GGP1/adak/internal/totp"
+	"github.com/GGP1/adak/pkg/auth/twofactor"
+	"github.com/GGP1/adak/pkg/role"
+	"github.com/GGP1/adak/pkg/user"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var usr = user.AddUser{ID: "1", CartID: "1", Username: "test", Email: "2fa@test.com", Password: "testing123"}
+
+// TestMain failed when creating the two-factor service.
+func NewTwoFactorService(t *testing.T) (context.Context, twofactor.Service, role.Service) {
+	t.Helper()
+	logger.Disable()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	db := test.StartPostgres(t)
+	mc := test.StartMemcached(t)
+	service := twofactor.NewService(db)
+
+	assert.NoError(t, user.NewService(db, mc).Create(ctx, usr))
+
+	t.Cleanup(func() {
+		cancel()
+	})
+
+	return ctx, service, role.NewService(db)
+}
+
+func TestTwoFactorService(t *testing.T) {
+	ctx, s, roles := NewTwoFactorService(t)
+
+	var recoveryCodes []string
+	t.Run("Enroll", func(t *testing.T) {
+		enrollment, err := s.Enroll(ctx, usr.ID)
+		assert.NoError(t, err)
+		assert.Contains(t, enrollment.URI, "otpauth://totp/")
+
+		pending, err := s.Pending(ctx, usr.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, enrollment, pending)
+
+		_, err = s.Enable(ctx, usr.ID, "000000")
+		assert.ErrorIs(t, err, twofactor.ErrInvalidCode)
+
+		code, err := totp.Code(enrollment.Secret, totp.Counter(time.Now()))
+		assert.NoError(t, err)
+		recoveryCodes, err = s.Enable(ctx, usr.ID, code)
+		assert.NoError(t, err)
+		assert.Len(t, recoveryCodes, 10)
+
+		enabled, err := s.Enabled(ctx, usr.ID)
+		assert.NoError(t, err)
+		assert.True(t, enabled)
+
+		// The secret isn't shown after enabling
+		_, err = s.Pending(ctx, usr.ID)
+		assert.ErrorIs(t, err, twofactor.ErrAlreadyEnabled)
+		_, err = s.Enroll(ctx, usr.ID)
+		assert.ErrorIs(t, err, twofactor.ErrAlreadyEnabled)
+
+		// The code used to enable it can't be reused
+		assert.ErrorIs(t, s.Verify(ctx, usr.ID, code), twofactor.ErrInvalidCode)
+	})
+
+	t.Run("Recovery codes", func(t *testing.T) {
+		assert.NoError(t, s.Verify(ctx, usr.ID, recoveryCodes[0]))
+		assert.ErrorIs(t, s.Verify(ctx, usr.ID, recoveryCodes[0]), twofactor.ErrInvalidCode)
+	})
+
+	t.Run("Required roles", func(t *testing.T) {
+		assert.NoError(t, roles.Grant(ctx, usr.ID, role.Support, ""))
+		assert.NoError(t, s.SetRequired(ctx, role.Support, true, ""))
+		assert.ErrorIs(t, s.SetRequired(ctx, "unknown", true, ""), role.ErrUnknownRole)
+
+		required, err := s.RequiredRoles(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{role.Support}, required)
+
+		missing, err := s.Missing(ctx, usr.ID)
+		assert.NoError(t, err)
+		assert.False(t, missing)
+
+		assert.ErrorIs(t, s.Disable(ctx, usr.ID, recoveryCodes[1]), twofactor.ErrRequired)
+
+		assert.NoError(t, s.SetRequired(ctx, role.Support, false, ""))
+		assert.NoError(t, s.Disable(ctx, usr.ID, recoveryCodes[1]))
+
+		assert.NoError(t, s.SetRequired(ctx, role.Support, true, ""))
+		missing, err = s.Missing(ctx, usr.ID)
+		assert.NoError(t, err)
+		assert.True(t, missing)
+	})
+}
@@ -15,3 +15,22 @@ type UserAuth struct {
 	Email    string `json:"email" validate:"email,required"`
 	Password string `json:"password" validate:"required,min=6"`
 }
+
+// PendingLogin is the response to a login of a user with two-factor authentication enabled.
+type PendingLogin struct {
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	Token             string `json:"token"`
+}
+
+// TwoFactorLogin is the second step of the login, the code can be a recovery code.
+type TwoFactorLogin struct {
+	Token string `json:"token" validate:"required"`
+	Code  string `json:"code" validate:"required"`
+}
+
+// Reauthentication confirms the credentials of a logged in user before performing sensitive
+// actions, the code is required only if the user has two-factor authentication enabled.
+type Reauthentication struct {
+	Password string `json:"password" validate:"required"`
+	Code     string `json:"code"`
+}
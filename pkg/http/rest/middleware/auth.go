@@ -5,59 +5,208 @@ import (
 	"net/http"
 	"strings"
 
-	"github.com/GGP1/adak/internal/cookie"
+	"github.com/GGP1/adak/internal/identity"
 	"github.com/GGP1/adak/internal/response"
 	"github.com/GGP1/adak/pkg/auth"
-	"github.com/GGP1/adak/pkg/user"
+	"github.com/GGP1/adak/pkg/auth/apikey"
+	"github.com/GGP1/adak/pkg/auth/twofactor"
+	"github.com/GGP1/adak/pkg/role"
 
 	"github.com/jmoiron/sqlx"
 )
 
 // Auth contains the elements needed to authorize users.
+//
+// Users are authenticated with the session cookies or with an API key sent in the
+// "Authorization: Bearer <key>" header, the identity is stored in the request context
+// so handlers don't depend on the method used.
 type Auth struct {
+	APIKeys     apikey.Service
 	DB          *sqlx.DB
-	UserService user.Service
+	RoleService role.Service
 	Session     auth.Session
+	TwoFactor   twofactor.Service
 }
 
-// AdminsOnly requires the user to be an administrator to proceed.
+// AdminsOnly requires the user to be an administrator to proceed, API keys also need the admin scope.
 func (a *Auth) AdminsOnly(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
-
-		sessionID, err := cookie.GetValue(r, "SID")
-		if err != nil {
-			response.Error(w, http.StatusForbidden, errors.New("unauthorized"))
+		r, id, ok := a.authenticate(w, r, "unauthorized")
+		if !ok {
 			return
 		}
 
-		id := strings.Split(sessionID, ":")[0]
-
-		isAdmin, err := a.UserService.IsAdmin(ctx, id)
+		roles, err := a.RoleService.Get(r.Context(), id.UserID)
 		if err != nil {
 			response.Error(w, http.StatusNotFound, err)
 			return
 		}
 
-		if !isAdmin {
+		if !hasRole(roles, role.Admin) || !id.HasScopes(apikey.ScopeAdmin) {
 			// Return 404 instead of 401 to not give additional information
 			response.Error(w, http.StatusNotFound, errors.New("not found"))
 			return
 		}
 
+		if !a.checkTwoFactor(w, r, id.UserID) {
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Require makes sure the user's roles grant all the permissions provided before forwarding the request,
+// API keys must also have them in their scopes.
+func (a *Auth) Require(perms ...role.Permission) func(http.Handler) http.Handler {
+	scopes := make([]string, len(perms))
+	for i, p := range perms {
+		scopes[i] = string(p)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r, id, ok := a.authenticate(w, r, "please log in to access")
+			if !ok {
+				return
+			}
+
+			can, err := a.RoleService.Can(r.Context(), id.UserID, perms...)
+			if err != nil {
+				response.Error(w, http.StatusInternalServerError, err)
+				return
+			}
+
+			if !can || !id.HasScopes(scopes...) {
+				response.Error(w, http.StatusForbidden, errors.New("insufficient permissions"))
+				return
+			}
+
+			if !a.checkTwoFactor(w, r, id.UserID) {
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireFresh makes sure the user logged in or confirmed their credentials recently before
+// performing sensitive actions. API keys are not accepted.
+func (a *Auth) RequireFresh(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, ok := identity.FromContext(r.Context()); (ok && id.APIKey) || hasBearer(r) {
+			response.Error(w, http.StatusForbidden, errors.New("this action requires logging in, api keys can't be used"))
+			return
+		}
+
+		r, _, ok := a.authenticate(w, r, "please log in to access")
+		if !ok {
+			return
+		}
+
+		if !a.Session.Fresh(r.Context(), r) {
+			response.Error(w, http.StatusForbidden, errors.New("please confirm your credentials at /reauthenticate to perform this action"))
+			return
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
 
-// RequireLogin makes sure the user is logged in before forwarding the request,
-// it returns an error otherwise.
+// RequireLogin makes sure the user is logged in or used a valid API key with the account scope
+// before forwarding the request, it returns an error otherwise.
 func (a *Auth) RequireLogin(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !a.Session.AlreadyLoggedIn(r.Context(), r) {
-			response.Error(w, http.StatusForbidden, errors.New("please log in to access"))
+		r, id, ok := a.authenticate(w, r, "please log in to access")
+		if !ok {
+			return
+		}
+
+		if !id.HasScopes(apikey.ScopeAccount) {
+			response.Error(w, http.StatusForbidden, errors.New("the api key doesn't have the account scope"))
 			return
 		}
 
 		next.ServeHTTP(w, r)
 	})
 }
+
+// authenticate identifies the user by its API key or session and returns the request with
+// the identity in its context. It writes the error, using msg if the user isn't logged in,
+// and returns false otherwise.
+func (a *Auth) authenticate(w http.ResponseWriter, r *http.Request, msg string) (*http.Request, identity.Identity, bool) {
+	ctx := r.Context()
+	if id, ok := identity.FromContext(ctx); ok {
+		return r, id, true
+	}
+
+	var id identity.Identity
+	if key, ok := bearerToken(r); ok {
+		k, err := a.APIKeys.Authenticate(ctx, key)
+		if err != nil {
+			if errors.Is(err, apikey.ErrInvalidKey) {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				response.Error(w, http.StatusUnauthorized, err)
+				return r, id, false
+			}
+			response.Error(w, http.StatusInternalServerError, err)
+			return r, id, false
+		}
+
+		id = identity.Identity{UserID: k.UserID, CartID: k.CartID, Scopes: k.Scopes, APIKey: true}
+	} else {
+		var err error
+		id, err = a.Session.Identity(ctx, r)
+		if err != nil {
+			if !errors.Is(err, auth.ErrSessionNotFound) {
+				response.Error(w, http.StatusInternalServerError, err)
+				return r, id, false
+			}
+			response.Error(w, http.StatusForbidden, errors.New(msg))
+			return r, id, false
+		}
+	}
+
+	return r.WithContext(identity.NewContext(ctx, id)), id, true
+}
+
+// checkTwoFactor makes sure that users whose roles require two-factor authentication have
+// enabled it before using their permissions. It writes the error and returns false otherwise.
+func (a *Auth) checkTwoFactor(w http.ResponseWriter, r *http.Request, userID string) bool {
+	missing, err := a.TwoFactor.Missing(r.Context(), userID)
+	if err != nil {
+		response.Error(w, http.StatusInternalServerError, err)
+		return false
+	}
+
+	if missing {
+		response.Error(w, http.StatusForbidden, errors.New("your roles require two-factor authentication, enable it at /settings/2fa"))
+		return false
+	}
+
+	return true
+}
+
+// bearerToken returns the token from the Authorization header.
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(header[7:]), true
+}
+
+func hasBearer(r *http.Request) bool {
+	_, ok := bearerToken(r)
+	return ok
+}
+
+func hasRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/GGP1/adak/pkg/auth/apikey"
+	"github.com/GGP1/adak/pkg/role"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type scopedKeys struct {
+	apikey.Service
+}
+
+func (s scopedKeys) Authenticate(ctx context.Context, key string) (apikey.Key, error) {
+	switch key {
+	case apikey.Prefix + "account":
+		return apikey.Key{UserID: "1", Scopes: []string{apikey.ScopeAccount}}, nil
+	case apikey.Prefix + "products":
+		return apikey.Key{UserID: "1", Scopes: []string{string(role.ProductsWrite)}}, nil
+	}
+	return apikey.Key{}, apikey.ErrInvalidKey
+}
+
+func TestRequireLogin(t *testing.T) {
+	a := Auth{APIKeys: scopedKeys{}}
+	handler := a.RequireLogin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	cases := []struct {
+		desc     string
+		key      string
+		expected int
+	}{
+		{desc: "Account scope", key: "account", expected: http.StatusOK},
+		{desc: "Missing account scope", key: "products", expected: http.StatusForbidden},
+		{desc: "Invalid key", key: "invalid", expected: http.StatusUnauthorized},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Authorization", "Bearer "+apikey.Prefix+tc.key)
+			rec := httptest.NewRecorder()
+
+			handler.ServeHTTP(rec, r)
+			assert.Equal(t, tc.expected, rec.Code)
+		})
+	}
+}
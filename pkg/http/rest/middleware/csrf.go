@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+
+	"github.com/GGP1/adak/internal/cookie"
+	"github.com/GGP1/adak/internal/response"
+	"github.com/GGP1/adak/pkg/auth"
+)
+
+// csrfHeader is the header carrying the session's CSRF token.
+const csrfHeader = "X-CSRF-Token"
+
+var errInvalidCSRFToken = errors.New("invalid or missing CSRF token")
+
+// CSRF protects the users authenticated with the session cookies from cross-site request
+// forgery, requests with unsafe methods must send the session's token in the X-CSRF-Token header.
+//
+// Clients using API keys are skipped, browsers don't attach the Authorization header
+// automatically so those requests can't be forged. Requests without a valid session are
+// skipped as well, there is nothing to impersonate.
+func (a *Auth) CSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if safeMethod(r.Method) || hasBearer(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !cookie.IsSet(r, "SID") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		expected, err := a.Session.CSRFToken(r.Context(), r)
+		if err != nil {
+			if errors.Is(err, auth.ErrSessionNotFound) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			response.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		got := r.Header.Get(csrfHeader)
+		if got == "" || subtle.ConstantTimeCompare([]byte(got), []byte(expected)) != 1 {
+			response.Error(w, http.StatusForbidden, errInvalidCSRFToken)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/GGP1/adak/pkg/auth"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type csrfSession struct {
+	auth.Session
+}
+
+func (s csrfSession) CSRFToken(ctx context.Context, r *http.Request) (string, error) {
+	c, err := r.Cookie("SID")
+	if err != nil || c.Value != "valid" {
+		return "", auth.ErrSessionNotFound
+	}
+	return "token", nil
+}
+
+func TestCSRF(t *testing.T) {
+	a := Auth{Session: csrfSession{}}
+	handler := a.CSRF(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	cases := []struct {
+		desc     string
+		method   string
+		sID      string
+		header   string
+		bearer   bool
+		expected int
+	}{
+		{desc: "Safe method", method: http.MethodGet, sID: "valid", expected: http.StatusOK},
+		{desc: "Valid token", method: http.MethodPost, sID: "valid", header: "token", expected: http.StatusOK},
+		{desc: "Invalid token", method: http.MethodPut, sID: "valid", header: "invalid", expected: http.StatusForbidden},
+		{desc: "Missing token", method: http.MethodDelete, sID: "valid", expected: http.StatusForbidden},
+		{desc: "Bearer token", method: http.MethodPost, sID: "valid", bearer: true, expected: http.StatusOK},
+		{desc: "No session", method: http.MethodPost, expected: http.StatusOK},
+		{desc: "Expired session", method: http.MethodPost, sID: "expired", expected: http.StatusOK},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, "/", nil)
+			if tc.sID != "" {
+				req.AddCookie(&http.Cookie{Name: "SID", Value: tc.sID})
+			}
+			if tc.header != "" {
+				req.Header.Set("X-CSRF-Token", tc.header)
+			}
+			if tc.bearer {
+				req.Header.Set("Authorization", "Bearer adak_key")
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			assert.Equal(t, tc.expected, rec.Code)
+		})
+	}
+}
@@ -1,15 +1,26 @@
 package rest
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/GGP1/adak/internal/config"
+	"github.com/GGP1/adak/internal/cookie"
+	"github.com/GGP1/adak/internal/crypt"
 	"github.com/GGP1/adak/internal/email"
+	"github.com/GGP1/adak/internal/geo"
+	"github.com/GGP1/adak/internal/logger"
+	"github.com/GGP1/adak/internal/password"
 	"github.com/GGP1/adak/pkg/auth"
+	"github.com/GGP1/adak/pkg/auth/apikey"
+	"github.com/GGP1/adak/pkg/auth/oidc"
+	"github.com/GGP1/adak/pkg/auth/twofactor"
 	"github.com/GGP1/adak/pkg/http/rest/middleware"
 	"github.com/GGP1/adak/pkg/product"
 	"github.com/GGP1/adak/pkg/review"
+	"github.com/GGP1/adak/pkg/role"
 	"github.com/GGP1/adak/pkg/shop"
+	"github.com/GGP1/adak/pkg/shop/member"
 	"github.com/GGP1/adak/pkg/shopping/cart"
 	"github.com/GGP1/adak/pkg/shopping/ordering"
 	"github.com/GGP1/adak/pkg/shopping/payment/stripe"
@@ -21,34 +32,67 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/go-redis/redis/v8"
 	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-// NewRouter initializes services, creates and returns a mux router
-func NewRouter(config config.Config, db *sqlx.DB, mc *memcache.Client, rdb *redis.Client) http.Handler {
+// NewRouter initializes services, creates and returns a mux router.
+//
+// The background jobs started run until the context is cancelled. It fails if the keys that
+// encrypt the data, the password policy or the cookie policy can't be loaded.
+func NewRouter(ctx context.Context, config config.Config, db *sqlx.DB, mc *memcache.Client, rdb *redis.Client) (http.Handler, error) {
+	// Policies and keys, loaded before the services so a failure aborts early
+	if err := password.Configure(config.Password); err != nil {
+		return nil, errors.Wrap(err, "loading the password policy")
+	}
+	if err := cookie.Configure(config.Cookie); err != nil {
+		return nil, errors.Wrap(err, "loading the cookie policy")
+	}
+	if err := crypt.Configure(config.Keyring); err != nil {
+		return nil, errors.Wrap(err, "loading the keyring")
+	}
+
 	router := chi.NewRouter()
 
 	// Services
-	accountService := account.NewService(db)
+	accountService := account.NewService(db, config.PasswordReset, config.EmailChange, config.Verification)
+	apiKeyService := apikey.NewService(db)
 	cartService := cart.NewService(db, mc)
+	memberService := member.NewService(db)
+	oidcService := oidc.NewService(db, rdb, config.OIDC, config.Admins)
 	orderingService := ordering.NewService(db)
 	productService := product.NewService(db, mc)
-	reviewService := review.NewService(db, mc)
+	reviewService := review.NewService(db, mc, config.Reviews, config.Moderation, ordering.PurchasedStatuses())
+	roleService := role.NewService(db)
 	shopService := shop.NewService(db, mc)
 	userService := user.NewService(db, mc)
 	trackingService := tracking.NewService(db)
-	session := auth.NewSession(db, rdb, config.Session, config.Development)
+	twoFactorService := twofactor.NewService(db)
 	emailer := email.New()
+	session := auth.NewSession(db, rdb, twoFactorService, &emailer, config.Session, config.Development)
+	// Unverified accounts can log in while developing, keep them
+	if config.Verification.Cleanup > 0 && !config.Development {
+		go user.CleanUnverified(ctx, userService, config.Verification.Cleanup)
+	}
+	geocoder, err := geo.Load(config.Geocoding.Dataset)
+	if err != nil {
+		logger.Errorf("couldn't load the geocoding dataset, shops coordinates won't be looked up: %v", err)
+		geocoder, _ = geo.Load("")
+	}
 
 	// Authentication middleware
 	mAuth := middleware.Auth{
+		APIKeys:     apiKeyService,
 		DB:          db,
-		UserService: userService,
+		RoleService: roleService,
 		Session:     session,
+		TwoFactor:   twoFactorService,
 	}
 	adminsOnly := mAuth.AdminsOnly
 	requireLogin := mAuth.RequireLogin
+	requireFresh := mAuth.RequireFresh
+	require := mAuth.Require
 	// Metrics middleware
 	metrics := middleware.NewMetrics()
 
@@ -61,13 +105,21 @@ func NewRouter(config config.Config, db *sqlx.DB, mc *memcache.Client, rdb *redi
 		rateLimiter := middleware.NewRateLimiter(config.RateLimiter, rdb)
 		router.Use(rateLimiter.Limit)
 	}
+	router.Use(mAuth.CSRF)
 
 	// Auth
 	router.Post("/login", auth.Login(session))
+	router.Post("/login/2fa", auth.LoginTwoFactor(session))
 	router.Get("/login/basic", auth.BasicAuth(session))
+	router.Get("/login/unlock/{token}", auth.Unlock(session))
+	router.Get("/csrf", auth.CSRFToken(session))
 	router.With(requireLogin).Get("/logout", auth.Logout(session))
-	router.Get("/login/google", auth.LoginGoogle(session))
-	router.Get("/login/oauth2/google", auth.OAuth2Google(session))
+	router.With(requireLogin).Post("/reauthenticate", auth.Reauthenticate(session))
+	router.With(requireLogin).Get("/settings/sessions", auth.Sessions(session))
+	router.With(requireLogin).Delete("/settings/sessions", auth.RevokeOtherSessions(session))
+	router.With(requireLogin).Delete("/settings/sessions/{id}", auth.RevokeSession(session))
+	router.Get("/login/{provider}", auth.LoginProvider(session, oidcService))
+	router.Get("/login/{provider}/callback", auth.ProviderCallback(session, oidcService))
 
 	// Cart
 	cart := cart.NewHandler(cartService, db, mc)
@@ -98,11 +150,13 @@ func NewRouter(config config.Config, db *sqlx.DB, mc *memcache.Client, rdb *redi
 	// Ordering
 	order := ordering.NewHandler(config.Development, orderingService, cartService, db, mc)
 	router.Route("/orders", func(r chi.Router) {
-		r.With(adminsOnly).Get("/", order.Get())
-		r.With(adminsOnly).Delete("/{id}", order.Delete())
-		r.With(adminsOnly).Get("/{id}", order.GetByID())
+		r.With(require(role.OrdersRead)).Get("/", order.Get())
+		r.With(require(role.OrdersWrite)).Delete("/{id}", order.Delete())
+		r.With(require(role.OrdersRead)).Get("/{id}", order.GetByID())
 		r.With(requireLogin).Get("/user/{id}", order.GetByUserID())
-		r.With(requireLogin).Post("/new", order.New())
+		r.With(requireFresh).Post("/new", order.New(shopService, geocoder))
+		r.With(requireLogin).Get("/{id}/pickup/qr", order.PickupQR())
+		r.With(requireLogin).Post("/{id}/collect", order.Collect(memberService))
 	})
 
 	// Product
@@ -110,36 +164,77 @@ func NewRouter(config config.Config, db *sqlx.DB, mc *memcache.Client, rdb *redi
 	router.Route("/products", func(r chi.Router) {
 		r.Get("/", product.Get())
 		r.Get("/{id}", product.GetByID())
-		r.With(adminsOnly).Put("/{id}", product.Update())
-		r.With(adminsOnly).Delete("/{id}", product.Delete())
-		r.With(adminsOnly).Post("/create", product.Create())
+		r.With(require(role.ProductsWrite)).Put("/{id}", product.Update(memberService))
+		r.With(require(role.ProductsWrite)).Delete("/{id}", product.Delete(memberService))
+		r.With(require(role.ProductsWrite)).Post("/create", product.Create(memberService))
 		r.Get("/search/{query}", product.Search())
 	})
 
 	// Review
-	review := review.NewHandler(reviewService, mc)
+	reviews := review.NewHandler(reviewService, mc)
 	router.Route("/reviews", func(r chi.Router) {
-		r.Get("/", review.Get())
-		r.Get("/{id}", review.GetByID())
-		r.With(adminsOnly).Delete("/{id}", review.Delete())
-		r.With(requireLogin).Post("/create", review.Create())
+		r.Get("/", reviews.Get())
+		r.Get("/{id}", reviews.GetByID())
+		r.With(require(role.ReviewsModerate)).Delete("/{id}", reviews.Delete())
+		r.With(requireLogin).Post("/create", reviews.Create())
+		r.With(requireLogin).Put("/{id}", reviews.Update())
+		r.Get("/{id}/edits", reviews.Edits())
+		r.With(requireLogin).Post("/{id}/vote", reviews.Vote())
+		r.With(require(role.ReviewsReply)).Post("/{id}/reply", reviews.Reply(memberService))
+		r.With(requireLogin).Post("/{id}/report", reviews.Report())
+		r.With(require(role.ReviewsModerate)).Get("/moderation", reviews.Queue())
+		r.With(require(role.ReviewsModerate)).Post("/{id}/approve", reviews.Moderate(review.Approved))
+		r.With(require(role.ReviewsModerate)).Post("/{id}/reject", reviews.Moderate(review.Rejected))
+		r.With(require(role.ReviewsModerate)).Post("/{id}/hide", reviews.Moderate(review.Hidden))
 	})
 
 	// Shop
-	shop := shop.NewHandler(shopService, mc)
+	shop := shop.NewHandler(shopService, geocoder, mc)
+	members := member.NewHandler(memberService, emailer)
 	router.Route("/shops", func(r chi.Router) {
 		r.Get("/", shop.Get())
 		r.Get("/{id}", shop.GetByID())
-		r.With(adminsOnly).Delete("/{id}", shop.Delete())
-		r.With(adminsOnly).Put("/{id}", shop.Update())
-		r.With(adminsOnly).Post("/create", shop.Create())
+		r.With(requireLogin).Delete("/{id}", shop.Delete(memberService))
+		r.With(requireLogin).Put("/{id}", shop.Update(memberService))
+		r.With(require(role.ShopsWrite)).Post("/create", shop.Create())
 		r.Get("/search/{query}", shop.Search())
+		r.Get("/nearby", shop.Nearby())
+		r.With(requireLogin).Put("/{id}/location", shop.UpdateLocation(memberService))
+		r.Get("/{id}/locations", shop.Locations())
+		r.With(requireLogin).Post("/{id}/locations", shop.AddLocation(memberService))
+		r.With(requireLogin).Put("/{id}/locations/{locationID}", shop.UpdateLocation(memberService))
+		r.With(requireLogin).Delete("/{id}/locations/{locationID}", shop.DeleteLocation(memberService))
+		r.Get("/{id}/schedule", shop.Schedule())
+		r.With(requireLogin).Put("/{id}/schedule", shop.UpdateSchedule(memberService))
+		r.Get("/{id}/zones", shop.Zones())
+		r.With(requireLogin).Put("/{id}/zones", shop.UpdateZones(memberService))
+		r.Get("/{id}/delivers-to", shop.DeliversTo())
+		r.With(requireLogin).Get("/{id}/orders", order.GetByShopID(memberService))
+		r.With(requireLogin).Get("/{id}/members", members.Get())
+		r.With(requireLogin).Delete("/{id}/members/{userID}", members.Remove())
+		r.With(requireLogin).Post("/{id}/invitations", members.Invite())
+		r.With(requireLogin).Get("/invitations/{token}", members.Accept())
+	})
+
+	// Role
+	roles := role.NewHandler(roleService)
+	twoFactor := twofactor.NewHandler(twoFactorService)
+	router.Route("/roles", func(r chi.Router) {
+		r.Use(adminsOnly)
+
+		r.Get("/", roles.Get())
+		r.Get("/user/{id}", roles.GetByUserID())
+		r.With(requireFresh).Post("/user/{id}/{role}", roles.Grant())
+		r.With(requireFresh).Delete("/user/{id}/{role}", roles.Revoke())
+		r.Get("/2fa", twoFactor.RequiredRoles())
+		r.With(requireFresh).Put("/{role}/2fa", twoFactor.SetRequired(true))
+		r.With(requireFresh).Delete("/{role}/2fa", twoFactor.SetRequired(false))
 	})
 
 	// Stripe
 	stripe := stripe.NewHandler()
 	router.Route("/stripe", func(r chi.Router) {
-		r.Use(adminsOnly)
+		r.Use(require(role.PaymentsRead))
 
 		r.Get("/balance", stripe.GetBalance())
 		r.Get("/event/{event}", stripe.GetEvent())
@@ -151,10 +246,10 @@ func NewRouter(config config.Config, db *sqlx.DB, mc *memcache.Client, rdb *redi
 	// Tracking
 	tracker := tracking.NewHandler(trackingService)
 	router.Route("/tracker", func(r chi.Router) {
-		r.Use(adminsOnly)
+		r.Use(require(role.TrackingRead))
 
 		r.Get("/", tracker.GetHits())
-		r.Delete("/{id}", tracker.DeleteHit())
+		r.With(require(role.TrackingWrite)).Delete("/{id}", tracker.DeleteHit())
 		r.Get("/search/{query}", tracker.SearchHit())
 		r.Get("/{field}/{value}", tracker.SearchHitByField())
 	})
@@ -164,21 +259,38 @@ func NewRouter(config config.Config, db *sqlx.DB, mc *memcache.Client, rdb *redi
 	router.Route("/users", func(r chi.Router) {
 		r.Get("/", user.Get())
 		r.Get("/{id}", user.GetByID())
-		r.With(requireLogin).Delete("/{id}", user.Delete(session))
+		r.With(requireFresh).Delete("/{id}", user.Delete(session))
 		r.With(requireLogin).Put("/{id}", user.Update())
+		r.With(adminsOnly, requireFresh).Delete("/{id}/sessions", auth.ForceLogout(session))
 		r.Get("/email/{email}", user.GetByEmail())
 		r.Get("/username/{username}", user.GetByUsername())
-		r.Post("/create", user.Create())
+		r.Post("/create", user.Create(accountService))
 		r.Get("/search/{query}", user.Search())
 	})
 
 	// Account
-	account := account.NewHandler(accountService, userService, emailer)
-	router.With(requireLogin).Post("/settings/email", account.SendChangeConfirmation())
-	router.With(requireLogin).Post("/settings/password", account.ChangePassword())
-	router.Get("/verification/{email}/{token}", account.SendEmailValidation(userService))
-	router.Get("/verification/{token}/{email}/{id}", account.ChangeEmail())
+	account := account.NewHandler(accountService, emailer, rdb, config.PasswordReset, config.Verification)
+	router.Post("/password/forgot", account.ForgotPassword())
+	router.Post("/password/reset/{token}", account.ResetPassword(session))
+	router.With(requireFresh).Post("/settings/email", account.SendChangeConfirmation())
+	router.With(requireFresh).Post("/settings/password", account.ChangePassword())
+	router.With(requireLogin).Post("/settings/2fa", twoFactor.Enroll())
+	router.With(requireLogin).Get("/settings/2fa/qr", twoFactor.QRCode())
+	router.With(requireLogin).Post("/settings/2fa/enable", twoFactor.Enable())
+	router.With(requireFresh).Delete("/settings/2fa", twoFactor.Disable(session))
+	identities := oidc.NewHandler(oidcService)
+	router.With(requireLogin).Get("/settings/identities", identities.Identities())
+	router.With(requireFresh).Get("/settings/identities/{provider}", identities.Link())
+	router.With(requireFresh).Delete("/settings/identities/{provider}", identities.Unlink())
+	apiKeys := apikey.NewHandler(apiKeyService)
+	router.With(requireLogin).Get("/settings/tokens", apiKeys.List())
+	router.With(requireFresh).Post("/settings/tokens", apiKeys.Create())
+	router.With(requireLogin).Delete("/settings/tokens/{id}", apiKeys.Delete())
+	router.Get("/verification/{token}", account.VerifyEmail())
+	router.Post("/verification/resend", account.ResendVerification())
+	router.Get("/email/confirm/{token}", account.ChangeEmail(session))
+	router.Get("/email/revert/{token}", account.RevertEmailChange(session))
 
 	http.Handle("/", router)
-	return router
+	return router, nil
 }
@@ -1,6 +1,7 @@
 package rest_test
 
 import (
+	"context"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -13,7 +14,8 @@ import (
 )
 
 func TestRouter(t *testing.T) {
-	mux := rest.NewRouter(config.Config{}, nil, nil, nil)
+	mux, err := rest.NewRouter(context.Background(), config.Config{}, nil, nil, nil)
+	assert.NoError(t, err)
 	ts := httptest.NewServer(mux)
 	defer ts.Close()
 
@@ -41,3 +43,17 @@ func TestRouter(t *testing.T) {
 	assert.Equal(t, h.Get("X-Permitted-Cross-Domain-Policies"), "none")
 	assert.Equal(t, h.Get("X-Xss-Protection"), "1; mode=block")
 }
+
+func TestRouterConfigErrors(t *testing.T) {
+	cases := map[string]config.Config{
+		"Keyring":         {Keyring: config.Keyring{File: "missing_keyring"}},
+		"Password policy": {Password: config.Password{Blocklist: "missing_blocklist"}},
+		"Cookie policy":   {Cookie: config.Cookie{SameSite: "none", Secure: false}},
+	}
+	for name, conf := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := rest.NewRouter(context.Background(), conf, nil, nil, nil)
+			assert.Error(t, err)
+		})
+	}
+}
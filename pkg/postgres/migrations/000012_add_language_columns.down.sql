@@ -0,0 +1,24 @@
+DROP TRIGGER IF EXISTS users_tsvector_update ON users;
+DROP TRIGGER IF EXISTS shops_tsvector_update ON shops;
+DROP TRIGGER IF EXISTS products_tsvector_update ON products;
+DROP FUNCTION IF EXISTS users_tsvector_trigger();
+DROP FUNCTION IF EXISTS shops_tsvector_trigger();
+DROP FUNCTION IF EXISTS products_tsvector_trigger();
+DROP FUNCTION IF EXISTS search_config(text);
+
+DROP TEXT SEARCH CONFIGURATION IF EXISTS adak_simple;
+DROP TEXT SEARCH CONFIGURATION IF EXISTS adak_english;
+DROP TEXT SEARCH CONFIGURATION IF EXISTS adak_spanish;
+DROP TEXT SEARCH CONFIGURATION IF EXISTS adak_portuguese;
+DROP TEXT SEARCH CONFIGURATION IF EXISTS adak_german;
+DROP TEXT SEARCH CONFIGURATION IF EXISTS adak_french;
+DROP TEXT SEARCH CONFIGURATION IF EXISTS adak_italian;
+DROP TEXT SEARCH CONFIGURATION IF EXISTS adak_russian;
+DROP EXTENSION IF EXISTS unaccent;
+
+ALTER TABLE users DROP COLUMN IF EXISTS search;
+ALTER TABLE shops DROP COLUMN IF EXISTS search;
+ALTER TABLE products DROP COLUMN IF EXISTS search;
+
+ALTER TABLE shops DROP COLUMN IF EXISTS language;
+ALTER TABLE products DROP COLUMN IF EXISTS language;
\ No newline at end of file
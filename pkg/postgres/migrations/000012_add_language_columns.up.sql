@@ -0,0 +1,97 @@
+ALTER TABLE shops ADD COLUMN IF NOT EXISTS language text NOT NULL DEFAULT 'en';
+ALTER TABLE products ADD COLUMN IF NOT EXISTS language text NOT NULL DEFAULT 'en';
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS search tsvector;
+ALTER TABLE shops ADD COLUMN IF NOT EXISTS search tsvector;
+ALTER TABLE products ADD COLUMN IF NOT EXISTS search tsvector;
+
+-- Each supported language gets a configuration that strips accents before stemming,
+-- search_config() maps ISO 639-1 codes to them and falls back to english.
+-- Languages without a snowball stemmer use the simple dictionary.
+CREATE EXTENSION IF NOT EXISTS unaccent;
+
+DO $$
+DECLARE
+  cfg text[];
+BEGIN
+  FOREACH cfg SLICE 1 IN ARRAY ARRAY[
+    ['simple', 'simple'],
+    ['english', 'english_stem'],
+    ['spanish', 'spanish_stem'],
+    ['portuguese', 'portuguese_stem'],
+    ['german', 'german_stem'],
+    ['french', 'french_stem'],
+    ['italian', 'italian_stem'],
+    ['russian', 'russian_stem']
+  ] LOOP
+    IF NOT EXISTS (SELECT 1 FROM pg_ts_config WHERE cfgname = 'adak_' || cfg[1]) THEN
+      EXECUTE format('CREATE TEXT SEARCH CONFIGURATION adak_%s (COPY = %s)', cfg[1], cfg[1]);
+      EXECUTE format('ALTER TEXT SEARCH CONFIGURATION adak_%s
+        ALTER MAPPING FOR hword, hword_part, word WITH unaccent, %s', cfg[1], cfg[2]);
+    END IF;
+  END LOOP;
+END
+$$;
+
+CREATE OR REPLACE FUNCTION search_config(lang text) RETURNS regconfig AS $$
+  SELECT CASE lang
+    WHEN 'es' THEN 'adak_spanish'
+    WHEN 'pt' THEN 'adak_portuguese'
+    WHEN 'de' THEN 'adak_german'
+    WHEN 'fr' THEN 'adak_french'
+    WHEN 'it' THEN 'adak_italian'
+    WHEN 'ru' THEN 'adak_russian'
+    WHEN 'zh' THEN 'adak_simple'
+    WHEN 'hi' THEN 'adak_simple'
+    WHEN 'ja' THEN 'adak_simple'
+    ELSE 'adak_english'
+  END::regconfig
+$$ LANGUAGE sql STABLE;
+
+CREATE OR REPLACE FUNCTION users_tsvector_trigger() RETURNS trigger AS $$
+BEGIN
+  new.search := to_tsvector('adak_simple', new.username);
+  return new;
+END
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS users_tsvector_update ON users;
+
+CREATE TRIGGER users_tsvector_update BEFORE INSERT OR UPDATE
+    ON users FOR EACH ROW EXECUTE PROCEDURE users_tsvector_trigger();
+
+--
+    
+CREATE OR REPLACE FUNCTION shops_tsvector_trigger() RETURNS trigger AS $$
+BEGIN
+  new.search := to_tsvector(search_config(new.language), new.name);
+  return new;
+END
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS shops_tsvector_update ON shops;
+
+CREATE TRIGGER shops_tsvector_update BEFORE INSERT OR UPDATE
+    ON shops FOR EACH ROW EXECUTE PROCEDURE shops_tsvector_trigger();
+
+--
+
+CREATE OR REPLACE FUNCTION products_tsvector_trigger() RETURNS trigger AS $$
+BEGIN
+  new.search :=
+  setweight(to_tsvector(search_config(new.language), new.type), 'A')
+  || setweight(to_tsvector(search_config(new.language), new.category), 'B')
+  || setweight(to_tsvector(search_config(new.language), new.brand), 'C');
+  return new;
+END
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS products_tsvector_update ON products;
+
+CREATE TRIGGER products_tsvector_update BEFORE INSERT OR UPDATE
+    ON products FOR EACH ROW EXECUTE PROCEDURE products_tsvector_trigger();
+
+-- Index the existing rows with the new configurations
+UPDATE users SET username = username;
+UPDATE shops SET name = name;
+UPDATE products SET type = type;
\ No newline at end of file
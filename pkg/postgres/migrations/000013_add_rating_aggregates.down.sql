@@ -0,0 +1,9 @@
+ALTER TABLE shops
+    DROP COLUMN IF EXISTS rating_average,
+    DROP COLUMN IF EXISTS rating_count,
+    DROP COLUMN IF EXISTS rating_histogram;
+
+ALTER TABLE products
+    DROP COLUMN IF EXISTS rating_average,
+    DROP COLUMN IF EXISTS rating_count,
+    DROP COLUMN IF EXISTS rating_histogram;
\ No newline at end of file
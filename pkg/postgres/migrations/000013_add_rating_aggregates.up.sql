@@ -0,0 +1,31 @@
+ALTER TABLE shops
+    ADD COLUMN IF NOT EXISTS rating_average numeric(3,2) NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS rating_count integer NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS rating_histogram integer[] NOT NULL DEFAULT '{0,0,0,0,0}';
+
+ALTER TABLE products
+    ADD COLUMN IF NOT EXISTS rating_average numeric(3,2) NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS rating_count integer NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS rating_histogram integer[] NOT NULL DEFAULT '{0,0,0,0,0}';
+
+UPDATE shops SET (rating_average, rating_count, rating_histogram) = (
+    SELECT COALESCE(ROUND(AVG(stars), 2), 0), COUNT(*), ARRAY[
+        COUNT(*) FILTER (WHERE stars=1),
+        COUNT(*) FILTER (WHERE stars=2),
+        COUNT(*) FILTER (WHERE stars=3),
+        COUNT(*) FILTER (WHERE stars=4),
+        COUNT(*) FILTER (WHERE stars=5)
+    ]
+    FROM reviews WHERE reviews.shop_id=shops.id
+);
+
+UPDATE products SET (rating_average, rating_count, rating_histogram) = (
+    SELECT COALESCE(ROUND(AVG(stars), 2), 0), COUNT(*), ARRAY[
+        COUNT(*) FILTER (WHERE stars=1),
+        COUNT(*) FILTER (WHERE stars=2),
+        COUNT(*) FILTER (WHERE stars=3),
+        COUNT(*) FILTER (WHERE stars=4),
+        COUNT(*) FILTER (WHERE stars=5)
+    ]
+    FROM reviews WHERE reviews.product_id=products.id
+);
\ No newline at end of file
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS reviews_user_shop_key;
+DROP INDEX IF EXISTS reviews_user_product_key;
+ALTER TABLE reviews DROP COLUMN IF EXISTS verified;
\ No newline at end of file
@@ -0,0 +1,20 @@
+ALTER TABLE reviews ADD COLUMN IF NOT EXISTS verified boolean NOT NULL DEFAULT false;
+
+UPDATE reviews AS r SET verified = EXISTS(
+    SELECT 1 FROM orders AS o
+    INNER JOIN order_products AS op ON o.id=op.order_id
+    LEFT JOIN products AS p ON p.id=op.product_id
+    WHERE o.user_id=r.user_id AND o.status IN (1, 2, 3) AND
+    CASE WHEN r.product_id IS NULL THEN p.shop_id=r.shop_id ELSE op.product_id=r.product_id END
+);
+
+-- Keep the oldest review when a user reviewed the same item more than once
+DELETE FROM reviews AS r USING reviews AS older
+WHERE r.user_id=older.user_id AND r.product_id IS NOT DISTINCT FROM older.product_id
+AND (r.product_id IS NOT NULL OR r.shop_id=older.shop_id)
+AND (r.created_at, r.id) > (older.created_at, older.id);
+
+CREATE UNIQUE INDEX IF NOT EXISTS reviews_user_product_key ON reviews (user_id, product_id)
+WHERE product_id IS NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS reviews_user_shop_key ON reviews (user_id, shop_id)
+WHERE product_id IS NULL;
\ No newline at end of file
@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS review_reports;
+DROP INDEX IF EXISTS reviews_status_idx;
+ALTER TABLE reviews
+    DROP COLUMN IF EXISTS status,
+    DROP COLUMN IF EXISTS moderation_reason,
+    DROP COLUMN IF EXISTS moderated_by,
+    DROP COLUMN IF EXISTS moderated_at;
\ No newline at end of file
@@ -0,0 +1,20 @@
+-- Reviews created before moderation existed are approved
+ALTER TABLE reviews
+    ADD COLUMN IF NOT EXISTS status text NOT NULL DEFAULT 'approved',
+    ADD COLUMN IF NOT EXISTS moderation_reason text,
+    ADD COLUMN IF NOT EXISTS moderated_by text REFERENCES users (id) ON DELETE SET NULL,
+    ADD COLUMN IF NOT EXISTS moderated_at timestamp with time zone;
+ALTER TABLE reviews ALTER COLUMN status SET DEFAULT 'pending';
+
+CREATE INDEX IF NOT EXISTS reviews_status_idx ON reviews (status);
+
+CREATE TABLE IF NOT EXISTS review_reports
+(
+    review_id text NOT NULL,
+    user_id text NOT NULL,
+    reason text NOT NULL,
+    created_at timestamp with time zone DEFAULT NOW(),
+    CONSTRAINT review_reports_pkey PRIMARY KEY (review_id, user_id),
+    FOREIGN KEY (review_id) REFERENCES reviews (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
\ No newline at end of file
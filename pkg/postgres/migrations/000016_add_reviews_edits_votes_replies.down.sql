@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS review_replies;
+DROP TABLE IF EXISTS review_votes;
+DROP TABLE IF EXISTS review_edits;
+ALTER TABLE reviews
+    DROP COLUMN IF EXISTS helpful_count,
+    DROP COLUMN IF EXISTS unhelpful_count,
+    DROP COLUMN IF EXISTS edited_at;
\ No newline at end of file
@@ -0,0 +1,36 @@
+ALTER TABLE reviews
+    ADD COLUMN IF NOT EXISTS helpful_count integer NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS unhelpful_count integer NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS edited_at timestamp with time zone;
+
+CREATE TABLE IF NOT EXISTS review_edits
+(
+    review_id text NOT NULL,
+    stars integer NOT NULL,
+    comment text,
+    edited_at timestamp with time zone DEFAULT NOW(),
+    FOREIGN KEY (review_id) REFERENCES reviews (id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS review_edits_review_id_idx ON review_edits (review_id);
+
+CREATE TABLE IF NOT EXISTS review_votes
+(
+    review_id text NOT NULL,
+    user_id text NOT NULL,
+    helpful boolean NOT NULL,
+    created_at timestamp with time zone DEFAULT NOW(),
+    CONSTRAINT review_votes_pkey PRIMARY KEY (review_id, user_id),
+    FOREIGN KEY (review_id) REFERENCES reviews (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS review_replies
+(
+    review_id text NOT NULL,
+    user_id text,
+    comment text NOT NULL,
+    created_at timestamp with time zone DEFAULT NOW(),
+    CONSTRAINT review_replies_pkey PRIMARY KEY (review_id),
+    FOREIGN KEY (review_id) REFERENCES reviews (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE SET NULL
+);
\ No newline at end of file
@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS user_roles
+(
+    user_id text NOT NULL,
+    role text NOT NULL,
+    granted_by text,
+    created_at timestamp with time zone DEFAULT NOW(),
+    CONSTRAINT user_roles_pkey PRIMARY KEY (user_id, role),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+    FOREIGN KEY (granted_by) REFERENCES users (id) ON DELETE SET NULL
+);
+CREATE INDEX IF NOT EXISTS user_roles_role_idx ON user_roles (role);
+
+INSERT INTO user_roles (user_id, role)
+SELECT id, 'customer' FROM users
+ON CONFLICT DO NOTHING;
+
+INSERT INTO user_roles (user_id, role)
+SELECT id, 'admin' FROM users WHERE is_admin
+ON CONFLICT DO NOTHING;
+
+ALTER TABLE users DROP COLUMN IF EXISTS is_admin;
\ No newline at end of file
@@ -0,0 +1,3 @@
+ALTER TABLE order_products DROP COLUMN IF EXISTS shop_id;
+DROP TABLE IF EXISTS shop_invitations;
+DROP TABLE IF EXISTS shop_members;
\ No newline at end of file
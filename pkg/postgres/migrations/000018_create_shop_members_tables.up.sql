@@ -0,0 +1,29 @@
+CREATE TABLE IF NOT EXISTS shop_members
+(
+    shop_id text NOT NULL,
+    user_id text NOT NULL,
+    role text NOT NULL CHECK (role IN ('owner', 'staff')),
+    created_at timestamp with time zone DEFAULT NOW(),
+    CONSTRAINT shop_members_pkey PRIMARY KEY (shop_id, user_id),
+    FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS shop_invitations
+(
+    token_hash text NOT NULL,
+    shop_id text NOT NULL,
+    email text NOT NULL,
+    invited_by text,
+    expires_at timestamp with time zone NOT NULL,
+    created_at timestamp with time zone DEFAULT NOW(),
+    CONSTRAINT shop_invitations_pkey PRIMARY KEY (token_hash),
+    FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE CASCADE,
+    FOREIGN KEY (invited_by) REFERENCES users (id) ON DELETE SET NULL
+);
+CREATE INDEX IF NOT EXISTS shop_members_user_id_idx ON shop_members (user_id);
+
+ALTER TABLE order_products ADD COLUMN IF NOT EXISTS shop_id text;
+UPDATE order_products AS op SET shop_id = p.shop_id
+FROM products AS p WHERE p.id = op.product_id;
+CREATE INDEX IF NOT EXISTS order_products_shop_id_idx ON order_products (shop_id);
\ No newline at end of file
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS locations_earth_idx;
+ALTER TABLE locations DROP COLUMN IF EXISTS longitude;
+ALTER TABLE locations DROP COLUMN IF EXISTS latitude;
\ No newline at end of file
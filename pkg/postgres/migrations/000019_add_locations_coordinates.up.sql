@@ -0,0 +1,7 @@
+CREATE EXTENSION IF NOT EXISTS cube;
+CREATE EXTENSION IF NOT EXISTS earthdistance;
+
+ALTER TABLE locations ADD COLUMN IF NOT EXISTS latitude double precision;
+ALTER TABLE locations ADD COLUMN IF NOT EXISTS longitude double precision;
+CREATE INDEX IF NOT EXISTS locations_earth_idx ON locations USING gist (ll_to_earth(latitude, longitude))
+WHERE latitude IS NOT NULL AND longitude IS NOT NULL;
\ No newline at end of file
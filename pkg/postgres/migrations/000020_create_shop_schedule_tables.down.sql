@@ -0,0 +1,4 @@
+DROP FUNCTION IF EXISTS shop_open(text, text, timestamp with time zone);
+DROP TABLE IF EXISTS shop_holidays;
+DROP TABLE IF EXISTS shop_hours;
+ALTER TABLE shops DROP COLUMN IF EXISTS timezone;
\ No newline at end of file
@@ -0,0 +1,34 @@
+ALTER TABLE shops ADD COLUMN IF NOT EXISTS timezone text NOT NULL DEFAULT 'UTC';
+
+CREATE TABLE IF NOT EXISTS shop_hours
+(
+    shop_id text NOT NULL,
+    weekday smallint NOT NULL CHECK (weekday BETWEEN 0 AND 6),
+    opens_at time NOT NULL,
+    closes_at time NOT NULL,
+    FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS shop_holidays
+(
+    shop_id text NOT NULL,
+    date date NOT NULL,
+    name text NOT NULL DEFAULT '',
+    CONSTRAINT shop_holidays_pkey PRIMARY KEY (shop_id, date),
+    FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS shop_hours_shop_id_idx ON shop_hours (shop_id, weekday);
+
+CREATE OR REPLACE FUNCTION shop_open(shop text, tz text, ts timestamp with time zone) RETURNS boolean AS $$
+  SELECT NOT EXISTS (
+    SELECT 1 FROM shop_holidays WHERE shop_id = shop AND date = (ts AT TIME ZONE tz)::date
+  ) AND (NOT EXISTS (SELECT 1 FROM shop_hours WHERE shop_id = shop) OR EXISTS (
+    SELECT 1 FROM shop_hours AS h, LATERAL (SELECT ts AT TIME ZONE tz AS local_ts) AS l
+    WHERE h.shop_id = shop AND (
+      (h.weekday = EXTRACT(DOW FROM l.local_ts) AND l.local_ts::time >= h.opens_at
+        AND (l.local_ts::time < h.closes_at OR h.closes_at <= h.opens_at))
+      OR (h.weekday = EXTRACT(DOW FROM l.local_ts - interval '1 day') AND h.closes_at <= h.opens_at
+        AND l.local_ts::time < h.closes_at)
+    )
+  ))
+$$ LANGUAGE sql STABLE;
\ No newline at end of file
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS delivery_zones
+(
+    shop_id text NOT NULL,
+    type text NOT NULL CHECK (type IN ('zip_codes', 'region', 'radius')),
+    country text NOT NULL DEFAULT '',
+    zip_codes text[] NOT NULL DEFAULT '{}',
+    states text[] NOT NULL DEFAULT '{}',
+    radius double precision NOT NULL DEFAULT 0,
+    FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS delivery_zones_shop_id_idx ON delivery_zones (shop_id);
\ No newline at end of file
@@ -0,0 +1,4 @@
+ALTER TABLE orders DROP COLUMN IF EXISTS collected_at;
+ALTER TABLE orders DROP COLUMN IF EXISTS pickup_code;
+ALTER TABLE orders DROP COLUMN IF EXISTS pickup_shop_id;
+ALTER TABLE orders DROP COLUMN IF EXISTS fulfilment;
\ No newline at end of file
@@ -0,0 +1,5 @@
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS fulfilment text NOT NULL DEFAULT 'delivery'
+    CHECK (fulfilment IN ('delivery', 'pickup'));
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS pickup_shop_id text REFERENCES shops (id) ON DELETE SET NULL;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS pickup_code text;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS collected_at timestamp with time zone;
\ No newline at end of file
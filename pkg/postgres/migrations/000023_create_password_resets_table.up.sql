@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS password_resets
+(
+    token_hash text NOT NULL,
+    user_id text NOT NULL,
+    expires_at timestamp with time zone NOT NULL,
+    created_at timestamp with time zone DEFAULT NOW(),
+    CONSTRAINT password_resets_pkey PRIMARY KEY (token_hash),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
\ No newline at end of file
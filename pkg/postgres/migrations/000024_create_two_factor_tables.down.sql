@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS two_factor_roles;
+DROP TABLE IF EXISTS recovery_codes;
+DROP TABLE IF EXISTS two_factor;
\ No newline at end of file
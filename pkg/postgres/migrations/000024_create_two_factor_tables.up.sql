@@ -0,0 +1,28 @@
+CREATE TABLE IF NOT EXISTS two_factor
+(
+    user_id text NOT NULL,
+    secret bytea NOT NULL,
+    enabled boolean NOT NULL DEFAULT false,
+    last_counter bigint NOT NULL DEFAULT 0,
+    enabled_at timestamp with time zone,
+    created_at timestamp with time zone DEFAULT NOW(),
+    CONSTRAINT two_factor_pkey PRIMARY KEY (user_id),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS recovery_codes
+(
+    user_id text NOT NULL,
+    code_hash text NOT NULL,
+    CONSTRAINT recovery_codes_pkey PRIMARY KEY (user_id, code_hash),
+    FOREIGN KEY (user_id) REFERENCES two_factor (user_id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS two_factor_roles
+(
+    role text NOT NULL,
+    set_by text,
+    created_at timestamp with time zone DEFAULT NOW(),
+    CONSTRAINT two_factor_roles_pkey PRIMARY KEY (role),
+    FOREIGN KEY (set_by) REFERENCES users (id) ON DELETE SET NULL
+);
\ No newline at end of file
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS identities
+(
+    provider text NOT NULL,
+    subject text NOT NULL,
+    user_id text NOT NULL,
+    email text NOT NULL DEFAULT '',
+    created_at timestamp with time zone DEFAULT NOW(),
+    CONSTRAINT identities_pkey PRIMARY KEY (provider, subject),
+    CONSTRAINT identities_user_id_provider_key UNIQUE (user_id, provider),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
\ No newline at end of file
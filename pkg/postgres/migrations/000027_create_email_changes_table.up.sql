@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS email_changes
+(
+    token_hash text NOT NULL,
+    user_id text NOT NULL,
+    kind text NOT NULL CHECK (kind IN ('confirm', 'revert')),
+    old_email text NOT NULL,
+    new_email text NOT NULL,
+    expires_at timestamp with time zone NOT NULL,
+    created_at timestamp with time zone DEFAULT NOW(),
+    CONSTRAINT email_changes_pkey PRIMARY KEY (token_hash),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
\ No newline at end of file
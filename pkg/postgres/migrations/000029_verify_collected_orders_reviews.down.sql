@@ -0,0 +1,8 @@
+UPDATE reviews AS r SET verified = EXISTS(
+    SELECT 1 FROM orders AS o
+    INNER JOIN order_products AS op ON o.id=op.order_id
+    LEFT JOIN products AS p ON p.id=op.product_id
+    WHERE o.user_id=r.user_id AND o.status IN (1, 2, 3) AND
+    CASE WHEN r.product_id IS NULL THEN p.shop_id=r.shop_id ELSE op.product_id=r.product_id END
+)
+WHERE r.verified;
\ No newline at end of file
@@ -0,0 +1,10 @@
+-- Orders collected at the shop (status 5, ordering.Collected) are purchases too, along with the
+-- paid (1), shipping (2) and shipped (3) ones
+UPDATE reviews AS r SET verified = true
+WHERE NOT r.verified AND EXISTS(
+    SELECT 1 FROM orders AS o
+    INNER JOIN order_products AS op ON o.id=op.order_id
+    LEFT JOIN products AS p ON p.id=op.product_id
+    WHERE o.user_id=r.user_id AND o.status IN (1, 2, 3, 5) AND
+    CASE WHEN r.product_id IS NULL THEN p.shop_id=r.shop_id ELSE op.product_id=r.product_id END
+);
\ No newline at end of file
@@ -0,0 +1 @@
+UPDATE api_keys SET scopes = array_remove(scopes, 'account');
\ No newline at end of file
@@ -0,0 +1,2 @@
+-- Keys created before the account scope existed could access every endpoint requiring a login
+UPDATE api_keys SET scopes = array_append(scopes, 'account') WHERE NOT 'account' = ANY(scopes);
\ No newline at end of file
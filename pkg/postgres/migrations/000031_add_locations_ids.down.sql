@@ -0,0 +1,6 @@
+ALTER TABLE orders DROP COLUMN IF EXISTS pickup_location_id;
+
+DROP INDEX IF EXISTS locations_shop_id_idx;
+ALTER TABLE locations DROP CONSTRAINT IF EXISTS locations_pkey;
+ALTER TABLE locations DROP COLUMN IF EXISTS created_at;
+ALTER TABLE locations DROP COLUMN IF EXISTS id;
\ No newline at end of file
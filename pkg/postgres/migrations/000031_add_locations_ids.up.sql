@@ -0,0 +1,10 @@
+-- Existing locations get a random id
+ALTER TABLE locations ADD COLUMN IF NOT EXISTS id text;
+ALTER TABLE locations ADD COLUMN IF NOT EXISTS created_at timestamp with time zone NOT NULL DEFAULT NOW();
+UPDATE locations SET id = md5(random()::text || clock_timestamp()::text)::uuid::text WHERE id IS NULL;
+ALTER TABLE locations ALTER COLUMN id SET NOT NULL;
+ALTER TABLE locations ADD CONSTRAINT locations_pkey PRIMARY KEY (id);
+CREATE INDEX IF NOT EXISTS locations_shop_id_idx ON locations (shop_id);
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS pickup_location_id text
+REFERENCES locations (id) ON DELETE SET NULL;
\ No newline at end of file
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS users_email_key;
\ No newline at end of file
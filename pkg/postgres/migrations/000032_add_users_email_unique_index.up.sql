@@ -0,0 +1,26 @@
+-- Unverified accounts sharing their email with another one are deleted along with their carts,
+-- like the ones holding an email that gets verified by another account
+WITH deleted AS (
+    DELETE FROM users WHERE id IN (
+        SELECT id FROM (
+            SELECT id, verified_email, row_number() OVER (
+                PARTITION BY lower(email) ORDER BY verified_email DESC NULLS LAST, created_at, id
+            ) AS n
+            FROM users
+        ) AS ranked
+        WHERE n > 1 AND NOT COALESCE(verified_email, false)
+    ) RETURNING cart_id
+)
+DELETE FROM carts WHERE id IN (SELECT cart_id FROM deleted);
+
+-- The oldest of the verified accounts keeps the email, the others get an unusable one
+UPDATE users SET email = id || '@duplicate.invalid', verified_email = false
+WHERE id IN (
+    SELECT id FROM (
+        SELECT id, row_number() OVER (PARTITION BY lower(email) ORDER BY created_at, id) AS n
+        FROM users
+    ) AS ranked
+    WHERE n > 1
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_key ON users (lower(email));
\ No newline at end of file
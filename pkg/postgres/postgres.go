@@ -34,16 +34,28 @@ func Connect(ctx context.Context, c config.Postgres) (*sqlx.DB, error) {
 	return db, nil
 }
 
-// Migrate creates database tables, indexes and triggers.
+// Migrate creates database tables, indexes, text search configurations, functions and triggers.
 func Migrate(ctx context.Context, db *sqlx.DB) error {
 	if err := createTables(ctx, db); err != nil {
 		return err
 	}
 
+	if err := deduplicateEmails(ctx, db); err != nil {
+		return err
+	}
+
 	if err := createIndexes(ctx, db); err != nil {
 		return err
 	}
 
+	if err := createTextSearch(ctx, db); err != nil {
+		return err
+	}
+
+	if err := createFunctions(ctx, db); err != nil {
+		return err
+	}
+
 	return createTriggers(ctx, db)
 }
 
@@ -56,6 +68,15 @@ func createTables(ctx context.Context, db *sqlx.DB) error {
 	return nil
 }
 
+// deduplicateEmails leaves a single account per case-insensitive email so the
+// users_email_key index can be created.
+func deduplicateEmails(ctx context.Context, db *sqlx.DB) error {
+	if _, err := db.ExecContext(ctx, duplicateEmails); err != nil {
+		return errors.Wrap(err, "couldn't deduplicate the users emails")
+	}
+	return nil
+}
+
 // createIndexes creates database indexes.
 func createIndexes(ctx context.Context, db *sqlx.DB) error {
 	if _, err := db.ExecContext(ctx, indexes); err != nil {
@@ -64,6 +85,22 @@ func createIndexes(ctx context.Context, db *sqlx.DB) error {
 	return nil
 }
 
+// createTextSearch creates the text search configurations used by the triggers.
+func createTextSearch(ctx context.Context, db *sqlx.DB) error {
+	if _, err := db.ExecContext(ctx, textSearch); err != nil {
+		return errors.Wrap(err, "couldn't create text search configurations")
+	}
+	return nil
+}
+
+// createFunctions creates the database functions used by the queries.
+func createFunctions(ctx context.Context, db *sqlx.DB) error {
+	if _, err := db.ExecContext(ctx, functions); err != nil {
+		return errors.Wrap(err, "couldn't create functions")
+	}
+	return nil
+}
+
 // createTriggers creates database functions and its triggers.
 func createTriggers(ctx context.Context, db *sqlx.DB) error {
 	if _, err := db.ExecContext(ctx, triggers); err != nil {
@@ -82,7 +119,6 @@ CREATE TABLE IF NOT EXISTS users
     email text NOT NULL,
     password text NOT NULL,
     verified_email boolean DEFAULT false,
-    is_admin boolean DEFAULT false,
     confirmation_code text,
     search tsvector,
     created_at timestamp with time zone DEFAULT NOW(),
@@ -90,24 +126,187 @@ CREATE TABLE IF NOT EXISTS users
     CONSTRAINT users_pkey PRIMARY KEY (id)
 );
 
+CREATE TABLE IF NOT EXISTS user_roles
+(
+    user_id text NOT NULL,
+    role text NOT NULL,
+    granted_by text,
+    created_at timestamp with time zone DEFAULT NOW(),
+    CONSTRAINT user_roles_pkey PRIMARY KEY (user_id, role),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+    FOREIGN KEY (granted_by) REFERENCES users (id) ON DELETE SET NULL
+);
+
+CREATE TABLE IF NOT EXISTS password_resets
+(
+    token_hash text NOT NULL,
+    user_id text NOT NULL,
+    expires_at timestamp with time zone NOT NULL,
+    created_at timestamp with time zone DEFAULT NOW(),
+    CONSTRAINT password_resets_pkey PRIMARY KEY (token_hash),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS email_changes
+(
+    token_hash text NOT NULL,
+    user_id text NOT NULL,
+    kind text NOT NULL CHECK (kind IN ('confirm', 'revert')),
+    old_email text NOT NULL,
+    new_email text NOT NULL,
+    expires_at timestamp with time zone NOT NULL,
+    created_at timestamp with time zone DEFAULT NOW(),
+    CONSTRAINT email_changes_pkey PRIMARY KEY (token_hash),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS email_verifications
+(
+    token_hash text NOT NULL,
+    user_id text NOT NULL,
+    expires_at timestamp with time zone NOT NULL,
+    created_at timestamp with time zone DEFAULT NOW(),
+    CONSTRAINT email_verifications_pkey PRIMARY KEY (token_hash),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS two_factor
+(
+    user_id text NOT NULL,
+    secret bytea NOT NULL,
+    enabled boolean NOT NULL DEFAULT false,
+    last_counter bigint NOT NULL DEFAULT 0,
+    enabled_at timestamp with time zone,
+    created_at timestamp with time zone DEFAULT NOW(),
+    CONSTRAINT two_factor_pkey PRIMARY KEY (user_id),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS recovery_codes
+(
+    user_id text NOT NULL,
+    code_hash text NOT NULL,
+    CONSTRAINT recovery_codes_pkey PRIMARY KEY (user_id, code_hash),
+    FOREIGN KEY (user_id) REFERENCES two_factor (user_id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS two_factor_roles
+(
+    role text NOT NULL,
+    set_by text,
+    created_at timestamp with time zone DEFAULT NOW(),
+    CONSTRAINT two_factor_roles_pkey PRIMARY KEY (role),
+    FOREIGN KEY (set_by) REFERENCES users (id) ON DELETE SET NULL
+);
+
+CREATE TABLE IF NOT EXISTS api_keys
+(
+    id text NOT NULL,
+    user_id text NOT NULL,
+    name text NOT NULL,
+    key_hash text NOT NULL,
+    scopes text[] NOT NULL DEFAULT '{}',
+    expires_at timestamp with time zone,
+    last_used_at timestamp with time zone,
+    created_at timestamp with time zone DEFAULT NOW(),
+    CONSTRAINT api_keys_pkey PRIMARY KEY (id),
+    CONSTRAINT api_keys_key_hash_key UNIQUE (key_hash),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS identities
+(
+    provider text NOT NULL,
+    subject text NOT NULL,
+    user_id text NOT NULL,
+    email text NOT NULL DEFAULT '',
+    created_at timestamp with time zone DEFAULT NOW(),
+    CONSTRAINT identities_pkey PRIMARY KEY (provider, subject),
+    CONSTRAINT identities_user_id_provider_key UNIQUE (user_id, provider),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
 CREATE TABLE IF NOT EXISTS shops
 (
     id text NOT NULL,
     name text NOT NULL,
+    language text NOT NULL DEFAULT 'en',
+    timezone text NOT NULL DEFAULT 'UTC',
+    rating_average numeric(3,2) NOT NULL DEFAULT 0,
+    rating_count integer NOT NULL DEFAULT 0,
+    rating_histogram integer[] NOT NULL DEFAULT '{0,0,0,0,0}',
     search tsvector,
     created_at timestamp with time zone DEFAULT NOW(),
     updated_at timestamp with time zone,
     CONSTRAINT shops_pkey PRIMARY KEY (id)
 );
 
+CREATE TABLE IF NOT EXISTS shop_hours
+(
+    shop_id text NOT NULL,
+    weekday smallint NOT NULL CHECK (weekday BETWEEN 0 AND 6),
+    opens_at time NOT NULL,
+    closes_at time NOT NULL,
+    FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS shop_holidays
+(
+    shop_id text NOT NULL,
+    date date NOT NULL,
+    name text NOT NULL DEFAULT '',
+    CONSTRAINT shop_holidays_pkey PRIMARY KEY (shop_id, date),
+    FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS shop_members
+(
+    shop_id text NOT NULL,
+    user_id text NOT NULL,
+    role text NOT NULL CHECK (role IN ('owner', 'staff')),
+    created_at timestamp with time zone DEFAULT NOW(),
+    CONSTRAINT shop_members_pkey PRIMARY KEY (shop_id, user_id),
+    FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS shop_invitations
+(
+    token_hash text NOT NULL,
+    shop_id text NOT NULL,
+    email text NOT NULL,
+    invited_by text,
+    expires_at timestamp with time zone NOT NULL,
+    created_at timestamp with time zone DEFAULT NOW(),
+    CONSTRAINT shop_invitations_pkey PRIMARY KEY (token_hash),
+    FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE CASCADE,
+    FOREIGN KEY (invited_by) REFERENCES users (id) ON DELETE SET NULL
+);
+
 CREATE TABLE IF NOT EXISTS locations
 (
+    id text NOT NULL,
     shop_id text NOT NULL,
     country text NOT NULL,
     state text NOT NULL,
     zip_code text NOT NULL,
     city text NOT NULL,
     address text NOT NULL,
+    latitude double precision,
+    longitude double precision,
+    created_at timestamp with time zone NOT NULL DEFAULT NOW(),
+    CONSTRAINT locations_pkey PRIMARY KEY (id),
+    FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS delivery_zones
+(
+    shop_id text NOT NULL,
+    type text NOT NULL CHECK (type IN ('zip_codes', 'region', 'radius')),
+    country text NOT NULL DEFAULT '',
+    zip_codes text[] NOT NULL DEFAULT '{}',
+    states text[] NOT NULL DEFAULT '{}',
+    radius double precision NOT NULL DEFAULT 0,
     FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE CASCADE
 );
 
@@ -125,6 +324,10 @@ CREATE TABLE IF NOT EXISTS products
     discount integer,
     subtotal integer NOT NULL,
     total integer NOT NULL,
+    language text NOT NULL DEFAULT 'en',
+    rating_average numeric(3,2) NOT NULL DEFAULT 0,
+    rating_count integer NOT NULL DEFAULT 0,
+    rating_histogram integer[] NOT NULL DEFAULT '{0,0,0,0,0}',
     search tsvector,
     created_at timestamp with time zone DEFAULT NOW(),
     updated_at timestamp with time zone,
@@ -135,16 +338,67 @@ CREATE TABLE IF NOT EXISTS products
 CREATE TABLE IF NOT EXISTS reviews
 (
     id text NOT NULL,
-    stars integer NOT NULL,
+    stars integer NOT NULL CHECK (stars BETWEEN 1 AND 5),
     comment text,
     user_id text NOT NULL,
     product_id text,
     shop_id text,
+    verified boolean NOT NULL DEFAULT false,
+    status text NOT NULL DEFAULT 'pending',
+    moderation_reason text,
+    moderated_by text,
+    moderated_at timestamp with time zone,
+    helpful_count integer NOT NULL DEFAULT 0,
+    unhelpful_count integer NOT NULL DEFAULT 0,
+    edited_at timestamp with time zone,
     created_at timestamp with time zone DEFAULT NOW(),
     CONSTRAINT reviews_pkey PRIMARY KEY (id),
     FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
     FOREIGN KEY (product_id) REFERENCES products (id) ON DELETE CASCADE,
-    FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE CASCADE
+    FOREIGN KEY (shop_id) REFERENCES shops (id) ON DELETE CASCADE,
+    FOREIGN KEY (moderated_by) REFERENCES users (id) ON DELETE SET NULL
+);
+
+CREATE TABLE IF NOT EXISTS review_reports
+(
+    review_id text NOT NULL,
+    user_id text NOT NULL,
+    reason text NOT NULL,
+    created_at timestamp with time zone DEFAULT NOW(),
+    CONSTRAINT review_reports_pkey PRIMARY KEY (review_id, user_id),
+    FOREIGN KEY (review_id) REFERENCES reviews (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS review_edits
+(
+    review_id text NOT NULL,
+    stars integer NOT NULL,
+    comment text,
+    edited_at timestamp with time zone DEFAULT NOW(),
+    FOREIGN KEY (review_id) REFERENCES reviews (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS review_votes
+(
+    review_id text NOT NULL,
+    user_id text NOT NULL,
+    helpful boolean NOT NULL,
+    created_at timestamp with time zone DEFAULT NOW(),
+    CONSTRAINT review_votes_pkey PRIMARY KEY (review_id, user_id),
+    FOREIGN KEY (review_id) REFERENCES reviews (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS review_replies
+(
+    review_id text NOT NULL,
+    user_id text,
+    comment text NOT NULL,
+    created_at timestamp with time zone DEFAULT NOW(),
+    CONSTRAINT review_replies_pkey PRIMARY KEY (review_id),
+    FOREIGN KEY (review_id) REFERENCES reviews (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE SET NULL
 );
 
 CREATE TABLE IF NOT EXISTS carts
@@ -196,8 +450,15 @@ CREATE TABLE IF NOT EXISTS orders
     created_at timestamp with time zone DEFAULT NOW(),
     ordered_at timestamp with time zone,
     delivery_date timestamp with time zone,
+    fulfilment text NOT NULL DEFAULT 'delivery' CHECK (fulfilment IN ('delivery', 'pickup')),
+    pickup_shop_id text,
+    pickup_location_id text,
+    pickup_code text,
+    collected_at timestamp with time zone,
     CONSTRAINT orders_pkey PRIMARY KEY (id),
-    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+    FOREIGN KEY (pickup_shop_id) REFERENCES shops (id) ON DELETE SET NULL,
+    FOREIGN KEY (pickup_location_id) REFERENCES locations (id) ON DELETE SET NULL
 );
 
 CREATE TABLE IF NOT EXISTS order_carts
@@ -216,6 +477,7 @@ CREATE TABLE IF NOT EXISTS order_products
 (
     order_id text NOT NULL,
     product_id text NOT NULL,
+    shop_id text,
     quantity integer,
     brand text,
     category text,
@@ -232,7 +494,37 @@ CREATE TABLE IF NOT EXISTS order_products
         DEFERRABLE INITIALLY DEFERRED
 );`
 
+// Unverified accounts sharing their email with another one are deleted along with their carts, like
+// the ones holding an email that gets verified by another account. The oldest of the verified accounts
+// keeps the email and the others get an unusable one.
+const duplicateEmails = `
+WITH deleted AS (
+    DELETE FROM users WHERE id IN (
+        SELECT id FROM (
+            SELECT id, verified_email, row_number() OVER (
+                PARTITION BY lower(email) ORDER BY verified_email DESC NULLS LAST, created_at, id
+            ) AS n
+            FROM users
+        ) AS ranked
+        WHERE n > 1 AND NOT COALESCE(verified_email, false)
+    ) RETURNING cart_id
+)
+DELETE FROM carts WHERE id IN (SELECT cart_id FROM deleted);
+
+UPDATE users SET email = id || '@duplicate.invalid', verified_email = false
+WHERE id IN (
+    SELECT id FROM (
+        SELECT id, row_number() OVER (PARTITION BY lower(email) ORDER BY created_at, id) AS n
+        FROM users
+    ) AS ranked
+    WHERE n > 1
+);`
+
 const indexes = `
+-- earthdistance (and cube, which it depends on) provides the functions used to search nearby shops
+CREATE EXTENSION IF NOT EXISTS cube;
+CREATE EXTENSION IF NOT EXISTS earthdistance;
+
 CREATE INDEX ON users USING GIN (search);
 CREATE INDEX ON shops USING GIN (search);
 CREATE INDEX ON products USING GIN (search);
@@ -241,12 +533,91 @@ CREATE INDEX ON users (created_at);
 CREATE INDEX ON shops (created_at);
 CREATE INDEX ON products (created_at);
 CREATE INDEX ON reviews (created_at);
-CREATE INDEX ON orders (created_at);`
+CREATE INDEX ON orders (created_at);
+
+CREATE UNIQUE INDEX IF NOT EXISTS reviews_user_product_key ON reviews (user_id, product_id) 
+WHERE product_id IS NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS reviews_user_shop_key ON reviews (user_id, shop_id) 
+WHERE product_id IS NULL;
+CREATE INDEX IF NOT EXISTS reviews_status_idx ON reviews (status);
+CREATE INDEX IF NOT EXISTS review_edits_review_id_idx ON review_edits (review_id);
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_key ON users (lower(email));
+CREATE INDEX IF NOT EXISTS user_roles_role_idx ON user_roles (role);
+CREATE INDEX IF NOT EXISTS shop_members_user_id_idx ON shop_members (user_id);
+CREATE INDEX IF NOT EXISTS order_products_shop_id_idx ON order_products (shop_id);
+CREATE INDEX IF NOT EXISTS shop_hours_shop_id_idx ON shop_hours (shop_id, weekday);
+CREATE INDEX IF NOT EXISTS delivery_zones_shop_id_idx ON delivery_zones (shop_id);
+CREATE INDEX IF NOT EXISTS locations_shop_id_idx ON locations (shop_id);
+CREATE INDEX IF NOT EXISTS api_keys_user_id_idx ON api_keys (user_id);
+CREATE INDEX IF NOT EXISTS locations_earth_idx ON locations USING gist (ll_to_earth(latitude, longitude))
+WHERE latitude IS NOT NULL AND longitude IS NOT NULL;`
+
+// Each supported language gets a configuration that strips accents before stemming,
+// search_config() maps ISO 639-1 codes to them and falls back to english.
+// Languages without a snowball stemmer use the simple dictionary.
+const textSearch = `
+CREATE EXTENSION IF NOT EXISTS unaccent;
+
+DO $$
+DECLARE
+  cfg text[];
+BEGIN
+  FOREACH cfg SLICE 1 IN ARRAY ARRAY[
+    ['simple', 'simple'],
+    ['english', 'english_stem'],
+    ['spanish', 'spanish_stem'],
+    ['portuguese', 'portuguese_stem'],
+    ['german', 'german_stem'],
+    ['french', 'french_stem'],
+    ['italian', 'italian_stem'],
+    ['russian', 'russian_stem']
+  ] LOOP
+    IF NOT EXISTS (SELECT 1 FROM pg_ts_config WHERE cfgname = 'adak_' || cfg[1]) THEN
+      EXECUTE format('CREATE TEXT SEARCH CONFIGURATION adak_%s (COPY = %s)', cfg[1], cfg[1]);
+      EXECUTE format('ALTER TEXT SEARCH CONFIGURATION adak_%s
+        ALTER MAPPING FOR hword, hword_part, word WITH unaccent, %s', cfg[1], cfg[2]);
+    END IF;
+  END LOOP;
+END
+$$;
+
+CREATE OR REPLACE FUNCTION search_config(lang text) RETURNS regconfig AS $$
+  SELECT CASE lang
+    WHEN 'es' THEN 'adak_spanish'
+    WHEN 'pt' THEN 'adak_portuguese'
+    WHEN 'de' THEN 'adak_german'
+    WHEN 'fr' THEN 'adak_french'
+    WHEN 'it' THEN 'adak_italian'
+    WHEN 'ru' THEN 'adak_russian'
+    WHEN 'zh' THEN 'adak_simple'
+    WHEN 'hi' THEN 'adak_simple'
+    WHEN 'ja' THEN 'adak_simple'
+    ELSE 'adak_english'
+  END::regconfig
+$$ LANGUAGE sql STABLE;`
+
+// shop_open tells whether a shop is open at a given time, it mirrors shop.Schedule.OpenAt().
+// Ranges closing at or before the time they open finish on the following day and shops
+// without opening hours are considered always open.
+const functions = `
+CREATE OR REPLACE FUNCTION shop_open(shop text, tz text, ts timestamp with time zone) RETURNS boolean AS $$
+  SELECT NOT EXISTS (
+    SELECT 1 FROM shop_holidays WHERE shop_id = shop AND date = (ts AT TIME ZONE tz)::date
+  ) AND (NOT EXISTS (SELECT 1 FROM shop_hours WHERE shop_id = shop) OR EXISTS (
+    SELECT 1 FROM shop_hours AS h, LATERAL (SELECT ts AT TIME ZONE tz AS local_ts) AS l
+    WHERE h.shop_id = shop AND (
+      (h.weekday = EXTRACT(DOW FROM l.local_ts) AND l.local_ts::time >= h.opens_at
+        AND (l.local_ts::time < h.closes_at OR h.closes_at <= h.opens_at))
+      OR (h.weekday = EXTRACT(DOW FROM l.local_ts - interval '1 day') AND h.closes_at <= h.opens_at
+        AND l.local_ts::time < h.closes_at)
+    )
+  ))
+$$ LANGUAGE sql STABLE;`
 
 const triggers = `
 CREATE OR REPLACE FUNCTION users_tsvector_trigger() RETURNS trigger AS $$
 BEGIN
-  new.search := to_tsvector('english', new.username);
+  new.search := to_tsvector('adak_simple', new.username);
   return new;
 END
 $$ LANGUAGE plpgsql;
@@ -260,7 +631,7 @@ CREATE TRIGGER users_tsvector_update BEFORE INSERT OR UPDATE
     
 CREATE OR REPLACE FUNCTION shops_tsvector_trigger() RETURNS trigger AS $$
 BEGIN
-  new.search := to_tsvector('english', new.name);
+  new.search := to_tsvector(search_config(new.language), new.name);
   return new;
 END
 $$ LANGUAGE plpgsql;
@@ -275,9 +646,9 @@ CREATE TRIGGER shops_tsvector_update BEFORE INSERT OR UPDATE
 CREATE OR REPLACE FUNCTION products_tsvector_trigger() RETURNS trigger AS $$
 BEGIN
   new.search :=
-  setweight(to_tsvector('english', new.type), 'A')
-  || setweight(to_tsvector('english', new.category), 'B')
-  || setweight(to_tsvector('english', new.brand), 'C');
+  setweight(to_tsvector(search_config(new.language), new.type), 'A')
+  || setweight(to_tsvector(search_config(new.language), new.category), 'B')
+  || setweight(to_tsvector(search_config(new.language), new.brand), 'C');
   return new;
 END
 $$ LANGUAGE plpgsql;
@@ -31,3 +31,38 @@ func TestConnect(t *testing.T) {
 	})
 	assert.NoError(t, err)
 }
+
+func TestMigrateDuplicateEmails(t *testing.T) {
+	ctx := context.Background()
+	db := test.StartPostgres(t)
+
+	// Databases created before the index existed may contain duplicates
+	_, err := db.Exec("DROP INDEX users_email_key")
+	assert.NoError(t, err)
+
+	q := `INSERT INTO users (id, cart_id, username, email, password, verified_email, created_at)
+	VALUES ($1, $1, $1, $2, '', $3, NOW() - $4 * INTERVAL '1 day')`
+	users := []struct {
+		id       string
+		email    string
+		verified bool
+		age      int
+	}{
+		{id: "oldest", email: "dup@test.com", verified: true, age: 3},
+		{id: "newer", email: "DUP@test.com", verified: true, age: 2},
+		{id: "unverified", email: "Dup@test.com", verified: false, age: 4},
+	}
+	for _, u := range users {
+		_, err := db.Exec(q, u.id, u.email, u.verified, u.age)
+		assert.NoError(t, err)
+	}
+
+	assert.NoError(t, postgres.Migrate(ctx, db))
+
+	var emails []string
+	assert.NoError(t, db.Select(&emails, "SELECT email FROM users ORDER BY created_at"))
+	assert.Equal(t, []string{"dup@test.com", "newer@duplicate.invalid"}, emails)
+
+	_, err = db.Exec("INSERT INTO users (id, cart_id, username, email, password) VALUES ('other', 'other', 'other', 'Dup@Test.com', '')")
+	assert.Error(t, err, "Emails must be unique case-insensitively")
+}
@@ -34,3 +34,12 @@ func AddPagination(query string, params params.Query) (string, []interface{}) {
 
 	return buf.String(), args
 }
+
+// SearchOrder returns the ORDER BY expression for full-text search results, the alias
+// is the one of the table searched and the query must be named "query".
+func SearchOrder(alias, sort string) string {
+	if sort == params.SortRating {
+		return alias + ".rating_average DESC, " + alias + ".rating_count DESC, " + alias + ".id"
+	}
+	return "ts_rank(" + alias + ".search, query) DESC, " + alias + ".id"
+}
@@ -7,12 +7,12 @@ import (
 
 	"github.com/GGP1/adak/internal/params"
 	"github.com/GGP1/adak/internal/response"
-	"github.com/GGP1/adak/internal/sanitize"
 	"github.com/GGP1/adak/internal/validate"
+	"github.com/GGP1/adak/pkg/shop/member"
 	"github.com/google/uuid"
 
 	"github.com/bradfitz/gomemcache/memcache"
-	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
 	"gopkg.in/guregu/null.v4/zero"
 )
 
@@ -35,8 +35,8 @@ func NewHandler(service Service, cache *memcache.Client) Handler {
 	}
 }
 
-// Create creates a new product and saves it.
-func (h *Handler) Create() http.HandlerFunc {
+// Create creates a new product and saves it, only the shop members can do it.
+func (h *Handler) Create(members member.Service) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 
@@ -52,6 +52,16 @@ func (h *Handler) Create() http.HandlerFunc {
 			return
 		}
 
+		if p.Language.Valid && !params.SupportedLanguage(p.Language.String) {
+			response.Error(w, http.StatusBadRequest, errors.Errorf("unsupported language %q", p.Language.String))
+			return
+		}
+
+		if _, err := member.Authorize(r, members, p.ShopID.String, member.Owner, member.Staff); err != nil {
+			response.Error(w, http.StatusForbidden, err)
+			return
+		}
+
 		p.ID = zero.StringFrom(uuid.NewString())
 		p.CreatedAt = zero.TimeFrom(time.Now())
 		if err := h.service.Create(ctx, p); err != nil {
@@ -63,8 +73,8 @@ func (h *Handler) Create() http.HandlerFunc {
 	}
 }
 
-// Delete removes a product.
-func (h *Handler) Delete() http.HandlerFunc {
+// Delete removes a product, only the shop owner can do it.
+func (h *Handler) Delete(members member.Service) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 
@@ -74,6 +84,11 @@ func (h *Handler) Delete() http.HandlerFunc {
 			return
 		}
 
+		if _, err := member.AuthorizeProduct(r, members, id, member.Owner); err != nil {
+			response.Error(w, http.StatusForbidden, err)
+			return
+		}
+
 		if err := h.service.Delete(ctx, id); err != nil {
 			response.Error(w, http.StatusInternalServerError, err)
 			return
@@ -145,16 +160,15 @@ func (h *Handler) GetByID() http.HandlerFunc {
 // Search looks for the products with the given value.
 func (h *Handler) Search() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		query := chi.URLParam(r, "query")
 		ctx := r.Context()
 
-		query = sanitize.Normalize(query)
-		if err := validate.SearchQuery(query); err != nil {
+		search, err := params.ParseSearch(r)
+		if err != nil {
 			response.Error(w, http.StatusBadRequest, err)
 			return
 		}
 
-		products, err := h.service.Search(ctx, query)
+		products, err := h.service.Search(ctx, search)
 		if err != nil {
 			response.Error(w, http.StatusNotFound, err)
 			return
@@ -164,8 +178,8 @@ func (h *Handler) Search() http.HandlerFunc {
 	}
 }
 
-// Update updates the product with the given id.
-func (h *Handler) Update() http.HandlerFunc {
+// Update updates the product with the given id, only the shop members can do it.
+func (h *Handler) Update(members member.Service) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 
@@ -175,6 +189,11 @@ func (h *Handler) Update() http.HandlerFunc {
 			return
 		}
 
+		if _, err := member.AuthorizeProduct(r, members, id, member.Owner, member.Staff); err != nil {
+			response.Error(w, http.StatusForbidden, err)
+			return
+		}
+
 		var product UpdateProduct
 		if err := json.NewDecoder(r.Body).Decode(&product); err != nil {
 			response.Error(w, http.StatusBadRequest, err)
@@ -187,6 +206,11 @@ func (h *Handler) Update() http.HandlerFunc {
 			return
 		}
 
+		if product.Language.Valid && !params.SupportedLanguage(product.Language.String) {
+			response.Error(w, http.StatusBadRequest, errors.Errorf("unsupported language %q", product.Language.String))
+			return
+		}
+
 		if err := h.service.Update(ctx, id, product); err != nil {
 			response.Error(w, http.StatusInternalServerError, err)
 			return
@@ -10,6 +10,8 @@ import (
 //
 // Amounts to be provided in a currency’s smallest unit.
 // 100 = 1 USD.
+//
+// The language is an ISO 639-1 code, the shop's one is used if it's not specified.
 type Product struct {
 	ID          zero.String `json:"id,omitempty"`
 	ShopID      zero.String `json:"shop_id,omitempty" db:"shop_id" validate:"required"`
@@ -24,6 +26,8 @@ type Product struct {
 	Taxes     zero.Int        `json:"taxes,omitempty" validate:"min=0"`
 	Subtotal  zero.Int        `json:"subtotal,omitempty" validate:"required"`
 	Total     zero.Int        `json:"total,omitempty" validate:"min=0"`
+	Language  zero.String     `json:"language,omitempty"`
+	Rating    review.Rating   `json:"rating" db:"rating"`
 	Reviews   []review.Review `json:"reviews,omitempty"`
 	CreatedAt zero.Time       `json:"created_at,omitempty" db:"created_at"`
 	UpdatedAt zero.Time       `json:"updated_at,omitempty" db:"updated_at"`
@@ -41,4 +45,5 @@ type UpdateProduct struct {
 	Taxes       zero.Int    `json:"taxes,omitempty" validate:"min=0"`
 	Subtotal    zero.Int    `json:"subtotal,omitempty" validate:"required"`
 	Total       zero.Int    `json:"total,omitempty" validate:"min=0"`
+	Language    zero.String `json:"language,omitempty"`
 }
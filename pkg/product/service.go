@@ -11,13 +11,18 @@ import (
 	"github.com/pkg/errors"
 )
 
+// Columns contains the products table fields (aliased "p") in the order they are scanned.
+const Columns = `p.id, p.shop_id, p.stock, p.brand, p.category, p.type, p.description,
+	p.weight, p.discount, p.taxes, p.subtotal, p.total, p.language, p.rating_average AS "rating.average",
+	p.rating_count AS "rating.count", p.rating_histogram AS "rating.histogram", p.created_at, p.updated_at`
+
 // Service provides product operations.
 type Service interface {
 	Create(ctx context.Context, p Product) error
 	Delete(ctx context.Context, id string) error
 	Get(ctx context.Context, params params.Query) ([]Product, error)
 	GetByID(ctx context.Context, id string) (Product, error)
-	Search(ctx context.Context, query string) ([]Product, error)
+	Search(ctx context.Context, params params.Search) ([]Product, error)
 	Update(ctx context.Context, id string, p UpdateProduct) error
 }
 
@@ -36,13 +41,15 @@ func NewService(db *sqlx.DB, mc *memcache.Client) Service {
 func (s *service) Create(ctx context.Context, p Product) error {
 	s.metrics.incMethodCalls("Create")
 
+	// Products inherit the shop language if they don't specify one
 	q := `INSERT INTO products 
 	(id, shop_id, stock, brand, category, type, description, 
-	weight, discount, taxes, subtotal, total, created_at)
-	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`
+	weight, discount, taxes, subtotal, total, created_at, language)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13,
+	COALESCE(NULLIF($14, ''), (SELECT language FROM shops WHERE id=$2), 'en'))`
 	_, err := s.db.ExecContext(ctx, q, p.ID, p.ShopID, p.Stock, p.Brand,
 		p.Category, p.Type, p.Description, p.Weight, p.Discount, p.Taxes,
-		p.Subtotal, p.Total, p.CreatedAt)
+		p.Subtotal, p.Total, p.CreatedAt, p.Language)
 	if err != nil {
 		return errors.Wrap(err, "couldn't create the product")
 	}
@@ -71,9 +78,9 @@ func (s *service) Delete(ctx context.Context, id string) error {
 func (s *service) Get(ctx context.Context, params params.Query) ([]Product, error) {
 	s.metrics.incMethodCalls("Get")
 
-	q, args := postgres.AddPagination(`SELECT p.*, r.*
+	q, args := postgres.AddPagination(`SELECT `+Columns+`, `+review.Columns+`
 	FROM products AS p
-	LEFT JOIN reviews AS r ON p.id=r.product_id`, params)
+	LEFT JOIN reviews AS r ON p.id=r.product_id AND r.status='approved'`, params)
 
 	rows, err := s.db.QueryContext(ctx, q, args...)
 	if err != nil {
@@ -88,9 +95,10 @@ func (s *service) Get(ctx context.Context, params params.Query) ([]Product, erro
 		err := rows.Scan(
 			&p.ID, &p.ShopID, &p.Stock, &p.Brand, &p.Category, &p.Type,
 			&p.Description, &p.Weight, &p.Discount, &p.Taxes, &p.Subtotal,
-			&p.Total, &p.CreatedAt, &p.UpdatedAt,
+			&p.Total, &p.Language, &p.Rating.Average, &p.Rating.Count, &p.Rating.Histogram,
+			&p.CreatedAt, &p.UpdatedAt,
 			&r.ID, &r.Stars, &r.Comment, &r.UserID, &r.ProductID, &r.ShopID,
-			&r.CreatedAt,
+			&r.Verified, &r.Status, &r.Helpful, &r.Unhelpful, &r.EditedAt, &r.CreatedAt,
 		)
 		if err != nil {
 			return nil, errors.Wrap(err, "couldn't scan product")
@@ -107,9 +115,9 @@ func (s *service) Get(ctx context.Context, params params.Query) ([]Product, erro
 func (s *service) GetByID(ctx context.Context, id string) (Product, error) {
 	s.metrics.incMethodCalls("GetByID")
 
-	q := `SELECT p.*, r.*
+	q := `SELECT ` + Columns + `, ` + review.Columns + `
 	FROM products p
-	LEFT JOIN reviews r ON p.id=r.product_id
+	LEFT JOIN reviews r ON p.id=r.product_id AND r.status='approved'
 	WHERE p.id=$1`
 	rows, err := s.db.QueryContext(ctx, q, id)
 	if err != nil {
@@ -123,9 +131,10 @@ func (s *service) GetByID(ctx context.Context, id string) (Product, error) {
 		err := rows.Scan(
 			&p.ID, &p.ShopID, &p.Stock, &p.Brand, &p.Category, &p.Type,
 			&p.Description, &p.Weight, &p.Discount, &p.Taxes, &p.Subtotal,
-			&p.Total, &p.CreatedAt, &p.UpdatedAt,
+			&p.Total, &p.Language, &p.Rating.Average, &p.Rating.Count, &p.Rating.Histogram,
+			&p.CreatedAt, &p.UpdatedAt,
 			&r.ID, &r.Stars, &r.Comment, &r.UserID, &r.ProductID, &r.ShopID,
-			&r.CreatedAt,
+			&r.Verified, &r.Status, &r.Helpful, &r.Unhelpful, &r.EditedAt, &r.CreatedAt,
 		)
 		if err != nil {
 			return Product{}, errors.Wrap(err, "couldn't scan product")
@@ -138,12 +147,16 @@ func (s *service) GetByID(ctx context.Context, id string) (Product, error) {
 }
 
 // Search looks for the products that contain the value specified. (Only text fields)
-func (s *service) Search(ctx context.Context, query string) ([]Product, error) {
+//
+// The query is parsed using the text search configuration of the language requested.
+func (s *service) Search(ctx context.Context, params params.Search) ([]Product, error) {
 	s.metrics.incMethodCalls("Search")
 
 	var products []Product
-	q := "SELECT * FROM products WHERE search @@ plainto_tsquery($1)"
-	if err := s.db.SelectContext(ctx, &products, q, query); err != nil {
+	q := `SELECT ` + Columns + ` FROM products AS p, plainto_tsquery(search_config($2), $1) AS query
+	WHERE p.search @@ query
+	ORDER BY ` + postgres.SearchOrder("p", params.Sort)
+	if err := s.db.SelectContext(ctx, &products, q, params.Query, params.Language); err != nil {
 		return nil, errors.Wrap(err, "couldn't find products")
 	}
 
@@ -155,10 +168,11 @@ func (s *service) Update(ctx context.Context, id string, p UpdateProduct) error
 	s.metrics.incMethodCalls("Update")
 
 	q := `UPDATE products SET stock=$2, brand=$3, category=$4, type=$5,
-	description=$6, weight=$7, discount=$8, taxes=$9, subtotal=$10, total=$11
+	description=$6, weight=$7, discount=$8, taxes=$9, subtotal=$10, total=$11,
+	language=COALESCE(NULLIF($12, ''), language)
 	WHERE id=$1`
 	_, err := s.db.ExecContext(ctx, q, id, p.Stock, p.Brand, p.Category, p.Type,
-		p.Description, p.Weight, p.Discount, p.Taxes, p.Subtotal, p.Total)
+		p.Description, p.Weight, p.Discount, p.Taxes, p.Subtotal, p.Total, p.Language)
 	if err != nil {
 		return errors.Wrap(err, "couldn't update the product")
 	}
@@ -9,6 +9,7 @@ import (
 	"github.com/GGP1/adak/internal/test"
 	"github.com/GGP1/adak/pkg/product"
 	"github.com/GGP1/adak/pkg/shop"
+	"github.com/GGP1/adak/pkg/user"
 
 	"github.com/bradfitz/gomemcache/memcache"
 	"github.com/jmoiron/sqlx"
@@ -118,7 +119,7 @@ func update(ctx context.Context, s product.Service) func(t *testing.T) {
 
 func search(ctx context.Context, s product.Service) func(t *testing.T) {
 	return func(t *testing.T) {
-		products, err := s.Search(ctx, "brand")
+		products, err := s.Search(ctx, params.Search{Query: "brand", Language: params.DefaultLanguage})
 		assert.NoError(t, err)
 
 		t.Log(products)
@@ -137,10 +138,20 @@ func search(ctx context.Context, s product.Service) func(t *testing.T) {
 func createRelationship(ctx context.Context, t *testing.T, db *sqlx.DB, mc *memcache.Client) {
 	t.Helper()
 
+	userService := user.NewService(db, mc)
+	err := userService.Create(ctx, user.AddUser{
+		ID:       "1",
+		CartID:   "test",
+		Email:    "test",
+		Username: "test",
+		Password: "testing123",
+	})
+	assert.NoError(t, err)
+
 	shopService := shop.NewService(db, mc)
-	err := shopService.Create(ctx, shop.Shop{
+	err = shopService.Create(ctx, shop.Shop{
 		ID:   "6",
 		Name: "test",
-	})
+	}, "1")
 	assert.NoError(t, err)
 }
@@ -4,14 +4,15 @@ import (
 	"encoding/json"
 	"net/http"
 
-	"github.com/GGP1/adak/internal/cookie"
+	"github.com/GGP1/adak/internal/identity"
 	"github.com/GGP1/adak/internal/params"
 	"github.com/GGP1/adak/internal/response"
-	"github.com/GGP1/adak/internal/token"
 	"github.com/GGP1/adak/internal/validate"
+	"github.com/GGP1/adak/pkg/shop/member"
 	"github.com/google/uuid"
 
 	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/pkg/errors"
 	"gopkg.in/guregu/null.v4/zero"
 )
 
@@ -20,6 +21,11 @@ type cursorResponse struct {
 	Reviews    []Review `json:"reviews,omitempty"`
 }
 
+type queueResponse struct {
+	NextCursor string       `json:"next_cursor,omitempty"`
+	Reviews    []Moderation `json:"reviews,omitempty"`
+}
+
 // Handler handles reviews endpoints.
 type Handler struct {
 	service Service
@@ -39,17 +45,12 @@ func (h *Handler) Create() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 
-		userID, err := cookie.GetValue(r, "UID")
+		userID, err := identity.UserID(r)
 		if err != nil {
 			response.Error(w, http.StatusForbidden, err)
 			return
 		}
 
-		if err := token.CheckPermits(r, userID); err != nil {
-			response.Error(w, http.StatusUnauthorized, err)
-			return
-		}
-
 		var review Review
 		if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
 			response.Error(w, http.StatusBadRequest, err)
@@ -62,8 +63,19 @@ func (h *Handler) Create() http.HandlerFunc {
 			return
 		}
 
+		if review.Stars.Int64 < 1 || review.Stars.Int64 > 5 {
+			response.Error(w, http.StatusBadRequest, errors.New("stars must be between 1 and 5"))
+			return
+		}
+
 		review.ID = zero.StringFrom(uuid.NewString())
-		if err := h.service.Create(ctx, review); err != nil {
+		review.UserID = zero.StringFrom(userID)
+		review, err = h.service.Create(ctx, review)
+		if err != nil {
+			if errors.Is(err, ErrAlreadyReviewed) {
+				response.Error(w, http.StatusConflict, err)
+				return
+			}
 			response.Error(w, http.StatusInternalServerError, err)
 			return
 		}
@@ -150,3 +162,271 @@ func (h *Handler) GetByID() http.HandlerFunc {
 		response.JSONAndCache(h.cache, w, id, review)
 	}
 }
+
+// Moderate sets the status of a review.
+func (h *Handler) Moderate(status string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		id, err := params.URLID(ctx)
+		if err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		adminID, err := identity.UserID(r)
+		if err != nil {
+			response.Error(w, http.StatusForbidden, err)
+			return
+		}
+
+		var decision Decision
+		if err := json.NewDecoder(r.Body).Decode(&decision); err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+		defer r.Body.Close()
+
+		if err := validate.Struct(ctx, decision); err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if status != Approved && decision.Reason == "" {
+			response.Error(w, http.StatusBadRequest, errors.New("a reason is required"))
+			return
+		}
+
+		if err := h.service.Moderate(ctx, id, adminID, status, decision.Reason); err != nil {
+			response.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		response.JSONText(w, http.StatusOK, id)
+	}
+}
+
+// Queue lists the reviews waiting for moderation.
+func (h *Handler) Queue() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		urlParams, err := params.ParseQuery(r.URL.RawQuery, params.Review)
+		if err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		reviews, err := h.service.Queue(ctx, urlParams)
+		if err != nil {
+			response.Error(w, http.StatusNotFound, err)
+			return
+		}
+
+		var nextCursor string
+		if len(reviews) > 0 {
+			nextCursor = params.EncodeCursor(
+				reviews[len(reviews)-1].CreatedAt.Time,
+				reviews[len(reviews)-1].ID.String,
+			)
+		}
+
+		response.JSON(w, http.StatusOK, queueResponse{
+			NextCursor: nextCursor,
+			Reviews:    reviews,
+		})
+	}
+}
+
+// Report lets users report abusive reviews.
+func (h *Handler) Report() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		id, err := params.URLID(ctx)
+		if err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		userID, err := identity.UserID(r)
+		if err != nil {
+			response.Error(w, http.StatusForbidden, err)
+			return
+		}
+
+		var report Report
+		if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+		defer r.Body.Close()
+
+		if err := validate.Struct(ctx, report); err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if err := h.service.Report(ctx, id, userID, report.Reason); err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		response.JSONText(w, http.StatusOK, id)
+	}
+}
+
+// Edits lists the previous versions of a review.
+func (h *Handler) Edits() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		id, err := params.URLID(ctx)
+		if err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		edits, err := h.service.Edits(ctx, id)
+		if err != nil {
+			response.Error(w, http.StatusNotFound, err)
+			return
+		}
+
+		response.JSON(w, http.StatusOK, edits)
+	}
+}
+
+// Reply posts the public reply to a review, only the owner of the shop reviewed can do it.
+func (h *Handler) Reply(members member.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		id, err := params.URLID(ctx)
+		if err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		review, err := h.service.GetByID(ctx, id)
+		if err != nil {
+			response.Error(w, http.StatusNotFound, err)
+			return
+		}
+
+		var userID string
+		if review.ProductID.Valid {
+			userID, err = member.AuthorizeProduct(r, members, review.ProductID.String, member.Owner)
+		} else {
+			userID, err = member.Authorize(r, members, review.ShopID.String, member.Owner)
+		}
+		if err != nil {
+			response.Error(w, http.StatusForbidden, err)
+			return
+		}
+
+		var reply Reply
+		if err := json.NewDecoder(r.Body).Decode(&reply); err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+		defer r.Body.Close()
+
+		if err := validate.Struct(ctx, reply); err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		reply.ReviewID = id
+		reply.UserID = zero.StringFrom(userID)
+		if err := h.service.Reply(ctx, id, reply); err != nil {
+			if errors.Is(err, ErrAlreadyReplied) {
+				response.Error(w, http.StatusConflict, err)
+				return
+			}
+			response.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		response.JSON(w, http.StatusCreated, reply)
+	}
+}
+
+// Update edits a review.
+func (h *Handler) Update() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		id, err := params.URLID(ctx)
+		if err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		userID, err := identity.UserID(r)
+		if err != nil {
+			response.Error(w, http.StatusForbidden, err)
+			return
+		}
+
+		var review UpdateReview
+		if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+		defer r.Body.Close()
+
+		if review.Stars.Int64 < 1 || review.Stars.Int64 > 5 {
+			response.Error(w, http.StatusBadRequest, errors.New("stars must be between 1 and 5"))
+			return
+		}
+
+		if err := h.service.Update(ctx, id, userID, review); err != nil {
+			if errors.Is(err, ErrForbidden) {
+				response.Error(w, http.StatusForbidden, err)
+				return
+			}
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		response.JSONText(w, http.StatusOK, id)
+	}
+}
+
+// Vote saves the user vote on a review.
+func (h *Handler) Vote() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		id, err := params.URLID(ctx)
+		if err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		userID, err := identity.UserID(r)
+		if err != nil {
+			response.Error(w, http.StatusForbidden, err)
+			return
+		}
+
+		var vote Vote
+		if err := json.NewDecoder(r.Body).Decode(&vote); err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+		defer r.Body.Close()
+
+		if err := h.service.Vote(ctx, id, userID, vote.Helpful); err != nil {
+			if errors.Is(err, ErrForbidden) {
+				response.Error(w, http.StatusForbidden, err)
+				return
+			}
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		response.JSONText(w, http.StatusOK, id)
+	}
+}
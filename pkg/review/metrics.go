@@ -6,8 +6,10 @@ import (
 )
 
 type metrics struct {
-	totalReviews prometheus.Gauge
-	methodCalls  *prometheus.CounterVec
+	totalReviews        prometheus.Gauge
+	reports             prometheus.Counter
+	moderationDecisions *prometheus.CounterVec
+	methodCalls         *prometheus.CounterVec
 }
 
 func initMetrics() metrics {
@@ -19,6 +21,18 @@ func initMetrics() metrics {
 			Name:      "reviews_total",
 			Help:      "Total number of reviews",
 		}),
+		reports: promauto.NewCounter(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "reports_total",
+			Help:      "Total number of reports received",
+		}),
+		moderationDecisions: promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "moderation_decisions_total",
+			Help:      "Total number of moderation decisions per status",
+		}, []string{"status"}),
 		methodCalls: promauto.NewCounterVec(prometheus.CounterOpts{
 			Namespace: ns,
 			Subsystem: sub,
@@ -1,16 +1,99 @@
 package review
 
 import (
+	"time"
+
+	"github.com/lib/pq"
 	"gopkg.in/guregu/null.v4/zero"
 )
 
+// Columns contains the reviews table fields (aliased "r") in the order they are scanned
+// by the services that join them.
+const Columns = `r.id, r.stars, r.comment, r.user_id, r.product_id, r.shop_id, r.verified, r.status,
+	r.helpful_count, r.unhelpful_count, r.edited_at, r.created_at`
+
+// Review moderation status.
+const (
+	// Pending reviews are waiting for an admin decision and aren't public
+	Pending = "pending"
+	// Approved reviews are public and count towards the rating
+	Approved = "approved"
+	// Rejected reviews never made it through moderation
+	Rejected = "rejected"
+	// Hidden reviews were taken down by an admin
+	Hidden = "hidden"
+)
+
 // Review represents users critics over a shop or product.
+//
+// The user is taken from the session and Verified is set on creation if the user
+// bought the item reviewed, the values received from the client are ignored.
+//
+// Helpful and Unhelpful hold the number of votes received.
 type Review struct {
 	ID        zero.String `json:"id,omitempty"`
-	Stars     zero.Int    `json:"stars,omitempty" validate:"min=0,max=5"`
+	Stars     zero.Int    `json:"stars,omitempty" validate:"min=1,max=5"`
 	Comment   zero.String `json:"comment,omitempty"`
-	UserID    zero.String `json:"user_id,omitempty" db:"user_id" validate:"required"`
+	UserID    zero.String `json:"user_id,omitempty" db:"user_id"`
 	ProductID zero.String `json:"product_id,omitempty" db:"product_id" validate:"required_without=ShopID"`
 	ShopID    zero.String `json:"shop_id,omitempty" db:"shop_id" validate:"required_without=ProductID"`
+	Verified  zero.Bool   `json:"verified"`
+	Status    zero.String `json:"status,omitempty"`
+	Helpful   zero.Int    `json:"helpful" db:"helpful_count"`
+	Unhelpful zero.Int    `json:"unhelpful" db:"unhelpful_count"`
+	Reply     *Reply      `json:"reply,omitempty" db:"-"`
+	EditedAt  zero.Time   `json:"edited_at,omitempty" db:"edited_at"`
 	CreatedAt zero.Time   `json:"created_at,omitempty" db:"created_at"`
 }
+
+// UpdateReview is the structure used to edit reviews.
+type UpdateReview struct {
+	Stars   zero.Int    `json:"stars,omitempty" validate:"required"`
+	Comment zero.String `json:"comment,omitempty"`
+}
+
+// Edit is a previous version of a review.
+type Edit struct {
+	Stars    zero.Int    `json:"stars,omitempty"`
+	Comment  zero.String `json:"comment,omitempty"`
+	EditedAt time.Time   `json:"edited_at,omitempty" db:"edited_at"`
+}
+
+// Vote is the structure used to vote reviews.
+type Vote struct {
+	Helpful bool `json:"helpful"`
+}
+
+// Reply is the public answer of a shop to a review.
+type Reply struct {
+	ReviewID  string      `json:"review_id,omitempty" db:"review_id"`
+	UserID    zero.String `json:"user_id,omitempty" db:"user_id"`
+	Comment   string      `json:"comment,omitempty" validate:"required,max=1000"`
+	CreatedAt time.Time   `json:"created_at,omitempty" db:"created_at"`
+}
+
+// Moderation contains a review held for moderation along with the reason and
+// the number of reports it received.
+type Moderation struct {
+	Review
+	Reason  zero.String `json:"reason,omitempty" db:"moderation_reason"`
+	Reports int64       `json:"reports"`
+}
+
+// Decision is the structure used by admins to moderate reviews.
+type Decision struct {
+	Reason string `json:"reason,omitempty" validate:"max=500"`
+}
+
+// Report is the structure used by users to report abusive reviews.
+type Report struct {
+	Reason string `json:"reason,omitempty" validate:"required,max=500"`
+}
+
+// Rating is the summary of the reviews received by a product or shop.
+type Rating struct {
+	Average float64 `json:"average" db:"average"`
+	Count   int64   `json:"count" db:"count"`
+	// Number of reviews per amount of stars, the first element holds the 1-star ones
+	Histogram pq.Int64Array `json:"histogram" db:"histogram"`
+}
@@ -0,0 +1,65 @@
+package review
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"gopkg.in/guregu/null.v4/zero"
+)
+
+// ratingQuery recalculates the rating of the object in the table, the column
+// is the one referencing it in the reviews table. Only approved reviews are taken into account.
+const ratingQuery = `UPDATE %[1]s SET 
+(rating_average, rating_count, rating_histogram) = (
+	SELECT COALESCE(ROUND(AVG(stars), 2), 0), COUNT(*), ARRAY[
+		COUNT(*) FILTER (WHERE stars=1),
+		COUNT(*) FILTER (WHERE stars=2),
+		COUNT(*) FILTER (WHERE stars=3),
+		COUNT(*) FILTER (WHERE stars=4),
+		COUNT(*) FILTER (WHERE stars=5)
+	]
+	FROM reviews WHERE %[2]s=$1 AND status='approved'
+)
+WHERE id=$1`
+
+var (
+	productRatingQuery = fmt.Sprintf(ratingQuery, "products", "product_id")
+	shopRatingQuery    = fmt.Sprintf(ratingQuery, "shops", "shop_id")
+)
+
+// lockReviewed locks the product and shop rows so concurrent transactions
+// can't calculate their ratings with an outdated set of reviews.
+func lockReviewed(ctx context.Context, tx *sqlx.Tx, productID, shopID zero.String) error {
+	if productID.Valid {
+		_, err := tx.ExecContext(ctx, "SELECT 1 FROM products WHERE id=$1 FOR UPDATE", productID)
+		if err != nil {
+			return errors.Wrap(err, "locking product")
+		}
+	}
+	if shopID.Valid {
+		_, err := tx.ExecContext(ctx, "SELECT 1 FROM shops WHERE id=$1 FOR UPDATE", shopID)
+		if err != nil {
+			return errors.Wrap(err, "locking shop")
+		}
+	}
+
+	return nil
+}
+
+// updateRatings recalculates the rating aggregates of the product and shop reviewed.
+func updateRatings(ctx context.Context, tx *sqlx.Tx, productID, shopID zero.String) error {
+	if productID.Valid {
+		if _, err := tx.ExecContext(ctx, productRatingQuery, productID); err != nil {
+			return errors.Wrap(err, "updating product rating")
+		}
+	}
+	if shopID.Valid {
+		if _, err := tx.ExecContext(ctx, shopRatingQuery, shopID); err != nil {
+			return errors.Wrap(err, "updating shop rating")
+		}
+	}
+
+	return nil
+}
@@ -2,94 +2,597 @@ package review
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"time"
 
+	"github.com/GGP1/adak/internal/config"
+	"github.com/GGP1/adak/internal/filter"
 	"github.com/GGP1/adak/internal/params"
 	"github.com/GGP1/adak/pkg/postgres"
 	"github.com/bradfitz/gomemcache/memcache"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"gopkg.in/guregu/null.v4/zero"
 )
 
+var (
+	// ErrAlreadyReviewed is returned when the user has already reviewed the product or shop.
+	ErrAlreadyReviewed = errors.New("the user has already reviewed this item")
+	// ErrAlreadyReplied is returned when the review already has a reply.
+	ErrAlreadyReplied = errors.New("the review was already replied")
+	// ErrForbidden is returned when the user is not allowed to perform the action on the review.
+	ErrForbidden = errors.New("the user is not allowed to perform this action on the review")
+)
+
 // Service provides review operations.
 type Service interface {
-	Create(ctx context.Context, r Review) error
+	Create(ctx context.Context, r Review) (Review, error)
 	Delete(ctx context.Context, id string) error
 	Get(ctx context.Context, params params.Query) ([]Review, error)
+	Edits(ctx context.Context, id string) ([]Edit, error)
 	GetByID(ctx context.Context, id string) (Review, error)
+	Moderate(ctx context.Context, id, adminID, status, reason string) error
+	Queue(ctx context.Context, params params.Query) ([]Moderation, error)
+	Reply(ctx context.Context, id string, reply Reply) error
+	Report(ctx context.Context, id, userID, reason string) error
+	Update(ctx context.Context, id, userID string, r UpdateReview) error
+	Vote(ctx context.Context, id, userID string, helpful bool) error
 }
 
 type service struct {
-	db      *sqlx.DB
-	mc      *memcache.Client
-	metrics metrics
+	db         *sqlx.DB
+	mc         *memcache.Client
+	filter     filter.Filter
+	editWindow time.Duration
+	moderation config.Moderation
+	purchased  pq.Int64Array
+	metrics    metrics
 }
 
-// NewService returns a new review service.
-func NewService(db *sqlx.DB, mc *memcache.Client) Service {
-	return &service{db, mc, initMetrics()}
+// NewService returns a new review service, the reviews of users with orders in the purchased
+// statuses are verified.
+func NewService(db *sqlx.DB, mc *memcache.Client, reviews config.Reviews, moderation config.Moderation, purchased []int64) Service {
+	return &service{
+		db:         db,
+		mc:         mc,
+		filter:     filter.New(moderation.Words),
+		editWindow: reviews.EditWindow,
+		moderation: moderation,
+		purchased:  purchased,
+		metrics:    initMetrics(),
+	}
 }
 
-// Create a review.
-func (s *service) Create(ctx context.Context, r Review) error {
+// verifiedQuery returns whether the user bought the product or, in the case of shop reviews,
+// any product of the shop. Only the orders in the purchased statuses are taken into account.
+const verifiedQuery = `SELECT EXISTS(
+	SELECT 1 FROM orders AS o
+	INNER JOIN order_products AS op ON o.id=op.order_id
+	LEFT JOIN products AS p ON p.id=op.product_id
+	WHERE o.user_id=$1 AND o.status = ANY($4) AND
+	CASE WHEN $2::text IS NULL THEN p.shop_id=$3 ELSE op.product_id=$2 END
+)`
+
+// Create a review and update the rating of the product and shop reviewed.
+func (s *service) Create(ctx context.Context, r Review) (Review, error) {
 	s.metrics.incMethodCalls("Create")
 
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return Review{}, errors.Wrap(err, "starting transaction")
+	}
+	defer tx.Rollback()
+
+	// Locking the items reviewed also serializes the creation of their reviews,
+	// the existence check below is not subject to races
+	if err := lockReviewed(ctx, tx, r.ProductID, r.ShopID); err != nil {
+		return Review{}, err
+	}
+
+	// Product reviews are unique per product, shop reviews are the ones without a product
+	var exists bool
+	existsQuery := `SELECT EXISTS(SELECT 1 FROM reviews WHERE user_id=$1 AND 
+	CASE WHEN $2::text IS NULL THEN product_id IS NULL AND shop_id=$3 ELSE product_id=$2 END)`
+	if err := tx.GetContext(ctx, &exists, existsQuery, r.UserID, r.ProductID, r.ShopID); err != nil {
+		return Review{}, errors.Wrap(err, "checking previous reviews")
+	}
+	if exists {
+		return Review{}, ErrAlreadyReviewed
+	}
+
+	if err := tx.GetContext(ctx, &r.Verified, verifiedQuery, r.UserID, r.ProductID, r.ShopID, s.purchased); err != nil {
+		return Review{}, errors.Wrap(err, "checking purchases")
+	}
+
+	status, reason := s.filterComment(r.Comment.String)
+	r.Status = zero.StringFrom(status)
+
 	q := `INSERT INTO reviews
-	(id, stars, comment, user_id, product_id, shop_id, created_at)
-	VALUES ($1, $2, $3, $4, $5, $6, $7)`
-	_, err := s.db.ExecContext(ctx, q, r.ID, r.Stars, r.Comment, r.UserID, r.ProductID,
-		r.ShopID, zero.TimeFrom(time.Now()))
+	(id, stars, comment, user_id, product_id, shop_id, verified, status, moderation_reason, created_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+	r.CreatedAt = zero.TimeFrom(time.Now())
+	_, err = tx.ExecContext(ctx, q, r.ID, r.Stars, r.Comment, r.UserID, r.ProductID,
+		r.ShopID, r.Verified, r.Status, reason, r.CreatedAt)
 	if err != nil {
-		return errors.Wrap(err, "couldn't create the review")
+		return Review{}, errors.Wrap(err, "couldn't create the review")
+	}
+
+	if err := updateRatings(ctx, tx, r.ProductID, r.ShopID); err != nil {
+		return Review{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Review{}, errors.Wrap(err, "committing transaction")
 	}
 
 	s.metrics.totalReviews.Inc()
-	return nil
+	if err := s.deleteReviewedFromCache(r.ProductID, r.ShopID); err != nil {
+		return Review{}, err
+	}
+
+	return r, nil
 }
 
-// Delete permanently deletes a review from the database.
+// Delete permanently deletes a review from the database and updates the rating
+// of the product and shop reviewed.
 func (s *service) Delete(ctx context.Context, id string) error {
 	s.metrics.incMethodCalls("Delete")
-	_, err := s.db.ExecContext(ctx, "DELETE FROM reviews WHERE id=$1", id)
+
+	tx, err := s.db.BeginTxx(ctx, nil)
 	if err != nil {
+		return errors.Wrap(err, "starting transaction")
+	}
+	defer tx.Rollback()
+
+	var productID, shopID zero.String
+	row := tx.QueryRowContext(ctx, "SELECT product_id, shop_id FROM reviews WHERE id=$1", id)
+	if err := row.Scan(&productID, &shopID); err != nil {
+		return errors.Wrap(err, "couldn't find the review")
+	}
+
+	if err := lockReviewed(ctx, tx, productID, shopID); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM reviews WHERE id=$1", id); err != nil {
 		return errors.Wrap(err, "couldn't delete the review")
 	}
+
+	if err := updateRatings(ctx, tx, productID, shopID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "committing transaction")
+	}
 	s.metrics.totalReviews.Dec()
 
 	if err := s.mc.Delete(id); err != nil && err != memcache.ErrCacheMiss {
 		return errors.Wrap(err, "deleting review from cache")
 	}
 
-	return nil
+	return s.deleteReviewedFromCache(productID, shopID)
 }
 
-// Get returns a list with all the reviews stored in the database.
-func (s *service) Get(ctx context.Context, params params.Query) ([]Review, error) {
+// Get returns a list with all the approved reviews stored in the database.
+//
+// Only verified purchases are included if the parameters specify so.
+func (s *service) Get(ctx context.Context, urlParams params.Query) ([]Review, error) {
 	s.metrics.incMethodCalls("Get")
 
+	query := "SELECT r.*, r.helpful_count - r.unhelpful_count AS score FROM reviews AS r WHERE r.status='approved'"
+	if urlParams.Verified {
+		query += " AND r.verified"
+	}
+	query = "SELECT " + Columns + " FROM (" + query + ") AS r"
+
+	var (
+		q    string
+		args []interface{}
+	)
+	if urlParams.Sort == params.SortHelpful {
+		// The cursor review is used to continue from its position
+		q, args = query, []interface{}{urlParams.Limit}
+		if urlParams.Cursor.Used {
+			q += ` WHERE (r.score, r.created_at, r.id) < 
+			(SELECT helpful_count - unhelpful_count, created_at, id FROM reviews WHERE id=$2)`
+			args = append(args, urlParams.Cursor.ID)
+		}
+		q += " ORDER BY r.score DESC, r.created_at DESC, r.id DESC LIMIT $1"
+	} else {
+		q, args = postgres.AddPagination(query, urlParams)
+	}
+
 	var reviews []Review
-	q, args := postgres.AddPagination("SELECT * FROM reviews", params)
 	if err := s.db.SelectContext(ctx, &reviews, q, args...); err != nil {
 		return nil, errors.Wrap(err, "couldn't find the reviews")
 	}
 
+	if err := s.addReplies(ctx, reviews); err != nil {
+		return nil, err
+	}
+
 	return reviews, nil
 }
 
-// GetByID retrieves the review requested from the database.
+// GetByID retrieves the approved review requested from the database.
 func (s *service) GetByID(ctx context.Context, id string) (Review, error) {
 	s.metrics.incMethodCalls("GetByID")
 
 	var review Review
-	row := s.db.QueryRowContext(ctx, "SELECT * FROM reviews WHERE id=$1", id)
+	q := "SELECT " + Columns + " FROM reviews AS r WHERE r.id=$1 AND r.status='approved'"
+	row := s.db.QueryRowContext(ctx, q, id)
 	err := row.Scan(
-		&review.ID, &review.Stars, &review.Comment, &review.UserID,
-		&review.ShopID, &review.ProductID, &review.CreatedAt,
+		&review.ID, &review.Stars, &review.Comment, &review.UserID, &review.ProductID,
+		&review.ShopID, &review.Verified, &review.Status, &review.Helpful, &review.Unhelpful,
+		&review.EditedAt, &review.CreatedAt,
 	)
 	if err != nil {
 		return Review{}, errors.Wrap(err, "couldn't scan review")
 	}
 
-	return review, nil
+	reviews := []Review{review}
+	if err := s.addReplies(ctx, reviews); err != nil {
+		return Review{}, err
+	}
+
+	return reviews[0], nil
+}
+
+// Edits returns the previous versions of a review, from the newest to the oldest.
+func (s *service) Edits(ctx context.Context, id string) ([]Edit, error) {
+	s.metrics.incMethodCalls("Edits")
+
+	var edits []Edit
+	q := `SELECT e.stars, e.comment, e.edited_at FROM review_edits AS e
+	INNER JOIN reviews AS r ON r.id=e.review_id
+	WHERE e.review_id=$1 AND r.status='approved'
+	ORDER BY e.edited_at DESC`
+	if err := s.db.SelectContext(ctx, &edits, q, id); err != nil {
+		return nil, errors.Wrap(err, "couldn't find the review edits")
+	}
+
+	return edits, nil
+}
+
+// Moderate sets the status of a review and the reason of the decision, the reports
+// received are discarded and the ratings updated.
+func (s *service) Moderate(ctx context.Context, id, adminID, status, reason string) error {
+	s.metrics.incMethodCalls("Moderate")
+
+	switch status {
+	case Approved, Rejected, Hidden:
+	default:
+		return errors.Errorf("invalid status %q", status)
+	}
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "starting transaction")
+	}
+	defer tx.Rollback()
+
+	var productID, shopID zero.String
+	row := tx.QueryRowContext(ctx, "SELECT product_id, shop_id FROM reviews WHERE id=$1", id)
+	if err := row.Scan(&productID, &shopID); err != nil {
+		return errors.Wrap(err, "couldn't find the review")
+	}
+
+	if err := lockReviewed(ctx, tx, productID, shopID); err != nil {
+		return err
+	}
+
+	q := `UPDATE reviews SET status=$2, moderation_reason=$3, moderated_by=$4, moderated_at=$5
+	WHERE id=$1`
+	_, err = tx.ExecContext(ctx, q, id, status, zero.StringFrom(reason), adminID, time.Now())
+	if err != nil {
+		return errors.Wrap(err, "couldn't moderate the review")
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM review_reports WHERE review_id=$1", id); err != nil {
+		return errors.Wrap(err, "discarding reports")
+	}
+
+	if err := updateRatings(ctx, tx, productID, shopID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "committing transaction")
+	}
+	s.metrics.moderationDecisions.With(prometheus.Labels{"status": status}).Inc()
+
+	if err := s.mc.Delete(id); err != nil && err != memcache.ErrCacheMiss {
+		return errors.Wrap(err, "deleting review from cache")
+	}
+
+	return s.deleteReviewedFromCache(productID, shopID)
+}
+
+// Queue returns the reviews waiting for moderation.
+func (s *service) Queue(ctx context.Context, params params.Query) ([]Moderation, error) {
+	s.metrics.incMethodCalls("Queue")
+
+	var reviews []Moderation
+	q, args := postgres.AddPagination(`SELECT * FROM (
+		SELECT `+Columns+`, r.moderation_reason, 
+		(SELECT COUNT(*) FROM review_reports WHERE review_id=r.id) AS reports
+		FROM reviews AS r WHERE r.status='pending'
+	) AS r`, params)
+	if err := s.db.SelectContext(ctx, &reviews, q, args...); err != nil {
+		return nil, errors.Wrap(err, "couldn't find the reviews")
+	}
+
+	return reviews, nil
+}
+
+// Reply saves the reply to a review, each review can have only one.
+func (s *service) Reply(ctx context.Context, id string, reply Reply) error {
+	s.metrics.incMethodCalls("Reply")
+
+	q := `INSERT INTO review_replies (review_id, user_id, comment, created_at)
+	SELECT id, $2, $3, $4 FROM reviews WHERE id=$1 AND status='approved'
+	ON CONFLICT DO NOTHING`
+	res, err := s.db.ExecContext(ctx, q, id, reply.UserID, reply.Comment, time.Now())
+	if err != nil {
+		return errors.Wrap(err, "couldn't reply the review")
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		var exists bool
+		if err := s.db.GetContext(ctx, &exists, "SELECT EXISTS(SELECT 1 FROM review_replies WHERE review_id=$1)", id); err != nil {
+			return errors.Wrap(err, "couldn't reply the review")
+		}
+		if exists {
+			return ErrAlreadyReplied
+		}
+		return errors.New("review not found")
+	}
+
+	if err := s.mc.Delete(id); err != nil && err != memcache.ErrCacheMiss {
+		return errors.Wrap(err, "deleting review from cache")
+	}
+
+	return nil
+}
+
+// Report saves a user report on a review. Once a review reaches the number of reports
+// configured it's sent back to the moderation queue.
+func (s *service) Report(ctx context.Context, id, userID, reason string) error {
+	s.metrics.incMethodCalls("Report")
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "starting transaction")
+	}
+	defer tx.Rollback()
+
+	var productID, shopID zero.String
+	q := "SELECT product_id, shop_id FROM reviews WHERE id=$1 AND status='approved'"
+	if err := tx.QueryRowContext(ctx, q, id).Scan(&productID, &shopID); err != nil {
+		return errors.Wrap(err, "couldn't find the review")
+	}
+
+	if err := lockReviewed(ctx, tx, productID, shopID); err != nil {
+		return err
+	}
+
+	rQuery := `INSERT INTO review_reports (review_id, user_id, reason, created_at) 
+	VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING`
+	res, err := tx.ExecContext(ctx, rQuery, id, userID, reason, time.Now())
+	if err != nil {
+		return errors.Wrap(err, "couldn't report the review")
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("the review was already reported by the user")
+	}
+
+	var reports int
+	if err := tx.GetContext(ctx, &reports, "SELECT COUNT(*) FROM review_reports WHERE review_id=$1", id); err != nil {
+		return errors.Wrap(err, "counting reports")
+	}
+
+	if reports >= s.moderation.ReportThreshold {
+		uQuery := "UPDATE reviews SET status='pending', moderation_reason=$2 WHERE id=$1"
+		_, err := tx.ExecContext(ctx, uQuery, id, fmt.Sprintf("reported by %d users", reports))
+		if err != nil {
+			return errors.Wrap(err, "sending review to the moderation queue")
+		}
+
+		if err := updateRatings(ctx, tx, productID, shopID); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "committing transaction")
+	}
+	s.metrics.reports.Inc()
+
+	if reports < s.moderation.ReportThreshold {
+		return nil
+	}
+
+	if err := s.mc.Delete(id); err != nil && err != memcache.ErrCacheMiss {
+		return errors.Wrap(err, "deleting review from cache")
+	}
+
+	return s.deleteReviewedFromCache(productID, shopID)
+}
+
+// Update edits a review within the time window configured, the previous version is saved
+// in the edits history.
+func (s *service) Update(ctx context.Context, id, userID string, r UpdateReview) error {
+	s.metrics.incMethodCalls("Update")
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "starting transaction")
+	}
+	defer tx.Rollback()
+
+	var productID, shopID zero.String
+	row := tx.QueryRowContext(ctx, "SELECT product_id, shop_id FROM reviews WHERE id=$1", id)
+	if err := row.Scan(&productID, &shopID); err != nil {
+		return errors.Wrap(err, "couldn't find the review")
+	}
+
+	if err := lockReviewed(ctx, tx, productID, shopID); err != nil {
+		return err
+	}
+
+	var (
+		authorID, status string
+		createdAt        time.Time
+	)
+	q := "SELECT user_id, status, created_at FROM reviews WHERE id=$1 FOR UPDATE"
+	if err := tx.QueryRowContext(ctx, q, id).Scan(&authorID, &status, &createdAt); err != nil {
+		return errors.Wrap(err, "couldn't find the review")
+	}
+	if authorID != userID {
+		return ErrForbidden
+	}
+	if time.Since(createdAt) > s.editWindow {
+		return errors.Errorf("reviews can only be edited during %v after their creation", s.editWindow)
+	}
+	if status != Approved && status != Pending {
+		return errors.New("moderated reviews can't be edited")
+	}
+
+	eQuery := `INSERT INTO review_edits (review_id, stars, comment, edited_at)
+	SELECT id, stars, comment, $2 FROM reviews WHERE id=$1`
+	now := time.Now()
+	if _, err := tx.ExecContext(ctx, eQuery, id, now); err != nil {
+		return errors.Wrap(err, "saving previous version")
+	}
+
+	// The new comment goes through the filter again, pending reviews stay in the queue
+	newStatus, reason := s.filterComment(r.Comment.String)
+	if status == Pending {
+		newStatus = Pending
+	}
+	uQuery := `UPDATE reviews SET stars=$2, comment=$3, status=$4, 
+	moderation_reason=COALESCE($5, moderation_reason), edited_at=$6 
+	WHERE id=$1`
+	_, err = tx.ExecContext(ctx, uQuery, id, r.Stars, r.Comment, newStatus, reason, now)
+	if err != nil {
+		return errors.Wrap(err, "couldn't update the review")
+	}
+
+	if err := updateRatings(ctx, tx, productID, shopID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "committing transaction")
+	}
+
+	if err := s.mc.Delete(id); err != nil && err != memcache.ErrCacheMiss {
+		return errors.Wrap(err, "deleting review from cache")
+	}
+
+	return s.deleteReviewedFromCache(productID, shopID)
+}
+
+// Vote saves the user vote on a review, voting again replaces the previous vote.
+func (s *service) Vote(ctx context.Context, id, userID string, helpful bool) error {
+	s.metrics.incMethodCalls("Vote")
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "starting transaction")
+	}
+	defer tx.Rollback()
+
+	// Lock the review so the counters are calculated with all the votes
+	var authorID string
+	q := "SELECT user_id FROM reviews WHERE id=$1 AND status='approved' FOR UPDATE"
+	if err := tx.GetContext(ctx, &authorID, q, id); err != nil {
+		return errors.Wrap(err, "couldn't find the review")
+	}
+	if authorID == userID {
+		return ErrForbidden
+	}
+
+	vQuery := `INSERT INTO review_votes (review_id, user_id, helpful, created_at) 
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (review_id, user_id) DO UPDATE SET helpful=EXCLUDED.helpful`
+	if _, err := tx.ExecContext(ctx, vQuery, id, userID, helpful, time.Now()); err != nil {
+		return errors.Wrap(err, "couldn't save the vote")
+	}
+
+	cQuery := `UPDATE reviews SET (helpful_count, unhelpful_count) = (
+		SELECT COUNT(*) FILTER (WHERE helpful), COUNT(*) FILTER (WHERE NOT helpful)
+		FROM review_votes WHERE review_id=$1
+	) WHERE id=$1`
+	if _, err := tx.ExecContext(ctx, cQuery, id); err != nil {
+		return errors.Wrap(err, "updating votes count")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "committing transaction")
+	}
+
+	if err := s.mc.Delete(id); err != nil && err != memcache.ErrCacheMiss {
+		return errors.Wrap(err, "deleting review from cache")
+	}
+
+	return nil
+}
+
+// addReplies looks for the replies of the reviews and attaches them.
+func (s *service) addReplies(ctx context.Context, reviews []Review) error {
+	if len(reviews) == 0 {
+		return nil
+	}
+
+	ids := make(pq.StringArray, 0, len(reviews))
+	for _, r := range reviews {
+		ids = append(ids, r.ID.String)
+	}
+
+	var replies []Reply
+	q := "SELECT review_id, user_id, comment, created_at FROM review_replies WHERE review_id = ANY($1)"
+	if err := s.db.SelectContext(ctx, &replies, q, ids); err != nil {
+		return errors.Wrap(err, "couldn't find the replies")
+	}
+
+	for i := range replies {
+		for j := range reviews {
+			if reviews[j].ID.String == replies[i].ReviewID {
+				reviews[j].Reply = &replies[i]
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// filterComment returns the status of a review given its comment and the reason
+// in case it's held for moderation.
+func (s *service) filterComment(comment string) (string, zero.String) {
+	matches := s.filter.Match(comment)
+	if len(matches) == 0 {
+		return Approved, zero.String{}
+	}
+
+	return Pending, zero.StringFrom("contains filtered words: " + strings.Join(matches, ", "))
+}
+
+// deleteReviewedFromCache removes the product and shop reviewed from the cache so
+// their ratings are up to date the next time they are requested.
+func (s *service) deleteReviewedFromCache(productID, shopID zero.String) error {
+	for _, id := range []zero.String{productID, shopID} {
+		if !id.Valid {
+			continue
+		}
+		if err := s.mc.Delete(id.String); err != nil && err != memcache.ErrCacheMiss {
+			return errors.Wrap(err, "deleting reviewed object from cache")
+		}
+	}
+
+	return nil
 }
@@ -3,13 +3,16 @@ package review_test
 import (
 	"context"
 	"testing"
+	"time"
 
+	"github.com/GGP1/adak/internal/config"
 	"github.com/GGP1/adak/internal/logger"
 	"github.com/GGP1/adak/internal/params"
 	"github.com/GGP1/adak/internal/test"
 	"github.com/GGP1/adak/pkg/product"
 	"github.com/GGP1/adak/pkg/review"
 	"github.com/GGP1/adak/pkg/shop"
+	"github.com/GGP1/adak/pkg/shopping/ordering"
 	"github.com/GGP1/adak/pkg/user"
 
 	"github.com/bradfitz/gomemcache/memcache"
@@ -28,40 +31,52 @@ var r = review.Review{
 }
 
 // TestMain failed when creating the review service.
-func NewReviewService(t *testing.T) (context.Context, review.Service) {
+func NewReviewService(t *testing.T) (context.Context, *sqlx.DB, review.Service) {
 	t.Helper()
 	logger.Disable()
 	ctx, cancel := context.WithCancel(context.Background())
 
 	db := test.StartPostgres(t)
 	mc := test.StartMemcached(t)
-	service := review.NewService(db, mc)
+	moderation := config.Moderation{Words: []string{"scam"}, ReportThreshold: 1}
+	service := review.NewService(db, mc, config.Reviews{EditWindow: time.Hour}, moderation, ordering.PurchasedStatuses())
 	createRelations(ctx, t, db, mc)
 
 	t.Cleanup(func() {
 		cancel()
 	})
 
-	return ctx, service
+	return ctx, db, service
 }
 
 func TestReviewService(t *testing.T) {
-	ctx, s := NewReviewService(t)
+	ctx, db, s := NewReviewService(t)
 
 	t.Run("Create", create(ctx, s))
+	t.Run("Rating", rating(ctx, db))
 	t.Run("Get", get(ctx, s))
 	t.Run("Get by id", getByID(ctx, s))
+	t.Run("Moderation", moderation(ctx, s))
+	t.Run("Interactions", interactions(ctx, s))
 	t.Run("Delete", delete(ctx, s))
+	t.Run("Verified", verified(ctx, db, s))
 }
 
 func create(ctx context.Context, s review.Service) func(t *testing.T) {
 	return func(t *testing.T) {
-		assert.NoError(t, s.Create(ctx, r))
+		created, err := s.Create(ctx, r)
+		assert.NoError(t, err)
+		assert.False(t, created.Verified.Bool)
 
-		review, err := s.GetByID(ctx, r.ID.String)
+		rev, err := s.GetByID(ctx, r.ID.String)
 		assert.NoError(t, err)
 
-		assert.Equal(t, r.Comment, review.Comment)
+		assert.Equal(t, r.Comment, rev.Comment)
+
+		duplicate := r
+		duplicate.ID = zero.StringFrom("test2")
+		_, err = s.Create(ctx, duplicate)
+		assert.ErrorIs(t, err, review.ErrAlreadyReviewed)
 	}
 }
 
@@ -91,6 +106,107 @@ func getByID(ctx context.Context, s review.Service) func(t *testing.T) {
 	}
 }
 
+func moderation(ctx context.Context, s review.Service) func(t *testing.T) {
+	return func(t *testing.T) {
+		shopReview := review.Review{
+			ID:      zero.StringFrom("moderation"),
+			Stars:   zero.IntFrom(1),
+			Comment: zero.StringFrom("This shop is a scam"),
+			UserID:  r.UserID,
+			ShopID:  r.ShopID,
+		}
+		created, err := s.Create(ctx, shopReview)
+		assert.NoError(t, err)
+		assert.Equal(t, review.Pending, created.Status.String)
+
+		_, err = s.GetByID(ctx, shopReview.ID.String)
+		assert.Error(t, err)
+
+		queue, err := s.Queue(ctx, params.Query{Limit: "10"})
+		assert.NoError(t, err)
+		assert.Len(t, queue, 1)
+		assert.Equal(t, shopReview.ID, queue[0].ID)
+
+		assert.NoError(t, s.Moderate(ctx, shopReview.ID.String, r.UserID.String, review.Approved, ""))
+		_, err = s.GetByID(ctx, shopReview.ID.String)
+		assert.NoError(t, err)
+
+		// The threshold is 1, a single report sends the review back to the queue
+		assert.NoError(t, s.Report(ctx, r.ID.String, r.UserID.String, "spam"))
+		_, err = s.GetByID(ctx, r.ID.String)
+		assert.Error(t, err)
+
+		assert.NoError(t, s.Moderate(ctx, r.ID.String, r.UserID.String, review.Approved, ""))
+		_, err = s.GetByID(ctx, r.ID.String)
+		assert.NoError(t, err)
+	}
+}
+
+func interactions(ctx context.Context, s review.Service) func(t *testing.T) {
+	return func(t *testing.T) {
+		const voterID = "2"
+		update := review.UpdateReview{Stars: zero.IntFrom(4), Comment: zero.StringFrom("edited")}
+		assert.NoError(t, s.Update(ctx, r.ID.String, r.UserID.String, update))
+		err := s.Update(ctx, r.ID.String, voterID, update)
+		assert.ErrorIs(t, err, review.ErrForbidden)
+
+		edits, err := s.Edits(ctx, r.ID.String)
+		assert.NoError(t, err)
+		assert.Len(t, edits, 1)
+		assert.Equal(t, r.Comment, edits[0].Comment)
+
+		assert.NoError(t, s.Vote(ctx, r.ID.String, voterID, true))
+		err = s.Vote(ctx, r.ID.String, r.UserID.String, true)
+		assert.ErrorIs(t, err, review.ErrForbidden)
+
+		reply := review.Reply{UserID: r.UserID, Comment: "Thanks!"}
+		assert.NoError(t, s.Reply(ctx, r.ID.String, reply))
+		err = s.Reply(ctx, r.ID.String, reply)
+		assert.ErrorIs(t, err, review.ErrAlreadyReplied)
+
+		rev, err := s.GetByID(ctx, r.ID.String)
+		assert.NoError(t, err)
+		assert.Equal(t, update.Comment, rev.Comment)
+		assert.Equal(t, int64(1), rev.Helpful.Int64)
+		if assert.NotNil(t, rev.Reply) {
+			assert.Equal(t, reply.Comment, rev.Reply.Comment)
+		}
+
+		reviews, err := s.Get(ctx, params.Query{Limit: "10", Sort: params.SortHelpful})
+		assert.NoError(t, err)
+		assert.Equal(t, r.ID, reviews[0].ID)
+	}
+}
+
+func rating(ctx context.Context, db *sqlx.DB) func(t *testing.T) {
+	return func(t *testing.T) {
+		productService := product.NewService(db, nil)
+		p, err := productService.GetByID(ctx, r.ProductID.String)
+		assert.NoError(t, err)
+
+		expected := review.Rating{Average: 5, Count: 1, Histogram: []int64{0, 0, 0, 0, 1}}
+		assert.Equal(t, expected, p.Rating)
+	}
+}
+
+func verified(ctx context.Context, db *sqlx.DB, s review.Service) func(t *testing.T) {
+	return func(t *testing.T) {
+		_, err := db.ExecContext(ctx, "INSERT INTO orders (id, user_id, status, fulfilment) VALUES ('verified', '2', $1, 'pickup')", ordering.Collected)
+		assert.NoError(t, err)
+		_, err = db.ExecContext(ctx, "INSERT INTO order_products (order_id, product_id, shop_id) VALUES ('verified', '3', '5')")
+		assert.NoError(t, err)
+
+		rev := r
+		rev.ID = zero.StringFrom("verified")
+		rev.UserID = zero.StringFrom("2")
+		created, err := s.Create(ctx, rev)
+		assert.NoError(t, err)
+		assert.True(t, created.Verified.Bool, "Collected orders are purchases")
+
+		assert.NoError(t, s.Delete(ctx, rev.ID.String))
+	}
+}
+
 func createRelations(ctx context.Context, t *testing.T, db *sqlx.DB, mc *memcache.Client) {
 	t.Helper()
 	userService := user.NewService(db, mc)
@@ -99,7 +215,15 @@ func createRelations(ctx context.Context, t *testing.T, db *sqlx.DB, mc *memcach
 		CartID:   "test",
 		Email:    "test",
 		Username: "test",
-		Password: "test",
+		Password: "testing123",
+	})
+	assert.NoError(t, err)
+	err = userService.Create(ctx, user.AddUser{
+		ID:       "2",
+		CartID:   "test2",
+		Email:    "test2",
+		Username: "test2",
+		Password: "testing123",
 	})
 	assert.NoError(t, err)
 
@@ -107,7 +231,7 @@ func createRelations(ctx context.Context, t *testing.T, db *sqlx.DB, mc *memcach
 	err = shopService.Create(ctx, shop.Shop{
 		ID:   "5",
 		Name: "test",
-	})
+	}, "1")
 	assert.NoError(t, err)
 
 	productService := product.NewService(db, mc)
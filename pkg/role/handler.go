@@ -0,0 +1,117 @@
+package role
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/GGP1/adak/internal/identity"
+	"github.com/GGP1/adak/internal/params"
+	"github.com/GGP1/adak/internal/response"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+)
+
+type userRoles struct {
+	UserID string   `json:"user_id"`
+	Roles  []string `json:"roles"`
+}
+
+// Handler handles roles endpoints.
+type Handler struct {
+	service Service
+}
+
+// NewHandler returns a new role handler.
+func NewHandler(service Service) Handler {
+	return Handler{service}
+}
+
+// Get lists the roles available and the permissions they grant.
+func (h *Handler) Get() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		response.JSON(w, http.StatusOK, List())
+	}
+}
+
+// GetByUserID lists the roles of a user.
+func (h *Handler) GetByUserID() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		id, err := params.URLID(ctx)
+		if err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		roles, err := h.service.Get(ctx, id)
+		if err != nil {
+			response.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		response.JSON(w, http.StatusOK, userRoles{UserID: id, Roles: roles})
+	}
+}
+
+// Grant gives a role to a user.
+func (h *Handler) Grant() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		id, err := params.URLID(ctx)
+		if err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		adminID, err := identity.UserID(r)
+		if err != nil {
+			response.Error(w, http.StatusForbidden, err)
+			return
+		}
+
+		role := chi.URLParam(r, "role")
+		if err := h.service.Grant(ctx, id, role, adminID); err != nil {
+			response.Error(w, statusCode(err), err)
+			return
+		}
+
+		response.JSONText(w, http.StatusOK, fmt.Sprintf("role %q granted to %q", role, id))
+	}
+}
+
+// Revoke takes a role away from a user.
+func (h *Handler) Revoke() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		id, err := params.URLID(ctx)
+		if err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		role := chi.URLParam(r, "role")
+		if err := h.service.Revoke(ctx, id, role); err != nil {
+			response.Error(w, statusCode(err), err)
+			return
+		}
+
+		response.JSONText(w, http.StatusOK, fmt.Sprintf("role %q revoked from %q", role, id))
+	}
+}
+
+func statusCode(err error) int {
+	switch {
+	case errors.Is(err, ErrUnknownRole):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrUserNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrLastAdmin):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
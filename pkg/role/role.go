@@ -0,0 +1,91 @@
+// Package role implements role-based access control.
+package role
+
+// Roles
+const (
+	Customer  = "customer"
+	ShopOwner = "shop_owner"
+	ShopStaff = "shop_staff"
+	Support   = "support"
+	Admin     = "admin"
+)
+
+// Permission is an action that can be performed over a resource, in the format "resource:action".
+type Permission string
+
+// Permissions
+const (
+	OrdersRead      Permission = "orders:read"
+	OrdersWrite     Permission = "orders:write"
+	PaymentsRead    Permission = "payments:read"
+	ProductsWrite   Permission = "products:write"
+	ReviewsModerate Permission = "reviews:moderate"
+	ReviewsReply    Permission = "reviews:reply"
+	ShopsWrite      Permission = "shops:write"
+	TrackingRead    Permission = "tracking:read"
+	TrackingWrite   Permission = "tracking:write"
+)
+
+// permissions maps each role to the permissions it grants. Customers have no
+// special permissions, what they can do depends only on being logged in.
+var permissions = map[string][]Permission{
+	Customer:  {},
+	ShopOwner: {ProductsWrite, ReviewsReply, ShopsWrite},
+	ShopStaff: {ProductsWrite},
+	Support:   {OrdersRead, ReviewsModerate, TrackingRead},
+	Admin: {
+		OrdersRead, OrdersWrite, PaymentsRead, ProductsWrite, ReviewsModerate,
+		ReviewsReply, ShopsWrite, TrackingRead, TrackingWrite,
+	},
+}
+
+// Role contains a role's name and the permissions it grants.
+type Role struct {
+	Name        string       `json:"name"`
+	Permissions []Permission `json:"permissions"`
+}
+
+// List returns all the roles available.
+func List() []Role {
+	names := []string{Customer, ShopOwner, ShopStaff, Support, Admin}
+	roles := make([]Role, 0, len(names))
+	for _, name := range names {
+		roles = append(roles, Role{Name: name, Permissions: permissions[name]})
+	}
+	return roles
+}
+
+// Initial returns the roles of a new user. The admins list is used only to bootstrap
+// the first administrators, the rest are granted the role at runtime.
+func Initial(email string, admins []string) []string {
+	roles := []string{Customer}
+	for _, admin := range admins {
+		if admin == email {
+			return append(roles, Admin)
+		}
+	}
+	return roles
+}
+
+// Exists returns whether the role exists.
+func Exists(role string) bool {
+	_, ok := permissions[role]
+	return ok
+}
+
+// Grants returns whether any of the roles grants all the permissions provided.
+func Grants(roles []string, perms ...Permission) bool {
+	granted := make(map[Permission]struct{})
+	for _, role := range roles {
+		for _, p := range permissions[role] {
+			granted[p] = struct{}{}
+		}
+	}
+
+	for _, p := range perms {
+		if _, ok := granted[p]; !ok {
+			return false
+		}
+	}
+	return true
+}
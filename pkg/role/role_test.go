@@ -0,0 +1,45 @@
+package role
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGrants(t *testing.T) {
+	cases := []struct {
+		desc     string
+		roles    []string
+		perms    []Permission
+		expected bool
+	}{
+		{desc: "No roles", roles: nil, perms: []Permission{ProductsWrite}, expected: false},
+		{desc: "No permissions required", roles: []string{Customer}, perms: nil, expected: true},
+		{desc: "Customer", roles: []string{Customer}, perms: []Permission{ProductsWrite}, expected: false},
+		{desc: "Shop owner", roles: []string{Customer, ShopOwner}, perms: []Permission{ProductsWrite}, expected: true},
+		{desc: "Partially granted", roles: []string{Support}, perms: []Permission{OrdersRead, OrdersWrite}, expected: false},
+		{desc: "Combined roles", roles: []string{ShopOwner, Support}, perms: []Permission{ProductsWrite, OrdersRead}, expected: true},
+		{desc: "Unknown role", roles: []string{"superuser"}, perms: []Permission{ShopsWrite}, expected: false},
+		{desc: "Admin", roles: []string{Admin}, perms: []Permission{PaymentsRead, ShopsWrite}, expected: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert.Equal(t, tc.expected, Grants(tc.roles, tc.perms...))
+		})
+	}
+}
+
+func TestInitial(t *testing.T) {
+	admins := []string{"admin@test.com"}
+	assert.Equal(t, []string{Customer}, Initial("user@test.com", admins))
+	assert.Equal(t, []string{Customer, Admin}, Initial("admin@test.com", admins))
+	assert.Equal(t, []string{Customer}, Initial("admin@test.com", nil))
+}
+
+func TestList(t *testing.T) {
+	for _, r := range List() {
+		assert.True(t, Exists(r.Name), r.Name)
+	}
+	assert.False(t, Exists("superuser"))
+}
@@ -0,0 +1,133 @@
+package role
+
+import (
+	"context"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrLastAdmin is returned when trying to revoke the admin role from the only administrator left.
+	ErrLastAdmin = errors.New("the last administrator's role can't be revoked")
+	// ErrUnknownRole is returned when the role doesn't exist.
+	ErrUnknownRole = errors.New("unknown role")
+	// ErrUserNotFound is returned when the user the role is granted to doesn't exist.
+	ErrUserNotFound = errors.New("user not found")
+)
+
+// Service provides role operations.
+type Service interface {
+	Can(ctx context.Context, userID string, perms ...Permission) (bool, error)
+	Get(ctx context.Context, userID string) ([]string, error)
+	Grant(ctx context.Context, userID, role, grantedBy string) error
+	Revoke(ctx context.Context, userID, role string) error
+}
+
+type service struct {
+	db      *sqlx.DB
+	metrics metrics
+}
+
+// NewService returns a new role service.
+func NewService(db *sqlx.DB) Service {
+	return &service{db, initMetrics()}
+}
+
+// Can returns whether the user's roles grant all the permissions provided.
+func (s *service) Can(ctx context.Context, userID string, perms ...Permission) (bool, error) {
+	s.metrics.incMethodCalls("Can")
+
+	roles, err := s.get(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+
+	return Grants(roles, perms...), nil
+}
+
+// Get returns the roles of the user.
+func (s *service) Get(ctx context.Context, userID string) ([]string, error) {
+	s.metrics.incMethodCalls("Get")
+	return s.get(ctx, userID)
+}
+
+// Grant gives a role to the user, granting a role the user already has is a no-op.
+func (s *service) Grant(ctx context.Context, userID, role, grantedBy string) error {
+	s.metrics.incMethodCalls("Grant")
+
+	if !Exists(role) {
+		return ErrUnknownRole
+	}
+
+	var exists bool
+	if err := s.db.GetContext(ctx, &exists, "SELECT EXISTS(SELECT 1 FROM users WHERE id=$1)", userID); err != nil {
+		return errors.Wrap(err, "checking user existence")
+	}
+	if !exists {
+		return ErrUserNotFound
+	}
+
+	q := `INSERT INTO user_roles (user_id, role, granted_by) VALUES ($1, $2, NULLIF($3, ''))
+	ON CONFLICT (user_id, role) DO NOTHING`
+	res, err := s.db.ExecContext(ctx, q, userID, role, grantedBy)
+	if err != nil {
+		return errors.Wrap(err, "couldn't grant the role")
+	}
+
+	if n, _ := res.RowsAffected(); n > 0 {
+		s.metrics.changes.WithLabelValues(role, "grant").Inc()
+	}
+	return nil
+}
+
+// Revoke takes a role away from the user.
+func (s *service) Revoke(ctx context.Context, userID, role string) error {
+	s.metrics.incMethodCalls("Revoke")
+
+	if !Exists(role) {
+		return ErrUnknownRole
+	}
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "starting transaction")
+	}
+	defer tx.Rollback()
+
+	if role == Admin {
+		// Lock the administrators' rows so two of them can't revoke each other concurrently
+		var admins []string
+		q := "SELECT user_id FROM user_roles WHERE role=$1 FOR UPDATE"
+		if err := tx.SelectContext(ctx, &admins, q, Admin); err != nil {
+			return errors.Wrap(err, "fetching administrators")
+		}
+		if len(admins) == 1 && admins[0] == userID {
+			return ErrLastAdmin
+		}
+	}
+
+	res, err := tx.ExecContext(ctx, "DELETE FROM user_roles WHERE user_id=$1 AND role=$2", userID, role)
+	if err != nil {
+		return errors.Wrap(err, "couldn't revoke the role")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "committing transaction")
+	}
+
+	if n, _ := res.RowsAffected(); n > 0 {
+		s.metrics.changes.WithLabelValues(role, "revoke").Inc()
+	}
+	return nil
+}
+
+func (s *service) get(ctx context.Context, userID string) ([]string, error) {
+	roles := []string{}
+	q := "SELECT role FROM user_roles WHERE user_id=$1 ORDER BY role"
+	if err := s.db.SelectContext(ctx, &roles, q, userID); err != nil {
+		return nil, errors.Wrap(err, "couldn't find the user's roles")
+	}
+
+	return roles, nil
+}
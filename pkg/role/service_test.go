@@ -0,0 +1,99 @@
+package role_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/GGP1/adak/internal/logger"
+	"github.com/GGP1/adak/internal/test"
+	"github.com/GGP1/adak/pkg/role"
+	"github.com/GGP1/adak/pkg/user"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	admin    = user.AddUser{ID: "1", CartID: "1", Username: "admin", Email: "admin@test.com", Password: "testing123"}
+	customer = user.AddUser{ID: "2", CartID: "2", Username: "customer", Email: "customer@test.com", Password: "testing123"}
+)
+
+// TestMain failed when creating the role service.
+func NewRoleService(t *testing.T) (context.Context, role.Service) {
+	t.Helper()
+	logger.Disable()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	db := test.StartPostgres(t)
+	mc := test.StartMemcached(t)
+	service := role.NewService(db)
+
+	viper.Set("admins", []string{admin.Email})
+	userService := user.NewService(db, mc)
+	assert.NoError(t, userService.Create(ctx, admin))
+	assert.NoError(t, userService.Create(ctx, customer))
+
+	t.Cleanup(func() {
+		cancel()
+	})
+
+	return ctx, service
+}
+
+func TestRoleService(t *testing.T) {
+	ctx, s := NewRoleService(t)
+
+	t.Run("Signup roles", signupRoles(ctx, s))
+	t.Run("Grant", grant(ctx, s))
+	t.Run("Revoke", revoke(ctx, s))
+}
+
+func signupRoles(ctx context.Context, s role.Service) func(t *testing.T) {
+	return func(t *testing.T) {
+		roles, err := s.Get(ctx, admin.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{role.Admin, role.Customer}, roles)
+
+		roles, err = s.Get(ctx, customer.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{role.Customer}, roles)
+	}
+}
+
+func grant(ctx context.Context, s role.Service) func(t *testing.T) {
+	return func(t *testing.T) {
+		can, err := s.Can(ctx, customer.ID, role.ProductsWrite)
+		assert.NoError(t, err)
+		assert.False(t, can)
+
+		assert.NoError(t, s.Grant(ctx, customer.ID, role.ShopOwner, admin.ID))
+		// Granting it twice is a no-op
+		assert.NoError(t, s.Grant(ctx, customer.ID, role.ShopOwner, admin.ID))
+
+		can, err = s.Can(ctx, customer.ID, role.ProductsWrite)
+		assert.NoError(t, err)
+		assert.True(t, can)
+
+		assert.ErrorIs(t, s.Grant(ctx, customer.ID, "superuser", admin.ID), role.ErrUnknownRole)
+		assert.ErrorIs(t, s.Grant(ctx, "3", role.Support, admin.ID), role.ErrUserNotFound)
+	}
+}
+
+func revoke(ctx context.Context, s role.Service) func(t *testing.T) {
+	return func(t *testing.T) {
+		assert.NoError(t, s.Revoke(ctx, customer.ID, role.ShopOwner))
+
+		roles, err := s.Get(ctx, customer.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{role.Customer}, roles)
+
+		assert.ErrorIs(t, s.Revoke(ctx, admin.ID, role.Admin), role.ErrLastAdmin)
+
+		assert.NoError(t, s.Grant(ctx, customer.ID, role.Admin, admin.ID))
+		assert.NoError(t, s.Revoke(ctx, admin.ID, role.Admin))
+
+		can, err := s.Can(ctx, admin.ID, role.ShopsWrite)
+		assert.NoError(t, err)
+		assert.False(t, can)
+	}
+}
@@ -3,17 +3,35 @@ package shop
 import (
 	"encoding/json"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/GGP1/adak/internal/geo"
+	"github.com/GGP1/adak/internal/identity"
 	"github.com/GGP1/adak/internal/params"
 	"github.com/GGP1/adak/internal/response"
-	"github.com/GGP1/adak/internal/sanitize"
 	"github.com/GGP1/adak/internal/validate"
+	"github.com/GGP1/adak/pkg/shop/member"
 	"github.com/google/uuid"
 
 	"github.com/bradfitz/gomemcache/memcache"
 	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+	"gopkg.in/guregu/null.v4"
 )
 
+const (
+	// defaultRadius and maxRadius are expressed in kilometers
+	defaultRadius = 5
+	maxRadius     = 50
+)
+
+var errInvalidCoordinates = errors.New("invalid coordinates, both latitude and longitude must be provided and within range")
+
+type deliversToResponse struct {
+	Delivers bool `json:"delivers"`
+}
+
 type cursorResponse struct {
 	NextCursor string `json:"next_cursor,omitempty"`
 	Shops      []Shop `json:"shops,omitempty"`
@@ -21,15 +39,61 @@ type cursorResponse struct {
 
 // Handler handles shop endpoints.
 type Handler struct {
-	service Service
-	cache   *memcache.Client
+	service  Service
+	geocoder *geo.Geocoder
+	cache    *memcache.Client
 }
 
 // NewHandler returns a new shop handler.
-func NewHandler(service Service, cache *memcache.Client) Handler {
+func NewHandler(service Service, geocoder *geo.Geocoder, cache *memcache.Client) Handler {
 	return Handler{
-		service: service,
-		cache:   cache,
+		service:  service,
+		geocoder: geocoder,
+		cache:    cache,
+	}
+}
+
+// AddLocation adds a location to the shop, only its owner can do it.
+func (h *Handler) AddLocation(members member.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		id, err := params.URLID(ctx)
+		if err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if _, err := member.Authorize(r, members, id, member.Owner); err != nil {
+			response.Error(w, http.StatusForbidden, err)
+			return
+		}
+
+		var location Location
+		if err := json.NewDecoder(r.Body).Decode(&location); err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+		defer r.Body.Close()
+
+		if err := validate.Struct(ctx, location); err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if err := h.locate(&location); err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		location.ID = uuid.NewString()
+		location.ShopID = id
+		if err := h.service.AddLocation(ctx, location); err != nil {
+			response.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		response.JSON(w, http.StatusCreated, location)
 	}
 }
 
@@ -38,6 +102,12 @@ func (h *Handler) Create() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 
+		userID, err := identity.UserID(r)
+		if err != nil {
+			response.Error(w, http.StatusForbidden, err)
+			return
+		}
+
 		var shop Shop
 		if err := json.NewDecoder(r.Body).Decode(&shop); err != nil {
 			response.Error(w, http.StatusBadRequest, err)
@@ -50,8 +120,25 @@ func (h *Handler) Create() http.HandlerFunc {
 			return
 		}
 
+		if shop.Language != "" && !params.SupportedLanguage(shop.Language) {
+			response.Error(w, http.StatusBadRequest, errors.Errorf("unsupported language %q", shop.Language))
+			return
+		}
+
+		if err := shop.Schedule().Validate(); err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if err := h.locate(&shop.Location); err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
 		shop.ID = uuid.NewString()
-		if err := h.service.Create(ctx, shop); err != nil {
+		shop.Location.ID = uuid.NewString()
+		shop.Location.ShopID = shop.ID
+		if err := h.service.Create(ctx, shop, userID); err != nil {
 			response.Error(w, http.StatusInternalServerError, err)
 			return
 		}
@@ -60,8 +147,8 @@ func (h *Handler) Create() http.HandlerFunc {
 	}
 }
 
-// Delete removes a shop.
-func (h *Handler) Delete() http.HandlerFunc {
+// Delete removes a shop, only its owner can do it.
+func (h *Handler) Delete(members member.Service) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 
@@ -71,6 +158,11 @@ func (h *Handler) Delete() http.HandlerFunc {
 			return
 		}
 
+		if _, err := member.Authorize(r, members, id, member.Owner); err != nil {
+			response.Error(w, http.StatusForbidden, err)
+			return
+		}
+
 		if err := h.service.Delete(ctx, id); err != nil {
 			response.Error(w, http.StatusInternalServerError, err)
 			return
@@ -80,6 +172,39 @@ func (h *Handler) Delete() http.HandlerFunc {
 	}
 }
 
+// DeleteLocation removes a shop location, only its owner can do it.
+func (h *Handler) DeleteLocation(members member.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		id, err := params.URLID(ctx)
+		if err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if _, err := member.Authorize(r, members, id, member.Owner); err != nil {
+			response.Error(w, http.StatusForbidden, err)
+			return
+		}
+
+		locationID := chi.URLParam(r, "locationID")
+		if err := h.service.DeleteLocation(ctx, id, locationID); err != nil {
+			switch {
+			case errors.Is(err, ErrLocationNotFound):
+				response.Error(w, http.StatusNotFound, err)
+			case errors.Is(err, ErrLastLocation):
+				response.Error(w, http.StatusBadRequest, err)
+			default:
+				response.Error(w, http.StatusInternalServerError, err)
+			}
+			return
+		}
+
+		response.JSONText(w, http.StatusOK, locationID)
+	}
+}
+
 // Get lists all the shops.
 func (h *Handler) Get() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -109,6 +234,38 @@ func (h *Handler) Get() http.HandlerFunc {
 	}
 }
 
+// DeliversTo checks whether the shop delivers to the address in the url parameters.
+func (h *Handler) DeliversTo() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		id, err := params.URLID(ctx)
+		if err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		address, err := parseAddress(r)
+		if err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+		address.Geocode(h.geocoder)
+
+		undeliverable, err := h.service.Undeliverable(ctx, address, id)
+		if err != nil {
+			if errors.Is(err, ErrShopNotFound) {
+				response.Error(w, http.StatusNotFound, err)
+				return
+			}
+			response.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		response.JSON(w, http.StatusOK, deliversToResponse{Delivers: len(undeliverable) == 0})
+	}
+}
+
 // GetByID lists the shop with the id requested.
 func (h *Handler) GetByID() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -120,10 +277,15 @@ func (h *Handler) GetByID() http.HandlerFunc {
 			return
 		}
 
+		// The open_now flag changes over time, refresh it when the shop is cached
 		item, err := h.cache.Get(id)
 		if err == nil {
-			response.EncodedJSON(w, item.Value)
-			return
+			var shop Shop
+			if err := json.Unmarshal(item.Value, &shop); err == nil {
+				shop.OpenNow = shop.Schedule().OpenAt(time.Now())
+				response.JSON(w, http.StatusOK, shop)
+				return
+			}
 		}
 
 		shop, err := h.service.GetByID(ctx, id)
@@ -136,19 +298,82 @@ func (h *Handler) GetByID() http.HandlerFunc {
 	}
 }
 
+// Locations lists the shop locations, starting with the main one.
+func (h *Handler) Locations() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		id, err := params.URLID(ctx)
+		if err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		locations, err := h.service.Locations(ctx, id)
+		if err != nil {
+			response.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		response.JSON(w, http.StatusOK, locations)
+	}
+}
+
+// Nearby lists the shops located within a radius (in kilometers) of the coordinates provided,
+// optionally only the ones that are open.
+func (h *Handler) Nearby() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		nearby, err := parseNearby(r)
+		if err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		shops, err := h.service.Nearby(ctx, nearby)
+		if err != nil {
+			response.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		response.JSON(w, http.StatusOK, shops)
+	}
+}
+
+// Schedule lists the shop's opening hours and upcoming holidays.
+func (h *Handler) Schedule() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		id, err := params.URLID(ctx)
+		if err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		schedule, err := h.service.Schedule(ctx, id)
+		if err != nil {
+			response.Error(w, http.StatusNotFound, err)
+			return
+		}
+
+		response.JSON(w, http.StatusOK, schedule)
+	}
+}
+
 // Search looks for the products with the given value.
 func (h *Handler) Search() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		query := chi.URLParam(r, "query")
 		ctx := r.Context()
 
-		query = sanitize.Normalize(query)
-		if err := validate.SearchQuery(query); err != nil {
+		search, err := params.ParseSearch(r)
+		if err != nil {
 			response.Error(w, http.StatusBadRequest, err)
 			return
 		}
 
-		shops, err := h.service.Search(ctx, query)
+		shops, err := h.service.Search(ctx, search)
 		if err != nil {
 			response.Error(w, http.StatusNotFound, err)
 			return
@@ -158,8 +383,8 @@ func (h *Handler) Search() http.HandlerFunc {
 	}
 }
 
-// Update updates the shop with the given id.
-func (h *Handler) Update() http.HandlerFunc {
+// Update updates the shop with the given id, only its owner can do it.
+func (h *Handler) Update(members member.Service) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 
@@ -169,6 +394,11 @@ func (h *Handler) Update() http.HandlerFunc {
 			return
 		}
 
+		if _, err := member.Authorize(r, members, id, member.Owner); err != nil {
+			response.Error(w, http.StatusForbidden, err)
+			return
+		}
+
 		var shop UpdateShop
 		if err := json.NewDecoder(r.Body).Decode(&shop); err != nil {
 			response.Error(w, http.StatusBadRequest, err)
@@ -181,6 +411,11 @@ func (h *Handler) Update() http.HandlerFunc {
 			return
 		}
 
+		if shop.Language != "" && !params.SupportedLanguage(shop.Language) {
+			response.Error(w, http.StatusBadRequest, errors.Errorf("unsupported language %q", shop.Language))
+			return
+		}
+
 		if err := h.service.Update(ctx, id, shop); err != nil {
 			response.Error(w, http.StatusInternalServerError, err)
 			return
@@ -189,3 +424,263 @@ func (h *Handler) Update() http.HandlerFunc {
 		response.JSONText(w, http.StatusOK, id)
 	}
 }
+
+// UpdateLocation updates a shop location, the main one if the url has no location id.
+// Only the shop owner can do it.
+func (h *Handler) UpdateLocation(members member.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		id, err := params.URLID(ctx)
+		if err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if _, err := member.Authorize(r, members, id, member.Owner); err != nil {
+			response.Error(w, http.StatusForbidden, err)
+			return
+		}
+
+		var location Location
+		if err := json.NewDecoder(r.Body).Decode(&location); err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+		defer r.Body.Close()
+
+		if err := validate.Struct(ctx, location); err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if err := h.locate(&location); err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		location.ID = chi.URLParam(r, "locationID")
+		location.ShopID = id
+		if err := h.service.UpdateLocation(ctx, id, location); err != nil {
+			if errors.Is(err, ErrLocationNotFound) {
+				response.Error(w, http.StatusNotFound, err)
+				return
+			}
+			response.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		response.JSON(w, http.StatusOK, location)
+	}
+}
+
+// UpdateSchedule replaces the shop's opening hours and holidays, only its owner can do it.
+func (h *Handler) UpdateSchedule(members member.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		id, err := params.URLID(ctx)
+		if err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if _, err := member.Authorize(r, members, id, member.Owner); err != nil {
+			response.Error(w, http.StatusForbidden, err)
+			return
+		}
+
+		var schedule Schedule
+		if err := json.NewDecoder(r.Body).Decode(&schedule); err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+		defer r.Body.Close()
+
+		if err := schedule.Validate(); err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if err := h.service.UpdateSchedule(ctx, id, schedule); err != nil {
+			response.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		response.JSON(w, http.StatusOK, schedule)
+	}
+}
+
+// UpdateZones replaces the shop's delivery zones, only its owner can do it.
+func (h *Handler) UpdateZones(members member.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		id, err := params.URLID(ctx)
+		if err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if _, err := member.Authorize(r, members, id, member.Owner); err != nil {
+			response.Error(w, http.StatusForbidden, err)
+			return
+		}
+
+		var zones []Zone
+		if err := json.NewDecoder(r.Body).Decode(&zones); err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+		defer r.Body.Close()
+
+		for _, z := range zones {
+			if err := z.Validate(); err != nil {
+				response.Error(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+
+		if err := h.service.UpdateZones(ctx, id, zones); err != nil {
+			if errors.Is(err, ErrMissingCoordinates) {
+				response.Error(w, http.StatusBadRequest, err)
+				return
+			}
+			response.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		response.JSON(w, http.StatusOK, zones)
+	}
+}
+
+// Zones lists the shop's delivery zones.
+func (h *Handler) Zones() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		id, err := params.URLID(ctx)
+		if err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		zones, err := h.service.Zones(ctx, id)
+		if err != nil {
+			if errors.Is(err, ErrShopNotFound) {
+				response.Error(w, http.StatusNotFound, err)
+				return
+			}
+			response.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		response.JSON(w, http.StatusOK, zones)
+	}
+}
+
+// locate validates the location coordinates and, if they weren't provided, looks them up
+// using the geocoder. Locations that can't be geocoded are saved without coordinates.
+func (h *Handler) locate(location *Location) error {
+	if location.Latitude.Valid != location.Longitude.Valid {
+		return errInvalidCoordinates
+	}
+
+	if location.Latitude.Valid {
+		if !geo.ValidCoordinates(location.Latitude.Float64, location.Longitude.Float64) {
+			return errInvalidCoordinates
+		}
+		return nil
+	}
+
+	if p, ok := h.geocoder.Lookup(location.Country, location.ZipCode, location.City); ok {
+		location.Latitude = null.FloatFrom(p.Latitude)
+		location.Longitude = null.FloatFrom(p.Longitude)
+	}
+	return nil
+}
+
+// parseAddress returns the delivery address from the request url, the coordinates are optional.
+func parseAddress(r *http.Request) (Address, error) {
+	query := r.URL.Query()
+	address := Address{
+		Country: query.Get("country"),
+		State:   query.Get("state"),
+		ZipCode: query.Get("zip_code"),
+		City:    query.Get("city"),
+	}
+	if address.Country == "" {
+		return Address{}, errors.New("country is required")
+	}
+
+	lat, lng := query.Get("lat"), query.Get("lng")
+	if lat == "" && lng == "" {
+		return address, nil
+	}
+
+	latitude, err := strconv.ParseFloat(lat, 64)
+	if err != nil {
+		return Address{}, errors.Wrap(err, "lat")
+	}
+	longitude, err := strconv.ParseFloat(lng, 64)
+	if err != nil {
+		return Address{}, errors.Wrap(err, "lng")
+	}
+	if !geo.ValidCoordinates(latitude, longitude) {
+		return Address{}, errInvalidCoordinates
+	}
+	address.Latitude = null.FloatFrom(latitude)
+	address.Longitude = null.FloatFrom(longitude)
+
+	return address, nil
+}
+
+// parseNearby returns the nearby search parameters from the request url.
+func parseNearby(r *http.Request) (Nearby, error) {
+	query := r.URL.Query()
+
+	lat, err := strconv.ParseFloat(query.Get("lat"), 64)
+	if err != nil {
+		return Nearby{}, errors.Wrap(err, "lat")
+	}
+	lng, err := strconv.ParseFloat(query.Get("lng"), 64)
+	if err != nil {
+		return Nearby{}, errors.Wrap(err, "lng")
+	}
+	if !geo.ValidCoordinates(lat, lng) {
+		return Nearby{}, errInvalidCoordinates
+	}
+
+	radius := float64(defaultRadius)
+	if v := query.Get("radius"); v != "" {
+		radius, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			return Nearby{}, errors.Wrap(err, "radius")
+		}
+		if radius <= 0 || radius > maxRadius {
+			return Nearby{}, errors.Errorf("radius must be greater than 0 and lower than %d kilometers", maxRadius)
+		}
+	}
+
+	var openNow bool
+	if v := query.Get("open_now"); v != "" {
+		openNow, err = strconv.ParseBool(v)
+		if err != nil {
+			return Nearby{}, errors.Wrap(err, "open_now")
+		}
+	}
+
+	urlParams, err := params.ParseQuery(r.URL.RawQuery, params.Shop)
+	if err != nil {
+		return Nearby{}, err
+	}
+
+	nearby := Nearby{
+		Latitude:  lat,
+		Longitude: lng,
+		Radius:    radius * 1000,
+		Limit:     urlParams.Limit,
+		OpenNow:   openNow,
+	}
+	return nearby, nil
+}
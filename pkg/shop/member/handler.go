@@ -0,0 +1,197 @@
+package member
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/GGP1/adak/internal/email"
+	"github.com/GGP1/adak/internal/identity"
+	"github.com/GGP1/adak/internal/params"
+	"github.com/GGP1/adak/internal/response"
+	"github.com/GGP1/adak/internal/validate"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+)
+
+// Handler handles shop members endpoints.
+type Handler struct {
+	service Service
+	emailer email.Emailer
+}
+
+// NewHandler returns a new shop members handler.
+func NewHandler(service Service, emailer email.Emailer) Handler {
+	return Handler{
+		service: service,
+		emailer: emailer,
+	}
+}
+
+// Accept adds the logged in user to the staff of the shop that invited them.
+func (h *Handler) Accept() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		userID, err := identity.UserID(r)
+		if err != nil {
+			response.Error(w, http.StatusForbidden, err)
+			return
+		}
+
+		shopID, err := h.service.Accept(ctx, chi.URLParam(r, "token"), userID)
+		if err != nil {
+			if errors.Is(err, ErrInvalidInvitation) {
+				response.Error(w, http.StatusNotFound, err)
+				return
+			}
+			response.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		response.JSONText(w, http.StatusOK, shopID)
+	}
+}
+
+// Get lists the members of a shop.
+func (h *Handler) Get() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		id, err := params.URLID(ctx)
+		if err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if _, err := Authorize(r, h.service, id, Owner, Staff); err != nil {
+			response.Error(w, http.StatusForbidden, err)
+			return
+		}
+
+		members, err := h.service.Get(ctx, id)
+		if err != nil {
+			response.Error(w, http.StatusNotFound, err)
+			return
+		}
+
+		response.JSON(w, http.StatusOK, members)
+	}
+}
+
+// Invite sends an email inviting a user to join the shop's staff.
+func (h *Handler) Invite() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		id, err := params.URLID(ctx)
+		if err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		userID, err := Authorize(r, h.service, id, Owner)
+		if err != nil {
+			response.Error(w, http.StatusForbidden, err)
+			return
+		}
+
+		var invitation Invitation
+		if err := json.NewDecoder(r.Body).Decode(&invitation); err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+		defer r.Body.Close()
+
+		if err := validate.Struct(ctx, invitation); err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		token, shopName, err := h.service.Invite(ctx, id, invitation.Email, userID)
+		if err != nil {
+			if errors.Is(err, ErrShopNotFound) {
+				response.Error(w, http.StatusNotFound, err)
+				return
+			}
+			response.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		if err := h.emailer.SendInvitation(invitation.Email, shopName, token); err != nil {
+			response.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		response.JSONText(w, http.StatusOK, "invitation sent to "+invitation.Email)
+	}
+}
+
+// Remove takes a member out of the shop's staff.
+func (h *Handler) Remove() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		id, err := params.URLID(ctx)
+		if err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if _, err := Authorize(r, h.service, id, Owner); err != nil {
+			response.Error(w, http.StatusForbidden, err)
+			return
+		}
+
+		userID := chi.URLParam(r, "userID")
+		if err := h.service.Remove(ctx, id, userID); err != nil {
+			switch {
+			case errors.Is(err, ErrNotMember):
+				response.Error(w, http.StatusNotFound, err)
+			case errors.Is(err, ErrOwner):
+				response.Error(w, http.StatusConflict, err)
+			default:
+				response.Error(w, http.StatusInternalServerError, err)
+			}
+			return
+		}
+
+		response.JSONText(w, http.StatusOK, userID)
+	}
+}
+
+// Authorize returns the id of the logged in user if they are a member of the shop with any of the roles provided.
+func Authorize(r *http.Request, service Service, shopID string, roles ...string) (string, error) {
+	userID, err := identity.UserID(r)
+	if err != nil {
+		return "", err
+	}
+
+	can, err := service.Can(r.Context(), shopID, userID, roles...)
+	if err != nil {
+		return "", err
+	}
+	if !can {
+		return "", ErrForbidden
+	}
+
+	return userID, nil
+}
+
+// AuthorizeProduct is like Authorize but takes the id of one of the shop's products.
+func AuthorizeProduct(r *http.Request, service Service, productID string, roles ...string) (string, error) {
+	userID, err := identity.UserID(r)
+	if err != nil {
+		return "", err
+	}
+
+	can, err := service.CanProduct(r.Context(), productID, userID, roles...)
+	if err != nil {
+		return "", err
+	}
+	if !can {
+		return "", ErrForbidden
+	}
+
+	return userID, nil
+}
@@ -0,0 +1,25 @@
+package member
+
+import (
+	"time"
+)
+
+// Members roles
+const (
+	Owner = "owner"
+	Staff = "staff"
+)
+
+// Member is a user that manages a shop.
+type Member struct {
+	UserID    string    `json:"user_id" db:"user_id"`
+	Username  string    `json:"username"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// Invitation is used to invite a user to join a shop's staff.
+type Invitation struct {
+	Email string `json:"email" validate:"email,required"`
+}
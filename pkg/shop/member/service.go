@@ -0,0 +1,220 @@
+// Package member implements the shops' ownership and staff management.
+package member
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/GGP1/adak/internal/token"
+	"github.com/GGP1/adak/pkg/role"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// invitationExpiration is the time staff invitations can be accepted within.
+const invitationExpiration = 7 * 24 * time.Hour
+
+var (
+	// ErrForbidden is returned when the user isn't allowed to manage the shop.
+	ErrForbidden = errors.New("you are not allowed to manage this shop")
+	// ErrInvalidInvitation is returned when the invitation doesn't exist, expired or was sent to another email.
+	ErrInvalidInvitation = errors.New("invalid or expired invitation")
+	// ErrNotMember is returned when the user isn't a member of the shop.
+	ErrNotMember = errors.New("the user is not a member of the shop")
+	// ErrOwner is returned when trying to remove the owner of a shop.
+	ErrOwner = errors.New("the shop owner can't be removed")
+	// ErrShopNotFound is returned when the shop doesn't exist.
+	ErrShopNotFound = errors.New("shop not found")
+)
+
+// Service provides shop members operations.
+type Service interface {
+	Accept(ctx context.Context, token, userID string) (string, error)
+	Can(ctx context.Context, shopID, userID string, roles ...string) (bool, error)
+	CanProduct(ctx context.Context, productID, userID string, roles ...string) (bool, error)
+	Get(ctx context.Context, shopID string) ([]Member, error)
+	Invite(ctx context.Context, shopID, email, invitedBy string) (string, string, error)
+	Remove(ctx context.Context, shopID, userID string) error
+}
+
+type service struct {
+	db      *sqlx.DB
+	metrics metrics
+}
+
+// NewService returns a new shop members service.
+func NewService(db *sqlx.DB) Service {
+	return &service{db, initMetrics()}
+}
+
+// Accept adds the user to the staff of the shop that sent the invitation and returns its id.
+//
+// Invitations are single-use and only valid for the email they were sent to.
+func (s *service) Accept(ctx context.Context, tkn, userID string) (string, error) {
+	s.metrics.incMethodCalls("Accept")
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "starting transaction")
+	}
+	defer tx.Rollback()
+
+	var shopID string
+	q := `DELETE FROM shop_invitations
+	WHERE token_hash=$1 AND expires_at > NOW() AND email=(SELECT email FROM users WHERE id=$2)
+	RETURNING shop_id`
+	if err := tx.GetContext(ctx, &shopID, q, token.Hash(tkn), userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrInvalidInvitation
+		}
+		return "", errors.Wrap(err, "fetching invitation")
+	}
+
+	mQuery := `INSERT INTO shop_members (shop_id, user_id, role) VALUES ($1, $2, $3)
+	ON CONFLICT (shop_id, user_id) DO NOTHING`
+	if _, err := tx.ExecContext(ctx, mQuery, shopID, userID, Staff); err != nil {
+		return "", errors.Wrap(err, "couldn't add the member")
+	}
+
+	// The global role lets staff members through the products:write permission check
+	rQuery := `INSERT INTO user_roles (user_id, role) VALUES ($1, $2)
+	ON CONFLICT (user_id, role) DO NOTHING`
+	if _, err := tx.ExecContext(ctx, rQuery, userID, role.ShopStaff); err != nil {
+		return "", errors.Wrap(err, "couldn't grant the staff role")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", errors.Wrap(err, "committing transaction")
+	}
+
+	s.metrics.invitations.WithLabelValues("accepted").Inc()
+	return shopID, nil
+}
+
+// Can returns whether the user is a member of the shop with any of the roles provided.
+// Administrators can manage every shop.
+func (s *service) Can(ctx context.Context, shopID, userID string, roles ...string) (bool, error) {
+	s.metrics.incMethodCalls("Can")
+	return s.can(ctx, "$1", shopID, userID, roles)
+}
+
+// CanProduct is like Can but takes the id of one of the shop's products.
+func (s *service) CanProduct(ctx context.Context, productID, userID string, roles ...string) (bool, error) {
+	s.metrics.incMethodCalls("CanProduct")
+	return s.can(ctx, "(SELECT shop_id FROM products WHERE id=$1)", productID, userID, roles)
+}
+
+// Get returns the members of a shop.
+func (s *service) Get(ctx context.Context, shopID string) ([]Member, error) {
+	s.metrics.incMethodCalls("Get")
+
+	var members []Member
+	q := `SELECT m.user_id, u.username, u.email, m.role, m.created_at
+	FROM shop_members AS m
+	INNER JOIN users AS u ON u.id = m.user_id
+	WHERE m.shop_id=$1
+	ORDER BY m.role, m.created_at`
+	if err := s.db.SelectContext(ctx, &members, q, shopID); err != nil {
+		return nil, errors.Wrap(err, "couldn't find the shop members")
+	}
+
+	return members, nil
+}
+
+// Invite creates an invitation to join the shop's staff, it returns the token
+// that must be sent to the user and the name of the shop.
+//
+// Sending a new invitation to the same email invalidates the previous one.
+func (s *service) Invite(ctx context.Context, shopID, email, invitedBy string) (string, string, error) {
+	s.metrics.incMethodCalls("Invite")
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return "", "", errors.Wrap(err, "starting transaction")
+	}
+	defer tx.Rollback()
+
+	var shopName string
+	if err := tx.GetContext(ctx, &shopName, "SELECT name FROM shops WHERE id=$1", shopID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", "", ErrShopNotFound
+		}
+		return "", "", errors.Wrap(err, "fetching shop")
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM shop_invitations WHERE shop_id=$1 AND email=$2", shopID, email); err != nil {
+		return "", "", errors.Wrap(err, "deleting previous invitations")
+	}
+
+	tkn := token.RandString(40)
+	q := `INSERT INTO shop_invitations
+	(token_hash, shop_id, email, invited_by, expires_at)
+	VALUES ($1, $2, $3, $4, $5)`
+	_, err = tx.ExecContext(ctx, q, token.Hash(tkn), shopID, email, invitedBy, time.Now().Add(invitationExpiration))
+	if err != nil {
+		return "", "", errors.Wrap(err, "couldn't create the invitation")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", "", errors.Wrap(err, "committing transaction")
+	}
+
+	s.metrics.invitations.WithLabelValues("sent").Inc()
+	return tkn, shopName, nil
+}
+
+// Remove takes a staff member out of the shop.
+func (s *service) Remove(ctx context.Context, shopID, userID string) error {
+	s.metrics.incMethodCalls("Remove")
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "starting transaction")
+	}
+	defer tx.Rollback()
+
+	var memberRole string
+	q := "SELECT role FROM shop_members WHERE shop_id=$1 AND user_id=$2 FOR UPDATE"
+	if err := tx.GetContext(ctx, &memberRole, q, shopID, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotMember
+		}
+		return errors.Wrap(err, "fetching member")
+	}
+	if memberRole == Owner {
+		return ErrOwner
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM shop_members WHERE shop_id=$1 AND user_id=$2", shopID, userID); err != nil {
+		return errors.Wrap(err, "couldn't remove the member")
+	}
+
+	// Revoke the global role once the user isn't part of any shop's staff
+	rQuery := `DELETE FROM user_roles WHERE user_id=$1 AND role=$2
+	AND NOT EXISTS(SELECT 1 FROM shop_members WHERE user_id=$1 AND role=$3)`
+	if _, err := tx.ExecContext(ctx, rQuery, userID, role.ShopStaff, Staff); err != nil {
+		return errors.Wrap(err, "couldn't revoke the staff role")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "committing transaction")
+	}
+
+	return nil
+}
+
+// can checks the membership of the user in the shop obtained with shopExpr, which
+// must reference the id provided as $1.
+func (s *service) can(ctx context.Context, shopExpr, id, userID string, roles []string) (bool, error) {
+	var can bool
+	q := `SELECT EXISTS(SELECT 1 FROM shop_members WHERE shop_id=` + shopExpr + ` AND user_id=$2 AND role=ANY($3))
+	OR EXISTS(SELECT 1 FROM user_roles WHERE user_id=$2 AND role=$4)`
+	if err := s.db.GetContext(ctx, &can, q, id, userID, pq.StringArray(roles), role.Admin); err != nil {
+		return false, errors.Wrap(err, "checking shop membership")
+	}
+
+	return can, nil
+}
@@ -0,0 +1,107 @@
+package member_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/GGP1/adak/internal/logger"
+	"github.com/GGP1/adak/internal/test"
+	"github.com/GGP1/adak/pkg/role"
+	"github.com/GGP1/adak/pkg/shop"
+	"github.com/GGP1/adak/pkg/shop/member"
+	"github.com/GGP1/adak/pkg/user"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	owner = user.AddUser{ID: "1", CartID: "1", Username: "owner", Email: "owner@test.com", Password: "testing123"}
+	staff = user.AddUser{ID: "2", CartID: "2", Username: "staff", Email: "staff@test.com", Password: "testing123"}
+	sh    = shop.Shop{ID: "shop", Name: "test"}
+)
+
+// TestMain failed when creating the shop members service.
+func NewMemberService(t *testing.T) (context.Context, member.Service, role.Service) {
+	t.Helper()
+	logger.Disable()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	db := test.StartPostgres(t)
+	mc := test.StartMemcached(t)
+	service := member.NewService(db)
+
+	userService := user.NewService(db, mc)
+	assert.NoError(t, userService.Create(ctx, owner))
+	assert.NoError(t, userService.Create(ctx, staff))
+	assert.NoError(t, shop.NewService(db, mc).Create(ctx, sh, owner.ID))
+
+	t.Cleanup(func() {
+		cancel()
+	})
+
+	return ctx, service, role.NewService(db)
+}
+
+func TestMemberService(t *testing.T) {
+	ctx, s, roles := NewMemberService(t)
+
+	t.Run("Owner", ownerMember(ctx, s))
+	t.Run("Invitation", invitation(ctx, s, roles))
+	t.Run("Remove", remove(ctx, s, roles))
+}
+
+func ownerMember(ctx context.Context, s member.Service) func(t *testing.T) {
+	return func(t *testing.T) {
+		can, err := s.Can(ctx, sh.ID, owner.ID, member.Owner)
+		assert.NoError(t, err)
+		assert.True(t, can)
+
+		can, err = s.Can(ctx, sh.ID, staff.ID, member.Owner, member.Staff)
+		assert.NoError(t, err)
+		assert.False(t, can)
+	}
+}
+
+func invitation(ctx context.Context, s member.Service, roles role.Service) func(t *testing.T) {
+	return func(t *testing.T) {
+		token, shopName, err := s.Invite(ctx, sh.ID, staff.Email, owner.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, sh.Name, shopName)
+
+		// Invitations can only be accepted by the user they were sent to
+		_, err = s.Accept(ctx, token, owner.ID)
+		assert.ErrorIs(t, err, member.ErrInvalidInvitation)
+
+		shopID, err := s.Accept(ctx, token, staff.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, sh.ID, shopID)
+
+		// Single-use
+		_, err = s.Accept(ctx, token, staff.ID)
+		assert.ErrorIs(t, err, member.ErrInvalidInvitation)
+
+		can, err := s.Can(ctx, sh.ID, staff.ID, member.Owner, member.Staff)
+		assert.NoError(t, err)
+		assert.True(t, can)
+
+		members, err := s.Get(ctx, sh.ID)
+		assert.NoError(t, err)
+		assert.Len(t, members, 2)
+
+		userRoles, err := roles.Get(ctx, staff.ID)
+		assert.NoError(t, err)
+		assert.Contains(t, userRoles, role.ShopStaff)
+	}
+}
+
+func remove(ctx context.Context, s member.Service, roles role.Service) func(t *testing.T) {
+	return func(t *testing.T) {
+		assert.ErrorIs(t, s.Remove(ctx, sh.ID, owner.ID), member.ErrOwner)
+		assert.NoError(t, s.Remove(ctx, sh.ID, staff.ID))
+		assert.ErrorIs(t, s.Remove(ctx, sh.ID, staff.ID), member.ErrNotMember)
+
+		userRoles, err := roles.Get(ctx, staff.ID)
+		assert.NoError(t, err)
+		assert.NotContains(t, userRoles, role.ShopStaff)
+	}
+}
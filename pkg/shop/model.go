@@ -5,15 +5,25 @@ import (
 
 	"github.com/GGP1/adak/pkg/product"
 	"github.com/GGP1/adak/pkg/review"
+	"gopkg.in/guregu/null.v4"
 	"gopkg.in/guregu/null.v4/zero"
 )
 
 // Shop represents a market with its name and location.
 // Each shop has multiple reviews and products.
+//
+// The language is an ISO 639-1 code used to index the shop texts and the timezone
+// is the IANA name of the one used by the opening hours.
 type Shop struct {
 	ID        string            `json:"id,omitempty"`
 	Name      string            `json:"name,omitempty" validate:"required"`
 	Location  Location          `json:"location,omitempty"`
+	Language  string            `json:"language,omitempty"`
+	Timezone  string            `json:"timezone,omitempty"`
+	OpenNow   bool              `json:"open_now" db:"open_now"`
+	Hours     []Hours           `json:"hours,omitempty"`
+	Holidays  []Holiday         `json:"holidays,omitempty"`
+	Rating    review.Rating     `json:"rating" db:"rating"`
 	Reviews   []review.Review   `json:"reviews,omitempty"`
 	Products  []product.Product `json:"products,omitempty"`
 	CreatedAt time.Time         `json:"created_at,omitempty" db:"created_at"`
@@ -22,15 +32,39 @@ type Shop struct {
 
 // UpdateShop is the structure used to update shops.
 type UpdateShop struct {
-	Name string `json:"name,omitempty" validate:"required"`
+	Name     string `json:"name,omitempty" validate:"required"`
+	Language string `json:"language,omitempty"`
 }
 
 // Location of the shop.
+//
+// Shops may have multiple locations, the first one is the main location.
+// The coordinates are obtained from the geocoder when they aren't provided.
 type Location struct {
-	ShopID  string `json:"shop_id,omitempty" db:"shop_id"`
-	Country string `json:"country,omitempty" validate:"required"`
-	State   string `json:"state,omitempty"`
-	ZipCode string `json:"zip_code,omitempty" db:"zip_code"`
-	City    string `json:"city,omitempty" validate:"required"`
-	Address string `json:"address,omitempty" validate:"required"`
+	ID        string     `json:"id,omitempty"`
+	ShopID    string     `json:"shop_id,omitempty" db:"shop_id"`
+	Country   string     `json:"country,omitempty" validate:"required"`
+	State     string     `json:"state,omitempty"`
+	ZipCode   string     `json:"zip_code,omitempty" db:"zip_code"`
+	City      string     `json:"city,omitempty" validate:"required"`
+	Address   string     `json:"address,omitempty" validate:"required"`
+	Latitude  null.Float `json:"latitude,omitempty"`
+	Longitude null.Float `json:"longitude,omitempty"`
+}
+
+// NearbyShop is a shop with the distance in meters to the point searched.
+type NearbyShop struct {
+	Shop
+	Distance float64 `json:"distance"`
+}
+
+// Nearby contains the parameters used to look for shops near a point.
+type Nearby struct {
+	Latitude  float64
+	Longitude float64
+	// Radius in meters
+	Radius float64
+	Limit  string
+	// OpenNow excludes the shops that are closed
+	OpenNow bool
 }
@@ -0,0 +1,128 @@
+package shop
+
+import (
+	"time"
+	// The server image doesn't ship a timezone database
+	_ "time/tzdata"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultTimezone is used when the shop didn't specify one.
+	DefaultTimezone = "UTC"
+
+	clockLayout = "15:04"
+	dateLayout  = "2006-01-02"
+)
+
+// Hours is a range of time in which the shop is open.
+//
+// Weekdays go from 0 (sunday) to 6 (saturday), ranges closing at or before
+// the time they open finish on the following day.
+type Hours struct {
+	Weekday int    `json:"weekday" db:"weekday"`
+	Opens   string `json:"opens" db:"opens_at"`
+	Closes  string `json:"closes" db:"closes_at"`
+}
+
+// Holiday is a date in which the shop is closed.
+type Holiday struct {
+	Date string `json:"date"`
+	Name string `json:"name,omitempty"`
+}
+
+// Schedule contains the shop opening hours and holidays, expressed in its timezone.
+type Schedule struct {
+	Timezone string    `json:"timezone"`
+	Hours    []Hours   `json:"hours"`
+	Holidays []Holiday `json:"holidays"`
+}
+
+// Schedule returns the shop's schedule.
+func (s Shop) Schedule() Schedule {
+	return Schedule{
+		Timezone: s.Timezone,
+		Hours:    s.Hours,
+		Holidays: s.Holidays,
+	}
+}
+
+// OpenAt returns whether the shop is open at the time provided. Shops that
+// haven't set their opening hours are open every day but holidays.
+//
+// The postgres function shop_open() implements the same logic and they must be kept in sync.
+func (s Schedule) OpenAt(t time.Time) bool {
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	t = t.In(loc)
+
+	date := t.Format(dateLayout)
+	for _, h := range s.Holidays {
+		if h.Date == date {
+			return false
+		}
+	}
+
+	if len(s.Hours) == 0 {
+		return true
+	}
+
+	now := t.Hour()*60 + t.Minute()
+	today := int(t.Weekday())
+	yesterday := (today + 6) % 7
+	for _, h := range s.Hours {
+		opens, closes := minutes(h.Opens), minutes(h.Closes)
+		overnight := closes <= opens
+
+		switch h.Weekday {
+		case today:
+			if now >= opens && (now < closes || overnight) {
+				return true
+			}
+		case yesterday:
+			if overnight && now < closes {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Validate checks that the timezone, hours and holidays are well formed.
+func (s Schedule) Validate() error {
+	if s.Timezone != "" {
+		if _, err := time.LoadLocation(s.Timezone); err != nil {
+			return errors.Errorf("invalid timezone %q", s.Timezone)
+		}
+	}
+
+	for _, h := range s.Hours {
+		if h.Weekday < 0 || h.Weekday > 6 {
+			return errors.Errorf("invalid weekday %d, it must be between 0 (sunday) and 6 (saturday)", h.Weekday)
+		}
+		if _, err := time.Parse(clockLayout, h.Opens); err != nil {
+			return errors.Errorf("invalid opening time %q, expected HH:MM", h.Opens)
+		}
+		if _, err := time.Parse(clockLayout, h.Closes); err != nil {
+			return errors.Errorf("invalid closing time %q, expected HH:MM", h.Closes)
+		}
+	}
+
+	for _, h := range s.Holidays {
+		if _, err := time.Parse(dateLayout, h.Date); err != nil {
+			return errors.Errorf("invalid holiday date %q, expected YYYY-MM-DD", h.Date)
+		}
+	}
+
+	return nil
+}
+
+// minutes returns the minutes elapsed since midnight, the clock must be already validated.
+func minutes(clock string) int {
+	t, _ := time.Parse(clockLayout, clock)
+	return t.Hour()*60 + t.Minute()
+}
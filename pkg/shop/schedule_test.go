@@ -0,0 +1,79 @@
+package shop
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenAt(t *testing.T) {
+	schedule := Schedule{
+		Timezone: "America/Argentina/Buenos_Aires",
+		Hours: []Hours{
+			{Weekday: 1, Opens: "09:00", Closes: "13:00"},
+			{Weekday: 1, Opens: "16:00", Closes: "20:00"},
+			// Friday night until 2 AM
+			{Weekday: 5, Opens: "20:00", Closes: "02:00"},
+		},
+		Holidays: []Holiday{{Date: "2021-05-24", Name: "Bridge holiday"}},
+	}
+	// Buenos Aires is UTC-3
+	loc := time.FixedZone("UTC-3", -3*60*60)
+
+	cases := []struct {
+		desc     string
+		t        time.Time
+		expected bool
+	}{
+		{desc: "Morning", t: time.Date(2021, 5, 17, 10, 30, 0, 0, loc), expected: true},
+		{desc: "Between ranges", t: time.Date(2021, 5, 17, 14, 0, 0, 0, loc), expected: false},
+		{desc: "Closing time", t: time.Date(2021, 5, 17, 20, 0, 0, 0, loc), expected: false},
+		{desc: "Other timezone", t: time.Date(2021, 5, 17, 12, 0, 0, 0, time.UTC), expected: true},
+		{desc: "Closed weekday", t: time.Date(2021, 5, 18, 10, 0, 0, 0, loc), expected: false},
+		{desc: "Overnight before midnight", t: time.Date(2021, 5, 21, 23, 0, 0, 0, loc), expected: true},
+		{desc: "Overnight after midnight", t: time.Date(2021, 5, 22, 1, 59, 0, 0, loc), expected: true},
+		{desc: "Overnight closed", t: time.Date(2021, 5, 22, 2, 0, 0, 0, loc), expected: false},
+		{desc: "Holiday", t: time.Date(2021, 5, 24, 10, 0, 0, 0, loc), expected: false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert.Equal(t, tc.expected, schedule.OpenAt(tc.t))
+		})
+	}
+
+	t.Run("No hours", func(t *testing.T) {
+		assert.True(t, Schedule{}.OpenAt(time.Now()))
+	})
+}
+
+func TestValidateSchedule(t *testing.T) {
+	cases := []struct {
+		desc     string
+		schedule Schedule
+		valid    bool
+	}{
+		{desc: "Empty", schedule: Schedule{}, valid: true},
+		{desc: "Valid", schedule: Schedule{
+			Timezone: "Europe/Madrid",
+			Hours:    []Hours{{Weekday: 0, Opens: "10:00", Closes: "14:30"}},
+			Holidays: []Holiday{{Date: "2021-12-25"}},
+		}, valid: true},
+		{desc: "Invalid timezone", schedule: Schedule{Timezone: "Mars/Olympus"}},
+		{desc: "Invalid weekday", schedule: Schedule{Hours: []Hours{{Weekday: 7, Opens: "10:00", Closes: "14:00"}}}},
+		{desc: "Invalid time", schedule: Schedule{Hours: []Hours{{Weekday: 1, Opens: "25:00", Closes: "14:00"}}}},
+		{desc: "Invalid date", schedule: Schedule{Holidays: []Holiday{{Date: "25/12/2021"}}}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			err := tc.schedule.Validate()
+			if tc.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
@@ -2,27 +2,59 @@ package shop
 
 import (
 	"context"
+	"database/sql"
 	"time"
 
 	"github.com/GGP1/adak/internal/params"
 	"github.com/GGP1/adak/pkg/postgres"
 	"github.com/GGP1/adak/pkg/product"
 	"github.com/GGP1/adak/pkg/review"
+	"github.com/GGP1/adak/pkg/shop/member"
 	"gopkg.in/guregu/null.v4/zero"
 
 	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
 )
 
+// columns contains the shops table fields (aliased "s") selected when the shop relations aren't required.
+const columns = `s.id, s.name, s.language, s.timezone, shop_open(s.id, s.timezone, NOW()) AS open_now,
+	s.rating_average AS "rating.average", s.rating_count AS "rating.count",
+	s.rating_histogram AS "rating.histogram", s.created_at, s.updated_at`
+
+// ErrLastLocation is returned when trying to delete the only location of a shop.
+var ErrLastLocation = errors.New("shops must have at least one location")
+
+// ErrLocationNotFound is returned when the location doesn't belong to the shop.
+var ErrLocationNotFound = errors.New("location not found")
+
+// ErrShopNotFound is returned when the shop doesn't exist.
+var ErrShopNotFound = errors.New("shop not found")
+
+// ErrMissingCoordinates is returned when a radius delivery zone is added to a shop whose location has no coordinates.
+var ErrMissingCoordinates = errors.New("radius zones require the shop location coordinates")
+
 // Service provides shop operations.
 type Service interface {
-	Create(ctx context.Context, shop Shop) error
+	AddLocation(ctx context.Context, location Location) error
+	ClosedAt(ctx context.Context, t time.Time, shopIDs ...string) ([]string, error)
+	Create(ctx context.Context, shop Shop, ownerID string) error
 	Delete(ctx context.Context, id string) error
+	DeleteLocation(ctx context.Context, shopID, locationID string) error
 	Get(ctx context.Context, params params.Query) ([]Shop, error)
 	GetByID(ctx context.Context, id string) (Shop, error)
-	Search(ctx context.Context, query string) ([]Shop, error)
+	Locations(ctx context.Context, shopID string) ([]Location, error)
+	Nearby(ctx context.Context, nearby Nearby) ([]NearbyShop, error)
+	Schedule(ctx context.Context, shopID string) (Schedule, error)
+	Search(ctx context.Context, params params.Search) ([]Shop, error)
+	Undeliverable(ctx context.Context, address Address, shopIDs ...string) ([]string, error)
 	Update(ctx context.Context, id string, shop UpdateShop) error
+	UpdateLocation(ctx context.Context, shopID string, location Location) error
+	UpdateSchedule(ctx context.Context, shopID string, schedule Schedule) error
+	UpdateZones(ctx context.Context, shopID string, zones []Zone) error
+	Zones(ctx context.Context, shopID string) ([]Zone, error)
 }
 
 type service struct {
@@ -36,8 +68,36 @@ func NewService(db *sqlx.DB, mc *memcache.Client) Service {
 	return &service{db, mc, initMetrics()}
 }
 
-// Create a shop.
-func (s *service) Create(ctx context.Context, shop Shop) error {
+// AddLocation adds a location to the shop.
+func (s *service) AddLocation(ctx context.Context, location Location) error {
+	s.metrics.incMethodCalls("AddLocation")
+
+	if err := saveLocation(ctx, s.db, location); err != nil {
+		return err
+	}
+
+	if err := s.mc.Delete(location.ShopID); err != nil && err != memcache.ErrCacheMiss {
+		return errors.Wrap(err, "couldn't delete shop from cache")
+	}
+
+	return nil
+}
+
+// ClosedAt returns the names of the shops that are closed at the time provided.
+func (s *service) ClosedAt(ctx context.Context, t time.Time, shopIDs ...string) ([]string, error) {
+	s.metrics.incMethodCalls("ClosedAt")
+
+	var names []string
+	q := "SELECT name FROM shops WHERE id = ANY($1) AND NOT shop_open(id, timezone, $2) ORDER BY name"
+	if err := s.db.SelectContext(ctx, &names, q, pq.StringArray(shopIDs), t); err != nil {
+		return nil, errors.Wrap(err, "couldn't check the shops opening hours")
+	}
+
+	return names, nil
+}
+
+// Create a shop owned by the user provided.
+func (s *service) Create(ctx context.Context, shop Shop, ownerID string) error {
 	s.metrics.incMethodCalls("Create")
 
 	tx, err := s.db.Begin()
@@ -46,21 +106,36 @@ func (s *service) Create(ctx context.Context, shop Shop) error {
 	}
 	defer tx.Rollback()
 
+	if shop.Language == "" {
+		shop.Language = params.DefaultLanguage
+	}
+	if shop.Timezone == "" {
+		shop.Timezone = DefaultTimezone
+	}
+
 	sQuery := `INSERT INTO shops
-	(id, name, created_at)
-	VALUES ($1, $2, $3)`
-	_, err = tx.ExecContext(ctx, sQuery, shop.ID, shop.Name, time.Now())
+	(id, name, language, timezone, created_at)
+	VALUES ($1, $2, $3, $4, $5)`
+	_, err = tx.ExecContext(ctx, sQuery, shop.ID, shop.Name, shop.Language, shop.Timezone, time.Now())
 	if err != nil {
 		return errors.Wrap(err, "couldn't create the shop")
 	}
 
-	lQuery := `INSERT INTO locations
-	(shop_id, country, state, zip_code, city, address)
-	VALUES ($1, $2, $3, $4, $5, $6)`
-	_, err = tx.ExecContext(ctx, lQuery, shop.ID, shop.Location.Country, shop.Location.State,
-		shop.Location.ZipCode, shop.Location.City, shop.Location.Address)
-	if err != nil {
-		return errors.Wrap(err, "couldn't create the location")
+	if err := saveSchedule(ctx, tx, shop.ID, shop.Schedule()); err != nil {
+		return err
+	}
+
+	shop.Location.ShopID = shop.ID
+	if shop.Location.ID == "" {
+		shop.Location.ID = uuid.NewString()
+	}
+	if err := saveLocation(ctx, tx, shop.Location); err != nil {
+		return err
+	}
+
+	mQuery := "INSERT INTO shop_members (shop_id, user_id, role) VALUES ($1, $2, $3)"
+	if _, err := tx.ExecContext(ctx, mQuery, shop.ID, ownerID, member.Owner); err != nil {
+		return errors.Wrap(err, "couldn't add the shop owner")
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -87,13 +162,58 @@ func (s *service) Delete(ctx context.Context, id string) error {
 	return nil
 }
 
+// DeleteLocation deletes a shop location, the last one can't be deleted.
+func (s *service) DeleteLocation(ctx context.Context, shopID, locationID string) error {
+	s.metrics.incMethodCalls("DeleteLocation")
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "starting transaction")
+	}
+	defer tx.Rollback()
+
+	// Lock the shop locations so concurrent deletions can't remove all of them
+	var ids []string
+	q := "SELECT id FROM locations WHERE shop_id=$1 FOR UPDATE"
+	if err := tx.SelectContext(ctx, &ids, q, shopID); err != nil {
+		return errors.Wrap(err, "couldn't find the locations")
+	}
+	found := false
+	for _, id := range ids {
+		if id == locationID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return ErrLocationNotFound
+	}
+	if len(ids) == 1 {
+		return ErrLastLocation
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM locations WHERE id=$1", locationID); err != nil {
+		return errors.Wrap(err, "couldn't delete the location")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "committing transaction")
+	}
+
+	if err := s.mc.Delete(shopID); err != nil && err != memcache.ErrCacheMiss {
+		return errors.Wrap(err, "couldn't delete shop from cache")
+	}
+
+	return nil
+}
+
 // Get returns a list with all the shops stored in the database.
 func (s *service) Get(ctx context.Context, params params.Query) ([]Shop, error) {
 	s.metrics.incMethodCalls("Get")
 
 	var shops []Shop
-	q, args := postgres.AddPagination("SELECT * FROM shops", params)
-	if err := s.db.SelectContext(ctx, &shops, q, args); err != nil {
+	q, args := postgres.AddPagination("SELECT "+columns+" FROM shops AS s", params)
+	if err := s.db.SelectContext(ctx, &shops, q, args...); err != nil {
 		return nil, errors.Wrap(err, "couldn't find the shops")
 	}
 
@@ -104,10 +224,14 @@ func (s *service) Get(ctx context.Context, params params.Query) ([]Shop, error)
 func (s *service) GetByID(ctx context.Context, id string) (Shop, error) {
 	s.metrics.incMethodCalls("GetByID")
 
-	q := `SELECT s.*, l.*, r.*, p.* 
+	q := `SELECT ` + columns + `,
+	l.id, l.shop_id, l.country, l.state, l.zip_code, l.city, l.address, l.latitude, l.longitude,
+	` + review.Columns + `, ` + product.Columns + ` 
 	FROM shops s
-	LEFT JOIN locations l ON s.id=l.shop_id
-	LEFT JOIN reviews r ON s.id=r.shop_id
+	LEFT JOIN LATERAL (
+		SELECT * FROM locations WHERE shop_id=s.id ORDER BY created_at, id LIMIT 1
+	) l ON true
+	LEFT JOIN reviews r ON s.id=r.shop_id AND r.status='approved'
 	LEFT JOIN products p ON s.id=p.shop_id
 	WHERE s.id=$1`
 	rows, err := s.db.QueryContext(ctx, q, id)
@@ -121,12 +245,19 @@ func (s *service) GetByID(ctx context.Context, id string) (Shop, error) {
 		l := Location{}
 		r := review.Review{}
 		p := product.Product{}
+		// The product rating columns are NULL when the shop has no products
+		var ratingAverage sql.NullFloat64
+		var ratingCount sql.NullInt64
 		err := rows.Scan(
-			&shop.ID, &shop.Name, &shop.CreatedAt, &shop.UpdatedAt,
-			&l.ShopID, &l.Country, &l.State, &l.ZipCode, &l.City, &l.Address,
-			&r.ID, &r.Stars, &r.Comment, &r.UserID, &r.ProductID, &r.ShopID, &r.CreatedAt,
+			&shop.ID, &shop.Name, &shop.Language, &shop.Timezone, &shop.OpenNow,
+			&shop.Rating.Average, &shop.Rating.Count,
+			&shop.Rating.Histogram, &shop.CreatedAt, &shop.UpdatedAt,
+			&l.ID, &l.ShopID, &l.Country, &l.State, &l.ZipCode, &l.City, &l.Address, &l.Latitude, &l.Longitude,
+			&r.ID, &r.Stars, &r.Comment, &r.UserID, &r.ProductID, &r.ShopID, &r.Verified, &r.Status,
+			&r.Helpful, &r.Unhelpful, &r.EditedAt, &r.CreatedAt,
 			&p.ID, &p.ShopID, &p.Stock, &p.Brand, &p.Category, &p.Type, &p.Description, &p.Weight,
-			&p.Discount, &p.Taxes, &p.Subtotal, &p.Total, &p.CreatedAt, &p.UpdatedAt,
+			&p.Discount, &p.Taxes, &p.Subtotal, &p.Total, &p.Language, &ratingAverage,
+			&ratingCount, &p.Rating.Histogram, &p.CreatedAt, &p.UpdatedAt,
 		)
 		if err != nil {
 			return Shop{}, errors.Wrap(err, "couldn't scan shop")
@@ -134,31 +265,172 @@ func (s *service) GetByID(ctx context.Context, id string) (Shop, error) {
 
 		shop.Location = l
 		shop.Reviews = append(shop.Reviews, r)
-		shop.Products = append(shop.Products, p)
+		if p.ID.Valid {
+			p.Rating.Average = ratingAverage.Float64
+			p.Rating.Count = ratingCount.Int64
+			shop.Products = append(shop.Products, p)
+		}
 	}
 
+	if shop.ID == "" {
+		return shop, nil
+	}
+
+	schedule, err := s.getSchedule(ctx, id)
+	if err != nil {
+		return Shop{}, err
+	}
+	shop.Hours = schedule.Hours
+	shop.Holidays = schedule.Holidays
+
 	return shop, nil
 }
 
+// Locations returns the shop locations, starting with the main one.
+func (s *service) Locations(ctx context.Context, shopID string) ([]Location, error) {
+	s.metrics.incMethodCalls("Locations")
+
+	var locations []Location
+	q := `SELECT id, shop_id, country, state, zip_code, city, address, latitude, longitude
+	FROM locations WHERE shop_id=$1 ORDER BY created_at, id`
+	if err := s.db.SelectContext(ctx, &locations, q, shopID); err != nil {
+		return nil, errors.Wrap(err, "couldn't find the locations")
+	}
+
+	return locations, nil
+}
+
+// Nearby returns the shops located within the radius of the point provided, sorted
+// by the distance to their closest location.
+func (s *service) Nearby(ctx context.Context, nearby Nearby) ([]NearbyShop, error) {
+	s.metrics.incMethodCalls("Nearby")
+
+	// earth_box is used to take advantage of the index, it may include points slightly
+	// farther than the radius so the distance is checked afterwards
+	q := `SELECT * FROM (
+		SELECT DISTINCT ON (s.id) ` + columns + `,
+		earth_distance(ll_to_earth($1, $2), ll_to_earth(l.latitude, l.longitude)) AS distance
+		FROM shops AS s
+		INNER JOIN locations AS l ON l.shop_id = s.id
+		WHERE l.latitude IS NOT NULL AND l.longitude IS NOT NULL
+		AND earth_box(ll_to_earth($1, $2), $3) @> ll_to_earth(l.latitude, l.longitude)
+		AND (NOT $5 OR shop_open(s.id, s.timezone, NOW()))
+		ORDER BY s.id, distance
+	) AS nearby
+	WHERE distance <= $3
+	ORDER BY distance, id
+	LIMIT $4`
+
+	var shops []NearbyShop
+	err := s.db.SelectContext(ctx, &shops, q, nearby.Latitude, nearby.Longitude,
+		nearby.Radius, nearby.Limit, nearby.OpenNow)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't find nearby shops")
+	}
+
+	return shops, nil
+}
+
+// Schedule returns the shop's opening hours and holidays.
+func (s *service) Schedule(ctx context.Context, shopID string) (Schedule, error) {
+	s.metrics.incMethodCalls("Schedule")
+
+	var timezone string
+	if err := s.db.GetContext(ctx, &timezone, "SELECT timezone FROM shops WHERE id=$1", shopID); err != nil {
+		return Schedule{}, errors.Wrap(err, "couldn't find the shop")
+	}
+
+	schedule, err := s.getSchedule(ctx, shopID)
+	if err != nil {
+		return Schedule{}, err
+	}
+	schedule.Timezone = timezone
+
+	return schedule, nil
+}
+
 // Search looks for the shops that contain the value specified. (Only text fields)
-func (s *service) Search(ctx context.Context, query string) ([]Shop, error) {
+//
+// The query is parsed using the text search configuration of the language requested.
+func (s *service) Search(ctx context.Context, params params.Search) ([]Shop, error) {
 	s.metrics.incMethodCalls("Search")
 
 	var shops []Shop
-	q := "SELECT * FROM shops WHERE search @@ plainto_tsquery($1)"
-	if err := s.db.SelectContext(ctx, &shops, q, query); err != nil {
+	q := `SELECT ` + columns + ` FROM shops AS s, plainto_tsquery(search_config($2), $1) AS query
+	WHERE s.search @@ query
+	ORDER BY ` + postgres.SearchOrder("s", params.Sort)
+	if err := s.db.SelectContext(ctx, &shops, q, params.Query, params.Language); err != nil {
 		return nil, errors.Wrap(err, "couldn't find shops")
 	}
 
 	return shops, nil
 }
 
+// Undeliverable returns the names of the shops that don't deliver to the address provided.
+// Radius zones cover the addresses close enough to any of the shop locations.
+func (s *service) Undeliverable(ctx context.Context, address Address, shopIDs ...string) ([]string, error) {
+	s.metrics.incMethodCalls("Undeliverable")
+
+	var shops []struct {
+		ID   string
+		Name string
+	}
+	q := "SELECT id, name FROM shops WHERE id = ANY($1) ORDER BY name"
+	if err := s.db.SelectContext(ctx, &shops, q, pq.StringArray(shopIDs)); err != nil {
+		return nil, errors.Wrap(err, "couldn't find the shops")
+	}
+	found := make(map[string]bool, len(shops))
+	for _, sh := range shops {
+		found[sh.ID] = true
+	}
+	for _, id := range shopIDs {
+		if !found[id] {
+			return nil, ErrShopNotFound
+		}
+	}
+
+	var locations []Location
+	lQuery := "SELECT shop_id, latitude, longitude FROM locations WHERE shop_id = ANY($1)"
+	if err := s.db.SelectContext(ctx, &locations, lQuery, pq.StringArray(shopIDs)); err != nil {
+		return nil, errors.Wrap(err, "couldn't find the locations")
+	}
+
+	shopLocations := make(map[string][]Location, len(shops))
+	for _, l := range locations {
+		shopLocations[l.ShopID] = append(shopLocations[l.ShopID], l)
+	}
+
+	var zones []struct {
+		ShopID string `db:"shop_id"`
+		Zone
+	}
+	zQuery := "SELECT shop_id, type, country, zip_codes, states, radius FROM delivery_zones WHERE shop_id = ANY($1)"
+	if err := s.db.SelectContext(ctx, &zones, zQuery, pq.StringArray(shopIDs)); err != nil {
+		return nil, errors.Wrap(err, "couldn't find the delivery zones")
+	}
+
+	shopZones := make(map[string][]Zone, len(shops))
+	for _, z := range zones {
+		shopZones[z.ShopID] = append(shopZones[z.ShopID], z.Zone)
+	}
+
+	var names []string
+	for _, sh := range shops {
+		if !delivers(shopZones[sh.ID], address, shopLocations[sh.ID]) {
+			names = append(names, sh.Name)
+		}
+	}
+
+	return names, nil
+}
+
 // Update updates shop fields.
 func (s *service) Update(ctx context.Context, id string, shop UpdateShop) error {
 	s.metrics.incMethodCalls("Update")
 
-	q := "UPDATE shops SET name=$2, updated_at=$3 WHERE id=$1"
-	_, err := s.db.ExecContext(ctx, q, id, shop.Name, zero.TimeFrom(time.Now()))
+	q := `UPDATE shops SET name=$2, language=COALESCE(NULLIF($3, ''), language), updated_at=$4 
+	WHERE id=$1`
+	_, err := s.db.ExecContext(ctx, q, id, shop.Name, shop.Language, zero.TimeFrom(time.Now()))
 	if err != nil {
 		return errors.Wrap(err, "couldn't update the shop")
 	}
@@ -170,8 +442,191 @@ func (s *service) Update(ctx context.Context, id string, shop UpdateShop) error
 	return nil
 }
 
-// TODO: finish and add to Service interface
+// UpdateLocation updates a shop location, the main one if the location has no id.
 func (s *service) UpdateLocation(ctx context.Context, shopID string, location Location) error {
 	s.metrics.incMethodCalls("UpdateLocation")
+
+	q := `UPDATE locations SET country=$2, state=$3, zip_code=$4, city=$5, address=$6,
+	latitude=$7, longitude=$8
+	WHERE shop_id=$1 AND id=COALESCE(NULLIF($9, ''),
+		(SELECT id FROM locations WHERE shop_id=$1 ORDER BY created_at, id LIMIT 1))`
+	res, err := s.db.ExecContext(ctx, q, shopID, location.Country, location.State, location.ZipCode,
+		location.City, location.Address, location.Latitude, location.Longitude, location.ID)
+	if err != nil {
+		return errors.Wrap(err, "couldn't update the location")
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrLocationNotFound
+	}
+
+	if err := s.mc.Delete(shopID); err != nil && err != memcache.ErrCacheMiss {
+		return errors.Wrap(err, "couldn't delete shop from cache")
+	}
+
+	return nil
+}
+
+// UpdateSchedule replaces the shop's opening hours and holidays.
+func (s *service) UpdateSchedule(ctx context.Context, shopID string, schedule Schedule) error {
+	s.metrics.incMethodCalls("UpdateSchedule")
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "starting transaction")
+	}
+	defer tx.Rollback()
+
+	if schedule.Timezone == "" {
+		schedule.Timezone = DefaultTimezone
+	}
+
+	q := "UPDATE shops SET timezone=$2, updated_at=$3 WHERE id=$1"
+	if _, err := tx.ExecContext(ctx, q, shopID, schedule.Timezone, time.Now()); err != nil {
+		return errors.Wrap(err, "couldn't update the timezone")
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM shop_hours WHERE shop_id=$1", shopID); err != nil {
+		return errors.Wrap(err, "deleting opening hours")
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM shop_holidays WHERE shop_id=$1", shopID); err != nil {
+		return errors.Wrap(err, "deleting holidays")
+	}
+
+	if err := saveSchedule(ctx, tx, shopID, schedule); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "committing transaction")
+	}
+
+	if err := s.mc.Delete(shopID); err != nil && err != memcache.ErrCacheMiss {
+		return errors.Wrap(err, "couldn't delete shop from cache")
+	}
+
 	return nil
 }
+
+// getSchedule returns the shop's opening hours and holidays, without the timezone.
+func (s *service) getSchedule(ctx context.Context, shopID string) (Schedule, error) {
+	var schedule Schedule
+	hQuery := `SELECT weekday, to_char(opens_at, 'HH24:MI') AS opens_at, to_char(closes_at, 'HH24:MI') AS closes_at
+	FROM shop_hours WHERE shop_id=$1 ORDER BY weekday, opens_at`
+	if err := s.db.SelectContext(ctx, &schedule.Hours, hQuery, shopID); err != nil {
+		return Schedule{}, errors.Wrap(err, "couldn't find the opening hours")
+	}
+
+	dQuery := `SELECT to_char(date, 'YYYY-MM-DD') AS date, name
+	FROM shop_holidays WHERE shop_id=$1 AND date >= CURRENT_DATE ORDER BY date`
+	if err := s.db.SelectContext(ctx, &schedule.Holidays, dQuery, shopID); err != nil {
+		return Schedule{}, errors.Wrap(err, "couldn't find the holidays")
+	}
+
+	return schedule, nil
+}
+
+// saveSchedule inserts the opening hours and holidays of the shop.
+// saveLocation inserts the location provided.
+func saveLocation(ctx context.Context, db sqlx.ExecerContext, location Location) error {
+	q := `INSERT INTO locations
+	(id, shop_id, country, state, zip_code, city, address, latitude, longitude)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+	_, err := db.ExecContext(ctx, q, location.ID, location.ShopID, location.Country, location.State,
+		location.ZipCode, location.City, location.Address, location.Latitude, location.Longitude)
+	if err != nil {
+		return errors.Wrap(err, "couldn't create the location")
+	}
+	return nil
+}
+
+func saveSchedule(ctx context.Context, tx *sql.Tx, shopID string, schedule Schedule) error {
+	hQuery := "INSERT INTO shop_hours (shop_id, weekday, opens_at, closes_at) VALUES ($1, $2, $3, $4)"
+	for _, h := range schedule.Hours {
+		if _, err := tx.ExecContext(ctx, hQuery, shopID, h.Weekday, h.Opens, h.Closes); err != nil {
+			return errors.Wrap(err, "couldn't save the opening hours")
+		}
+	}
+
+	dQuery := `INSERT INTO shop_holidays (shop_id, date, name) VALUES ($1, $2, $3)
+	ON CONFLICT (shop_id, date) DO UPDATE SET name=$3`
+	for _, h := range schedule.Holidays {
+		if _, err := tx.ExecContext(ctx, dQuery, shopID, h.Date, h.Name); err != nil {
+			return errors.Wrap(err, "couldn't save the holidays")
+		}
+	}
+
+	return nil
+}
+
+// UpdateZones replaces the shop's delivery zones.
+func (s *service) UpdateZones(ctx context.Context, shopID string, zones []Zone) error {
+	s.metrics.incMethodCalls("UpdateZones")
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "starting transaction")
+	}
+	defer tx.Rollback()
+
+	for _, z := range zones {
+		if z.Type != ZoneRadius {
+			continue
+		}
+		var located bool
+		q := "SELECT EXISTS(SELECT 1 FROM locations WHERE shop_id=$1 AND latitude IS NOT NULL AND longitude IS NOT NULL)"
+		if err := tx.GetContext(ctx, &located, q, shopID); err != nil {
+			return errors.Wrap(err, "checking the shop location")
+		}
+		if !located {
+			return ErrMissingCoordinates
+		}
+		break
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM delivery_zones WHERE shop_id=$1", shopID); err != nil {
+		return errors.Wrap(err, "deleting delivery zones")
+	}
+
+	q := `INSERT INTO delivery_zones (shop_id, type, country, zip_codes, states, radius)
+	VALUES ($1, $2, $3, $4, $5, $6)`
+	for _, z := range zones {
+		if z.ZipCodes == nil {
+			z.ZipCodes = pq.StringArray{}
+		}
+		if z.States == nil {
+			z.States = pq.StringArray{}
+		}
+		if _, err := tx.ExecContext(ctx, q, shopID, z.Type, z.Country, z.ZipCodes, z.States, z.Radius); err != nil {
+			return errors.Wrap(err, "couldn't save the delivery zone")
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "committing transaction")
+	}
+
+	return nil
+}
+
+// Zones returns the shop's delivery zones.
+func (s *service) Zones(ctx context.Context, shopID string) ([]Zone, error) {
+	s.metrics.incMethodCalls("Zones")
+
+	var zones []Zone
+	q := "SELECT type, country, zip_codes, states, radius FROM delivery_zones WHERE shop_id=$1 ORDER BY type"
+	if err := s.db.SelectContext(ctx, &zones, q, shopID); err != nil {
+		return nil, errors.Wrap(err, "couldn't find the delivery zones")
+	}
+
+	if len(zones) == 0 {
+		var exists bool
+		if err := s.db.GetContext(ctx, &exists, "SELECT EXISTS(SELECT 1 FROM shops WHERE id=$1)", shopID); err != nil {
+			return nil, errors.Wrap(err, "couldn't find the shop")
+		}
+		if !exists {
+			return nil, ErrShopNotFound
+		}
+	}
+
+	return zones, nil
+}
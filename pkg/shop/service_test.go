@@ -3,28 +3,37 @@ package shop_test
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/GGP1/adak/internal/logger"
 	"github.com/GGP1/adak/internal/params"
 	"github.com/GGP1/adak/internal/test"
 	"github.com/GGP1/adak/pkg/shop"
+	"github.com/GGP1/adak/pkg/user"
 
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/guregu/null.v4"
 )
 
 var sh = shop.Shop{
 	ID:   "test",
 	Name: "Adak",
 	Location: shop.Location{
-		ShopID:  "test",
-		Country: "New Zealand",
-		State:   "Auckland",
-		ZipCode: "1023",
-		City:    "Auckland",
-		Address: "8 Hopetoun St",
+		ID:        "test",
+		ShopID:    "test",
+		Country:   "New Zealand",
+		State:     "Auckland",
+		ZipCode:   "1023",
+		City:      "Auckland",
+		Address:   "8 Hopetoun St",
+		Latitude:  null.FloatFrom(-36.8587),
+		Longitude: null.FloatFrom(174.7553),
 	},
 }
 
+const ownerID = "owner"
+
 // TestMain failed when creating the shop service.
 func NewShopService(t *testing.T) (context.Context, shop.Service) {
 	t.Helper()
@@ -35,6 +44,16 @@ func NewShopService(t *testing.T) (context.Context, shop.Service) {
 	mc := test.StartMemcached(t)
 	service := shop.NewService(db, mc)
 
+	userService := user.NewService(db, mc)
+	err := userService.Create(ctx, user.AddUser{
+		ID:       ownerID,
+		CartID:   "test",
+		Email:    "owner@test.com",
+		Username: "owner",
+		Password: "testing123",
+	})
+	assert.NoError(t, err)
+
 	t.Cleanup(func() {
 		cancel()
 	})
@@ -50,12 +69,16 @@ func TestShopService(t *testing.T) {
 	t.Run("Get by id", getByID(ctx, s))
 	t.Run("Update", update(ctx, s))
 	t.Run("Search", search(ctx, s))
+	t.Run("Nearby", nearby(ctx, s))
+	t.Run("Schedule", schedule(ctx, s))
+	t.Run("Zones", zones(ctx, s))
+	t.Run("Locations", locations(ctx, s))
 	t.Run("Delete", delete(ctx, s))
 }
 
 func create(ctx context.Context, s shop.Service) func(t *testing.T) {
 	return func(t *testing.T) {
-		assert.NoError(t, s.Create(ctx, sh))
+		assert.NoError(t, s.Create(ctx, sh, ownerID))
 
 		shop, err := s.GetByID(ctx, sh.ID)
 		assert.NoError(t, err)
@@ -89,6 +112,7 @@ func getByID(ctx context.Context, s shop.Service) func(t *testing.T) {
 		shop, err := s.GetByID(ctx, sh.ID)
 		assert.NoError(t, err)
 		assert.Equal(t, sh.Name, shop.Name)
+		assert.Empty(t, shop.Products, "Shops without products mustn't list empty ones")
 	}
 }
 
@@ -104,9 +128,134 @@ func update(ctx context.Context, s shop.Service) func(t *testing.T) {
 	}
 }
 
+func nearby(ctx context.Context, s shop.Service) func(t *testing.T) {
+	return func(t *testing.T) {
+		// Auckland Domain, about 1.9 kilometers away from the shop
+		nearby := shop.Nearby{Latitude: -36.8606, Longitude: 174.7766, Radius: 5000, Limit: "10"}
+		shops, err := s.Nearby(ctx, nearby)
+		assert.NoError(t, err)
+		assert.Len(t, shops, 1)
+		assert.InDelta(t, 1900, shops[0].Distance, 100)
+
+		nearby.Radius = 1000
+		shops, err = s.Nearby(ctx, nearby)
+		assert.NoError(t, err)
+		assert.Len(t, shops, 0)
+	}
+}
+
+func schedule(ctx context.Context, s shop.Service) func(t *testing.T) {
+	return func(t *testing.T) {
+		// Shops without hours are always open
+		closed, err := s.ClosedAt(ctx, time.Now(), sh.ID)
+		assert.NoError(t, err)
+		assert.Empty(t, closed)
+
+		schedule := shop.Schedule{
+			Timezone: "Pacific/Auckland",
+			Hours:    []shop.Hours{{Weekday: 1, Opens: "09:00", Closes: "18:00"}},
+			Holidays: []shop.Holiday{{Date: "2031-10-27", Name: "Labour Day"}},
+		}
+		assert.NoError(t, s.UpdateSchedule(ctx, sh.ID, schedule))
+
+		got, err := s.Schedule(ctx, sh.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, schedule, got)
+
+		auckland, err := time.LoadLocation(schedule.Timezone)
+		assert.NoError(t, err)
+		cases := []time.Time{
+			time.Date(2031, 10, 20, 10, 0, 0, 0, auckland),
+			time.Date(2031, 10, 20, 19, 0, 0, 0, auckland),
+			time.Date(2031, 10, 21, 10, 0, 0, 0, auckland),
+			time.Date(2031, 10, 27, 10, 0, 0, 0, auckland),
+		}
+		for _, c := range cases {
+			closed, err := s.ClosedAt(ctx, c, sh.ID)
+			assert.NoError(t, err)
+			// The database and the schedule must agree
+			assert.Equal(t, !schedule.OpenAt(c), len(closed) == 1, c)
+		}
+	}
+}
+
+func zones(ctx context.Context, s shop.Service) func(t *testing.T) {
+	return func(t *testing.T) {
+		zones := []shop.Zone{
+			{Type: shop.ZoneZipCodes, Country: "New Zealand", ZipCodes: pq.StringArray{"1010"}},
+			{Type: shop.ZoneRadius, Radius: 5},
+		}
+		assert.NoError(t, s.UpdateZones(ctx, sh.ID, zones))
+
+		got, err := s.Zones(ctx, sh.ID)
+		assert.NoError(t, err)
+		assert.Len(t, got, 2)
+
+		inside := shop.Address{Country: "New Zealand", ZipCode: "1010"}
+		undeliverable, err := s.Undeliverable(ctx, inside, sh.ID)
+		assert.NoError(t, err)
+		assert.Empty(t, undeliverable)
+
+		nearby := shop.Address{Country: "New Zealand", Latitude: null.FloatFrom(-36.8606), Longitude: null.FloatFrom(174.7766)}
+		undeliverable, err = s.Undeliverable(ctx, nearby, sh.ID)
+		assert.NoError(t, err)
+		assert.Empty(t, undeliverable)
+
+		outside := shop.Address{Country: "New Zealand", ZipCode: "6011"}
+		undeliverable, err = s.Undeliverable(ctx, outside, sh.ID)
+		assert.NoError(t, err)
+		assert.Len(t, undeliverable, 1)
+	}
+}
+
+func locations(ctx context.Context, s shop.Service) func(t *testing.T) {
+	return func(t *testing.T) {
+		branch := shop.Location{
+			ID:        "branch",
+			ShopID:    sh.ID,
+			Country:   "New Zealand",
+			City:      "Wellington",
+			Address:   "1 Lambton Quay",
+			Latitude:  null.FloatFrom(-41.2784),
+			Longitude: null.FloatFrom(174.7767),
+		}
+		assert.NoError(t, s.AddLocation(ctx, branch))
+
+		got, err := s.Locations(ctx, sh.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, []shop.Location{sh.Location, branch}, got)
+
+		// The radius zone covers the addresses close to any of the locations
+		wellington := shop.Address{Country: "New Zealand", Latitude: null.FloatFrom(-41.2865), Longitude: null.FloatFrom(174.7762)}
+		undeliverable, err := s.Undeliverable(ctx, wellington, sh.ID)
+		assert.NoError(t, err)
+		assert.Empty(t, undeliverable)
+
+		christchurch := shop.Address{Country: "New Zealand", Latitude: null.FloatFrom(-43.5321), Longitude: null.FloatFrom(172.6362)}
+		undeliverable, err = s.Undeliverable(ctx, christchurch, sh.ID, sh.ID)
+		assert.NoError(t, err)
+		assert.Len(t, undeliverable, 1, "Shops must be listed once")
+
+		_, err = s.Undeliverable(ctx, wellington, "unknown")
+		assert.ErrorIs(t, err, shop.ErrShopNotFound)
+		_, err = s.Zones(ctx, "unknown")
+		assert.ErrorIs(t, err, shop.ErrShopNotFound)
+
+		branch.ZipCode = "6011"
+		assert.NoError(t, s.UpdateLocation(ctx, sh.ID, branch))
+		updated, err := s.GetByID(ctx, sh.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, sh.Location, updated.Location, "The main location must not change")
+
+		assert.ErrorIs(t, s.UpdateLocation(ctx, "another", branch), shop.ErrLocationNotFound)
+		assert.NoError(t, s.DeleteLocation(ctx, sh.ID, branch.ID))
+		assert.ErrorIs(t, s.DeleteLocation(ctx, sh.ID, sh.Location.ID), shop.ErrLastLocation)
+	}
+}
+
 func search(ctx context.Context, s shop.Service) func(t *testing.T) {
 	return func(t *testing.T) {
-		shops, err := s.Search(ctx, sh.ID)
+		shops, err := s.Search(ctx, params.Search{Query: sh.ID, Language: params.DefaultLanguage})
 		assert.NoError(t, err)
 
 		var found bool
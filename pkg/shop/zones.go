@@ -0,0 +1,136 @@
+package shop
+
+import (
+	"strings"
+
+	"github.com/GGP1/adak/internal/geo"
+	"github.com/GGP1/adak/internal/sanitize"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"gopkg.in/guregu/null.v4"
+)
+
+// Delivery zone types.
+const (
+	// ZoneZipCodes covers the zip codes listed within a country
+	ZoneZipCodes = "zip_codes"
+	// ZoneRegion covers the states listed within a country, or the whole country if there are none
+	ZoneRegion = "region"
+	// ZoneRadius covers the addresses within a radius around any of the shop locations
+	ZoneRadius = "radius"
+)
+
+// maxZoneRadius is the largest radius, in kilometers, a delivery zone can have.
+const maxZoneRadius = 500
+
+// Zone is an area the shop delivers to.
+type Zone struct {
+	Type     string         `json:"type"`
+	Country  string         `json:"country,omitempty"`
+	ZipCodes pq.StringArray `json:"zip_codes,omitempty" db:"zip_codes"`
+	States   pq.StringArray `json:"states,omitempty"`
+	// Radius in kilometers
+	Radius float64 `json:"radius,omitempty"`
+}
+
+// Address is a delivery destination, the coordinates are only used by radius zones.
+type Address struct {
+	Country   string     `json:"country"`
+	State     string     `json:"state"`
+	ZipCode   string     `json:"zip_code"`
+	City      string     `json:"city"`
+	Latitude  null.Float `json:"latitude"`
+	Longitude null.Float `json:"longitude"`
+}
+
+// Geocode looks up the address coordinates if they weren't provided.
+func (a *Address) Geocode(geocoder *geo.Geocoder) {
+	if a.Latitude.Valid && a.Longitude.Valid {
+		return
+	}
+
+	if p, ok := geocoder.Lookup(a.Country, a.ZipCode, a.City); ok {
+		a.Latitude = null.FloatFrom(p.Latitude)
+		a.Longitude = null.FloatFrom(p.Longitude)
+	}
+}
+
+// Contains returns whether the address is inside the zone, origins are the shop locations.
+func (z Zone) Contains(address Address, origins []Location) bool {
+	switch z.Type {
+	case ZoneZipCodes:
+		return equal(z.Country, address.Country) && contains(z.ZipCodes, address.ZipCode)
+	case ZoneRegion:
+		return equal(z.Country, address.Country) && (len(z.States) == 0 || contains(z.States, address.State))
+	case ZoneRadius:
+		if !address.Latitude.Valid || !address.Longitude.Valid {
+			return false
+		}
+		to := geo.Point{Latitude: address.Latitude.Float64, Longitude: address.Longitude.Float64}
+		for _, origin := range origins {
+			if !origin.Latitude.Valid || !origin.Longitude.Valid {
+				continue
+			}
+			from := geo.Point{Latitude: origin.Latitude.Float64, Longitude: origin.Longitude.Float64}
+			if geo.Distance(from, to) <= z.Radius*1000 {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Validate checks the zone fields depending on its type.
+func (z Zone) Validate() error {
+	switch z.Type {
+	case ZoneZipCodes:
+		if z.Country == "" || len(z.ZipCodes) == 0 {
+			return errors.New("zip codes zones require a country and at least one zip code")
+		}
+	case ZoneRegion:
+		if z.Country == "" {
+			return errors.New("region zones require a country")
+		}
+	case ZoneRadius:
+		if z.Radius <= 0 || z.Radius > maxZoneRadius {
+			return errors.Errorf("the zone radius must be greater than 0 and lower than %d kilometers", maxZoneRadius)
+		}
+	default:
+		return errors.Errorf("invalid zone type %q", z.Type)
+	}
+
+	return nil
+}
+
+// delivers returns whether any of the zones contains the address. Shops without
+// zones deliver everywhere.
+func delivers(zones []Zone, address Address, origins []Location) bool {
+	if len(zones) == 0 {
+		return true
+	}
+
+	for _, z := range zones {
+		if z.Contains(address, origins) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if equal(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// equal compares two strings ignoring case, accents and surrounding spaces.
+func equal(a, b string) bool {
+	a = sanitize.Normalize(strings.TrimSpace(a))
+	b = sanitize.Normalize(strings.TrimSpace(b))
+	return strings.EqualFold(a, b)
+}
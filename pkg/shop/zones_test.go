@@ -0,0 +1,120 @@
+package shop
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GGP1/adak/internal/geo"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/guregu/null.v4"
+)
+
+func TestDelivers(t *testing.T) {
+	// Auckland CBD
+	origin := Location{Latitude: null.FloatFrom(-36.8485), Longitude: null.FloatFrom(174.7633)}
+	zones := []Zone{
+		{Type: ZoneZipCodes, Country: "New Zealand", ZipCodes: pq.StringArray{"1010", "1011"}},
+		{Type: ZoneRegion, Country: "Australia", States: pq.StringArray{"New South Wales"}},
+		{Type: ZoneRegion, Country: "España"},
+		{Type: ZoneRadius, Radius: 10},
+	}
+
+	cases := []struct {
+		desc     string
+		address  Address
+		expected bool
+	}{
+		{desc: "Zip code", address: Address{Country: "new zealand", ZipCode: "1011"}, expected: true},
+		{desc: "Zip code other country", address: Address{Country: "Australia", ZipCode: "1011"}, expected: false},
+		{desc: "State", address: Address{Country: "Australia", State: "new south wales"}, expected: true},
+		{desc: "Other state", address: Address{Country: "Australia", State: "Victoria"}, expected: false},
+		{desc: "Whole country", address: Address{Country: "Espana", State: "Madrid"}, expected: true},
+		{desc: "Within radius", address: Address{
+			Country:   "New Zealand",
+			ZipCode:   "1023",
+			Latitude:  null.FloatFrom(-36.8688),
+			Longitude: null.FloatFrom(174.7770),
+		}, expected: true},
+		{desc: "Outside radius", address: Address{
+			Country:   "New Zealand",
+			ZipCode:   "6011",
+			Latitude:  null.FloatFrom(-41.2865),
+			Longitude: null.FloatFrom(174.7762),
+		}, expected: false},
+		{desc: "Unknown coordinates", address: Address{Country: "New Zealand", ZipCode: "1023"}, expected: false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert.Equal(t, tc.expected, delivers(zones, tc.address, []Location{origin}))
+		})
+	}
+
+	t.Run("Origin without longitude", func(t *testing.T) {
+		address := Address{Latitude: null.FloatFrom(-36.8485), Longitude: null.FloatFrom(0)}
+		radius := []Zone{{Type: ZoneRadius, Radius: 10}}
+		assert.False(t, delivers(radius, address, []Location{{Latitude: origin.Latitude}}))
+	})
+
+	t.Run("Any location", func(t *testing.T) {
+		// Wellington CBD, far away from the Auckland location
+		wellington := Location{Latitude: null.FloatFrom(-41.2865), Longitude: null.FloatFrom(174.7762)}
+		address := Address{Latitude: null.FloatFrom(-41.2924), Longitude: null.FloatFrom(174.7787)}
+		radius := []Zone{{Type: ZoneRadius, Radius: 10}}
+		assert.False(t, delivers(radius, address, []Location{origin}))
+		assert.True(t, delivers(radius, address, []Location{origin, wellington}))
+	})
+
+	t.Run("No zones", func(t *testing.T) {
+		assert.True(t, delivers(nil, Address{Country: "Argentina"}, nil))
+	})
+}
+
+func TestGeocodeAddress(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "places.csv")
+	dataset := "country,zip_code,city,latitude,longitude\nNew Zealand,1023,Auckland,-36.8688,174.7770\n"
+	assert.NoError(t, os.WriteFile(path, []byte(dataset), 0o600))
+
+	g, err := geo.Load(path)
+	assert.NoError(t, err)
+
+	address := Address{Country: "New Zealand", ZipCode: "1023", City: "Auckland"}
+	address.Geocode(g)
+	assert.Equal(t, null.FloatFrom(-36.8688), address.Latitude)
+	assert.Equal(t, null.FloatFrom(174.7770), address.Longitude)
+
+	// Coordinates provided by the client are kept
+	address = Address{Country: "New Zealand", City: "Auckland", Latitude: null.FloatFrom(1), Longitude: null.FloatFrom(2)}
+	address.Geocode(g)
+	assert.Equal(t, null.FloatFrom(1), address.Latitude)
+}
+
+func TestValidateZone(t *testing.T) {
+	cases := []struct {
+		desc  string
+		zone  Zone
+		valid bool
+	}{
+		{desc: "Zip codes", zone: Zone{Type: ZoneZipCodes, Country: "Argentina", ZipCodes: pq.StringArray{"1900"}}, valid: true},
+		{desc: "Zip codes without country", zone: Zone{Type: ZoneZipCodes, ZipCodes: pq.StringArray{"1900"}}},
+		{desc: "Empty zip codes", zone: Zone{Type: ZoneZipCodes, Country: "Argentina"}},
+		{desc: "Region", zone: Zone{Type: ZoneRegion, Country: "Argentina"}, valid: true},
+		{desc: "Region without country", zone: Zone{Type: ZoneRegion}},
+		{desc: "Radius", zone: Zone{Type: ZoneRadius, Radius: 15}, valid: true},
+		{desc: "Radius too large", zone: Zone{Type: ZoneRadius, Radius: 1000}},
+		{desc: "Unknown type", zone: Zone{Type: "continent"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			err := tc.zone.Validate()
+			if tc.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
@@ -6,7 +6,7 @@ import (
 	"net/http"
 	"strconv"
 
-	"github.com/GGP1/adak/internal/cookie"
+	"github.com/GGP1/adak/internal/identity"
 	"github.com/GGP1/adak/internal/params"
 	"github.com/GGP1/adak/internal/response"
 	"github.com/GGP1/adak/internal/sanitize"
@@ -39,7 +39,7 @@ func (h *Handler) Add() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 
-		cartID, err := cookie.GetValue(r, "CID")
+		cartID, err := identity.CartID(r)
 		if err != nil {
 			response.Error(w, http.StatusForbidden, err)
 			return
@@ -71,7 +71,7 @@ func (h *Handler) Add() http.HandlerFunc {
 func (h *Handler) Checkout() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
-		cartID, err := cookie.GetValue(r, "CID")
+		cartID, err := identity.CartID(r)
 		if err != nil {
 			response.Error(w, http.StatusForbidden, err)
 			return
@@ -90,7 +90,7 @@ func (h *Handler) Checkout() http.HandlerFunc {
 // FilterBy returns the products filtered by the field provided.
 func (h *Handler) FilterBy() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		cartID, err := cookie.GetValue(r, "CID")
+		cartID, err := identity.CartID(r)
 		if err != nil {
 			response.Error(w, http.StatusForbidden, err)
 			return
@@ -114,7 +114,7 @@ func (h *Handler) FilterBy() http.HandlerFunc {
 func (h *Handler) Get() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
-		cartID, err := cookie.GetValue(r, "CID")
+		cartID, err := identity.CartID(r)
 		if err != nil {
 			response.Error(w, http.StatusForbidden, err)
 			return
@@ -140,7 +140,7 @@ func (h *Handler) Get() http.HandlerFunc {
 func (h *Handler) Products() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
-		cartID, err := cookie.GetValue(r, "CID")
+		cartID, err := identity.CartID(r)
 		if err != nil {
 			response.Error(w, http.StatusForbidden, err)
 			return
@@ -159,7 +159,7 @@ func (h *Handler) Products() http.HandlerFunc {
 // Remove takes out a product from the shopping cart.
 func (h *Handler) Remove() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		cartID, err := cookie.GetValue(r, "CID")
+		cartID, err := identity.CartID(r)
 		if err != nil {
 			response.Error(w, http.StatusForbidden, err)
 			return
@@ -192,7 +192,7 @@ func (h *Handler) Remove() http.HandlerFunc {
 func (h *Handler) Reset() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
-		cartID, err := cookie.GetValue(r, "CID")
+		cartID, err := identity.CartID(r)
 		if err != nil {
 			response.Error(w, http.StatusForbidden, err)
 			return
@@ -211,7 +211,7 @@ func (h *Handler) Reset() http.HandlerFunc {
 func (h *Handler) Size() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
-		cartID, err := cookie.GetValue(r, "CID")
+		cartID, err := identity.CartID(r)
 		if err != nil {
 			response.Error(w, http.StatusForbidden, err)
 			return
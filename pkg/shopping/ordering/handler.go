@@ -4,37 +4,66 @@ import (
 	"context"
 	"encoding/json"
 	"net/http"
+	"strings"
+	"time"
 
-	"github.com/GGP1/adak/internal/cookie"
+	"github.com/GGP1/adak/internal/geo"
+	"github.com/GGP1/adak/internal/identity"
 	"github.com/GGP1/adak/internal/params"
 	"github.com/GGP1/adak/internal/response"
 	"github.com/GGP1/adak/internal/sanitize"
 	"github.com/GGP1/adak/internal/token"
 	"github.com/GGP1/adak/internal/validate"
+	"github.com/GGP1/adak/pkg/shop"
+	"github.com/GGP1/adak/pkg/shop/member"
 	"github.com/GGP1/adak/pkg/shopping/cart"
 	"github.com/GGP1/adak/pkg/shopping/payment/stripe"
 	"github.com/google/uuid"
 
 	"github.com/bradfitz/gomemcache/memcache"
 	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/skip2/go-qrcode"
+	"gopkg.in/guregu/null.v4"
 	"gopkg.in/guregu/null.v4/zero"
 )
 
+type collectResponse struct {
+	ID               string `json:"id"`
+	PickupLocationID string `json:"pickup_location_id,omitempty"`
+	Address          string `json:"address,omitempty"`
+}
+
 type cursorResponse struct {
 	NextCursor string  `json:"next_cursor,omitempty"`
 	Orders     []Order `json:"orders,omitempty"`
 }
 
 // OrderParams holds the parameters for creating a order.
+//
+// The address coordinates are optional, they are looked up using the geocoder when missing.
+// Pickup orders don't require an address, the one of the shop location picked is used instead.
+// The location can be omitted when the shop has a single one.
 type OrderParams struct {
-	Currency string      `json:"currency" validate:"required"`
-	Address  string      `json:"address" validate:"required"`
-	City     string      `json:"city" validate:"required"`
-	Country  string      `json:"country" validate:"required"`
-	State    string      `json:"state" validate:"required"`
-	ZipCode  string      `json:"zip_code" validate:"required"`
-	Date     Date        `json:"date" validate:"required"`
-	Card     stripe.Card `json:"card" validate:"required"`
+	Currency   string      `json:"currency" validate:"required"`
+	Fulfilment string      `json:"fulfilment" validate:"omitempty,oneof=delivery pickup"`
+	Address    string      `json:"address" validate:"required_unless=Fulfilment pickup"`
+	City       string      `json:"city" validate:"required_unless=Fulfilment pickup"`
+	Country    string      `json:"country" validate:"required_unless=Fulfilment pickup"`
+	State      string      `json:"state" validate:"required_unless=Fulfilment pickup"`
+	ZipCode    string      `json:"zip_code" validate:"required_unless=Fulfilment pickup"`
+	Latitude   null.Float  `json:"latitude"`
+	Longitude  null.Float  `json:"longitude"`
+	Date       Date        `json:"date" validate:"required"`
+	Card       stripe.Card `json:"card" validate:"required"`
+	LocationID string      `json:"location_id"`
+	// PickupShopID is set by the server
+	PickupShopID string `json:"-"`
+}
+
+// PickupCode is the code the user shows to collect a pickup order.
+type PickupCode struct {
+	Code string `json:"code" validate:"required"`
 }
 
 // Date of the order.
@@ -44,8 +73,25 @@ type Date struct {
 	Day     int `json:"day" validate:"required,min=1,max=31"`
 	Hour    int `json:"hour" validate:"required,min=0,max=24"`
 	Minutes int `json:"minutes" validate:"required,min=0,max=60"`
+	// IANA name, the shops' timezone is used if it's empty
+	Timezone string `json:"timezone,omitempty" validate:"omitempty,timezone"`
 }
 
+// Time returns the date in its timezone, UTC if it's invalid.
+func (d Date) Time() time.Time {
+	loc, err := time.LoadLocation(d.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	return time.Date(d.Year, time.Month(d.Month), d.Day, d.Hour, d.Minutes, 0, 0, loc)
+}
+
+// errInvalidLocation is returned when the pickup location isn't one of the shop's locations.
+var errInvalidLocation = errors.New("the pickup location must be one of the shop's locations")
+
+// errMixedTimezones is returned when the date has no timezone and the shops ordered from have different ones.
+var errMixedTimezones = errors.New("the shops are in different timezones, the date's timezone is required")
+
 // Handler handles ordering endpoints.
 type Handler struct {
 	orderingService Service
@@ -66,6 +112,69 @@ func NewHandler(dev bool, orderingS Service, cartS cart.Service, db *sqlx.DB, ca
 	}
 }
 
+// Collect marks a pickup order as collected, only the staff of the shop can do it after verifying the code.
+// The response includes the location the order had to be collected at.
+func (h *Handler) Collect(members member.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		id, err := params.URLID(ctx)
+		if err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		var pickup PickupCode
+		if err := json.NewDecoder(r.Body).Decode(&pickup); err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+		defer r.Body.Close()
+
+		if err := validate.Struct(ctx, pickup); err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		order, err := h.orderingService.GetByID(ctx, id)
+		if err != nil || !order.ID.Valid {
+			response.Error(w, http.StatusNotFound, ErrOrderNotFound)
+			return
+		}
+		if !order.PickupShopID.Valid {
+			response.Error(w, http.StatusBadRequest, ErrNotPickup)
+			return
+		}
+
+		if _, err := member.Authorize(r, members, order.PickupShopID.String, member.Owner, member.Staff); err != nil {
+			response.Error(w, http.StatusForbidden, err)
+			return
+		}
+
+		if err := h.orderingService.Collect(ctx, id, pickup.Code); err != nil {
+			switch {
+			case errors.Is(err, ErrOrderNotFound):
+				response.Error(w, http.StatusNotFound, err)
+			case errors.Is(err, ErrInvalidPickupCode):
+				response.Error(w, http.StatusForbidden, err)
+			case errors.Is(err, ErrAlreadyCollected):
+				response.Error(w, http.StatusConflict, err)
+			case errors.Is(err, ErrNotPickup), errors.Is(err, ErrUnpaid):
+				response.Error(w, http.StatusBadRequest, err)
+			default:
+				response.Error(w, http.StatusInternalServerError, err)
+			}
+			return
+		}
+
+		response.JSON(w, http.StatusOK, collectResponse{
+			ID:               id,
+			PickupLocationID: order.PickupLocationID.String,
+			Address:          order.Address.String,
+		})
+	}
+}
+
 // Delete deletes an order.
 func (h *Handler) Delete() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -139,6 +248,96 @@ func (h *Handler) GetByID() http.HandlerFunc {
 	}
 }
 
+// PickupQR returns a PNG image with a QR code containing the order id and its pickup code
+// separated by a colon, only the user that placed the order can see it. The pickup location id
+// is sent in the X-Pickup-Location header.
+func (h *Handler) PickupQR() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		id, err := params.URLID(ctx)
+		if err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		order, err := h.orderingService.GetByID(ctx, id)
+		if err != nil || !order.ID.Valid {
+			response.Error(w, http.StatusNotFound, ErrOrderNotFound)
+			return
+		}
+
+		userID, err := identity.UserID(r)
+		if err != nil {
+			response.Error(w, http.StatusForbidden, err)
+			return
+		}
+		if order.UserID.String != userID {
+			response.Error(w, http.StatusForbidden, errors.New("the order belongs to another user"))
+			return
+		}
+
+		if !order.PickupCode.Valid {
+			response.Error(w, http.StatusBadRequest, ErrNotPickup)
+			return
+		}
+
+		png, err := qrcode.Encode(order.ID.String+":"+order.PickupCode.String, qrcode.Medium, 256)
+		if err != nil {
+			response.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("X-Pickup-Location", order.PickupLocationID.String)
+		w.WriteHeader(http.StatusOK)
+		w.Write(png)
+	}
+}
+
+// GetByShopID retrieves the orders containing products of the shop, only its members can see them.
+func (h *Handler) GetByShopID(members member.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		id, err := params.URLID(ctx)
+		if err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if _, err := member.Authorize(r, members, id, member.Owner, member.Staff); err != nil {
+			response.Error(w, http.StatusForbidden, err)
+			return
+		}
+
+		urlParams, err := params.ParseQuery(r.URL.RawQuery, params.Order)
+		if err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		orders, err := h.orderingService.GetByShopID(ctx, id, urlParams)
+		if err != nil {
+			response.Error(w, http.StatusNotFound, err)
+			return
+		}
+
+		var nextCursor string
+		if len(orders) > 0 {
+			nextCursor = params.EncodeCursor(
+				orders[len(orders)-1].CreatedAt.Time,
+				orders[len(orders)-1].ID.String,
+			)
+		}
+
+		response.JSON(w, http.StatusOK, cursorResponse{
+			NextCursor: nextCursor,
+			Orders:     orders,
+		})
+	}
+}
+
 // GetByUserID retrieves all the orders from the user.
 func (h *Handler) GetByUserID() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -173,15 +372,19 @@ func (h *Handler) GetByUserID() http.HandlerFunc {
 }
 
 // New creates a new order and the payment intent.
-func (h *Handler) New() http.HandlerFunc {
+//
+// The delivery date must be within the opening hours of all the shops whose products were ordered
+// and the address inside their delivery zones. Pickup orders are collected at the shop location picked
+// on the date provided. Dates without a timezone are in the shops' one.
+func (h *Handler) New(shops shop.Service, geocoder *geo.Geocoder) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
-		cartID, err := cookie.GetValue(r, "CID")
+		cartID, err := identity.CartID(r)
 		if err != nil {
 			response.Error(w, http.StatusForbidden, err)
 			return
 		}
-		userID, err := cookie.GetValue(r, "UID")
+		userID, err := identity.UserID(r)
 		if err != nil {
 			response.Error(w, http.StatusForbidden, err)
 			return
@@ -198,6 +401,80 @@ func (h *Handler) New() http.HandlerFunc {
 			return
 		}
 
+		shopIDs, err := h.orderingService.CartShops(ctx, cartID)
+		if err != nil {
+			response.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		if orderParams.Date.Timezone == "" {
+			orderParams.Date.Timezone, err = shopsTimezone(ctx, shops, shopIDs)
+			if err != nil {
+				if errors.Is(err, errMixedTimezones) {
+					response.Error(w, http.StatusBadRequest, err)
+					return
+				}
+				response.Error(w, http.StatusInternalServerError, err)
+				return
+			}
+		}
+
+		closed, err := shops.ClosedAt(ctx, orderParams.Date.Time(), shopIDs...)
+		if err != nil {
+			response.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+		if len(closed) > 0 {
+			err := errors.Errorf("the delivery date is outside the opening hours of: %s", strings.Join(closed, ", "))
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if orderParams.Fulfilment == Pickup {
+			if len(shopIDs) > 1 {
+				response.Error(w, http.StatusBadRequest, errors.New("pickup orders must contain products of a single shop"))
+				return
+			}
+			if len(shopIDs) == 1 {
+				location, err := pickupLocation(ctx, shops, shopIDs[0], orderParams.LocationID)
+				if err != nil {
+					if errors.Is(err, errInvalidLocation) {
+						response.Error(w, http.StatusBadRequest, err)
+						return
+					}
+					response.Error(w, http.StatusInternalServerError, err)
+					return
+				}
+				orderParams.PickupShopID = location.ShopID
+				orderParams.LocationID = location.ID
+				orderParams.Address = location.Address
+				orderParams.City = location.City
+				orderParams.Country = location.Country
+				orderParams.State = location.State
+				orderParams.ZipCode = location.ZipCode
+			}
+		} else {
+			address := shop.Address{
+				Country:   orderParams.Country,
+				State:     orderParams.State,
+				ZipCode:   orderParams.ZipCode,
+				City:      orderParams.City,
+				Latitude:  orderParams.Latitude,
+				Longitude: orderParams.Longitude,
+			}
+			address.Geocode(geocoder)
+			undeliverable, err := shops.Undeliverable(ctx, address, shopIDs...)
+			if err != nil {
+				response.Error(w, http.StatusInternalServerError, err)
+				return
+			}
+			if len(undeliverable) > 0 {
+				err := errors.Errorf("the address is outside the delivery zones of: %s", strings.Join(undeliverable, ", "))
+				response.Error(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+
 		id := uuid.NewString()
 		order, err := h.orderingService.New(ctx, id, userID, cartID, orderParams, h.cartService)
 		if err != nil {
@@ -230,10 +507,51 @@ func (h *Handler) New() http.HandlerFunc {
 	}
 }
 
+// pickupLocation returns the shop location with the id provided, which may be empty when the
+// shop has a single location.
+func pickupLocation(ctx context.Context, shops shop.Service, shopID, locationID string) (shop.Location, error) {
+	locations, err := shops.Locations(ctx, shopID)
+	if err != nil {
+		return shop.Location{}, err
+	}
+	if locationID == "" && len(locations) == 1 {
+		return locations[0], nil
+	}
+	for _, l := range locations {
+		if l.ID == locationID {
+			return l, nil
+		}
+	}
+	return shop.Location{}, errInvalidLocation
+}
+
+// shopsTimezone returns the timezone shared by the shops provided.
+func shopsTimezone(ctx context.Context, shops shop.Service, shopIDs []string) (string, error) {
+	timezone := shop.DefaultTimezone
+	for i, id := range shopIDs {
+		schedule, err := shops.Schedule(ctx, id)
+		if err != nil {
+			return "", err
+		}
+		if i > 0 && schedule.Timezone != timezone {
+			return "", errMixedTimezones
+		}
+		timezone = schedule.Timezone
+	}
+	return timezone, nil
+}
+
 func validateOrderParams(ctx context.Context, oParams *OrderParams) error {
 	if err := validate.Struct(ctx, oParams); err != nil {
 		return err
 	}
+	if oParams.Fulfilment == "" {
+		oParams.Fulfilment = Delivery
+	}
+	if oParams.Latitude.Valid != oParams.Longitude.Valid ||
+		(oParams.Latitude.Valid && !geo.ValidCoordinates(oParams.Latitude.Float64, oParams.Longitude.Float64)) {
+		return errors.New("invalid coordinates, both latitude and longitude must be provided and within range")
+	}
 	oParams.Address = sanitize.Normalize(oParams.Address)
 	oParams.City = sanitize.Normalize(oParams.City)
 	oParams.Country = sanitize.Normalize(oParams.Country)
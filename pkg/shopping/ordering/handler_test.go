@@ -0,0 +1,149 @@
+package ordering
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GGP1/adak/internal/identity"
+	"github.com/GGP1/adak/pkg/shop"
+	"github.com/GGP1/adak/pkg/shopping/cart"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/guregu/null.v4/zero"
+)
+
+type pickupOrders struct {
+	Service
+	order Order
+}
+
+func (s pickupOrders) GetByID(ctx context.Context, orderID string) (Order, error) {
+	if orderID != s.order.ID.String {
+		return Order{}, nil
+	}
+	return s.order, nil
+}
+
+func (s pickupOrders) CartShops(ctx context.Context, cartID string) ([]string, error) {
+	return []string{s.order.PickupShopID.String}, nil
+}
+
+func (s pickupOrders) New(ctx context.Context, id, userID, cartID string,
+	oParams OrderParams, cartService cart.Service) (Order, error) {
+	return Order{
+		ID:               zero.StringFrom(id),
+		PickupShopID:     zero.StringFrom(oParams.PickupShopID),
+		PickupLocationID: zero.StringFrom(oParams.LocationID),
+		Address:          zero.StringFrom(oParams.Address),
+	}, nil
+}
+
+func (s pickupOrders) UpdateStatus(ctx context.Context, orderID string, status status) error {
+	return nil
+}
+
+type pickupShops struct {
+	shop.Service
+	locations []shop.Location
+}
+
+func (s pickupShops) ClosedAt(ctx context.Context, t time.Time, shopIDs ...string) ([]string, error) {
+	return nil, nil
+}
+
+func (s pickupShops) Locations(ctx context.Context, shopID string) ([]shop.Location, error) {
+	return s.locations, nil
+}
+
+type resetCart struct {
+	cart.Service
+}
+
+func (resetCart) Reset(ctx context.Context, cartID string) error {
+	return nil
+}
+
+func TestNewPickupLocation(t *testing.T) {
+	mainLocation := shop.Location{ID: uuid.NewString(), ShopID: "shop", Address: "8 Hopetoun St"}
+	other := shop.Location{ID: uuid.NewString(), ShopID: "shop", Address: "1 Queen St"}
+	orders := pickupOrders{order: Order{PickupShopID: zero.StringFrom("shop")}}
+	handler := NewHandler(true, orders, resetCart{}, nil, nil)
+
+	cases := []struct {
+		desc       string
+		locations  []shop.Location
+		locationID string
+		expected   int
+		address    string
+	}{
+		{desc: "Single location", locations: []shop.Location{mainLocation}, expected: http.StatusCreated, address: mainLocation.Address},
+		{desc: "Location picked", locations: []shop.Location{mainLocation, other}, locationID: other.ID, expected: http.StatusCreated, address: other.Address},
+		{desc: "Location required", locations: []shop.Location{mainLocation, other}, expected: http.StatusBadRequest},
+		{desc: "Another shop location", locations: []shop.Location{mainLocation}, locationID: uuid.NewString(), expected: http.StatusBadRequest},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			body := `{"currency": "USD", "fulfilment": "pickup", "location_id": "` + tc.locationID + `",
+			"date": {"year": 2150, "month": 8, "day": 14, "hour": 10, "minutes": 30, "timezone": "UTC"},
+			"card": {"exp_year": "2150", "cvc": "123"}}`
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+			req = req.WithContext(identity.NewContext(req.Context(), identity.Identity{UserID: "user", CartID: "cart"}))
+			rec := httptest.NewRecorder()
+
+			handler.New(pickupShops{locations: tc.locations}, nil).ServeHTTP(rec, req)
+			assert.Equal(t, tc.expected, rec.Code, rec.Body.String())
+			if tc.expected != http.StatusCreated {
+				return
+			}
+
+			var order Order
+			assert.NoError(t, json.NewDecoder(rec.Body).Decode(&order))
+			assert.Equal(t, tc.address, order.Address.String)
+			assert.NotEmpty(t, order.PickupLocationID.String)
+		})
+	}
+}
+
+func TestPickupQR(t *testing.T) {
+	order := Order{
+		ID:               zero.StringFrom(uuid.NewString()),
+		UserID:           zero.StringFrom(uuid.NewString()),
+		PickupLocationID: zero.StringFrom(uuid.NewString()),
+		PickupCode:       zero.StringFrom("ABC234"),
+	}
+	handler := NewHandler(true, pickupOrders{order: order}, nil, nil, nil)
+	mux := chi.NewRouter()
+	mux.Get("/{id}/pickup/qr", handler.PickupQR())
+
+	cases := []struct {
+		desc     string
+		userID   string
+		expected int
+	}{
+		{desc: "Buyer", userID: order.UserID.String, expected: http.StatusOK},
+		{desc: "Other user", userID: uuid.NewString(), expected: http.StatusForbidden},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/"+order.ID.String+"/pickup/qr", nil)
+			req = req.WithContext(identity.NewContext(req.Context(), identity.Identity{UserID: tc.userID}))
+			rec := httptest.NewRecorder()
+
+			mux.ServeHTTP(rec, req)
+			assert.Equal(t, tc.expected, rec.Code)
+			if tc.expected == http.StatusOK {
+				assert.Equal(t, "image/png", rec.Header().Get("Content-Type"))
+				assert.Equal(t, order.PickupLocationID.String, rec.Header().Get("X-Pickup-Location"))
+			}
+		})
+	}
+}
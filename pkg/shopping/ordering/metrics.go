@@ -7,6 +7,7 @@ import (
 
 type metrics struct {
 	totalOrders *prometheus.CounterVec
+	pickups     *prometheus.CounterVec
 	methodCalls *prometheus.CounterVec
 }
 
@@ -19,6 +20,12 @@ func initMetrics() metrics {
 			Name:      "orders_total",
 			Help:      "Total number of orders",
 		}, []string{"status"}),
+		pickups: promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "pickups_total",
+			Help:      "Total number of pickup attempts",
+		}, []string{"result"}),
 		methodCalls: promauto.NewCounterVec(prometheus.CounterOpts{
 			Namespace: ns,
 			Subsystem: sub,
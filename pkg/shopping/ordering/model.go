@@ -13,25 +13,48 @@ const (
 	Shipping
 	Shipped
 	Failed
+	Collected
+)
+
+// PurchasedStatuses returns the statuses of the orders that were paid for.
+func PurchasedStatuses() []int64 {
+	return []int64{int64(Paid), int64(Shipping), int64(Shipped), int64(Collected)}
+}
+
+// Fulfilment types
+const (
+	// Delivery orders are shipped to the address provided, it's the default
+	Delivery = "delivery"
+	// Pickup orders are collected by the user at the shop's location
+	Pickup = "pickup"
 )
 
 // Order represents a user purchase request.
+//
+// The address of pickup orders is the one of the shop location they are collected at. Their pickup
+// code proves the user that placed them is collecting them, it's never encoded and only shown
+// to that user with PickupQR.
 type Order struct {
-	ID           zero.String    `json:"id,omitempty"`
-	UserID       zero.String    `json:"user_id,omitempty" db:"user_id"`
-	Currency     zero.String    `json:"currency,omitempty"`
-	Address      zero.String    `json:"address,omitempty"`
-	City         zero.String    `json:"city,omitempty"`
-	State        zero.String    `json:"state,omitempty"`
-	ZipCode      zero.String    `json:"zip_code,omitempty" db:"zip_code"`
-	Country      zero.String    `json:"country,omitempty"`
-	Status       zero.Int       `json:"status,omitempty"`
-	OrderedAt    zero.Time      `json:"ordered_at,omitempty" db:"ordered_at"`
-	DeliveryDate zero.Time      `json:"delivery_date,omitempty" db:"delivery_date"`
-	CartID       zero.String    `json:"cart_id,omitempty" db:"cart_id"`
-	Cart         OrderCart      `json:"cart,omitempty"`
-	Products     []OrderProduct `json:"products,omitempty"`
-	CreatedAt    zero.Time      `json:"created_at,omitempty" db:"created_at"`
+	ID               zero.String    `json:"id,omitempty"`
+	UserID           zero.String    `json:"user_id,omitempty" db:"user_id"`
+	Currency         zero.String    `json:"currency,omitempty"`
+	Address          zero.String    `json:"address,omitempty"`
+	City             zero.String    `json:"city,omitempty"`
+	State            zero.String    `json:"state,omitempty"`
+	ZipCode          zero.String    `json:"zip_code,omitempty" db:"zip_code"`
+	Country          zero.String    `json:"country,omitempty"`
+	Status           zero.Int       `json:"status,omitempty"`
+	OrderedAt        zero.Time      `json:"ordered_at,omitempty" db:"ordered_at"`
+	DeliveryDate     zero.Time      `json:"delivery_date,omitempty" db:"delivery_date"`
+	Fulfilment       zero.String    `json:"fulfilment,omitempty"`
+	PickupShopID     zero.String    `json:"pickup_shop_id,omitempty" db:"pickup_shop_id"`
+	PickupLocationID zero.String    `json:"pickup_location_id,omitempty" db:"pickup_location_id"`
+	PickupCode       zero.String    `json:"-" db:"pickup_code"`
+	CollectedAt      zero.Time      `json:"collected_at,omitempty" db:"collected_at"`
+	CartID           zero.String    `json:"cart_id,omitempty" db:"cart_id"`
+	Cart             OrderCart      `json:"cart,omitempty"`
+	Products         []OrderProduct `json:"products,omitempty"`
+	CreatedAt        zero.Time      `json:"created_at,omitempty" db:"created_at"`
 }
 
 // OrderCart represents the cart ordered by the user.
@@ -54,6 +77,7 @@ type OrderCart struct {
 // 100 = 1 USD.
 type OrderProduct struct {
 	ProductID   zero.String `json:"product_id,omitempty" db:"product_id"`
+	ShopID      zero.String `json:"shop_id,omitempty" db:"shop_id"`
 	OrderID     zero.String `json:"order_id,omitempty" db:"order_id"`
 	Quantity    zero.Int    `json:"quantity,omitempty"`
 	Brand       zero.String `json:"brand,omitempty"`
@@ -2,7 +2,12 @@ package ordering
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"math/big"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/GGP1/adak/internal/params"
@@ -16,12 +21,44 @@ import (
 	"gopkg.in/guregu/null.v4/zero"
 )
 
+// Columns of the orders (aliased "o"), order_carts ("c") and order_products ("p") tables.
+const (
+	orderColumns = `o.id, o.user_id, o.currency, o.address, o.city, o.state, o.zip_code, o.country,
+	o.status, o.ordered_at, o.delivery_date, o.fulfilment, o.pickup_shop_id, o.pickup_location_id,
+	o.pickup_code, o.collected_at, o.cart_id, o.created_at`
+	cartColumns    = "c.order_id, c.counter, c.weight, c.discount, c.taxes, c.subtotal, c.total"
+	productColumns = `p.product_id, p.shop_id, p.order_id, p.quantity, p.brand, p.category, p.type,
+	p.description, p.weight, p.discount, p.taxes, p.subtotal, p.total`
+)
+
+// pickupCodeLength is the number of characters of the pickup codes.
+const pickupCodeLength = 6
+
+// pickupCodePool excludes characters that are easily confused when read aloud or handwritten.
+var pickupCodePool = []byte("ABCDEFGHJKLMNPQRSTUVWXYZ23456789")
+
+var (
+	// ErrAlreadyCollected is returned when the pickup order was already collected.
+	ErrAlreadyCollected = errors.New("the order was already collected")
+	// ErrInvalidPickupCode is returned when the pickup code doesn't match the order's one.
+	ErrInvalidPickupCode = errors.New("invalid pickup code")
+	// ErrNotPickup is returned when trying to collect an order that is delivered.
+	ErrNotPickup = errors.New("the order is not for pickup")
+	// ErrOrderNotFound is returned when the order doesn't exist.
+	ErrOrderNotFound = errors.New("order not found")
+	// ErrUnpaid is returned when trying to collect an order that wasn't paid.
+	ErrUnpaid = errors.New("the order hasn't been paid")
+)
+
 // Service contains order functionalities.
 type Service interface {
 	New(ctx context.Context, id, userID string, cartID string, oParams OrderParams, cartService cart.Service) (Order, error)
+	CartShops(ctx context.Context, cartID string) ([]string, error)
+	Collect(ctx context.Context, orderID, code string) error
 	Delete(ctx context.Context, orderID string) error
 	Get(ctx context.Context, params params.Query) ([]Order, error)
 	GetByID(ctx context.Context, orderID string) (Order, error)
+	GetByShopID(ctx context.Context, shopID string, params params.Query) ([]Order, error)
 	GetByUserID(ctx context.Context, userID string) ([]Order, error)
 	GetCartByID(ctx context.Context, orderID string) (OrderCart, error)
 	GetProductsByID(ctx context.Context, orderID string) ([]OrderProduct, error)
@@ -52,13 +89,20 @@ func (s *service) New(ctx context.Context, id, userID, cartID string,
 		return Order{}, errors.New("ordering zero products is not permitted")
 	}
 
-	// Format delivery date
-	deliveryDate := time.Date(oParams.Date.Year, time.Month(oParams.Date.Month), oParams.Date.Day,
-		oParams.Date.Hour, oParams.Date.Minutes, 0, 0, time.Local)
+	deliveryDate := oParams.Date.Time()
 	if deliveryDate.Before(time.Now()) {
 		return Order{}, errors.New("past dates are not valid")
 	}
 
+	fulfilment := zero.StringFrom(Delivery)
+	var pickupShopID, pickupLocationID, pickupCode zero.String
+	if oParams.Fulfilment == Pickup {
+		fulfilment = zero.StringFrom(Pickup)
+		pickupShopID = zero.StringFrom(oParams.PickupShopID)
+		pickupLocationID = zero.StringFrom(oParams.LocationID)
+		pickupCode = zero.StringFrom(newPickupCode())
+	}
+
 	tx, err := s.db.Beginx()
 	if err != nil {
 		return Order{}, errors.Wrap(err, "starting transaction")
@@ -67,12 +111,12 @@ func (s *service) New(ctx context.Context, id, userID, cartID string,
 
 	orderQ := `INSERT INTO orders
 	(id, user_id, currency, address, city, country, state, zip_code, 
-	status, ordered_at, delivery_date, cart_id)
-	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`
+	status, ordered_at, delivery_date, fulfilment, pickup_shop_id, pickup_location_id, pickup_code, cart_id)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)`
 	_, err = tx.ExecContext(ctx, orderQ, id, userID, oParams.Currency,
 		oParams.Address, oParams.City, oParams.Country, oParams.State, oParams.ZipCode,
 		zero.IntFrom(int64(Pending)), zero.TimeFrom(time.Now()),
-		zero.TimeFrom(deliveryDate), cart.ID)
+		zero.TimeFrom(deliveryDate), fulfilment, pickupShopID, pickupLocationID, pickupCode, cart.ID)
 	if err != nil {
 		return Order{}, errors.Wrap(err, "couldn't create the order")
 	}
@@ -90,17 +134,22 @@ func (s *service) New(ctx context.Context, id, userID, cartID string,
 	}
 
 	order := Order{
-		ID:           zero.StringFrom(id),
-		UserID:       zero.StringFrom(userID),
-		Currency:     zero.StringFrom(oParams.Currency),
-		Address:      zero.StringFrom(oParams.Address),
-		City:         zero.StringFrom(oParams.City),
-		State:        zero.StringFrom(oParams.State),
-		ZipCode:      zero.StringFrom(oParams.ZipCode),
-		Status:       zero.IntFrom(int64(Pending)),
-		OrderedAt:    zero.TimeFrom(time.Now()),
-		DeliveryDate: zero.TimeFrom(deliveryDate),
-		CartID:       zero.StringFrom(cart.ID),
+		ID:               zero.StringFrom(id),
+		UserID:           zero.StringFrom(userID),
+		Currency:         zero.StringFrom(oParams.Currency),
+		Address:          zero.StringFrom(oParams.Address),
+		City:             zero.StringFrom(oParams.City),
+		State:            zero.StringFrom(oParams.State),
+		ZipCode:          zero.StringFrom(oParams.ZipCode),
+		Country:          zero.StringFrom(oParams.Country),
+		Status:           zero.IntFrom(int64(Pending)),
+		OrderedAt:        zero.TimeFrom(time.Now()),
+		DeliveryDate:     zero.TimeFrom(deliveryDate),
+		Fulfilment:       fulfilment,
+		PickupShopID:     pickupShopID,
+		PickupLocationID: pickupLocationID,
+		PickupCode:       pickupCode,
+		CartID:           zero.StringFrom(cart.ID),
 		Cart: OrderCart{
 			OrderID:  zero.StringFrom(id),
 			Counter:  cart.Counter,
@@ -116,6 +165,65 @@ func (s *service) New(ctx context.Context, id, userID, cartID string,
 	return order, nil
 }
 
+// CartShops returns the ids of the shops whose products are in the cart.
+func (s *service) CartShops(ctx context.Context, cartID string) ([]string, error) {
+	s.metrics.incMethodCalls("CartShops")
+
+	var shopIDs []string
+	q := `SELECT DISTINCT p.shop_id FROM cart_products AS cp
+	INNER JOIN products AS p ON p.id = cp.id
+	WHERE cp.cart_id=$1`
+	if err := s.db.SelectContext(ctx, &shopIDs, q, cartID); err != nil {
+		return nil, errors.Wrap(err, "couldn't find the cart shops")
+	}
+
+	return shopIDs, nil
+}
+
+// Collect marks the pickup order as collected if the code matches the one generated for it.
+func (s *service) Collect(ctx context.Context, orderID, code string) error {
+	s.metrics.incMethodCalls("Collect")
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "starting transaction")
+	}
+	defer tx.Rollback()
+
+	var order Order
+	q := "SELECT fulfilment, status, pickup_code FROM orders WHERE id=$1 FOR UPDATE"
+	if err := tx.GetContext(ctx, &order, q, orderID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrOrderNotFound
+		}
+		return errors.Wrap(err, "fetching order")
+	}
+
+	switch {
+	case order.Fulfilment.String != Pickup:
+		return ErrNotPickup
+	case order.Status.Int64 == int64(Collected):
+		return ErrAlreadyCollected
+	case order.Status.Int64 != int64(Paid):
+		return ErrUnpaid
+	case subtle.ConstantTimeCompare([]byte(strings.ToUpper(code)), []byte(order.PickupCode.String)) != 1:
+		s.metrics.pickups.With(prometheus.Labels{"result": "invalid_code"}).Inc()
+		return ErrInvalidPickupCode
+	}
+
+	uQuery := "UPDATE orders SET status=$2, collected_at=$3 WHERE id=$1"
+	if _, err := tx.ExecContext(ctx, uQuery, orderID, Collected, time.Now()); err != nil {
+		return errors.Wrap(err, "couldn't update the order")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "committing transaction")
+	}
+
+	s.metrics.pickups.With(prometheus.Labels{"result": "collected"}).Inc()
+	return nil
+}
+
 // Delete removes an order.
 func (s *service) Delete(ctx context.Context, orderID string) error {
 	s.metrics.incMethodCalls("Delete")
@@ -143,7 +251,7 @@ func (s *service) Get(ctx context.Context, params params.Query) ([]Order, error)
 func (s *service) GetByID(ctx context.Context, orderID string) (Order, error) {
 	s.metrics.incMethodCalls("GetByID")
 
-	q := `SELECT o.*, c.*, p.*
+	q := `SELECT ` + orderColumns + `, ` + cartColumns + `, ` + productColumns + `
 	FROM orders AS o
 	LEFT JOIN order_carts AS c ON o.id=c.order_id
 	LEFT JOIN order_products AS p ON o.id=p.order_id
@@ -154,39 +262,35 @@ func (s *service) GetByID(ctx context.Context, orderID string) (Order, error) {
 	}
 	defer rows.Close()
 
-	var order Order
-	for rows.Next() {
-		c := OrderCart{}
-		p := OrderProduct{}
-		err := rows.Scan(
-			&order.ID, &order.UserID, &order.Currency, &order.Address, &order.City,
-			&order.State, &order.ZipCode, &order.Country, &order.Status, &order.OrderedAt,
-			&order.DeliveryDate, &order.CartID,
-			&c.OrderID, &c.Counter, &c.Weight, &c.Discount, &c.Taxes, &c.Subtotal, &c.Total,
-			&p.ProductID, &p.OrderID, &p.Quantity, &p.Brand, &p.Category, &p.Type, &p.Description,
-			&p.Weight, &p.Discount, &p.Taxes, &p.Subtotal, &p.Total,
-		)
-		if err != nil {
-			return Order{}, errors.Wrap(err, "couldn't scan order")
-		}
-
-		order.Cart = c
-		order.Products = append(order.Products, p)
+	orders, err := scanOrders(rows)
+	if err != nil {
+		return Order{}, err
+	}
+	if len(orders) == 0 {
+		return Order{}, nil
 	}
 
-	return order, nil
+	return orders[0], nil
 }
 
-// GetByUserID retrieves orders depending on the user requested.
-func (s *service) GetByUserID(ctx context.Context, userID string) ([]Order, error) {
-	s.metrics.incMethodCalls("GetByUserID")
+// GetByShopID retrieves the orders containing products of the shop requested,
+// only the shop's products are included and the carts are omitted.
+func (s *service) GetByShopID(ctx context.Context, shopID string, urlParams params.Query) ([]Order, error) {
+	s.metrics.incMethodCalls("GetByShopID")
 
-	q := `SELECT o.*, c.*, p.*
-	FROM orders AS o
-	LEFT JOIN order_carts AS c ON o.id=c.order_id
-	LEFT JOIN order_products AS p ON o.id=p.order_id
-	WHERE o.user_id=$1`
-	rows, err := s.db.QueryContext(ctx, q, userID)
+	query := "SELECT * FROM orders WHERE id IN (SELECT order_id FROM order_products WHERE shop_id=$2)"
+	args := []interface{}{urlParams.Limit, shopID}
+	if urlParams.Cursor.Used {
+		query += " AND (created_at < $3 OR (created_at = $3 AND id < $4))"
+		args = append(args, urlParams.Cursor.CreatedAt, urlParams.Cursor.ID)
+	}
+	query += " ORDER BY created_at DESC, id DESC LIMIT $1"
+
+	q := `SELECT ` + orderColumns + `, ` + productColumns + `
+	FROM (` + query + `) AS o
+	INNER JOIN order_products AS p ON o.id=p.order_id AND p.shop_id=$2
+	ORDER BY o.created_at DESC, o.id DESC`
+	rows, err := s.db.QueryContext(ctx, q, args...)
 	if err != nil {
 		return nil, errors.Wrap(err, "fetching orders")
 	}
@@ -195,21 +299,23 @@ func (s *service) GetByUserID(ctx context.Context, userID string) ([]Order, erro
 	var orders []Order
 	for rows.Next() {
 		o := Order{}
-		c := OrderCart{}
 		p := OrderProduct{}
 		err := rows.Scan(
-			&o.ID, &o.UserID, &o.Currency, &o.Address, &o.City,
-			&o.State, &o.ZipCode, &o.Country, &o.Status, &o.OrderedAt,
-			&o.DeliveryDate, &o.CartID,
-			&c.OrderID, &c.Counter, &c.Weight, &c.Discount, &c.Taxes, &c.Subtotal, &c.Total,
-			&p.ProductID, &p.OrderID, &p.Quantity, &p.Brand, &p.Category, &p.Type,
+			&o.ID, &o.UserID, &o.Currency, &o.Address, &o.City, &o.State, &o.ZipCode, &o.Country,
+			&o.Status, &o.OrderedAt, &o.DeliveryDate, &o.Fulfilment, &o.PickupShopID, &o.PickupLocationID,
+			&o.PickupCode,
+			&o.CollectedAt, &o.CartID, &o.CreatedAt,
+			&p.ProductID, &p.ShopID, &p.OrderID, &p.Quantity, &p.Brand, &p.Category, &p.Type,
 			&p.Description, &p.Weight, &p.Discount, &p.Taxes, &p.Subtotal, &p.Total,
 		)
 		if err != nil {
 			return nil, errors.Wrap(err, "couldn't scan order")
 		}
 
-		o.Cart = c
+		if n := len(orders); n > 0 && orders[n-1].ID == o.ID {
+			orders[n-1].Products = append(orders[n-1].Products, p)
+			continue
+		}
 		o.Products = append(o.Products, p)
 		orders = append(orders, o)
 	}
@@ -217,6 +323,25 @@ func (s *service) GetByUserID(ctx context.Context, userID string) ([]Order, erro
 	return orders, nil
 }
 
+// GetByUserID retrieves orders depending on the user requested.
+func (s *service) GetByUserID(ctx context.Context, userID string) ([]Order, error) {
+	s.metrics.incMethodCalls("GetByUserID")
+
+	q := `SELECT ` + orderColumns + `, ` + cartColumns + `, ` + productColumns + `
+	FROM orders AS o
+	LEFT JOIN order_carts AS c ON o.id=c.order_id
+	LEFT JOIN order_products AS p ON o.id=p.order_id
+	WHERE o.user_id=$1
+	ORDER BY o.created_at DESC, o.id DESC`
+	rows, err := s.db.QueryContext(ctx, q, userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching orders")
+	}
+	defer rows.Close()
+
+	return scanOrders(rows)
+}
+
 // GetCartByID returns the cart with the order id provided.
 func (s *service) GetCartByID(ctx context.Context, orderID string) (OrderCart, error) {
 	s.metrics.incMethodCalls("GetCardByID")
@@ -269,7 +394,7 @@ func (s *service) saveOrderCart(ctx context.Context, tx *sqlx.Tx, id string, car
 
 // saveOrderProducts saves cart products to the database using batch insert.
 func (s *service) saveOrderProducts(ctx context.Context, tx *sqlx.Tx, id string, cartProducts []cart.Product) error {
-	stmt, err := tx.PreparexContext(ctx, "SELECT * FROM products WHERE id=$1")
+	stmt, err := tx.PreparexContext(ctx, "SELECT "+product.Columns+" FROM products AS p WHERE p.id=$1")
 	if err != nil {
 		return errors.Wrap(err, "preparing statement")
 	}
@@ -284,6 +409,7 @@ func (s *service) saveOrderProducts(ctx context.Context, tx *sqlx.Tx, id string,
 
 		orderProducts[i] = OrderProduct{
 			ProductID:   cp.ID,
+			ShopID:      p.ShopID,
 			OrderID:     zero.StringFrom(id),
 			Quantity:    cp.Quantity,
 			Brand:       p.Brand,
@@ -298,10 +424,10 @@ func (s *service) saveOrderProducts(ctx context.Context, tx *sqlx.Tx, id string,
 	}
 
 	q := `INSERT INTO order_products
-	(order_id, product_id, quantity, brand, category, type, description, weight, 
+	(order_id, product_id, shop_id, quantity, brand, category, type, description, weight, 
 	discount, taxes, subtotal, total)
 	VALUES 
-	(:order_id, :product_id, :quantity, :brand, :category, :type, :description, 
+	(:order_id, :product_id, :shop_id, :quantity, :brand, :category, :type, :description, 
 	:weight, :discount, :taxes, :subtotal, :total)`
 	if _, err := tx.NamedExecContext(ctx, q, orderProducts); err != nil {
 		return errors.Wrap(err, "couldn't save order products")
@@ -309,3 +435,46 @@ func (s *service) saveOrderProducts(ctx context.Context, tx *sqlx.Tx, id string,
 
 	return nil
 }
+
+// newPickupCode returns a random code that users show at the shop to collect their orders.
+func newPickupCode() string {
+	b := make([]byte, pickupCodeLength)
+	for i := range b {
+		// Don't handle error as len(pickupCodePool) is always greater than 0
+		n, _ := rand.Int(rand.Reader, big.NewInt(int64(len(pickupCodePool))))
+		b[i] = pickupCodePool[n.Int64()]
+	}
+	return string(b)
+}
+
+// scanOrders scans orders joined with their carts and products, rows of the same order must be contiguous.
+func scanOrders(rows *sql.Rows) ([]Order, error) {
+	var orders []Order
+	for rows.Next() {
+		o := Order{}
+		c := OrderCart{}
+		p := OrderProduct{}
+		err := rows.Scan(
+			&o.ID, &o.UserID, &o.Currency, &o.Address, &o.City, &o.State, &o.ZipCode, &o.Country,
+			&o.Status, &o.OrderedAt, &o.DeliveryDate, &o.Fulfilment, &o.PickupShopID, &o.PickupLocationID,
+			&o.PickupCode,
+			&o.CollectedAt, &o.CartID, &o.CreatedAt,
+			&c.OrderID, &c.Counter, &c.Weight, &c.Discount, &c.Taxes, &c.Subtotal, &c.Total,
+			&p.ProductID, &p.ShopID, &p.OrderID, &p.Quantity, &p.Brand, &p.Category, &p.Type,
+			&p.Description, &p.Weight, &p.Discount, &p.Taxes, &p.Subtotal, &p.Total,
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "couldn't scan order")
+		}
+
+		if n := len(orders); n > 0 && orders[n-1].ID == o.ID {
+			orders[n-1].Products = append(orders[n-1].Products, p)
+			continue
+		}
+		o.Cart = c
+		o.Products = append(o.Products, p)
+		orders = append(orders, o)
+	}
+
+	return orders, nil
+}
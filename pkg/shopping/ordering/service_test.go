@@ -2,7 +2,9 @@ package ordering_test
 
 import (
 	"context"
+	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/GGP1/adak/internal/logger"
 	"github.com/GGP1/adak/internal/params"
@@ -54,6 +56,15 @@ func TestOrderingService(t *testing.T) {
 	t.Run("Get products by ID", getProductsByID(ctx, s))
 	t.Run("Update status", updateStatus(ctx, s))
 	t.Run("Delete", delete(ctx, s))
+	t.Run("Collect", collect(ctx, s, cartService))
+}
+
+func TestDateTime(t *testing.T) {
+	d := ordering.Date{Year: 2150, Month: 8, Day: 14, Hour: 1, Timezone: "America/Argentina/Buenos_Aires"}
+	assert.Equal(t, time.Date(2150, 8, 14, 4, 0, 0, 0, time.UTC), d.Time().UTC())
+
+	d.Timezone = ""
+	assert.Equal(t, time.Date(2150, 8, 14, 1, 0, 0, 0, time.UTC), d.Time())
 }
 
 func new(ctx context.Context, s ordering.Service, cartService cart.Service) func(*testing.T) {
@@ -139,3 +150,32 @@ func updateStatus(ctx context.Context, s ordering.Service) func(*testing.T) {
 		assert.Equal(t, int64(status), order.Status.Int64)
 	}
 }
+
+func collect(ctx context.Context, s ordering.Service, cartService cart.Service) func(*testing.T) {
+	return func(t *testing.T) {
+		params := ordering.OrderParams{
+			Fulfilment: ordering.Pickup,
+			Date:       ordering.Date{Year: 2150, Month: 8, Day: 14, Hour: 1},
+		}
+		pickupID := "28"
+		order, err := s.New(ctx, pickupID, userID, cartID, params, cartService)
+		assert.NoError(t, err)
+		assert.Len(t, order.PickupCode.String, 6)
+
+		encoded, err := json.Marshal(order)
+		assert.NoError(t, err)
+		assert.NotContains(t, string(encoded), order.PickupCode.String, "The pickup code must be shown only in the QR code")
+
+		assert.ErrorIs(t, s.Collect(ctx, pickupID, order.PickupCode.String), ordering.ErrUnpaid)
+		assert.NoError(t, s.UpdateStatus(ctx, pickupID, ordering.Paid))
+
+		assert.ErrorIs(t, s.Collect(ctx, pickupID, "AAAAAA"), ordering.ErrInvalidPickupCode)
+		assert.NoError(t, s.Collect(ctx, pickupID, order.PickupCode.String))
+		assert.ErrorIs(t, s.Collect(ctx, pickupID, order.PickupCode.String), ordering.ErrAlreadyCollected)
+
+		collected, err := s.GetByID(ctx, pickupID)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(ordering.Collected), collected.Status.Int64)
+		assert.True(t, collected.CollectedAt.Valid)
+	}
+}
@@ -1,66 +1,131 @@
 package account
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/GGP1/adak/internal/cookie"
+	"github.com/GGP1/adak/internal/config"
 	"github.com/GGP1/adak/internal/email"
-	"github.com/GGP1/adak/internal/params"
+	"github.com/GGP1/adak/internal/identity"
+	"github.com/GGP1/adak/internal/logger"
+	"github.com/GGP1/adak/internal/password"
 	"github.com/GGP1/adak/internal/response"
-	"github.com/GGP1/adak/pkg/user"
-	"github.com/google/uuid"
+	"github.com/GGP1/adak/internal/sanitize"
+	"github.com/GGP1/adak/internal/token"
+	"github.com/GGP1/adak/internal/validate"
+	"github.com/GGP1/adak/pkg/auth"
+	"github.com/GGP1/adak/pkg/tracking"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/go-redis/redis/v8"
+	"github.com/go-redis/redis_rate/v9"
 	"github.com/pkg/errors"
 )
 
+// emailTimeout is the time given to the background tasks that email the tokens.
+const emailTimeout = 30 * time.Second
+
 // Handler handles account endpoints.
 type Handler struct {
 	accountService Service
-	userService    user.Service
 	emailer        email.Emailer
+	limiter        *redis_rate.Limiter
+	resetLimit     int
+	verifyLimit    int
 }
 
 type changeEmail struct {
-	Email string `json:"email"`
+	Email string `json:"email" validate:"required,email"`
+}
+
+type forgotPassword struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type resetPassword struct {
+	Password string `json:"password" validate:"required"`
+}
+
+type resendVerification struct {
+	Email string `json:"email" validate:"required,email"`
 }
 
 // NewHandler returns a new account handler.
-func NewHandler(accountS Service, userS user.Service, emailer email.Emailer) Handler {
+func NewHandler(accountS Service, emailer email.Emailer, rdb *redis.Client, reset config.PasswordReset, verification config.Verification) Handler {
 	return Handler{
 		accountService: accountS,
-		userService:    userS,
 		emailer:        emailer,
+		limiter:        redis_rate.NewLimiter(rdb),
+		resetLimit:     reset.Limit,
+		verifyLimit:    verification.Limit,
 	}
 }
 
-// ChangeEmail changes the user email to the specified one.
-func (h *Handler) ChangeEmail() http.HandlerFunc {
+// ChangeEmail confirms the email change with the token sent to the new address and logs
+// the user out of all their sessions. The old address is notified with a link to revert it.
+func (h *Handler) ChangeEmail(session auth.Session) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
-		token := chi.URLParam(r, "token")
-		email := chi.URLParam(r, "email")
 
-		id, err := params.URLID(ctx)
+		change, err := h.accountService.ChangeEmail(ctx, chi.URLParam(r, "token"))
 		if err != nil {
-			response.Error(w, http.StatusBadRequest, err)
+			if errors.Is(err, ErrInvalidEmailToken) || errors.Is(err, ErrEmailTaken) {
+				response.Error(w, http.StatusBadRequest, err)
+				return
+			}
+			response.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		// The email already changed, a failure must not look like the change did not happen
+		go func() {
+			if err := h.emailer.SendEmailChanged(change.Username, change.OldEmail, change.NewEmail, change.Token); err != nil {
+				logger.Errorf("couldn't send the email changed notification: %v", err)
+			}
+		}()
+
+		if err := session.LogoutAll(ctx, change.UserID); err != nil {
+			response.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		response.JSONText(w, http.StatusOK, fmt.Sprintf("email changed to %q, please log in again", change.NewEmail))
+	}
+}
+
+// RevertEmailChange restores the email with the token sent to the old address and logs the
+// user out of all their sessions, in case the change was made by someone else.
+func (h *Handler) RevertEmailChange(session auth.Session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		change, err := h.accountService.RevertEmailChange(ctx, chi.URLParam(r, "token"))
+		if err != nil {
+			if errors.Is(err, ErrInvalidEmailToken) || errors.Is(err, ErrEmailTaken) {
+				response.Error(w, http.StatusBadRequest, err)
+				return
+			}
+			response.Error(w, http.StatusInternalServerError, err)
 			return
 		}
 
-		if err := h.accountService.ChangeEmail(ctx, id, email, token); err != nil {
+		if err := session.LogoutAll(ctx, change.UserID); err != nil {
 			response.Error(w, http.StatusInternalServerError, err)
 			return
 		}
 
-		response.JSONText(w, http.StatusOK, fmt.Sprintf("email changed to %q", email))
+		response.JSONText(w, http.StatusOK, fmt.Sprintf("email restored to %q, if you didn't change it please reset your password", change.OldEmail))
 	}
 }
 
 type changePassword struct {
 	OldPassword string `json:"old_password" validate:"required"`
-	NewPassword string `json:"new_password" validate:"email,required"`
+	NewPassword string `json:"new_password" validate:"required"`
 }
 
 // ChangePassword updates the user password.
@@ -69,7 +134,7 @@ func (h *Handler) ChangePassword() http.HandlerFunc {
 		var changePass changePassword
 		ctx := r.Context()
 
-		userID, err := cookie.GetValue(r, "UID")
+		userID, err := identity.UserID(r)
 		if err != nil {
 			response.Error(w, http.StatusForbidden, err)
 			return
@@ -81,7 +146,17 @@ func (h *Handler) ChangePassword() http.HandlerFunc {
 		}
 		defer r.Body.Close()
 
+		if err := validate.Struct(ctx, changePass); err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
 		if err := h.accountService.ChangePassword(ctx, userID, changePass.OldPassword, changePass.NewPassword); err != nil {
+			var policyErr *password.PolicyError
+			if errors.Is(err, ErrInvalidPassword) || errors.As(err, &policyErr) {
+				response.Error(w, http.StatusBadRequest, err)
+				return
+			}
 			response.Error(w, http.StatusInternalServerError, err)
 			return
 		}
@@ -90,64 +165,234 @@ func (h *Handler) ChangePassword() http.HandlerFunc {
 	}
 }
 
-// SendChangeConfirmation takes the new email and sends an email confirmation.
-func (h *Handler) SendChangeConfirmation() http.HandlerFunc {
+// ForgotPassword emails a link to reset the password to the account registered with the email.
+//
+// The response is the same whether the account exists or not and the email is sent in
+// the background so the response time doesn't reveal it either.
+func (h *Handler) ForgotPassword() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var new changeEmail
+		var forgot forgotPassword
 		ctx := r.Context()
 
-		if err := json.NewDecoder(r.Body).Decode(&new); err != nil {
+		if err := json.NewDecoder(r.Body).Decode(&forgot); err != nil {
 			response.Error(w, http.StatusBadRequest, err)
 			return
 		}
 		defer r.Body.Close()
 
-		if _, err := h.userService.GetByEmail(ctx, new.Email); err == nil {
-			response.Error(w, http.StatusBadRequest, errors.New("email is already taken"))
+		if err := validate.Struct(ctx, forgot); err != nil {
+			response.Error(w, http.StatusBadRequest, err)
 			return
 		}
 
-		userID, err := cookie.GetValue(r, "UID")
-		if err != nil {
-			response.Error(w, http.StatusForbidden, err)
+		keys := []string{"password_reset:email:" + token.Hash(strings.ToLower(forgot.Email))}
+		if ip := tracking.GetUserIP(r); ip != "" {
+			keys = append(keys, "password_reset:ip:"+ip)
+		}
+		for _, key := range keys {
+			if err := h.allow(ctx, w, key, h.resetLimit, "password reset"); err != nil {
+				response.Error(w, http.StatusTooManyRequests, err)
+				return
+			}
+		}
+
+		go h.sendPasswordReset(forgot.Email)
+
+		response.JSONText(w, http.StatusOK, "if the email is registered, a link to reset the password will be sent to it")
+	}
+}
+
+// ResendVerification emails a new link to verify the email to the account registered with it.
+//
+// Like ForgotPassword, the response doesn't reveal whether the account exists or is verified.
+func (h *Handler) ResendVerification() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var resend resendVerification
+		ctx := r.Context()
+
+		if err := json.NewDecoder(r.Body).Decode(&resend); err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+		defer r.Body.Close()
+
+		if err := validate.Struct(ctx, resend); err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+		email := sanitize.Normalize(resend.Email)
+
+		keys := []string{"verification:email:" + token.Hash(strings.ToLower(email))}
+		if ip := tracking.GetUserIP(r); ip != "" {
+			keys = append(keys, "verification:ip:"+ip)
+		}
+		for _, key := range keys {
+			if err := h.allow(ctx, w, key, h.verifyLimit, "verification"); err != nil {
+				response.Error(w, http.StatusTooManyRequests, err)
+				return
+			}
+		}
+
+		go h.sendVerification(email)
+
+		response.JSONText(w, http.StatusOK, "if the email is registered and not verified yet, a link to verify it will be sent to it")
+	}
+}
+
+// ResetPassword sets a new password using the token received by email and logs the user
+// out of all their sessions.
+func (h *Handler) ResetPassword(session auth.Session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var reset resetPassword
+		ctx := r.Context()
+
+		if err := json.NewDecoder(r.Body).Decode(&reset); err != nil {
+			response.Error(w, http.StatusBadRequest, err)
 			return
 		}
+		defer r.Body.Close()
 
-		user, err := h.userService.GetByID(ctx, userID)
+		if err := validate.Struct(ctx, reset); err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		userID, err := h.accountService.ResetPassword(ctx, chi.URLParam(r, "token"), reset.Password)
 		if err != nil {
-			response.Error(w, http.StatusNotFound, err)
+			var policyErr *password.PolicyError
+			if errors.Is(err, ErrInvalidResetToken) || errors.As(err, &policyErr) {
+				response.Error(w, http.StatusBadRequest, err)
+				return
+			}
+			response.Error(w, http.StatusInternalServerError, err)
 			return
 		}
 
-		token := uuid.NewString()
-		if err := h.emailer.SendChangeConfirmation(user.ID, user.Username, user.Email, token, new.Email); err != nil {
+		if err := session.LogoutAll(ctx, userID); err != nil {
 			response.Error(w, http.StatusInternalServerError, err)
 			return
 		}
 
-		response.JSONText(w, http.StatusOK, "verification email sent")
+		response.JSONText(w, http.StatusOK, "password reset, please log in again")
 	}
 }
 
-// SendEmailValidation saves the user email into the validated list.
-// Once in the validated list, the user is able to log in.
-func (h *Handler) SendEmailValidation(u user.Service) http.HandlerFunc {
+// SendChangeConfirmation emails the link to confirm the email change to the new address.
+func (h *Handler) SendChangeConfirmation() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		email := chi.URLParam(r, "email")
-		token := chi.URLParam(r, "token")
+		var new changeEmail
 		ctx := r.Context()
 
-		usr, err := u.GetByEmail(ctx, email)
+		if err := json.NewDecoder(r.Body).Decode(&new); err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+		defer r.Body.Close()
+
+		if err := validate.Struct(ctx, new); err != nil {
+			response.Error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		userID, err := identity.UserID(r)
 		if err != nil {
-			response.Error(w, http.StatusNotFound, err)
+			response.Error(w, http.StatusForbidden, err)
 			return
 		}
 
-		if err := h.accountService.ValidateUserEmail(ctx, usr.ID, token, true); err != nil {
+		change, err := h.accountService.RequestEmailChange(ctx, userID, new.Email)
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrEmailTaken), errors.Is(err, ErrAccountTooNew):
+				response.Error(w, http.StatusBadRequest, err)
+			case errors.Is(err, ErrUserNotFound):
+				response.Error(w, http.StatusNotFound, err)
+			default:
+				response.Error(w, http.StatusInternalServerError, err)
+			}
+			return
+		}
+
+		if err := h.emailer.SendChangeConfirmation(change.Username, change.NewEmail, change.Token); err != nil {
 			response.Error(w, http.StatusInternalServerError, err)
 			return
 		}
 
-		response.JSONText(w, http.StatusOK, fmt.Sprintf("validated %q", email))
+		response.JSONText(w, http.StatusOK, "a link to confirm the change was sent to the new email")
+	}
+}
+
+// VerifyEmail marks the user's email as verified with the token sent to it, once verified
+// the user is able to log in.
+func (h *Handler) VerifyEmail() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, err := h.accountService.VerifyEmail(r.Context(), chi.URLParam(r, "token")); err != nil {
+			if errors.Is(err, ErrInvalidVerificationToken) {
+				response.Error(w, http.StatusBadRequest, err)
+				return
+			}
+			response.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		response.JSONText(w, http.StatusOK, "email verified, you can log in now")
+	}
+}
+
+// allow returns an error if the key exceeded the limit of requests per hour, action names
+// the requests in the error message.
+func (h *Handler) allow(ctx context.Context, w http.ResponseWriter, key string, limit int, action string) error {
+	if limit <= 0 {
+		return nil
+	}
+
+	res, err := h.limiter.Allow(ctx, key, redis_rate.PerHour(limit))
+	if err != nil {
+		return errors.Wrap(err, "rate limiting")
+	}
+
+	if res.Allowed == 0 {
+		w.Header().Add("Retry-After", strconv.Itoa(int(res.RetryAfter/time.Second)))
+		return errors.Errorf("too many %s requests, please try again later", action)
+	}
+
+	return nil
+}
+
+// sendPasswordReset creates a reset token and emails it if there is an account
+// registered with the email.
+func (h *Handler) sendPasswordReset(email string) {
+	ctx, cancel := context.WithTimeout(context.Background(), emailTimeout)
+	defer cancel()
+
+	tkn, username, err := h.accountService.RequestPasswordReset(ctx, email)
+	if err != nil {
+		if !errors.Is(err, ErrUserNotFound) {
+			logger.Errorf("couldn't create the password reset token: %v", err)
+		}
+		return
+	}
+
+	if err := h.emailer.SendPasswordReset(username, email, tkn); err != nil {
+		logger.Errorf("couldn't send the password reset email: %v", err)
+	}
+}
+
+// sendVerification creates a verification token and emails it if there is an unverified
+// account registered with the email.
+func (h *Handler) sendVerification(email string) {
+	ctx, cancel := context.WithTimeout(context.Background(), emailTimeout)
+	defer cancel()
+
+	tkn, username, err := h.accountService.RequestVerification(ctx, email)
+	if err != nil {
+		if !errors.Is(err, ErrUserNotFound) && !errors.Is(err, ErrAlreadyVerified) {
+			logger.Errorf("couldn't create the verification token: %v", err)
+		}
+		return
+	}
+
+	if err := h.emailer.SendValidation(ctx, username, email, tkn); err != nil {
+		logger.Errorf("couldn't send the verification email: %v", err)
 	}
 }
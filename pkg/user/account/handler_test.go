@@ -0,0 +1,95 @@
+package account_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/GGP1/adak/internal/config"
+	"github.com/GGP1/adak/internal/email"
+	"github.com/GGP1/adak/internal/logger"
+	"github.com/GGP1/adak/internal/test"
+	"github.com/GGP1/adak/pkg/auth"
+	"github.com/GGP1/adak/pkg/user/account"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+type resetService struct {
+	account.Service
+}
+
+func (resetService) RequestPasswordReset(ctx context.Context, email string) (string, string, error) {
+	return "", "", account.ErrUserNotFound
+}
+
+func (resetService) ResetPassword(ctx context.Context, token, password string) (string, error) {
+	if token != "valid" {
+		return "", account.ErrInvalidResetToken
+	}
+	return "reset", nil
+}
+
+type logoutSession struct {
+	auth.Session
+	loggedOut []string
+}
+
+func (s *logoutSession) LogoutAll(ctx context.Context, userID string) error {
+	s.loggedOut = append(s.loggedOut, userID)
+	return nil
+}
+
+func TestForgotPassword(t *testing.T) {
+	logger.Disable()
+	rdb := test.StartRedis(t)
+	handler := account.NewHandler(resetService{}, email.Emailer{}, rdb,
+		config.PasswordReset{Limit: 2}, config.Verification{})
+
+	forgot := func(email, ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"email": "`+email+`"}`))
+		req.RemoteAddr = ip + ":1234"
+		rec := httptest.NewRecorder()
+		handler.ForgotPassword().ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("Email limit", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, forgot("limit@test.com", "10.0.4.1").Code)
+		assert.Equal(t, http.StatusOK, forgot("LIMIT@test.com", "10.0.4.2").Code)
+
+		rec := forgot("limit@test.com", "10.0.4.3")
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code, "Emails must be limited case-insensitively")
+		assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+	})
+
+	t.Run("IP limit", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, forgot("first@test.com", "10.0.4.10").Code)
+		assert.Equal(t, http.StatusOK, forgot("second@test.com", "10.0.4.10").Code)
+		assert.Equal(t, http.StatusTooManyRequests, forgot("third@test.com", "10.0.4.10").Code)
+	})
+}
+
+func TestResetPassword(t *testing.T) {
+	logger.Disable()
+	session := &logoutSession{}
+	handler := account.NewHandler(resetService{}, email.Emailer{}, nil, config.PasswordReset{}, config.Verification{})
+	mux := chi.NewRouter()
+	mux.Post("/reset/{token}", handler.ResetPassword(session))
+
+	reset := func(token string) int {
+		req := httptest.NewRequest(http.MethodPost, "/reset/"+token, strings.NewReader(`{"password": "Plum-Velvet-Quarry-92"}`))
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusBadRequest, reset("wrong"))
+	assert.Empty(t, session.loggedOut)
+
+	assert.Equal(t, http.StatusOK, reset("valid"))
+	assert.Equal(t, []string{"reset"}, session.loggedOut, "Resetting the password must revoke all the sessions")
+}
@@ -2,53 +2,141 @@ package account
 
 import (
 	"context"
+	"database/sql"
 	"time"
 
+	"github.com/GGP1/adak/internal/config"
 	"github.com/GGP1/adak/internal/logger"
+	"github.com/GGP1/adak/internal/password"
+	"github.com/GGP1/adak/internal/token"
 	"github.com/GGP1/adak/pkg/user"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
-	"golang.org/x/crypto/bcrypt"
+)
+
+// minEmailChangeAge is the age accounts must have to change their email.
+const minEmailChangeAge = 72 * time.Hour
+
+var (
+	// ErrAlreadyVerified is returned when requesting a verification token for an account that is already verified.
+	ErrAlreadyVerified = errors.New("email already verified")
+	// ErrAccountTooNew is returned when the account isn't old enough to change its email.
+	ErrAccountTooNew = errors.New("accounts must be 3 days old to change email")
+	// ErrEmailTaken is returned when the new email is registered to another account.
+	ErrEmailTaken = errors.New("email is already taken")
+	// ErrInvalidEmailToken is returned when the email change token doesn't exist, expired or was already used.
+	ErrInvalidEmailToken = errors.New("invalid or expired email change token")
+	// ErrInvalidPassword is returned when the current password sent to change it is wrong.
+	ErrInvalidPassword = errors.New("invalid old password")
+	// ErrInvalidResetToken is returned when the reset token doesn't exist, expired or was already used.
+	ErrInvalidResetToken = errors.New("invalid or expired reset token")
+	// ErrInvalidVerificationToken is returned when the verification token doesn't exist, expired or was already used.
+	ErrInvalidVerificationToken = errors.New("invalid or expired verification token")
+	// ErrUserNotFound is returned when there is no account registered with the email.
+	ErrUserNotFound = errors.New("user not found")
 )
 
 // Service provides user account operations.
 type Service interface {
-	ChangeEmail(ctx context.Context, id, newEmail, token string) error
+	ChangeEmail(ctx context.Context, token string) (EmailChange, error)
 	ChangePassword(ctx context.Context, id, oldPass, newPass string) error
-	ValidateUserEmail(ctx context.Context, id, confirmationCode string, verified bool) error
+	RequestEmailChange(ctx context.Context, id, newEmail string) (EmailChange, error)
+	RequestPasswordReset(ctx context.Context, email string) (string, string, error)
+	ResetPassword(ctx context.Context, token, password string) (string, error)
+	RequestVerification(ctx context.Context, email string) (string, string, error)
+	RevertEmailChange(ctx context.Context, token string) (EmailChange, error)
+	VerifyEmail(ctx context.Context, token string) (string, error)
+}
+
+// EmailChange contains the information about a change of a user's email and the token
+// that must be sent to confirm it or revert it.
+type EmailChange struct {
+	UserID   string
+	Username string
+	OldEmail string
+	NewEmail string
+	Token    string
 }
 
 type service struct {
-	db      *sqlx.DB
-	metrics metrics
+	db           *sqlx.DB
+	emailChange  config.EmailChange
+	reset        config.PasswordReset
+	verification config.Verification
+	metrics      metrics
 }
 
 // NewService creates an account service.
-func NewService(db *sqlx.DB) Service {
-	return &service{db, initMetrics()}
+func NewService(db *sqlx.DB, reset config.PasswordReset, emailChange config.EmailChange, verification config.Verification) Service {
+	return &service{
+		db:           db,
+		emailChange:  emailChange,
+		reset:        reset,
+		verification: verification,
+		metrics:      initMetrics(),
+	}
 }
 
-// Change changes the user email.
-func (s *service) ChangeEmail(ctx context.Context, id, newEmail, token string) error {
+// ChangeEmail consumes the confirmation token sent to the new address and changes the
+// email. It returns the change with the token that lets the owner of the old address revert it.
+func (s *service) ChangeEmail(ctx context.Context, tkn string) (EmailChange, error) {
 	s.metrics.incMethodCalls("ChangeEmail")
 
-	var user user.User
-	if err := s.db.SelectContext(ctx, &user, "SELECT * FROM users WHERE id=?", id); err != nil {
-		return errors.Wrap(err, "invalid email")
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return EmailChange{}, errors.Wrap(err, "starting transaction")
 	}
+	defer tx.Rollback()
 
-	if user.CreatedAt.Add(72*time.Hour).Sub(time.Now()) < 0 {
-		return errors.New("accounts must be 3 days old to change email")
+	var change EmailChange
+	q := `DELETE FROM email_changes WHERE token_hash=$1 AND kind='confirm' AND expires_at > NOW()
+	RETURNING user_id, old_email, new_email`
+	row := tx.QueryRowContext(ctx, q, token.Hash(tkn))
+	if err := row.Scan(&change.UserID, &change.OldEmail, &change.NewEmail); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return EmailChange{}, ErrInvalidEmailToken
+		}
+		return EmailChange{}, errors.Wrap(err, "fetching email change token")
 	}
 
-	_, err := s.db.ExecContext(ctx, "UPDATE users set email=$2 WHERE id=$1", id, newEmail)
-	if err != nil {
+	// The email could have been registered by someone else since the change was requested
+	if err := emailAvailable(ctx, tx, change.NewEmail); err != nil {
+		return EmailChange{}, err
+	}
+
+	// The email could also have changed meanwhile, the token belongs to the old one
+	q = "UPDATE users SET email=$3, verified_email=true WHERE id=$1 AND email=$2 RETURNING username"
+	if err := tx.GetContext(ctx, &change.Username, q, change.UserID, change.OldEmail, change.NewEmail); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return EmailChange{}, ErrInvalidEmailToken
+		}
+		if uniqueViolation(err) {
+			return EmailChange{}, ErrEmailTaken
+		}
 		logger.Errorf("failed updating the user's email: %v", err)
-		return errors.Wrap(err, "couldn't change the email")
+		return EmailChange{}, errors.Wrap(err, "couldn't change the email")
 	}
 
-	return nil
+	if _, err := tx.ExecContext(ctx, "DELETE FROM email_changes WHERE user_id=$1 AND kind='confirm'", change.UserID); err != nil {
+		return EmailChange{}, errors.Wrap(err, "deleting email change tokens")
+	}
+
+	change.Token = token.RandString(40)
+	q = `INSERT INTO email_changes (token_hash, user_id, kind, old_email, new_email, expires_at)
+	VALUES ($1, $2, 'revert', $3, $4, $5)`
+	_, err = tx.ExecContext(ctx, q, token.Hash(change.Token), change.UserID,
+		change.OldEmail, change.NewEmail, time.Now().Add(s.emailChange.RevertExpiration))
+	if err != nil {
+		return EmailChange{}, errors.Wrap(err, "couldn't create the revert token")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return EmailChange{}, errors.Wrap(err, "committing transaction")
+	}
+
+	return change, nil
 }
 
 // ChangePassword changes the user password.
@@ -56,7 +144,8 @@ func (s *service) ChangePassword(ctx context.Context, id, oldPass, newPass strin
 	s.metrics.incMethodCalls("ChangePassword")
 
 	var user user.User
-	if err := s.db.GetContext(ctx, &user, "SELECT password, created_at FROM users WHERE id=$1", id); err != nil {
+	q := "SELECT id, username, email, password, created_at FROM users WHERE id=$1"
+	if err := s.db.GetContext(ctx, &user, q, id); err != nil {
 		return errors.Wrap(err, "invalid email")
 	}
 
@@ -64,16 +153,23 @@ func (s *service) ChangePassword(ctx context.Context, id, oldPass, newPass strin
 		return errors.New("accounts must be 3 days old to change password")
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(oldPass)); err != nil {
-		return errors.Wrap(err, "invalid old password")
+	if _, err := password.Verify(user.Password, oldPass); err != nil {
+		if errors.Is(err, password.ErrMismatch) {
+			return ErrInvalidPassword
+		}
+		return err
+	}
+
+	if err := password.Validate(newPass, user.Email, user.Username); err != nil {
+		return err
 	}
 
-	newPassHash, err := bcrypt.GenerateFromPassword([]byte(newPass), bcrypt.DefaultCost)
+	newPassHash, err := password.Hash(newPass)
 	if err != nil {
 		logger.Errorf("failed generating user's password hash: %v", err)
 		return errors.Wrap(err, "couldn't generate the password hash")
 	}
-	user.Password = string(newPassHash)
+	user.Password = newPassHash
 
 	_, err = s.db.ExecContext(ctx, "UPDATE users SET password=$2 WHERE id=$1", user.ID, user.Password)
 	if err != nil {
@@ -84,16 +180,317 @@ func (s *service) ChangePassword(ctx context.Context, id, oldPass, newPass strin
 	return nil
 }
 
-// ValidateUserEmail sets the time when the user validated its email and the token he received.
-func (s *service) ValidateUserEmail(ctx context.Context, id, confirmationCode string, verified bool) error {
-	s.metrics.incMethodCalls("ValidateUserEmail")
+// RequestEmailChange creates the token that must be sent to the new address to confirm the
+// change. Requesting a new change invalidates the previous ones.
+func (s *service) RequestEmailChange(ctx context.Context, id, newEmail string) (EmailChange, error) {
+	s.metrics.incMethodCalls("RequestEmailChange")
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return EmailChange{}, errors.Wrap(err, "starting transaction")
+	}
+	defer tx.Rollback()
+
+	var user user.User
+	if err := tx.GetContext(ctx, &user, "SELECT id, username, email, created_at FROM users WHERE id=$1", id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return EmailChange{}, ErrUserNotFound
+		}
+		return EmailChange{}, errors.Wrap(err, "fetching user")
+	}
+
+	if time.Since(user.CreatedAt) < minEmailChangeAge {
+		return EmailChange{}, ErrAccountTooNew
+	}
+
+	if err := emailAvailable(ctx, tx, newEmail); err != nil {
+		return EmailChange{}, err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM email_changes WHERE user_id=$1 AND kind='confirm'", id); err != nil {
+		return EmailChange{}, errors.Wrap(err, "deleting previous email change tokens")
+	}
+
+	change := EmailChange{
+		UserID:   user.ID,
+		Username: user.Username,
+		OldEmail: user.Email,
+		NewEmail: newEmail,
+		Token:    token.RandString(40),
+	}
+	q := `INSERT INTO email_changes (token_hash, user_id, kind, old_email, new_email, expires_at)
+	VALUES ($1, $2, 'confirm', $3, $4, $5)`
+	_, err = tx.ExecContext(ctx, q, token.Hash(change.Token), change.UserID,
+		change.OldEmail, change.NewEmail, time.Now().Add(s.emailChange.Expiration))
+	if err != nil {
+		return EmailChange{}, errors.Wrap(err, "couldn't create the email change token")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return EmailChange{}, errors.Wrap(err, "committing transaction")
+	}
+
+	return change, nil
+}
+
+// RequestPasswordReset creates a single-use reset token for the account registered with
+// the email, it returns the token that must be sent to the user and their username.
+//
+// Requesting a new token invalidates the previous ones.
+func (s *service) RequestPasswordReset(ctx context.Context, email string) (string, string, error) {
+	s.metrics.incMethodCalls("RequestPasswordReset")
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return "", "", errors.Wrap(err, "starting transaction")
+	}
+	defer tx.Rollback()
+
+	var user user.User
+	if err := tx.GetContext(ctx, &user, "SELECT id, username FROM users WHERE lower(email)=lower($1)", email); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", "", ErrUserNotFound
+		}
+		return "", "", errors.Wrap(err, "fetching user")
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM password_resets WHERE user_id=$1", user.ID); err != nil {
+		return "", "", errors.Wrap(err, "deleting previous reset tokens")
+	}
+
+	tkn := token.RandString(40)
+	q := "INSERT INTO password_resets (token_hash, user_id, expires_at) VALUES ($1, $2, $3)"
+	_, err = tx.ExecContext(ctx, q, token.Hash(tkn), user.ID, time.Now().Add(s.reset.Expiration))
+	if err != nil {
+		return "", "", errors.Wrap(err, "couldn't create the reset token")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", "", errors.Wrap(err, "committing transaction")
+	}
+
+	return tkn, user.Username, nil
+}
+
+// RequestVerification creates a single-use token to verify the email of the account registered
+// with it, it returns the token that must be sent to the user and their username.
+//
+// Requesting a new token invalidates the previous ones.
+func (s *service) RequestVerification(ctx context.Context, email string) (string, string, error) {
+	s.metrics.incMethodCalls("RequestVerification")
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return "", "", errors.Wrap(err, "starting transaction")
+	}
+	defer tx.Rollback()
+
+	var user user.User
+	q := "SELECT id, username, verified_email FROM users WHERE lower(email)=lower($1)"
+	if err := tx.GetContext(ctx, &user, q, email); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", "", ErrUserNotFound
+		}
+		return "", "", errors.Wrap(err, "fetching user")
+	}
+
+	if user.VerifiedEmail {
+		return "", "", ErrAlreadyVerified
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM email_verifications WHERE user_id=$1", user.ID); err != nil {
+		return "", "", errors.Wrap(err, "deleting previous verification tokens")
+	}
+
+	tkn := token.RandString(40)
+	q = "INSERT INTO email_verifications (token_hash, user_id, expires_at) VALUES ($1, $2, $3)"
+	_, err = tx.ExecContext(ctx, q, token.Hash(tkn), user.ID, time.Now().Add(s.verification.Expiration))
+	if err != nil {
+		return "", "", errors.Wrap(err, "couldn't create the verification token")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", "", errors.Wrap(err, "committing transaction")
+	}
+
+	return tkn, user.Username, nil
+}
+
+// ResetPassword consumes the reset token and sets the new password, it returns the id of the user.
+func (s *service) ResetPassword(ctx context.Context, tkn, newPass string) (string, error) {
+	s.metrics.incMethodCalls("ResetPassword")
 
-	q := "UPDATE users SET verified_email=$2, confirmation_code=$3 WHERE id=$1"
-	_, err := s.db.ExecContext(ctx, q, id, verified, confirmationCode)
+	tx, err := s.db.BeginTxx(ctx, nil)
 	if err != nil {
-		logger.Errorf("failed validating the user: %v", err)
-		return errors.Wrap(err, "couldn't validate the user")
+		return "", errors.Wrap(err, "starting transaction")
 	}
+	defer tx.Rollback()
 
+	var userID string
+	q := "DELETE FROM password_resets WHERE token_hash=$1 AND expires_at > NOW() RETURNING user_id"
+	if err := tx.GetContext(ctx, &userID, q, token.Hash(tkn)); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrInvalidResetToken
+		}
+		return "", errors.Wrap(err, "fetching reset token")
+	}
+
+	var user user.User
+	if err := tx.GetContext(ctx, &user, "SELECT username, email FROM users WHERE id=$1", userID); err != nil {
+		return "", errors.Wrap(err, "fetching user")
+	}
+
+	// The transaction is rolled back so the token can be used again with a valid password
+	if err := password.Validate(newPass, user.Email, user.Username); err != nil {
+		return "", err
+	}
+
+	hash, err := password.Hash(newPass)
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't generate the password hash")
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET password=$2 WHERE id=$1", userID, hash); err != nil {
+		return "", errors.Wrap(err, "couldn't reset the password")
+	}
+
+	// Drop the expired tokens left behind
+	if _, err := tx.ExecContext(ctx, "DELETE FROM password_resets WHERE user_id=$1", userID); err != nil {
+		return "", errors.Wrap(err, "deleting reset tokens")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", errors.Wrap(err, "committing transaction")
+	}
+
+	return userID, nil
+}
+
+// RevertEmailChange consumes the token sent to the old address and restores it. The
+// pending changes and the ones made afterwards are discarded, whoever made them mustn't
+// be able to undo the revert.
+func (s *service) RevertEmailChange(ctx context.Context, tkn string) (EmailChange, error) {
+	s.metrics.incMethodCalls("RevertEmailChange")
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return EmailChange{}, errors.Wrap(err, "starting transaction")
+	}
+	defer tx.Rollback()
+
+	var change EmailChange
+	q := `DELETE FROM email_changes WHERE token_hash=$1 AND kind='revert' AND expires_at > NOW()
+	RETURNING user_id, old_email, new_email`
+	row := tx.QueryRowContext(ctx, q, token.Hash(tkn))
+	if err := row.Scan(&change.UserID, &change.OldEmail, &change.NewEmail); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return EmailChange{}, ErrInvalidEmailToken
+		}
+		return EmailChange{}, errors.Wrap(err, "fetching revert token")
+	}
+
+	// Accounts registered with the old email since the change never proved they own it, the
+	// revert mustn't be blocked by them
+	if err := deleteUnverified(ctx, tx, change.UserID, change.OldEmail); err != nil {
+		return EmailChange{}, err
+	}
+	if err := emailAvailable(ctx, tx, change.OldEmail); err != nil {
+		return EmailChange{}, err
+	}
+
+	q = "UPDATE users SET email=$2, verified_email=true WHERE id=$1 RETURNING username"
+	if err := tx.GetContext(ctx, &change.Username, q, change.UserID, change.OldEmail); err != nil {
+		if uniqueViolation(err) {
+			return EmailChange{}, ErrEmailTaken
+		}
+		logger.Errorf("failed restoring the user's email: %v", err)
+		return EmailChange{}, errors.Wrap(err, "couldn't restore the email")
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM email_changes WHERE user_id=$1", change.UserID); err != nil {
+		return EmailChange{}, errors.Wrap(err, "deleting email change tokens")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return EmailChange{}, errors.Wrap(err, "committing transaction")
+	}
+
+	return change, nil
+}
+
+// VerifyEmail consumes the verification token and marks the user's email as verified, it
+// returns the id of the user.
+func (s *service) VerifyEmail(ctx context.Context, tkn string) (string, error) {
+	s.metrics.incMethodCalls("VerifyEmail")
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "starting transaction")
+	}
+	defer tx.Rollback()
+
+	var userID string
+	q := "DELETE FROM email_verifications WHERE token_hash=$1 AND expires_at > NOW() RETURNING user_id"
+	if err := tx.GetContext(ctx, &userID, q, token.Hash(tkn)); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrInvalidVerificationToken
+		}
+		return "", errors.Wrap(err, "fetching verification token")
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET verified_email=true WHERE id=$1", userID); err != nil {
+		logger.Errorf("failed verifying the user's email: %v", err)
+		return "", errors.Wrap(err, "couldn't verify the email")
+	}
+
+	// Drop the expired tokens left behind
+	if _, err := tx.ExecContext(ctx, "DELETE FROM email_verifications WHERE user_id=$1", userID); err != nil {
+		return "", errors.Wrap(err, "deleting verification tokens")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", errors.Wrap(err, "committing transaction")
+	}
+
+	return userID, nil
+}
+
+// deleteUnverified removes the accounts other than the user's registered with the email that
+// didn't verify it, along with their carts.
+func deleteUnverified(ctx context.Context, tx *sqlx.Tx, userID, email string) error {
+	var cartIDs pq.StringArray
+	q := `WITH deleted AS (
+		DELETE FROM users WHERE lower(email)=lower($1) AND NOT verified_email AND id<>$2 RETURNING cart_id
+	)
+	SELECT ARRAY(SELECT cart_id FROM deleted)`
+	if err := tx.GetContext(ctx, &cartIDs, q, email, userID); err != nil {
+		return errors.Wrap(err, "deleting unverified accounts")
+	}
+	if len(cartIDs) == 0 {
+		return nil
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM carts WHERE id = ANY($1)", cartIDs); err != nil {
+		return errors.Wrap(err, "deleting unverified accounts' carts")
+	}
+	return nil
+}
+
+// emailAvailable returns ErrEmailTaken if the email is registered to an account.
+func emailAvailable(ctx context.Context, tx *sqlx.Tx, email string) error {
+	var taken bool
+	q := "SELECT EXISTS(SELECT 1 FROM users WHERE lower(email)=lower($1))"
+	if err := tx.GetContext(ctx, &taken, q, email); err != nil {
+		return errors.Wrap(err, "checking email")
+	}
+	if taken {
+		return ErrEmailTaken
+	}
 	return nil
 }
+
+// uniqueViolation returns whether the error was caused by a unique constraint.
+func uniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
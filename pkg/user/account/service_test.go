@@ -0,0 +1,295 @@
+package account_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/GGP1/adak/internal/config"
+	"github.com/GGP1/adak/internal/logger"
+	"github.com/GGP1/adak/internal/password"
+	"github.com/GGP1/adak/internal/test"
+	"github.com/GGP1/adak/pkg/user/account"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmailChange(t *testing.T) {
+	logger.Disable()
+	ctx := context.Background()
+	db := test.StartPostgres(t)
+	s := account.NewService(db, config.PasswordReset{}, config.EmailChange{
+		Expiration:       time.Hour,
+		RevertExpiration: time.Hour,
+	}, config.Verification{})
+
+	old := time.Now().Add(-96 * time.Hour)
+	addUser(t, db, "email_change", "old@test.com", old)
+	addUser(t, db, "email_change_taken", "taken@test.com", old)
+	addUser(t, db, "email_change_new", "new_account@test.com", time.Now())
+
+	t.Run("Account too new", func(t *testing.T) {
+		_, err := s.RequestEmailChange(ctx, "email_change_new", "other@test.com")
+		assert.ErrorIs(t, err, account.ErrAccountTooNew)
+	})
+
+	t.Run("Email taken", func(t *testing.T) {
+		_, err := s.RequestEmailChange(ctx, "email_change", "taken@test.com")
+		assert.ErrorIs(t, err, account.ErrEmailTaken)
+
+		_, err = s.RequestEmailChange(ctx, "email_change", "TAKEN@test.com")
+		assert.ErrorIs(t, err, account.ErrEmailTaken, "Emails must be compared case-insensitively")
+	})
+
+	t.Run("Invalid token", func(t *testing.T) {
+		_, err := s.ChangeEmail(ctx, "invalid")
+		assert.ErrorIs(t, err, account.ErrInvalidEmailToken)
+	})
+
+	t.Run("Change and revert", func(t *testing.T) {
+		request, err := s.RequestEmailChange(ctx, "email_change", "new@test.com")
+		assert.NoError(t, err)
+		assert.Equal(t, "old@test.com", request.OldEmail)
+		assert.NotEmpty(t, request.Token)
+
+		var stored string
+		assert.NoError(t, db.GetContext(ctx, &stored, "SELECT token_hash FROM email_changes WHERE user_id=$1", "email_change"))
+		assert.NotEqual(t, request.Token, stored, "Tokens must be stored hashed")
+
+		// The email changes only once confirmed
+		assert.Equal(t, "old@test.com", userEmail(t, db, "email_change"))
+
+		change, err := s.ChangeEmail(ctx, request.Token)
+		assert.NoError(t, err)
+		assert.Equal(t, "new@test.com", change.NewEmail)
+		assert.Equal(t, "new@test.com", userEmail(t, db, "email_change"))
+
+		_, err = s.ChangeEmail(ctx, request.Token)
+		assert.ErrorIs(t, err, account.ErrInvalidEmailToken, "Tokens must be single-use")
+
+		// The revert token can't confirm changes
+		_, err = s.ChangeEmail(ctx, change.Token)
+		assert.ErrorIs(t, err, account.ErrInvalidEmailToken)
+
+		reverted, err := s.RevertEmailChange(ctx, change.Token)
+		assert.NoError(t, err)
+		assert.Equal(t, "email_change", reverted.UserID)
+		assert.Equal(t, "old@test.com", userEmail(t, db, "email_change"))
+
+		_, err = s.RevertEmailChange(ctx, change.Token)
+		assert.ErrorIs(t, err, account.ErrInvalidEmailToken)
+	})
+
+	t.Run("Revert discards pending changes", func(t *testing.T) {
+		first, err := s.RequestEmailChange(ctx, "email_change", "first@test.com")
+		assert.NoError(t, err)
+		change, err := s.ChangeEmail(ctx, first.Token)
+		assert.NoError(t, err)
+
+		pending, err := s.RequestEmailChange(ctx, "email_change", "second@test.com")
+		assert.NoError(t, err)
+
+		_, err = s.RevertEmailChange(ctx, change.Token)
+		assert.NoError(t, err)
+
+		_, err = s.ChangeEmail(ctx, pending.Token)
+		assert.ErrorIs(t, err, account.ErrInvalidEmailToken)
+		assert.Equal(t, "old@test.com", userEmail(t, db, "email_change"))
+	})
+
+	t.Run("Revert with the old email registered", func(t *testing.T) {
+		request, err := s.RequestEmailChange(ctx, "email_change", "reclaim@test.com")
+		assert.NoError(t, err)
+		change, err := s.ChangeEmail(ctx, request.Token)
+		assert.NoError(t, err)
+
+		// Accounts that didn't verify the email can't block the revert
+		addUser(t, db, "email_change_squatter", "old@test.com", time.Now())
+		_, err = db.Exec("UPDATE users SET verified_email=false WHERE id=$1", "email_change_squatter")
+		assert.NoError(t, err)
+
+		_, err = s.RevertEmailChange(ctx, change.Token)
+		assert.NoError(t, err)
+		assert.Equal(t, "old@test.com", userEmail(t, db, "email_change"))
+
+		var exists bool
+		assert.NoError(t, db.Get(&exists, "SELECT EXISTS(SELECT 1 FROM users WHERE id=$1)", "email_change_squatter"))
+		assert.False(t, exists)
+
+		// Verified ones can
+		request, err = s.RequestEmailChange(ctx, "email_change", "reclaim@test.com")
+		assert.NoError(t, err)
+		change, err = s.ChangeEmail(ctx, request.Token)
+		assert.NoError(t, err)
+		addUser(t, db, "email_change_owner", "OLD@test.com", time.Now())
+
+		_, err = s.RevertEmailChange(ctx, change.Token)
+		assert.ErrorIs(t, err, account.ErrEmailTaken)
+		assert.Equal(t, "reclaim@test.com", userEmail(t, db, "email_change"))
+
+		_, err = db.Exec("DELETE FROM users WHERE id=$1", "email_change_owner")
+		assert.NoError(t, err)
+		_, err = db.Exec("UPDATE users SET email=$2 WHERE id=$1", "email_change", "old@test.com")
+		assert.NoError(t, err)
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		request, err := s.RequestEmailChange(ctx, "email_change", "expired@test.com")
+		assert.NoError(t, err)
+
+		_, err = db.ExecContext(ctx, "UPDATE email_changes SET expires_at=NOW() - INTERVAL '1 minute' WHERE user_id=$1", "email_change")
+		assert.NoError(t, err)
+
+		_, err = s.ChangeEmail(ctx, request.Token)
+		assert.ErrorIs(t, err, account.ErrInvalidEmailToken)
+	})
+}
+
+func TestEmailVerification(t *testing.T) {
+	logger.Disable()
+	ctx := context.Background()
+	db := test.StartPostgres(t)
+	s := account.NewService(db, config.PasswordReset{}, config.EmailChange{}, config.Verification{
+		Expiration: time.Hour,
+	})
+
+	addUser(t, db, "verified", "verified@test.com", time.Now())
+	addUser(t, db, "unverified", "unverified@test.com", time.Now())
+	_, err := db.Exec("UPDATE users SET verified_email=false WHERE id=$1", "unverified")
+	assert.NoError(t, err)
+
+	t.Run("Not found", func(t *testing.T) {
+		_, _, err := s.RequestVerification(ctx, "not_found@test.com")
+		assert.ErrorIs(t, err, account.ErrUserNotFound)
+	})
+
+	t.Run("Already verified", func(t *testing.T) {
+		_, _, err := s.RequestVerification(ctx, "verified@test.com")
+		assert.ErrorIs(t, err, account.ErrAlreadyVerified)
+	})
+
+	t.Run("Invalid token", func(t *testing.T) {
+		_, err := s.VerifyEmail(ctx, "invalid")
+		assert.ErrorIs(t, err, account.ErrInvalidVerificationToken)
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		tkn, _, err := s.RequestVerification(ctx, "unverified@test.com")
+		assert.NoError(t, err)
+
+		_, err = db.Exec("UPDATE email_verifications SET expires_at=NOW() - INTERVAL '1 minute' WHERE user_id=$1", "unverified")
+		assert.NoError(t, err)
+
+		_, err = s.VerifyEmail(ctx, tkn)
+		assert.ErrorIs(t, err, account.ErrInvalidVerificationToken)
+	})
+
+	t.Run("Verify", func(t *testing.T) {
+		previous, _, err := s.RequestVerification(ctx, "unverified@test.com")
+		assert.NoError(t, err)
+
+		tkn, username, err := s.RequestVerification(ctx, "UNVERIFIED@test.com")
+		assert.NoError(t, err, "Emails must be compared case-insensitively")
+		assert.Equal(t, "unverified", username)
+
+		var stored string
+		assert.NoError(t, db.Get(&stored, "SELECT token_hash FROM email_verifications WHERE user_id=$1", "unverified"))
+		assert.NotEqual(t, tkn, stored, "Tokens must be stored hashed")
+
+		_, err = s.VerifyEmail(ctx, previous)
+		assert.ErrorIs(t, err, account.ErrInvalidVerificationToken, "Requesting a token must invalidate the previous ones")
+
+		userID, err := s.VerifyEmail(ctx, tkn)
+		assert.NoError(t, err)
+		assert.Equal(t, "unverified", userID)
+
+		var verified bool
+		assert.NoError(t, db.Get(&verified, "SELECT verified_email FROM users WHERE id=$1", "unverified"))
+		assert.True(t, verified)
+
+		_, err = s.VerifyEmail(ctx, tkn)
+		assert.ErrorIs(t, err, account.ErrInvalidVerificationToken, "Tokens must be single-use")
+	})
+}
+
+func TestPasswordReset(t *testing.T) {
+	logger.Disable()
+	ctx := context.Background()
+	db := test.StartPostgres(t)
+	s := account.NewService(db, config.PasswordReset{Expiration: time.Hour}, config.EmailChange{}, config.Verification{})
+
+	addUser(t, db, "reset", "reset@test.com", time.Now())
+	newPassword := "Plum-Velvet-Quarry-92"
+
+	t.Run("Not found", func(t *testing.T) {
+		_, _, err := s.RequestPasswordReset(ctx, "not_found@test.com")
+		assert.ErrorIs(t, err, account.ErrUserNotFound)
+	})
+
+	t.Run("Wrong token", func(t *testing.T) {
+		_, _, err := s.RequestPasswordReset(ctx, "reset@test.com")
+		assert.NoError(t, err)
+
+		_, err = s.ResetPassword(ctx, "wrong", newPassword)
+		assert.ErrorIs(t, err, account.ErrInvalidResetToken)
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		tkn, _, err := s.RequestPasswordReset(ctx, "reset@test.com")
+		assert.NoError(t, err)
+
+		_, err = db.Exec("UPDATE password_resets SET expires_at=NOW() - INTERVAL '1 minute' WHERE user_id=$1", "reset")
+		assert.NoError(t, err)
+
+		_, err = s.ResetPassword(ctx, tkn, newPassword)
+		assert.ErrorIs(t, err, account.ErrInvalidResetToken)
+	})
+
+	t.Run("Reset", func(t *testing.T) {
+		previous, _, err := s.RequestPasswordReset(ctx, "reset@test.com")
+		assert.NoError(t, err)
+
+		tkn, username, err := s.RequestPasswordReset(ctx, "RESET@test.com")
+		assert.NoError(t, err, "Emails must be compared case-insensitively")
+		assert.Equal(t, "reset", username)
+
+		var stored string
+		assert.NoError(t, db.Get(&stored, "SELECT token_hash FROM password_resets WHERE user_id=$1", "reset"))
+		assert.NotEqual(t, tkn, stored, "Tokens must be stored hashed")
+
+		_, err = s.ResetPassword(ctx, previous, newPassword)
+		assert.ErrorIs(t, err, account.ErrInvalidResetToken, "Requesting a token must invalidate the previous ones")
+
+		var policyErr *password.PolicyError
+		_, err = s.ResetPassword(ctx, tkn, "reset")
+		assert.ErrorAs(t, err, &policyErr)
+
+		userID, err := s.ResetPassword(ctx, tkn, newPassword)
+		assert.NoError(t, err, "Tokens must be usable again after an invalid password")
+		assert.Equal(t, "reset", userID)
+
+		var hash string
+		assert.NoError(t, db.Get(&hash, "SELECT password FROM users WHERE id=$1", "reset"))
+		_, err = password.Verify(hash, newPassword)
+		assert.NoError(t, err)
+
+		_, err = s.ResetPassword(ctx, tkn, "Another-Quarry-Velvet-31")
+		assert.ErrorIs(t, err, account.ErrInvalidResetToken, "Tokens must be single-use")
+	})
+}
+
+func addUser(t *testing.T, db *sqlx.DB, id, email string, createdAt time.Time) {
+	t.Helper()
+	q := `INSERT INTO users (id, cart_id, username, email, password, verified_email, created_at)
+	VALUES ($1, $1, $1, $2, '', true, $3)`
+	_, err := db.Exec(q, id, email, createdAt)
+	assert.NoError(t, err)
+}
+
+func userEmail(t *testing.T, db *sqlx.DB, id string) string {
+	t.Helper()
+	var email string
+	assert.NoError(t, db.Get(&email, "SELECT email FROM users WHERE id=$1", id))
+	return email
+}
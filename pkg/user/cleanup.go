@@ -0,0 +1,33 @@
+package user
+
+import (
+	"context"
+	"time"
+
+	"github.com/GGP1/adak/internal/logger"
+)
+
+// cleanupInterval is the time between the deletions of the unverified accounts.
+const cleanupInterval = time.Hour
+
+// CleanUnverified deletes the accounts that didn't verify their email within the period
+// given every cleanupInterval, it blocks until the context is cancelled.
+func CleanUnverified(ctx context.Context, s Service, period time.Duration) {
+	ticker := time.NewTicker(cleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		n, err := s.DeleteUnverified(ctx, time.Now().Add(-period))
+		if err != nil {
+			logger.Errorf("couldn't delete the unverified accounts: %v", err)
+		} else if n > 0 {
+			logger.Infof("deleted %d unverified accounts", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -1,12 +1,14 @@
 package user
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"time"
 
-	"github.com/GGP1/adak/internal/cookie"
 	"github.com/GGP1/adak/internal/email"
+	"github.com/GGP1/adak/internal/identity"
+	"github.com/GGP1/adak/internal/logger"
 	"github.com/GGP1/adak/internal/params"
 	"github.com/GGP1/adak/internal/response"
 	"github.com/GGP1/adak/internal/sanitize"
@@ -34,6 +36,11 @@ type Handler struct {
 	cartService cart.Service
 }
 
+// Verifier creates the tokens users verify their email with.
+type Verifier interface {
+	RequestVerification(ctx context.Context, email string) (string, string, error)
+}
+
 // NewHandler returns a new user handler.
 func NewHandler(dev bool, userS Service, cartS cart.Service, emailer email.Emailer, cache *memcache.Client) Handler {
 	return Handler{
@@ -45,8 +52,8 @@ func NewHandler(dev bool, userS Service, cartS cart.Service, emailer email.Email
 	}
 }
 
-// Create creates a new user and saves it.
-func (h *Handler) Create() http.HandlerFunc {
+// Create creates a new user and saves it, outside development a link to verify the email is sent to it.
+func (h *Handler) Create(verifier Verifier) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var user AddUser
 		ctx := r.Context()
@@ -62,14 +69,6 @@ func (h *Handler) Create() http.HandlerFunc {
 			return
 		}
 
-		if !h.development {
-			confirmationCode := uuid.NewString()
-			if err := h.emailer.SendValidation(ctx, user.Username, user.Email, confirmationCode); err != nil {
-				response.Error(w, http.StatusInternalServerError, err)
-				return
-			}
-		}
-
 		// Set fields here to make testing easier and normalize inputs
 		user.ID = uuid.NewString()
 		user.CartID = uuid.NewString()
@@ -87,6 +86,10 @@ func (h *Handler) Create() http.HandlerFunc {
 			return
 		}
 
+		if !h.development {
+			h.sendVerification(ctx, verifier, user.Email)
+		}
+
 		user.Password = "" // Do not return password
 		response.JSON(w, http.StatusCreated, user)
 	}
@@ -103,7 +106,7 @@ func (h *Handler) Delete(s auth.Session) http.HandlerFunc {
 			return
 		}
 
-		cartID, err := cookie.GetValue(r, "CID")
+		cartID, err := identity.CartID(r)
 		if err != nil {
 			response.Error(w, http.StatusForbidden, err)
 			return
@@ -279,3 +282,19 @@ func (h *Handler) Update() http.HandlerFunc {
 		response.JSONText(w, http.StatusOK, id)
 	}
 }
+
+// sendVerification creates the token to verify the user's email and sends it in the background.
+// Failures are only logged, the account already exists and the user can request another email.
+func (h *Handler) sendVerification(ctx context.Context, verifier Verifier, email string) {
+	tkn, username, err := verifier.RequestVerification(ctx, email)
+	if err != nil {
+		logger.Errorf("couldn't create the verification token: %v", err)
+		return
+	}
+
+	go func() {
+		if err := h.emailer.SendValidation(context.Background(), username, email, tkn); err != nil {
+			logger.Errorf("couldn't send the verification email: %v", err)
+		}
+	}()
+}
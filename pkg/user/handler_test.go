@@ -12,6 +12,7 @@ import (
 
 	"github.com/GGP1/adak/internal/config"
 	"github.com/GGP1/adak/internal/email"
+	"github.com/GGP1/adak/internal/identity"
 	"github.com/GGP1/adak/internal/logger"
 	"github.com/GGP1/adak/internal/test"
 	"github.com/GGP1/adak/pkg/auth"
@@ -64,34 +65,68 @@ func TestMain(m *testing.M) {
 	os.Exit(code)
 }
 
-func TestCreateHandler(t *testing.T) {
-	u := user.AddUser{
-		Email:    "test@test.com",
-		Username: "test",
-		Password: "testing123",
-	}
-
-	var buf bytes.Buffer
-	err := json.NewEncoder(&buf).Encode(u)
-	assert.NoError(t, err)
-
-	rec := httptest.NewRecorder()
-	req := httptest.NewRequest(http.MethodPost, "/", &buf)
-
-	handler.Create()(rec, req)
+// verifier records the emails it was asked to verify.
+type verifier struct {
+	emails []string
+}
 
-	var response user.ListUser
-	err = json.NewDecoder(rec.Body).Decode(&response)
-	assert.NoError(t, err)
+func (v *verifier) RequestVerification(ctx context.Context, email string) (string, string, error) {
+	v.emails = append(v.emails, email)
+	return "token", "username", nil
+}
 
-	assert.Equal(t, http.StatusCreated, rec.Code)
-	assert.Equal(t, u.Email, response.Email)
-	assert.Equal(t, u.Username, response.Username)
+func TestCreateHandler(t *testing.T) {
+	cases := []struct {
+		desc        string
+		development bool
+		user        user.AddUser
+	}{
+		{
+			desc:        "Development",
+			development: true,
+			user:        user.AddUser{Email: "test@test.com", Username: "test", Password: "testing123"},
+		},
+		{
+			desc:        "Production",
+			development: false,
+			user:        user.AddUser{Email: "test_verify@test.com", Username: "test_verify", Password: "testing123"},
+		},
+	}
 
-	c, err := cartService.Get(context.Background(), response.CartID)
-	assert.NoError(t, err)
-	assert.Equal(t, response.CartID, c.ID)
-	assert.Equal(t, int64(0), c.Total.Int64)
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := json.NewEncoder(&buf).Encode(tc.user)
+			assert.NoError(t, err)
+
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/", &buf)
+
+			v := &verifier{}
+			h := user.NewHandler(tc.development, userService, cartService, email.Emailer{}, nil)
+			h.Create(v)(rec, req)
+
+			var response user.ListUser
+			err = json.NewDecoder(rec.Body).Decode(&response)
+			assert.NoError(t, err)
+
+			assert.Equal(t, http.StatusCreated, rec.Code)
+			assert.Equal(t, tc.user.Email, response.Email)
+			assert.Equal(t, tc.user.Username, response.Username)
+
+			c, err := cartService.Get(context.Background(), response.CartID)
+			assert.NoError(t, err)
+			assert.Equal(t, response.CartID, c.ID)
+			assert.Equal(t, int64(0), c.Total.Int64)
+
+			// Outside development a verification token is created for the new email
+			if tc.development {
+				assert.Empty(t, v.emails)
+			} else {
+				assert.Equal(t, []string{tc.user.Email}, v.emails)
+			}
+		})
+	}
 }
 
 func TestDeleteHandler(t *testing.T) {
@@ -100,7 +135,7 @@ func TestDeleteHandler(t *testing.T) {
 		CartID:   "test_delete_cart",
 		Email:    "test_delete@test.com",
 		Username: "test_delete",
-		Password: "test_delete",
+		Password: "testing123",
 	}
 
 	err := userService.Create(context.Background(), u)
@@ -108,14 +143,13 @@ func TestDeleteHandler(t *testing.T) {
 
 	rdb := test.StartRedis(t)
 
-	session := auth.NewSession(nil, rdb, config.Session{}, true)
+	session := auth.NewSession(nil, rdb, nil, nil, config.Session{}, true)
 	mux := chi.NewRouter()
 	mux.Delete("/{id}", handler.Delete(session))
 
 	rec := httptest.NewRecorder()
 	req := httptest.NewRequest(http.MethodDelete, "/"+u.ID, nil)
-	test.AddCookie(t, req, "UID", u.ID)
-	test.AddCookie(t, req, "CID", u.CartID)
+	req = req.WithContext(identity.NewContext(req.Context(), identity.Identity{UserID: u.ID, CartID: u.CartID}))
 
 	mux.ServeHTTP(rec, req)
 
@@ -132,7 +166,7 @@ func TestGetHandler(t *testing.T) {
 		ID:       uuid.NewString(),
 		Email:    "test_get@test.com",
 		Username: "test_get",
-		Password: "test_get",
+		Password: "testing123",
 	}
 
 	err := userService.Create(context.Background(), u)
@@ -161,7 +195,7 @@ func TestGetByHandler(t *testing.T) {
 		ID:       uuid.NewString(),
 		Email:    "test_getby@test.com",
 		Username: "test_getby",
-		Password: "test_getby",
+		Password: "testing123",
 	}
 
 	err := userService.Create(context.Background(), u)
@@ -220,7 +254,7 @@ func TestSearchHandler(t *testing.T) {
 		ID:       uuid.NewString(),
 		Email:    "test_search@test.com",
 		Username: "test_search",
-		Password: "test_search",
+		Password: "testing123",
 	}
 
 	err := userService.Create(context.Background(), u)
@@ -247,7 +281,7 @@ func TestUpdateHandler(t *testing.T) {
 		ID:       uuid.NewString(),
 		Email:    "test_update@test.com",
 		Username: "test_update",
-		Password: "test_update",
+		Password: "testing123",
 	}
 
 	err := userService.Create(context.Background(), u)
@@ -266,7 +300,7 @@ func TestUpdateHandler(t *testing.T) {
 
 	rec := httptest.NewRecorder()
 	req := httptest.NewRequest(http.MethodPut, "/"+u.ID, &buf)
-	test.AddCookie(t, req, "UID", u.ID)
+	req = req.WithContext(identity.NewContext(req.Context(), identity.Identity{UserID: u.ID}))
 
 	mux.ServeHTTP(rec, req)
 
@@ -6,6 +6,7 @@ import (
 	"github.com/GGP1/adak/pkg/review"
 	"github.com/GGP1/adak/pkg/shopping/ordering"
 
+	"github.com/lib/pq"
 	"gopkg.in/guregu/null.v4/zero"
 )
 
@@ -18,7 +19,6 @@ type User struct {
 	Email            string           `json:"email,omitempty" validate:"email"`
 	Password         string           `json:"password,omitempty"`
 	VerifiedEmail    bool             `json:"verified_email,omitempty" db:"verified_email"`
-	IsAdmin          bool             `json:"is_admin,omitempty" db:"is_admin"`
 	ConfirmationCode string           `json:"confirmation_code,omitempty" db:"confirmation_code"`
 	Orders           []ordering.Order `json:"orders,omitempty"`
 	Reviews          []review.Review  `json:"reviews,omitempty"`
@@ -32,8 +32,7 @@ type AddUser struct {
 	CartID    string    `json:"cart_id,omitempty" db:"cart_id"`
 	Username  string    `json:"username,omitempty" validate:"required,max=25"`
 	Email     string    `json:"email,omitempty" validate:"email,required"`
-	Password  string    `json:"password,omitempty" validate:"required,min=6"`
-	IsAdmin   bool      `json:"is_admin,omitempty" db:"is_admin"`
+	Password  string    `json:"password,omitempty" validate:"required"`
 	CreatedAt time.Time `json:"created_at,omitempty" db:"created_at"`
 }
 
@@ -43,7 +42,7 @@ type ListUser struct {
 	CartID    string          `json:"cart_id,omitempty" db:"cart_id"`
 	Username  string          `json:"username,omitempty"`
 	Email     string          `json:"email,omitempty" validate:"email"`
-	IsAdmin   bool            `json:"is_admin,omitempty" db:"is_admin"`
+	Roles     pq.StringArray  `json:"roles,omitempty"`
 	Reviews   []review.Review `json:"reviews,omitempty"`
 	CreatedAt time.Time       `json:"created_at,omitempty" db:"created_at"`
 	UpdatedAt zero.Time       `json:"updated_at,omitempty" db:"updated_at"`
@@ -6,26 +6,31 @@ import (
 	"time"
 
 	"github.com/GGP1/adak/internal/params"
+	"github.com/GGP1/adak/internal/password"
 	"github.com/GGP1/adak/pkg/postgres"
 	"github.com/GGP1/adak/pkg/review"
+	"github.com/GGP1/adak/pkg/role"
 
 	"github.com/bradfitz/gomemcache/memcache"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
 	"github.com/spf13/viper"
-	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/guregu/null.v4/zero"
 )
 
+// rolesColumn selects the user's roles as an array, the users table must be aliased as "u".
+const rolesColumn = "ARRAY(SELECT role FROM user_roles WHERE user_id = u.id ORDER BY role) AS roles"
+
 // Service provides user operations.
 type Service interface {
 	Create(ctx context.Context, user AddUser) error
 	Delete(ctx context.Context, id string) error
+	DeleteUnverified(ctx context.Context, createdBefore time.Time) (int64, error)
 	Get(ctx context.Context, params params.Query) ([]ListUser, error)
 	GetByEmail(ctx context.Context, email string) (ListUser, error)
 	GetByID(ctx context.Context, id string) (ListUser, error)
 	GetByUsername(ctx context.Context, username string) (ListUser, error)
-	IsAdmin(ctx context.Context, id string) (bool, error)
 	Search(ctx context.Context, query string) ([]ListUser, error)
 	Update(ctx context.Context, u UpdateUser, id string) error
 }
@@ -52,37 +57,37 @@ func (s *service) Create(ctx context.Context, user AddUser) error {
 	defer tx.Rollback()
 
 	var exists bool
-	q := "SELECT EXISTS(SELECT 1 FROM users WHERE email=$1 OR username=$2)"
+	q := "SELECT EXISTS(SELECT 1 FROM users WHERE lower(email)=lower($1) OR username=$2)"
 	_ = tx.GetContext(ctx, &exists, q, user.Email, user.Username)
 	if exists {
 		return errors.New("email or username is already taken")
 	}
 
-	// Setting a value other than default blocks forever
-	hash, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+	if err := password.Validate(user.Password, user.Email, user.Username); err != nil {
+		return err
+	}
+
+	hash, err := password.Hash(user.Password)
 	if err != nil {
 		return errors.Wrap(err, "failed generating the password hash")
 	}
-	user.Password = string(hash)
+	user.Password = hash
 
-	// TODO: use a map O(1). Either change the configuration or create a map
-	// on initalization storing admins' emails in it.
-	user.IsAdmin = false
-	for _, admin := range viper.GetStringSlice("admins") {
-		if admin == user.Email {
-			user.IsAdmin = true
-			break
-		}
-	}
 	userQuery := `INSERT INTO users
-	(id, cart_id, username, email, password, is_admin, created_at)
-	VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	(id, cart_id, username, email, password, created_at)
+	VALUES ($1, $2, $3, $4, $5, $6)`
 	_, err = tx.ExecContext(ctx, userQuery, user.ID, user.CartID, user.Username,
-		user.Email, user.Password, user.IsAdmin, user.CreatedAt)
+		user.Email, user.Password, user.CreatedAt)
 	if err != nil {
 		return errors.Wrap(err, "couldn't create the user")
 	}
 
+	roles := role.Initial(user.Email, viper.GetStringSlice("admins"))
+	rolesQuery := "INSERT INTO user_roles (user_id, role) SELECT $1, unnest($2::text[])"
+	if _, err := tx.ExecContext(ctx, rolesQuery, user.ID, pq.StringArray(roles)); err != nil {
+		return errors.Wrap(err, "couldn't assign the user roles")
+	}
+
 	if err := tx.Commit(); err != nil {
 		return errors.Wrap(err, "committing transaction")
 	}
@@ -106,12 +111,59 @@ func (s *service) Delete(ctx context.Context, id string) error {
 	return nil
 }
 
+// DeleteUnverified permanently deletes the users created before the time provided that
+// haven't verified their email, along with their carts. It returns the number of users deleted.
+func (s *service) DeleteUnverified(ctx context.Context, createdBefore time.Time) (int64, error) {
+	s.metrics.incMethodCalls("DeleteUnverified")
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, errors.Wrap(err, "starting transaction")
+	}
+	defer tx.Rollback()
+
+	var users []struct {
+		ID     string `db:"id"`
+		CartID string `db:"cart_id"`
+	}
+	q := "DELETE FROM users WHERE verified_email=false AND created_at < $1 RETURNING id, cart_id"
+	if err := tx.SelectContext(ctx, &users, q, createdBefore); err != nil {
+		return 0, errors.Wrap(err, "couldn't delete the unverified users")
+	}
+	if len(users) == 0 {
+		return 0, nil
+	}
+
+	cartIDs := make([]string, len(users))
+	for i, u := range users {
+		cartIDs[i] = u.CartID
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM carts WHERE id = ANY($1)", pq.StringArray(cartIDs)); err != nil {
+		return 0, errors.Wrap(err, "couldn't delete the unverified users' carts")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, errors.Wrap(err, "committing transaction")
+	}
+	s.metrics.registeredUsers.Sub(float64(len(users)))
+
+	for _, u := range users {
+		for _, key := range []string{u.ID, u.CartID} {
+			if err := s.mc.Delete(key); err != nil && err != memcache.ErrCacheMiss {
+				return int64(len(users)), errors.Wrap(err, "deleting user from cache")
+			}
+		}
+	}
+
+	return int64(len(users)), nil
+}
+
 // Get returns a list with all the users stored in the database.
 func (s *service) Get(ctx context.Context, params params.Query) ([]ListUser, error) {
 	s.metrics.incMethodCalls("Get")
 
 	var users []ListUser
-	q, args := postgres.AddPagination("SELECT id, cart_id, username, email, is_admin, created_at, updated_at FROM users", params)
+	q, args := postgres.AddPagination("SELECT id, cart_id, username, email, "+rolesColumn+", created_at, updated_at FROM users AS u", params)
 	if err := s.db.SelectContext(ctx, &users, q, args...); err != nil {
 		return nil, errors.Wrap(err, "couldn't find the users")
 	}
@@ -137,26 +189,14 @@ func (s *service) GetByUsername(ctx context.Context, username string) (ListUser,
 	return s.getBy(ctx, "username", username)
 }
 
-// IsAdmin returns if the user is an admin and an error if the query failed.
-func (s *service) IsAdmin(ctx context.Context, id string) (bool, error) {
-	s.metrics.incMethodCalls("IsAdmin")
-	var isAdmin bool
-	row := s.db.QueryRowContext(ctx, "SELECT is_admin FROM users WHERE id=$1", id)
-	if err := row.Scan(&isAdmin); err != nil {
-		return false, errors.Wrap(err, "couldn't scan user role")
-	}
-
-	return isAdmin, nil
-}
-
 // Search looks for the users that contain the value specified (only text fields).
 func (s *service) Search(ctx context.Context, query string) ([]ListUser, error) {
 	s.metrics.incMethodCalls("Search")
 	var users []ListUser
 	q := `SELECT
-	id, cart_id, username, email, is_admin
-	FROM users
-	WHERE search @@ plainto_tsquery($1)`
+	id, cart_id, username, email, ` + rolesColumn + `
+	FROM users AS u
+	WHERE search @@ plainto_tsquery('adak_simple', $1)`
 
 	if err := s.db.SelectContext(ctx, &users, q, query); err != nil {
 		return nil, errors.Wrap(err, "couldn't find the users")
@@ -183,9 +223,9 @@ func (s *service) Update(ctx context.Context, u UpdateUser, id string) error {
 func (s *service) getBy(ctx context.Context, field, value string) (ListUser, error) {
 	// Concatenation preferred over fmt.Sprintf
 	q := `SELECT
-	u.id, u.cart_id, u.username, u.email, u.is_admin, u.created_at, u.updated_at, r.*
+	u.id, u.cart_id, u.username, u.email, ` + rolesColumn + `, u.created_at, u.updated_at, ` + review.Columns + `
 	FROM users AS u
-	LEFT JOIN reviews AS r ON u.id = r.user_id
+	LEFT JOIN reviews AS r ON u.id = r.user_id AND r.status = 'approved'
 	WHERE u.` + field + `=$1`
 
 	rows, err := s.db.QueryContext(ctx, q, value)
@@ -203,9 +243,9 @@ func scan(rows *sql.Rows) (ListUser, error) {
 	for rows.Next() {
 		r := &review.Review{}
 		err := rows.Scan(
-			&user.ID, &user.CartID, &user.Username, &user.Email, &user.IsAdmin, &user.CreatedAt, &user.UpdatedAt,
+			&user.ID, &user.CartID, &user.Username, &user.Email, &user.Roles, &user.CreatedAt, &user.UpdatedAt,
 			&r.ID, &r.Stars, &r.Comment, &r.UserID, &r.ProductID,
-			&r.ShopID, &r.CreatedAt,
+			&r.ShopID, &r.Verified, &r.Status, &r.Helpful, &r.Unhelpful, &r.EditedAt, &r.CreatedAt,
 		)
 		if err != nil {
 			return ListUser{}, errors.Wrap(err, "couldn't scan user")
@@ -3,12 +3,15 @@ package user_test
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/GGP1/adak/internal/logger"
 	"github.com/GGP1/adak/internal/params"
 	"github.com/GGP1/adak/internal/test"
+	"github.com/GGP1/adak/pkg/role"
 	"github.com/GGP1/adak/pkg/user"
 
+	"github.com/google/uuid"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
@@ -19,7 +22,6 @@ var u = user.AddUser{
 	Username: "test",
 	Email:    "test@test.com",
 	Password: "testing123",
-	IsAdmin:  true,
 }
 
 // TestMain failed when creating the user service.
@@ -49,12 +51,54 @@ func TestUserService(t *testing.T) {
 	t.Run("Get by id", getByID(ctx, s))
 	t.Run("Get by email", getByEmail(ctx, s))
 	t.Run("Get by username", getByUsername(ctx, s))
-	t.Run("Is admin", isAdmin(ctx, s))
+	t.Run("Roles", roles(ctx, s))
 	t.Run("Update", update(ctx, s))
 	t.Run("Search", search(ctx, s))
 	t.Run("Delete", delete(ctx, s))
 }
 
+func TestDeleteUnverified(t *testing.T) {
+	ctx := context.Background()
+	old := user.AddUser{
+		ID:        uuid.NewString(),
+		CartID:    uuid.NewString(),
+		Email:     "test_unverified_old@test.com",
+		Username:  "test_unverified_old",
+		Password:  "testing123",
+		CreatedAt: time.Now().Add(-48 * time.Hour),
+	}
+	recent := user.AddUser{
+		ID:        uuid.NewString(),
+		CartID:    uuid.NewString(),
+		Email:     "test_unverified_recent@test.com",
+		Username:  "test_unverified_recent",
+		Password:  "testing123",
+		CreatedAt: time.Now(),
+	}
+	for _, u := range []user.AddUser{old, recent} {
+		assert.NoError(t, userService.Create(ctx, u))
+		assert.NoError(t, cartService.Create(ctx, u.CartID))
+	}
+
+	n, err := userService.DeleteUnverified(ctx, time.Now().Add(-24*time.Hour))
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, n, int64(1))
+
+	u, err := userService.GetByID(ctx, old.ID)
+	assert.NoError(t, err)
+	assert.Empty(t, u.ID)
+	c, err := cartService.Get(ctx, old.CartID)
+	assert.NoError(t, err)
+	assert.Empty(t, c.ID)
+
+	u, err = userService.GetByID(ctx, recent.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, recent.ID, u.ID)
+	c, err = cartService.Get(ctx, recent.CartID)
+	assert.NoError(t, err)
+	assert.Equal(t, recent.CartID, c.ID)
+}
+
 func create(ctx context.Context, s user.Service) func(t *testing.T) {
 	return func(t *testing.T) {
 		assert.NoError(t, s.Create(ctx, u))
@@ -111,11 +155,12 @@ func getByUsername(ctx context.Context, s user.Service) func(t *testing.T) {
 	}
 }
 
-func isAdmin(ctx context.Context, s user.Service) func(t *testing.T) {
+func roles(ctx context.Context, s user.Service) func(t *testing.T) {
 	return func(t *testing.T) {
-		isAdmin, err := s.IsAdmin(ctx, u.ID)
+		user, err := s.GetByID(ctx, u.ID)
 		assert.NoError(t, err)
-		assert.Equal(t, u.IsAdmin, isAdmin)
+		// u.Email is in the admins list
+		assert.Equal(t, []string{role.Admin, role.Customer}, []string(user.Roles))
 	}
 }
 